@@ -4,9 +4,14 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"regexp"
@@ -21,11 +26,15 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/app"
+	"github.com/square/etre/audit"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
 	"github.com/square/etre/query"
+	"github.com/square/etre/trace"
 )
 
 func init() {
@@ -37,12 +46,21 @@ type API struct {
 	addr                     string
 	crt                      string
 	key                      string
+	ca                       string
+	mtls                     bool
 	es                       entity.Store
 	validate                 entity.Validator
-	auth                     auth.Plugin
+	entityTypes              entity.TypeRegistry
+	schemas                  map[string]config.SchemaConfig
+	snapshotter              entity.Snapshotter
+	auth                     auth.Manager
+	auditSink                audit.Sink
+	tracer                   *trace.Tracer
 	metricsStore             metrics.Store
 	cdcDisabled              bool
 	streamFactory            changestream.StreamerFactory
+	cdcCheckpoints           cdc.CheckpointStore
+	cdcReplayer              cdc.Replayer
 	metricsFactory           metrics.Factory
 	systemMetrics            metrics.Metrics
 	defaultClientVersion     string
@@ -65,11 +83,20 @@ func NewAPI(appCtx app.Context) *API {
 		addr:                     appCtx.Config.Server.Addr,
 		crt:                      appCtx.Config.Server.TLSCert,
 		key:                      appCtx.Config.Server.TLSKey,
+		ca:                       appCtx.Config.Server.TLSCA,
+		mtls:                     appCtx.Config.Security.Plugin == "mtls",
 		es:                       appCtx.EntityStore,
 		validate:                 appCtx.EntityValidator,
+		entityTypes:              appCtx.EntityTypes,
+		schemas:                  appCtx.Config.Entity.Schemas,
+		snapshotter:              appCtx.Snapshotter,
 		auth:                     appCtx.Auth,
+		auditSink:                appCtx.Audit,
+		tracer:                   appCtx.Tracer,
 		cdcDisabled:              appCtx.Config.CDC.Disabled,
 		streamFactory:            appCtx.StreamerFactory,
+		cdcCheckpoints:           appCtx.CDCCheckpoints,
+		cdcReplayer:              appCtx.CDCReplayer,
 		metricsFactory:           appCtx.MetricsFactory,
 		metricsStore:             appCtx.MetricsStore,
 		systemMetrics:            appCtx.SystemMetrics,
@@ -136,6 +163,13 @@ func NewAPI(appCtx app.Context) *API {
 			}
 			c.Set("inst", inst)
 
+			// Trace, continuing the client's trace if it sent a traceparent header.
+			// span is nil if tracing is disabled or the trace is not sampled.
+			span := api.tracer.Start(c.Request().Header.Get(etre.TRACEPARENT_HEADER), c.Request().Method+" "+c.Path())
+			span.SetAttribute("http.method", c.Request().Method)
+			span.SetAttribute("http.target", c.Request().URL.RequestURI())
+			c.Set("span", span)
+
 			// Only these HTTP methods are writes. Be careful: method != "GET" doesn't
 			// work because of "HEAD", "OPTIONS", etc.
 			method := c.Request().Method
@@ -145,7 +179,10 @@ func NewAPI(appCtx app.Context) *API {
 			// Authenticate
 			// --------------------------------------------------------------
 			inst.Start("authenticate")
+			authSpan := span.Child("authenticate")
 			caller, err := api.auth.Authenticate(c.Request())
+			authSpan.SetError(err)
+			authSpan.End()
 			inst.Stop("authenticate")
 			if err != nil {
 				log.Printf("AUTH: failed to authenticate: %s (caller: %+v request: %+v)", err, caller, c.Request())
@@ -156,12 +193,14 @@ func NewAPI(appCtx app.Context) *API {
 					Type:       "access-denied",
 					HTTPStatus: http.StatusUnauthorized,
 				}
+				api.audit(c, audit.EVENT_AUTHENTICATION_FAILED, authErr)
 				if write {
 					return c.JSON(api.WriteResult(c, nil, authErr))
 				}
 				return api.readError(c, authErr)
 			}
 			c.Set("caller", caller)
+			span.SetAttribute("etre.caller", caller.Name)
 
 			// --------------------------------------------------------------
 			// Metrics
@@ -174,12 +213,22 @@ func NewAPI(appCtx app.Context) *API {
 			c.Set("gm", gm)
 
 			if entityType == "" {
+				// Routes without an entity type (change feeds, replay, etc.) are
+				// limited, too, but not authorized here: their handlers do that
+				if err := api.acquire(c, caller, gm); err != nil {
+					return api.readError(c, err)
+				}
 				return next(c)
 			}
 
 			// If entity type is invalid, unset t0 so the LatencyMs metric isn't
 			// skewed with artificially fast queries
-			if err := api.validate.EntityType(entityType); err != nil {
+			span.SetAttribute("etre.entity_type", entityType)
+			validateSpan := span.Child("validate")
+			err = api.validate.EntityType(entityType)
+			validateSpan.SetError(err)
+			validateSpan.End()
+			if err != nil {
 				log.Printf("Invalid entity type: '%s': caller=%+v request=%+v", entityType, caller, c.Request())
 				gm.Inc(metrics.InvalidEntityType, 1)
 				c.Set("t0", time.Time{}) // don't skew latency samples toward zero
@@ -216,7 +265,11 @@ func NewAPI(appCtx app.Context) *API {
 
 				// All writes require a write op
 				wo := writeOp(c, caller)
-				if err := api.validate.WriteOp(wo); err != nil {
+				validateSpan := span.Child("validate")
+				err := api.validate.WriteOp(wo)
+				validateSpan.SetError(err)
+				validateSpan.End()
+				if err != nil {
 					c.Set("t0", time.Time{}) // don't skew latency samples toward zero
 					return c.JSON(api.WriteResult(c, nil, err))
 				}
@@ -225,7 +278,11 @@ func NewAPI(appCtx app.Context) *API {
 					gm.Inc(metrics.SetOp, 1)
 				}
 
-				if err := api.auth.Authorize(caller, auth.Action{EntityType: entityType, Op: auth.OP_WRITE}); err != nil {
+				authSpan := span.Child("authorize")
+				err = api.auth.Authorize(caller, auth.Action{EntityType: entityType, Op: auth.OP_WRITE})
+				authSpan.SetError(err)
+				authSpan.End()
+				if err != nil {
 					log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, c.Request())
 					gm.Inc(metrics.AuthorizationFailed, 1)
 					authErr := auth.Error{
@@ -233,13 +290,18 @@ func NewAPI(appCtx app.Context) *API {
 						Type:       "not-authorized",
 						HTTPStatus: http.StatusForbidden,
 					}
+					api.audit(c, audit.EVENT_AUTHORIZATION_FAILED, authErr)
 					c.Set("t0", time.Time{}) // don't skew latency samples toward zero
 					return c.JSON(api.WriteResult(c, nil, authErr))
 				}
 
 			} else {
 				gm.Inc(metrics.Read, 1)
-				if err := api.auth.Authorize(caller, auth.Action{EntityType: entityType, Op: auth.OP_READ}); err != nil {
+				authSpan := span.Child("authorize")
+				err := api.auth.Authorize(caller, auth.Action{EntityType: entityType, Op: auth.OP_READ})
+				authSpan.SetError(err)
+				authSpan.End()
+				if err != nil {
 					log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, c.Request())
 					gm.Inc(metrics.AuthorizationFailed, 1)
 					authErr := auth.Error{
@@ -247,12 +309,23 @@ func NewAPI(appCtx app.Context) *API {
 						Type:       "not-authorized",
 						HTTPStatus: http.StatusForbidden,
 					}
+					api.audit(c, audit.EVENT_AUTHORIZATION_FAILED, authErr)
 					c.Set("t0", time.Time{}) // don't skew latency samples toward zero
 					return api.readError(c, authErr)
 				}
 			}
 			inst.Stop("authorize")
 
+			// --------------------------------------------------------------
+			// Rate limits and concurrency quotas
+			// --------------------------------------------------------------
+			if err := api.acquire(c, caller, gm); err != nil {
+				if write {
+					return c.JSON(api.WriteResult(c, nil, err))
+				}
+				return api.readError(c, err)
+			}
+
 			// --------------------------------------------------------------
 			// Client options via headers
 			// --------------------------------------------------------------
@@ -301,7 +374,7 @@ func NewAPI(appCtx app.Context) *API {
 				}
 				ctx, cancel = context.WithTimeout(context.Background(), d)
 			}
-			c.Set("ctx", ctx)
+			c.Set("ctx", trace.NewContext(ctx, span))
 			c.Set("cancelFunc", cancel)
 
 			inst.Stop("client_headers")
@@ -321,6 +394,8 @@ func NewAPI(appCtx app.Context) *API {
 	router.POST("/entities/:type", api.postEntitiesHandler)
 	router.PUT("/entities/:type", api.putEntitiesHandler)
 	router.DELETE("/entities/:type", api.deleteEntitiesHandler)
+	router.POST("/entities/:type/labels/rename", api.renameLabelHandler)
+	router.DELETE("/entities/:type/labels/:label", api.deleteLabelsHandler)
 
 	// /////////////////////////////////////////////////////////////////////
 	// Single Entity
@@ -332,16 +407,27 @@ func NewAPI(appCtx app.Context) *API {
 	router.GET("/entity/:type/:id/labels", api.getLabelsHandler)
 	router.DELETE("/entity/:type/:id/labels/:label", api.deleteLabelHandler)
 
+	// /////////////////////////////////////////////////////////////////////
+	// Entity types (admin)
+	// /////////////////////////////////////////////////////////////////////
+	router.GET("/entity-types", api.getEntityTypesHandler)
+	router.POST("/entity-types", api.postEntityTypeHandler)
+	router.DELETE("/entity-types/:name", api.deleteEntityTypeHandler)
+
 	// /////////////////////////////////////////////////////////////////////
 	// Metrics and status
 	// /////////////////////////////////////////////////////////////////////
 	router.GET("/metrics", api.metricsHandler)
+	router.GET("/metrics/prometheus", api.prometheusMetricsHandler)
 	router.GET("/status", api.statusHandler)
 
 	// /////////////////////////////////////////////////////////////////////
 	// Changes
 	// /////////////////////////////////////////////////////////////////////
 	router.GET("/changes", api.changesHandler)
+	router.GET("/changes/poll", api.pollChangesHandler)
+	router.GET("/snapshot/:type", api.snapshotHandler)
+	router.POST("/cdc/replay", api.replayCDCHandler)
 
 	api.echo.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -351,6 +437,18 @@ func NewAPI(appCtx app.Context) *API {
 			if c.Get("load") != nil {
 				api.systemMetrics.Inc(metrics.Load, -1)
 			}
+			if release := c.Get("release"); release != nil {
+				release.(func())()
+			}
+			if v := c.Get("span"); v != nil {
+				span := v.(*trace.Span)
+				status := c.Response().Status
+				span.SetAttribute("http.status_code", strconv.Itoa(status))
+				if status >= 500 {
+					span.SetError(fmt.Errorf("HTTP status %d", status))
+				}
+				span.End()
+			}
 			return nil
 		}
 	})
@@ -358,7 +456,8 @@ func NewAPI(appCtx app.Context) *API {
 	// Called after every route/controller (even if 404)
 	api.echo.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			if err := next(c); err != nil {
+			err := next(c)
+			if err != nil {
 				c.Error(err)
 			}
 
@@ -370,6 +469,12 @@ func NewAPI(appCtx app.Context) *API {
 				caller = v.(auth.Caller)
 			}
 
+			// Audit writes, unless already audited (auth failure)
+			method := c.Request().Method
+			if (method == "PUT" || method == "POST" || method == "DELETE") && c.Get("audited") == nil {
+				api.audit(c, audit.EVENT_WRITE, err)
+			}
+
 			// Same as above: if the route has :entity param, it queried the db,
 			// so finish what the pre-route middleware started
 			entityType := c.Param("type")
@@ -434,6 +539,28 @@ func (api *API) Router() *echo.Echo {
 
 func (api *API) Run() error {
 	if api.crt != "" && api.key != "" {
+		if api.mtls {
+			// Verify client certificates, if given, for the mTLS auth plugin.
+			// Config validation ensures server.tls_ca is set.
+			caCert, err := ioutil.ReadFile(api.ca)
+			if err != nil {
+				return err
+			}
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				return fmt.Errorf("no certificates in %s", api.ca)
+			}
+			server := &http.Server{
+				Addr:    api.addr,
+				Handler: api,
+				TLSConfig: &tls.Config{
+					ClientCAs:  caCertPool,
+					ClientAuth: tls.VerifyClientCertIfGiven,
+				},
+			}
+			log.Printf("Listening on %s with TLS and client certificate verification", api.addr)
+			return server.ListenAndServeTLS(api.crt, api.key)
+		}
 		log.Printf("Listening on %s with TLS", api.addr)
 		return http.ListenAndServeTLS(api.addr, api.crt, api.key, api)
 	}
@@ -441,6 +568,39 @@ func (api *API) Run() error {
 	return http.ListenAndServe(api.addr, api)
 }
 
+// acquire applies the caller rate limits and concurrency quotas to the request.
+// If allowed, it sets "release" to release the request slot when done. Else it
+// returns ErrRateLimited and sets the Retry-After header. The change feed
+// (GET /changes and /changes/poll) is rate limited but doesn't take a concurrent
+// request slot because SSE and websocket clients stay connected indefinitely,
+// and long-poll clients wait up to CDC_POLL_MAX_WAIT.
+func (api *API) acquire(c echo.Context, caller auth.Caller, gm metrics.Metrics) error {
+	var err error
+	switch c.Path() {
+	case etre.API_ROOT + "/changes", etre.API_ROOT + "/changes/poll":
+		err = api.auth.AcquireRate(caller)
+	default:
+		var release func()
+		if release, err = api.auth.Acquire(caller); err == nil {
+			c.Set("release", release)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	log.Printf("AUTH: rate limited: %s (caller: %+v request: %+v)", err, caller, c.Request())
+	gm.Inc(metrics.Throttled, 1)
+	c.Set("t0", time.Time{}) // don't skew latency samples toward zero
+	retryAfter := time.Second
+	if limitErr, ok := err.(auth.LimitError); ok && limitErr.RetryAfter > retryAfter {
+		retryAfter = limitErr.RetryAfter
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	rateErr := ErrRateLimited // copy
+	rateErr.Message = err.Error()
+	return rateErr
+}
+
 func (api *API) Stop() error {
 	if api.crt != "" && api.key != "" {
 		return api.echo.TLSServer.Shutdown(context.TODO())
@@ -485,10 +645,32 @@ func (api *API) getEntitiesHandler(c echo.Context) error {
 	if _, ok := queryParam["distinct"]; ok {
 		f.Distinct = true
 	}
+	if csv, ok := queryParam["expand"]; ok {
+		f.Expand = strings.Split(csv[0], ",")
+	}
+	f.IncludeDeleted = c.QueryParam("includeDeleted") == "true"
 	if f.Distinct && len(f.ReturnLabels) > 1 {
 		return api.readError(c, ErrInvalidQuery.New("distinct requires only 1 return label but %d specified: %v", len(f.ReturnLabels), f.ReturnLabels))
 	}
 
+	// Labels queried or returned must be readable, and so must be the entity
+	// types of expanded references
+	labels, err := api.authorizeExpand(c, &f)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	for _, p := range q.Predicates {
+		labels = append(labels, p.Label)
+	}
+	if err := api.authorizeLabels(c, auth.OP_READ, labels); err != nil {
+		return api.readError(c, err)
+	}
+	scope, err := api.scope(c, auth.OP_READ)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	q.Predicates = append(q.Predicates, scope...)
+
 	inst.Start("db")
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).ReadEntities(c.Param("type"), q, f)
@@ -497,6 +679,7 @@ func (api *API) getEntitiesHandler(c echo.Context) error {
 		return api.readError(c, err)
 	}
 	gm.Val(metrics.ReadMatch, int64(len(entities)))
+	api.stripLabels(c, entities, f.Expand...)
 	return c.JSON(http.StatusOK, entities)
 }
 
@@ -517,7 +700,13 @@ func (api *API) postEntitiesHandler(c echo.Context) error {
 		return c.JSON(api.WriteResult(c, nil, ErrNoContent))
 	}
 	gm.Val(metrics.CreateBulk, int64(len(entities))) // inc before validating
-	if err := api.validate.Entities(entities, entity.VALIDATE_ON_CREATE); err != nil {
+	if err := api.validateEntities(c, entities, entity.VALIDATE_ON_CREATE); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(entities...)); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.newInScope(c, entities); err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
@@ -550,7 +739,17 @@ func (api *API) putEntitiesHandler(c echo.Context) error {
 	if len(patch) == 0 {
 		return c.JSON(api.WriteResult(c, nil, ErrNoContent))
 	}
-	if err := api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+	if err := api.validateEntities(c, []etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(patch)); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.labelsInScope(c, scope, patch.Labels(), patch); err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
@@ -564,6 +763,7 @@ func (api *API) putEntitiesHandler(c echo.Context) error {
 	}
 
 	// Patch all entities matching query
+	q.Predicates = append(q.Predicates, scope...)
 	wo := c.Get("wo").(entity.WriteOp)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).UpdateEntities(wo, q, patch)
@@ -592,6 +792,15 @@ func (api *API) deleteEntitiesHandler(c echo.Context) error {
 		gm.IncLabel(metrics.LabelRead, p.Label)
 	}
 
+	if err := api.authorizeLabels(c, auth.OP_WRITE, []string{auth.ALL_LABELS}); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+
+	q.Predicates = append(q.Predicates, scope...)
 	wo := c.Get("wo").(entity.WriteOp)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).DeleteEntities(wo, q)
@@ -600,6 +809,96 @@ func (api *API) deleteEntitiesHandler(c echo.Context) error {
 	return c.JSON(api.WriteResult(c, entities, err))
 }
 
+func (api *API) renameLabelHandler(c echo.Context) error {
+	gm := c.Get("gm").(metrics.Metrics)
+	gm.Inc(metrics.UpdateQuery, 1)
+
+	var r etre.LabelRename
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(api.WriteResult(c, nil, ErrInvalidContent.New("HTTP payload is not valid JSON: etre.LabelRename: %s", err)))
+	}
+	c.Set("rename", r) // for audit
+	if err := api.validate.RenameLabel(r.From, r.To); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, []string{r.From, r.To}); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	for _, p := range scope {
+		if p.Label == r.From || p.Label == r.To {
+			return c.JSON(api.WriteResult(c, nil, api.notAuthorized(c, fmt.Errorf("cannot rename label %s in write scope", p.Label))))
+		}
+	}
+
+	// Query is optional: default all entities with the label
+	q, err := query.Translate(r.Query)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, ErrInvalidQuery.New("invalid query: %s", err)))
+	}
+
+	// Label metrics
+	gm.Val(metrics.Labels, int64(len(q.Predicates)))
+	for _, p := range q.Predicates {
+		gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+	gm.IncLabel(metrics.LabelDelete, r.From)
+	gm.IncLabel(metrics.LabelUpdate, r.To)
+
+	wo := c.Get("wo").(entity.WriteOp)
+	ctx := c.Get("ctx").(context.Context)
+	q.Predicates = append(q.Predicates, scope...)
+	entities, err := api.es.WithContext(ctx).RenameLabel(wo, q, r.From, r.To)
+	gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	gm.Inc(metrics.Updated, int64(len(entities)))
+	return c.JSON(api.WriteResult(c, entities, err))
+}
+
+func (api *API) deleteLabelsHandler(c echo.Context) error {
+	gm := c.Get("gm").(metrics.Metrics)
+	gm.Inc(metrics.DeleteLabel, 1)
+
+	label := c.Param("label")
+	if label == "" {
+		return c.JSON(api.WriteResult(c, nil, ErrMissingParam.New("missing label param")))
+	}
+	gm.IncLabel(metrics.LabelDelete, label)
+	if err := api.validate.DeleteLabel(label); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(etre.Entity{label: nil})); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.labelsInScope(c, scope, []string{label}, etre.Entity{}); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+
+	// Query is optional: default all entities with the label
+	q, err := query.Translate(c.QueryParam("query"))
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, ErrInvalidQuery.New("invalid query: %s", err)))
+	}
+	gm.Val(metrics.Labels, int64(len(q.Predicates)))
+	for _, p := range q.Predicates {
+		gm.IncLabel(metrics.LabelRead, p.Label)
+	}
+
+	q.Predicates = append(q.Predicates, scope...)
+	wo := c.Get("wo").(entity.WriteOp)
+	ctx := c.Get("ctx").(context.Context)
+	entities, err := api.es.WithContext(ctx).DeleteLabels(wo, q, label)
+	gm.Val(metrics.UpdateBulk, int64(len(entities)))
+	gm.Inc(metrics.Updated, int64(len(entities)))
+	return c.JSON(api.WriteResult(c, entities, err))
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Single Enitity
 // //////////////////////////////////////////////////////////////////////////
@@ -621,9 +920,27 @@ func (api *API) getEntityHandler(c echo.Context) error {
 	if csv != "" {
 		f.ReturnLabels = strings.Split(csv, ",")
 	}
+	if csv := c.QueryParam("expand"); csv != "" {
+		f.Expand = strings.Split(csv, ",")
+	}
+	f.IncludeDeleted = c.QueryParam("includeDeleted") == "true"
+
+	labels, err := api.authorizeExpand(c, &f)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	if err := api.authorizeLabels(c, auth.OP_READ, labels); err != nil {
+		return api.readError(c, err)
+	}
+
+	scope, err := api.scope(c, auth.OP_READ)
+	if err != nil {
+		return api.readError(c, err)
+	}
 
 	// Read the entity by ID
 	q, _ := query.Translate("_id=" + oid.Hex())
+	q.Predicates = append(q.Predicates, scope...)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).ReadEntities(c.Param("type"), q, f)
 	if err != nil {
@@ -632,6 +949,7 @@ func (api *API) getEntityHandler(c echo.Context) error {
 	if len(entities) == 0 {
 		return c.JSON(http.StatusNotFound, nil)
 	}
+	api.stripLabels(c, entities, f.Expand...)
 	return c.JSON(http.StatusOK, entities[0])
 }
 
@@ -646,7 +964,13 @@ func (api *API) getLabelsHandler(c echo.Context) error {
 		return api.readError(c, err)
 	}
 
+	scope, err := api.scope(c, auth.OP_READ)
+	if err != nil {
+		return api.readError(c, err)
+	}
+
 	q, _ := query.Translate("_id=" + oid.Hex())
+	q.Predicates = append(q.Predicates, scope...)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).ReadEntities(c.Param("type"), q, etre.QueryFilter{})
 	if err != nil {
@@ -655,6 +979,7 @@ func (api *API) getLabelsHandler(c echo.Context) error {
 	if len(entities) == 0 {
 		return c.JSON(http.StatusNotFound, nil)
 	}
+	api.stripLabels(c, entities)
 	return c.JSON(http.StatusOK, entities[0].Labels())
 }
 
@@ -676,7 +1001,13 @@ func (api *API) postEntityHandler(c echo.Context) error {
 		return c.JSON(api.WriteResult(c, nil, ErrNoContent))
 	}
 	entities := []etre.Entity{newEntity}
-	if err := api.validate.Entities(entities, entity.VALIDATE_ON_CREATE); err != nil {
+	if err := api.validateEntities(c, entities, entity.VALIDATE_ON_CREATE); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(newEntity)); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.newInScope(c, entities); err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
@@ -710,7 +1041,17 @@ func (api *API) putEntityHandler(c echo.Context) error {
 	if len(patch) == 0 {
 		return c.JSON(api.WriteResult(c, nil, ErrNoContent))
 	}
-	if err := api.validate.Entities([]etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+	if err := api.validateEntities(c, []etre.Entity{patch}, entity.VALIDATE_ON_UPDATE); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(patch)); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.labelsInScope(c, scope, patch.Labels(), patch); err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
@@ -722,6 +1063,7 @@ func (api *API) putEntityHandler(c echo.Context) error {
 	// Patch one entity by ID
 	wo := c.Get("wo").(entity.WriteOp)
 	q, _ := query.Translate("_id=" + oid.Hex())
+	q.Predicates = append(q.Predicates, scope...)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).UpdateEntities(wo, q, patch)
 	if err == nil && len(entities) == 0 {
@@ -745,9 +1087,18 @@ func (api *API) deleteEntityHandler(c echo.Context) error {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
+	if err := api.authorizeLabels(c, auth.OP_WRITE, []string{auth.ALL_LABELS}); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+
 	// Delete one entity by ID
 	wo := c.Get("wo").(entity.WriteOp)
 	q, _ := query.Translate("_id=" + oid.Hex())
+	q.Predicates = append(q.Predicates, scope...)
 	ctx := c.Get("ctx").(context.Context)
 	entities, err := api.es.WithContext(ctx).DeleteEntities(wo, q)
 	if err == nil && len(entities) == 0 {
@@ -766,7 +1117,8 @@ func (api *API) deleteLabelHandler(c echo.Context) error {
 
 	// Get and validate entity id from URL (:id).
 	// wo has the same (string) value but didn't validate it.
-	if _, err := entityId(c); err != nil {
+	oid, err := entityId(c)
+	if err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
 
@@ -778,10 +1130,32 @@ func (api *API) deleteLabelHandler(c echo.Context) error {
 	if err := api.validate.DeleteLabel(label); err != nil {
 		return c.JSON(api.WriteResult(c, nil, err))
 	}
+	if err := api.authorizeLabels(c, auth.OP_WRITE, writeLabels(etre.Entity{label: nil})); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
+	if err := api.labelsInScope(c, scope, []string{label}, etre.Entity{}); err != nil {
+		return c.JSON(api.WriteResult(c, nil, err))
+	}
 
-	// Delete label from entity
+	// Delete label from entity, which must be in scope, if any
 	wo := c.Get("wo").(entity.WriteOp)
 	ctx := c.Get("ctx").(context.Context)
+	if len(scope) > 0 {
+		q, _ := query.Translate("_id=" + oid.Hex())
+		q.Predicates = append(q.Predicates, scope...)
+		f := etre.QueryFilter{ReturnLabels: []string{"_id"}}
+		entities, err := api.es.WithContext(ctx).ReadEntities(c.Param("type"), q, f)
+		if err != nil {
+			return c.JSON(api.WriteResult(c, nil, err))
+		}
+		if len(entities) == 0 {
+			return c.JSON(api.WriteResult(c, nil, ErrNotFound))
+		}
+	}
 	diff, err := api.es.WithContext(ctx).DeleteLabel(wo, label)
 	if err != nil && err == etre.ErrEntityNotFound {
 		return c.JSON(api.WriteResult(c, nil, ErrNotFound))
@@ -801,6 +1175,23 @@ func (api *API) metricsHandler(c echo.Context) error {
 		reset = true
 	}
 
+	return c.JSON(http.StatusOK, api.metricsReport(reset))
+}
+
+// prometheusMetricsHandler returns the same metrics as metricsHandler in
+// Prometheus text format. Scrapes don't reset samples, and summary _sum and
+// _count are cumulative even if GET /metrics?reset=true resets the samples,
+// so they never decrease.
+func (api *API) prometheusMetricsHandler(c echo.Context) error {
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf, api.metricsReport(false)); err != nil {
+		return api.readError(c, err)
+	}
+	return c.Blob(http.StatusOK, metrics.PROMETHEUS_CONTENT_TYPE, buf.Bytes())
+}
+
+// metricsReport returns system and group metrics.
+func (api *API) metricsReport(reset bool) etre.Metrics {
 	// Get system metrics which returns an etre.Metrics with System set
 	// and Groups nil, which we set next
 	all := api.systemMetrics.Report(reset)
@@ -810,7 +1201,7 @@ func (api *API) metricsHandler(c echo.Context) error {
 	// plugin can specify zero or more groups.
 	groups := api.metricsStore.Names()
 	if len(groups) == 0 { // no user-defined metric groups
-		return c.JSON(http.StatusOK, all)
+		return all
 	}
 
 	all.Groups = make([]etre.MetricsGroupReport, len(groups))
@@ -828,7 +1219,7 @@ func (api *API) metricsHandler(c echo.Context) error {
 		all.Groups[i] = r.Groups[0]
 	}
 
-	return c.JSON(http.StatusOK, all)
+	return all
 }
 
 func (api *API) statusHandler(c echo.Context) error {
@@ -839,6 +1230,376 @@ func (api *API) statusHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, status)
 }
 
+// --------------------------------------------------------------------------
+// Entity types
+// --------------------------------------------------------------------------
+
+// Runtime entity type names must be valid collection names and URL-safe.
+var reEntityTypeName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+func (api *API) getEntityTypesHandler(c echo.Context) error {
+	if api.entityTypes == nil {
+		return api.readError(c, ErrEntityTypesDisabled)
+	}
+	if err := api.authorizeAdmin(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, api.entityTypes.List())
+}
+
+func (api *API) postEntityTypeHandler(c echo.Context) error {
+	if api.entityTypes == nil {
+		return api.readError(c, ErrEntityTypesDisabled)
+	}
+	if err := api.authorizeAdmin(c); err != nil {
+		return err
+	}
+	var t entity.EntityType
+	if err := c.Bind(&t); err != nil {
+		return api.readError(c, ErrInvalidContent.New("HTTP payload is not valid JSON: entity.EntityType: %s", err))
+	}
+	if !reEntityTypeName.MatchString(t.Name) {
+		return api.readError(c, ErrInvalidParam.New("invalid entity type name: '%s': must match %s", t.Name, reEntityTypeName))
+	}
+	if err := config.ValidateEntityType(t.Name); err != nil {
+		return api.readError(c, ErrInvalidParam.New("%s", err))
+	}
+	t.CreatedBy = c.Get("caller").(auth.Caller).Name
+
+	ctx, cancel := context.WithTimeout(context.Background(), api.queryTimeout)
+	defer cancel()
+	if err := api.entityTypes.Create(ctx, t); err != nil {
+		return api.entityTypeError(c, err)
+	}
+	log.Printf("Created entity type %s: %+v", t.Name, t)
+	return c.JSON(http.StatusCreated, t)
+}
+
+func (api *API) deleteEntityTypeHandler(c echo.Context) error {
+	if api.entityTypes == nil {
+		return api.readError(c, ErrEntityTypesDisabled)
+	}
+	if err := api.authorizeAdmin(c); err != nil {
+		return err
+	}
+	name := c.Param("name")
+	caller := c.Get("caller").(auth.Caller).Name
+
+	ctx, cancel := context.WithTimeout(context.Background(), api.queryTimeout)
+	defer cancel()
+	if err := api.entityTypes.Retire(ctx, name, caller); err != nil {
+		return api.entityTypeError(c, err)
+	}
+	log.Printf("Retired entity type %s (caller: %s)", name, caller)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// authorizeAdmin returns an error if the caller does not have an admin role.
+// The error is the HTTP response.
+func (api *API) authorizeAdmin(c echo.Context) error {
+	caller := c.Get("caller").(auth.Caller)
+	if err := api.auth.Authorize(caller, auth.Action{Op: auth.OP_ADMIN}); err != nil {
+		log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, c.Request())
+		api.systemMetrics.Inc(metrics.AuthorizationFailed, 1)
+		authErr := auth.Error{
+			Err:        err,
+			Type:       "not-authorized",
+			HTTPStatus: http.StatusForbidden,
+		}
+		api.audit(c, audit.EVENT_AUTHORIZATION_FAILED, authErr)
+		return api.readError(c, authErr)
+	}
+	return nil
+}
+
+// authorizeLabels authorizes the caller to read or write the labels of the
+// entity type, which ACLs can restrict (auth.ACL.WriteLabels and DenyReadLabels).
+// The entity type was already authorized in the middleware, without labels.
+func (api *API) authorizeLabels(c echo.Context, op string, labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	caller := c.Get("caller").(auth.Caller)
+	a := auth.Action{EntityType: c.Param("type"), Op: op, Labels: labels}
+	if err := api.auth.Authorize(caller, a); err != nil {
+		return api.notAuthorized(c, err)
+	}
+	return nil
+}
+
+// authorizeExpand authorizes the caller to read the entity types referenced by
+// the expand labels, and the labels inlined from them, like rack_id.name (label
+// name of the referenced type). It sets f.ExpandScope to the read scopes of the
+// referenced types. It returns the other labels to authorize for the entity type:
+// the return labels that are not inlined, and the expand labels. Expand labels
+// that are not references are left for the store to reject.
+func (api *API) authorizeExpand(c echo.Context, f *etre.QueryFilter) ([]string, error) {
+	labels := append([]string{}, f.Expand...)
+	inlined := map[string][]string{}
+	for _, rl := range f.ReturnLabels {
+		if ref := api.expandedBy(c.Param("type"), rl, f.Expand); ref != "" {
+			inlined[ref] = append(inlined[ref], strings.TrimPrefix(rl, ref+"."))
+			continue
+		}
+		labels = append(labels, rl)
+	}
+	caller := c.Get("caller").(auth.Caller)
+	for _, label := range f.Expand {
+		refType := api.schemas[c.Param("type")].References[label].EntityType
+		if refType == "" {
+			continue
+		}
+		a := auth.Action{EntityType: refType, Op: auth.OP_READ}
+		if err := api.auth.Authorize(caller, a); err != nil {
+			return nil, api.notAuthorized(c, err)
+		}
+		if len(inlined[label]) > 0 {
+			a.Labels = inlined[label]
+			if err := api.auth.Authorize(caller, a); err != nil {
+				return nil, api.notAuthorized(c, err)
+			}
+		}
+		scope, err := api.scopeOf(c, refType, auth.OP_READ)
+		if err != nil {
+			return nil, err
+		}
+		if len(scope) > 0 {
+			if f.ExpandScope == nil {
+				f.ExpandScope = map[string]query.Query{}
+			}
+			f.ExpandScope[label] = query.Query{Predicates: scope}
+		}
+	}
+	return labels, nil
+}
+
+// expandedBy returns the expand label, which must be a reference of the entity
+// type, that the label is inlined by, or an empty string. For example, label
+// rack_id.name is inlined by rack_id.
+func (api *API) expandedBy(entityType, label string, expand []string) string {
+	for _, ref := range expand {
+		if _, ok := api.schemas[entityType].References[ref]; ok && strings.HasPrefix(label, ref+".") {
+			return ref
+		}
+	}
+	return ""
+}
+
+// scope returns the ACL scope of reads or writes of the entity type: predicates
+// to AND into queries (see auth.ACL.ReadScope and WriteScope), or nil if the
+// caller is not scoped.
+func (api *API) scope(c echo.Context, op string) ([]query.Predicate, error) {
+	return api.scopeOf(c, c.Param("type"), op)
+}
+
+// scopeOf is scope for the given entity type, like the type of a reference.
+func (api *API) scopeOf(c echo.Context, entityType, op string) ([]query.Predicate, error) {
+	caller := c.Get("caller").(auth.Caller)
+	scope, err := api.auth.Scope(caller, auth.Action{EntityType: entityType, Op: op})
+	if err != nil {
+		return nil, api.notAuthorized(c, err)
+	}
+	if scope == "" {
+		return nil, nil
+	}
+	q, err := query.Translate(scope)
+	if err != nil {
+		return nil, api.notAuthorized(c, fmt.Errorf("invalid scope: %s: %s", scope, err))
+	}
+	return q.Predicates, nil
+}
+
+// newInScope returns an error if new entities do not match the write scope.
+func (api *API) newInScope(c echo.Context, entities []etre.Entity) error {
+	scope, err := api.scope(c, auth.OP_WRITE)
+	if err != nil || len(scope) == 0 {
+		return err
+	}
+	q := query.Query{Predicates: scope}
+	for i, e := range entities {
+		if !entity.Matches(q, e) {
+			return api.notAuthorized(c, fmt.Errorf("entity index %d does not match write scope", i))
+		}
+	}
+	return nil
+}
+
+// labelsInScope returns an error if writing the labels would move entities out
+// of the write scope. values has the new values of the labels; labels not in
+// values are deleted.
+func (api *API) labelsInScope(c echo.Context, scope []query.Predicate, labels []string, values etre.Entity) error {
+	preds := []query.Predicate{}
+	for _, p := range scope {
+		for _, label := range labels {
+			if p.Label == label {
+				preds = append(preds, p)
+			}
+		}
+	}
+	if !entity.Matches(query.Query{Predicates: preds}, values) {
+		return api.notAuthorized(c, fmt.Errorf("writing labels %v does not match write scope", labels))
+	}
+	return nil
+}
+
+// notAuthorized logs and counts the authorization failure and returns an
+// auth.Error for HTTP status 403.
+func (api *API) notAuthorized(c echo.Context, err error) error {
+	caller := c.Get("caller").(auth.Caller)
+	log.Printf("AUTH: not authorized: %s (caller: %+v request: %+v)", err, caller, c.Request())
+	c.Get("gm").(metrics.Metrics).Inc(metrics.AuthorizationFailed, 1)
+	authErr := auth.Error{
+		Err:        err,
+		Type:       "not-authorized",
+		HTTPStatus: http.StatusForbidden,
+	}
+	api.audit(c, audit.EVENT_AUTHORIZATION_FAILED, authErr)
+	return authErr
+}
+
+// audit writes an audit event for the request, if the audit log is enabled.
+// Auth failures are audited where they occur, and writes after the route, when
+// the write result is known. err is the error returned to the caller, if any.
+func (api *API) audit(c echo.Context, eventType string, err error) {
+	if api.auditSink == nil {
+		return
+	}
+	c.Set("audited", true)
+	req := c.Request()
+	e := audit.Event{
+		Ts:         time.Now().UnixNano() / int64(time.Millisecond),
+		Type:       eventType,
+		RemoteAddr: c.RealIP(),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		EntityType: c.Param("type"),
+		Query:      c.QueryParam("query"),
+		SetOp:      c.QueryParam("setOp"),
+		SetId:      c.QueryParam("setId"),
+		HTTPStatus: c.Response().Status,
+	}
+	e.SetSize, _ = strconv.Atoi(c.QueryParam("setSize"))
+	if v := c.Get("caller"); v != nil {
+		caller := v.(auth.Caller)
+		e.Caller = caller.Name
+		e.Roles = caller.Roles
+		e.Trace = caller.Trace
+	}
+	if v := c.Get("rename"); v != nil {
+		r := v.(etre.LabelRename)
+		e.RenameFrom, e.RenameTo, e.Query = r.From, r.To, r.Query
+	}
+	if v := c.Get("wr"); v != nil {
+		wr := v.(etre.WriteResult)
+		for _, w := range wr.Writes {
+			e.EntityIds = append(e.EntityIds, w.EntityId)
+		}
+		if wr.Error != nil {
+			e.Error, e.ErrorType = wr.Error.Message, wr.Error.Type
+		}
+	}
+	switch v := err.(type) {
+	case auth.Error:
+		e.Error, e.ErrorType, e.HTTPStatus = v.Err.Error(), v.Type, v.HTTPStatus
+	case *echo.HTTPError:
+		if etreErr, ok := v.Message.(etre.Error); ok {
+			e.Error, e.ErrorType = etreErr.Message, etreErr.Type
+		} else {
+			e.Error = fmt.Sprintf("%v", v.Message)
+		}
+	}
+	if err := api.auditSink.Write(e); err != nil {
+		log.Printf("ERROR: writing audit event: %s (event: %+v)", err, e)
+	}
+}
+
+// stripLabels removes labels that the caller is not authorized to read from
+// the entities, and counts an authorization failure if any are removed.
+func (api *API) stripLabels(c echo.Context, entities []etre.Entity, expand ...string) {
+	// Labels inlined from expanded references, like rack_id.name, are authorized
+	// as label name of the referenced entity type
+	type typeLabel struct {
+		entityType string
+		label      string
+	}
+	entityType := c.Param("type")
+	authLabel := map[string]typeLabel{} // keyed on entity label
+	byType := map[string][]string{}
+	seen := map[typeLabel]bool{}
+	for _, e := range entities {
+		for label := range e {
+			if _, ok := authLabel[label]; ok {
+				continue
+			}
+			tl := typeLabel{entityType, label}
+			if ref := api.expandedBy(entityType, label, expand); ref != "" {
+				tl = typeLabel{api.schemas[entityType].References[ref].EntityType, strings.TrimPrefix(label, ref+".")}
+			}
+			authLabel[label] = tl
+			if !seen[tl] {
+				seen[tl] = true
+				byType[tl.entityType] = append(byType[tl.entityType], tl.label)
+			}
+		}
+	}
+	caller := c.Get("caller").(auth.Caller)
+	denied := map[typeLabel]bool{}
+	for t, labels := range byType {
+		for label := range api.deniedLabels(caller, t, labels) {
+			denied[typeLabel{t, label}] = true
+		}
+	}
+	if len(denied) == 0 {
+		return
+	}
+	c.Get("gm").(metrics.Metrics).Inc(metrics.AuthorizationFailed, 1)
+	for label, tl := range authLabel {
+		if !denied[tl] {
+			continue
+		}
+		for _, e := range entities {
+			delete(e, label)
+		}
+	}
+}
+
+// validateEntities validates entities in a child span of the request span.
+func (api *API) validateEntities(c echo.Context, entities []etre.Entity, op byte) error {
+	span := c.Get("span").(*trace.Span).Child("validate")
+	err := api.validate.Entities(entities, op)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// deniedLabels returns the labels of the entity type that the caller is not
+// authorized to read, or nil if none. It authorizes all labels at once, which
+// is the common case, and each label only if that fails.
+func (api *API) deniedLabels(caller auth.Caller, entityType string, labels []string) map[string]bool {
+	a := auth.Action{EntityType: entityType, Op: auth.OP_READ, Labels: labels}
+	if err := api.auth.Authorize(caller, a); err == nil {
+		return nil
+	}
+	denied := map[string]bool{}
+	for _, label := range labels {
+		a.Labels = []string{label}
+		if err := api.auth.Authorize(caller, a); err != nil {
+			denied[label] = true
+		}
+	}
+	return denied
+}
+
+func (api *API) entityTypeError(c echo.Context, err error) error {
+	switch err {
+	case entity.ErrEntityTypeExists:
+		return api.readError(c, ErrEntityTypeExists)
+	case entity.ErrEntityTypeNotFound:
+		return api.readError(c, ErrEntityTypeNotFound)
+	}
+	return api.readError(c, err)
+}
+
 // --------------------------------------------------------------------------
 // Change feed
 // --------------------------------------------------------------------------
@@ -848,10 +1609,23 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// Long-poll change feed defaults and limits: GET /changes/poll.
+const (
+	CDC_POLL_LIMIT     = 100
+	CDC_POLL_MAX_LIMIT = 10000
+	CDC_POLL_WAIT      = 30 * time.Second
+	CDC_POLL_MAX_WAIT  = 5 * time.Minute
+)
+
+// changesHandler streams the change feed over a websocket, or as Server-Sent
+// Events if format=sse.
 func (api *API) changesHandler(c echo.Context) error {
 	if api.cdcDisabled {
 		return api.readError(c, ErrCDCDisabled)
 	}
+	if c.QueryParam("format") == "sse" {
+		return api.sseChangesHandler(c)
+	}
 
 	// Upgrade to a WebSocket connection.
 	wsConn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
@@ -864,16 +1638,22 @@ func (api *API) changesHandler(c echo.Context) error {
 	gm.Inc(metrics.CDCClients, 1)
 	defer gm.Inc(metrics.CDCClients, -1)
 
-	var caller auth.Caller
-	if v := c.Get("caller"); v != nil {
-		caller = v.(auth.Caller)
-	}
-
-	clientId := fmt.Sprintf("%s@%s", caller.Name, c.Request().RemoteAddr)
+	clientId := cdcClientId(c)
 	log.Printf("CDC: %s: connected", clientId)
 
+	// Durable consumers are scoped to the caller so one client can't read or
+	// overwrite another client's checkpoint
+	var checkpoints cdc.CheckpointStore
+	if api.cdcCheckpoints != nil {
+		var caller auth.Caller
+		if v := c.Get("caller"); v != nil {
+			caller = v.(auth.Caller)
+		}
+		checkpoints = cdc.CallerCheckpoints(api.cdcCheckpoints, caller.Name)
+	}
+
 	stream := api.streamFactory.Make(clientId)
-	client := changestream.NewWebsocketClient(clientId, wsConn, stream)
+	client := changestream.NewWebsocketClient(clientId, wsConn, stream, checkpoints, api.cdcAuth(c))
 	if err := client.Run(); err != nil {
 		switch err {
 		case changestream.ErrWebsocketClosed:
@@ -885,6 +1665,271 @@ func (api *API) changesHandler(c echo.Context) error {
 	return nil
 }
 
+// sseChangesHandler streams the change feed as Server-Sent Events: GET /changes?format=sse.
+// Query params since (cursor or ts), entityTypes, ops, labels, and query are
+// optional. The Last-Event-ID header, sent by clients on reconnect, overrides since.
+func (api *API) sseChangesHandler(c echo.Context) error {
+	since := c.QueryParam("since")
+	if id := c.Request().Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	cp, filter, err := cdcParams(since, c)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	filter = filter.WithAuth(api.cdcAuth(c))
+
+	gm := c.Get("gm").(metrics.Metrics)
+	gm.Inc(metrics.CDCClients, 1)
+	defer gm.Inc(metrics.CDCClients, -1)
+
+	clientId := cdcClientId(c)
+	stream := api.streamFactory.Make(clientId)
+	client, err := changestream.NewSSEClient(clientId, c.Response(), stream)
+	if err != nil {
+		return api.readError(c, ErrInternal.New(err.Error()))
+	}
+	log.Printf("CDC: %s: connected (SSE)", clientId)
+	if err := client.Run(cp, filter, c.Request().Context().Done()); err != nil {
+		log.Printf("CDC: %s: lost connection: %s", clientId, err)
+	} else {
+		log.Printf("CDC: %s: closed connection", clientId)
+	}
+	return nil
+}
+
+// pollChangesHandler returns the next events in the change feed: GET /changes/poll.
+// It waits up to wait (default 30s) for events. Query params are the same as
+// sseChangesHandler plus limit (default 100). The response is etre.CDCPollResult.
+func (api *API) pollChangesHandler(c echo.Context) error {
+	if api.cdcDisabled {
+		return api.readError(c, ErrCDCDisabled)
+	}
+	cp, filter, err := cdcParams(c.QueryParam("since"), c)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	filter = filter.WithAuth(api.cdcAuth(c))
+	limit := CDC_POLL_LIMIT
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > CDC_POLL_MAX_LIMIT {
+			return api.readError(c, ErrInvalidParam.New("limit must be between 1 and %d", CDC_POLL_MAX_LIMIT))
+		}
+	}
+	wait := CDC_POLL_WAIT
+	if v := c.QueryParam("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 || wait > CDC_POLL_MAX_WAIT {
+			return api.readError(c, ErrInvalidParam.New("wait must be a duration between 0s and %s", CDC_POLL_MAX_WAIT))
+		}
+	}
+
+	gm := c.Get("gm").(metrics.Metrics)
+	gm.Inc(metrics.CDCClients, 1)
+	defer gm.Inc(metrics.CDCClients, -1)
+
+	stream := api.streamFactory.Make(cdcClientId(c))
+	res, err := changestream.Poll(stream, cp, filter, limit, wait, c.Request().Context().Done())
+	if err != nil {
+		return api.readError(c, ErrInternal.New(err.Error()))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// snapshotHandler returns entities of the type and the CDC position they
+// correspond to: GET /snapshot/:type. The optional query param filters entities.
+// To mirror entities, the consumer loads the snapshot and starts the change feed
+// after the position (CDCStartOptions.After), so no event is missed between
+// reading entities and starting the feed.
+func (api *API) snapshotHandler(c echo.Context) error {
+	if api.cdcDisabled || api.snapshotter == nil {
+		return api.readError(c, ErrCDCDisabled)
+	}
+	gm := c.Get("gm").(metrics.Metrics)
+	gm.Inc(metrics.ReadQuery, 1)
+
+	q := query.Query{}
+	if requestLabelSelector := c.QueryParam("query"); requestLabelSelector != "" {
+		var err error
+		if q, err = query.Translate(requestLabelSelector); err != nil {
+			return api.readError(c, ErrInvalidQuery.New("invalid query: %s", err))
+		}
+		labels := make([]string, len(q.Predicates))
+		for i, p := range q.Predicates {
+			labels[i] = p.Label
+		}
+		if err := api.authorizeLabels(c, auth.OP_READ, labels); err != nil {
+			return api.readError(c, err)
+		}
+	}
+	scope, err := api.scope(c, auth.OP_READ)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	q.Predicates = append(q.Predicates, scope...)
+
+	ctx := c.Get("ctx").(context.Context)
+	snap, err := api.snapshotter.Snapshot(ctx, c.Param("type"), q)
+	if err != nil {
+		return api.readError(c, err)
+	}
+	gm.Val(metrics.ReadMatch, int64(len(snap.Entities)))
+	api.stripLabels(c, snap.Entities)
+	return c.JSON(http.StatusOK, etre.CDCSnapshot{
+		Entities: snap.Entities,
+		Cursor:   changestream.FormatCursor(snap.Position),
+	})
+}
+
+// cdcParams returns the position and filter from the since cursor and HTTP
+// query params. If since is empty, the position is now.
+func cdcParams(since string, c echo.Context) (cdc.Checkpoint, changestream.Filter, error) {
+	cp := cdc.Checkpoint{Ts: time.Now().UnixNano() / int64(time.Millisecond)}
+	if since != "" {
+		var err error
+		if cp, err = changestream.ParseCursor(since); err != nil {
+			return cp, changestream.NoFilter, ErrInvalidParam.New("since: %s", err)
+		}
+	}
+	f := etre.CDCFilter{Query: c.QueryParam("query")}
+	if csv := c.QueryParam("entityTypes"); csv != "" {
+		f.EntityTypes = strings.Split(csv, ",")
+	}
+	if csv := c.QueryParam("ops"); csv != "" {
+		f.Ops = strings.Split(csv, ",")
+	}
+	if csv := c.QueryParam("labels"); csv != "" {
+		f.Labels = strings.Split(csv, ",")
+	}
+	filter, err := changestream.NewFilter(f)
+	if err != nil {
+		return cp, filter, ErrInvalidParam.New(err.Error())
+	}
+	return cp, filter, nil
+}
+
+// cdcAuth returns the changestream.Authorizer for the caller of a change feed.
+func (api *API) cdcAuth(c echo.Context) changestream.Authorizer {
+	return cdcAuthorizer{
+		api:    api,
+		caller: c.Get("caller").(auth.Caller),
+		gm:     c.Get("gm").(metrics.Metrics),
+	}
+}
+
+// cdcAuthorizer authorizes change feed events like reads: the caller must be allowed
+// to read the entity type, and labels it cannot read are removed.
+type cdcAuthorizer struct {
+	api    *API
+	caller auth.Caller
+	gm     metrics.Metrics
+}
+
+func (a cdcAuthorizer) EntityType(entityType string) bool {
+	return a.api.auth.Authorize(a.caller, auth.Action{EntityType: entityType, Op: auth.OP_READ}) == nil
+}
+
+func (a cdcAuthorizer) Event(e etre.CDCEvent) (etre.CDCEvent, bool) {
+	if !a.EntityType(e.EntityType) || !a.inScope(e) {
+		return e, false
+	}
+	seen := map[string]bool{}
+	labels := []string{}
+	for _, ent := range []*etre.Entity{e.Old, e.New, e.Full} {
+		if ent == nil {
+			continue
+		}
+		for label := range *ent {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	denied := a.api.deniedLabels(a.caller, e.EntityType, labels)
+	if len(denied) == 0 {
+		return e, true
+	}
+	a.gm.Inc(metrics.AuthorizationFailed, 1)
+	e.Old = withoutLabels(e.Old, denied)
+	e.New = withoutLabels(e.New, denied)
+	e.Full = withoutLabels(e.Full, denied)
+	return e, true
+}
+
+// inScope returns true if the entity of the event matches the caller's read
+// scope before or after the write, so callers see entities move in and out of
+// scope. Scoped entity types have the whole entity in update events (the server
+// enables CDCFullEntity for them), so scope is checked on the event, not by
+// reading the entity which has changed since. An update without Full, like an
+// event written before scope was enabled, is not in scope.
+func (a cdcAuthorizer) inScope(e etre.CDCEvent) bool {
+	scope, err := a.api.auth.Scope(a.caller, auth.Action{EntityType: e.EntityType, Op: auth.OP_READ})
+	if err != nil {
+		return false
+	}
+	if scope == "" {
+		return true
+	}
+	q, err := query.Translate(scope)
+	if err != nil {
+		return false
+	}
+	switch e.Op {
+	case "i":
+		return e.New != nil && entity.Matches(q, *e.New)
+	case "d", "p":
+		return e.Old != nil && entity.Matches(q, *e.Old)
+	}
+	if e.Full == nil {
+		return false
+	}
+	return entity.Matches(q, *e.Full) || entity.Matches(q, changestream.BeforeUpdate(e, *e.Full))
+}
+
+// withoutLabels returns a copy of the entity without the labels. It copies
+// because the same event is sent to every stream.
+func withoutLabels(e *etre.Entity, labels map[string]bool) *etre.Entity {
+	if e == nil {
+		return nil
+	}
+	cp := etre.Entity{}
+	for label, v := range *e {
+		if !labels[label] {
+			cp[label] = v
+		}
+	}
+	return &cp
+}
+
+func cdcClientId(c echo.Context) string {
+	var caller auth.Caller
+	if v := c.Get("caller"); v != nil {
+		caller = v.(auth.Caller)
+	}
+	return fmt.Sprintf("%s@%s", caller.Name, c.Request().RemoteAddr)
+}
+
+// replayCDCHandler replays the CDC fallback file. This is done automatically
+// on startup, but if MongoDB was down while the server was running, an admin
+// can replay the file once it's back up.
+func (api *API) replayCDCHandler(c echo.Context) error {
+	if api.cdcDisabled {
+		return api.readError(c, ErrCDCDisabled)
+	}
+	if api.cdcReplayer == nil {
+		return api.readError(c, ErrNoCDCFallbackFile)
+	}
+	if err := api.authorizeAdmin(c); err != nil {
+		return err
+	}
+	res, err := api.cdcReplayer.Replay()
+	if err != nil {
+		return api.readError(c, ErrInternal.New("error replaying CDC fallback file %s: %s (result: %+v)", res.File, err, res))
+	}
+	log.Printf("Replayed CDC fallback file: %+v (caller: %s)", res, c.Get("caller").(auth.Caller).Name)
+	return c.JSON(http.StatusOK, res)
+}
+
 // Return error on read. Writes always return an etre.WriteResult by calling WriteResult.
 func (api *API) readError(c echo.Context, err error) *echo.HTTPError {
 	api.systemMetrics.Inc(metrics.Error, 1)
@@ -1049,6 +2094,7 @@ func (api *API) WriteResult(c echo.Context, v interface{}, err error) (int, inte
 		wr.Writes = writes
 	}
 
+	c.Set("wr", wr) // for audit
 	return httpStatus, wr
 }
 
@@ -1076,6 +2122,23 @@ func writeOp(c echo.Context, caller auth.Caller) entity.WriteOp {
 	return wo
 }
 
+// writeLabels returns the labels in the entities that ACLs can restrict:
+// all labels except metalabels.
+func writeLabels(entities ...etre.Entity) []string {
+	seen := map[string]bool{}
+	labels := []string{}
+	for _, e := range entities {
+		for label := range e {
+			if seen[label] || etre.IsMetalabel(label) {
+				continue
+			}
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
 func entityId(c echo.Context) (primitive.ObjectID, error) {
 	id := c.Param("id")
 	if id == "" {
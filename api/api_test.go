@@ -25,6 +25,7 @@ import (
 	srv "github.com/square/etre/server"
 	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
+	"github.com/square/etre/trace"
 )
 
 var (
@@ -41,10 +42,16 @@ type server struct {
 	ts              *httptest.Server
 	url             string
 	auth            *mock.AuthPlugin
+	entityTypes     *mock.EntityTypeRegistry
+	snapshotter     *mock.EntitySnapshotter
 	cdcStore        *mock.CDCStore
+	checkpoints     *mock.CDCCheckpointStore
+	replayer        *mock.CDCReplayer
 	streamerFactory *mock.StreamerFactory
 	metricsrec      *mock.MetricRecorder
 	sysmetrics      *mock.MetricRecorder
+	audit           *mock.AuditSink
+	trace           *mock.TraceExporter
 }
 
 var testEntities = []etre.Entity{
@@ -83,10 +90,16 @@ func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
 		store:           store,
 		cfg:             cfg,
 		auth:            &mock.AuthPlugin{},
+		entityTypes:     &mock.EntityTypeRegistry{},
+		snapshotter:     &mock.EntitySnapshotter{},
 		cdcStore:        &mock.CDCStore{},
+		checkpoints:     &mock.CDCCheckpointStore{},
+		replayer:        &mock.CDCReplayer{},
 		streamerFactory: &mock.StreamerFactory{},
 		metricsrec:      mock.NewMetricsRecorder(),
 		sysmetrics:      mock.NewMetricsRecorder(),
+		audit:           &mock.AuditSink{},
+		trace:           &mock.TraceExporter{},
 	}
 
 	acls, err := srv.MapConfigACLRoles(cfg.Security.ACL)
@@ -98,11 +111,17 @@ func setup(t *testing.T, cfg config.Config, store mock.EntityStore) *server {
 		Config:          server.cfg,
 		EntityStore:     server.store,
 		EntityValidator: validate,
+		EntityTypes:     server.entityTypes,
+		Snapshotter:     server.snapshotter,
 		Auth:            auth.NewManager(acls, server.auth),
 		MetricsStore:    mock.MetricsStore{},
 		MetricsFactory:  mock.MetricsFactory{MetricRecorder: server.metricsrec},
 		StreamerFactory: server.streamerFactory,
+		CDCCheckpoints:  server.checkpoints,
+		CDCReplayer:     server.replayer,
 		SystemMetrics:   server.sysmetrics,
+		Audit:           server.audit,
+		Tracer:          trace.NewTracer(server.trace, 0), // only requests with a traceparent
 	}
 	server.api = api.NewAPI(appCtx)
 	server.ts = httptest.NewServer(server.api)
@@ -0,0 +1,158 @@
+// Copyright 2020, Square, Inc.
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/audit"
+	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test"
+	"github.com/square/etre/test/mock"
+)
+
+func TestAudit(t *testing.T) {
+	// Test that writes and auth failures are audited, but reads are not
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{Role: "rw", Read: []string{entityType}, Write: []string{entityType}},
+			{Role: "ro", Read: []string{entityType}},
+		},
+	}
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{}, nil
+		},
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			return []string{"id1", "id2"}, nil
+		},
+		RenameLabelFunc: func(wo entity.WriteOp, q query.Query, from, to string) ([]etre.Entity, error) {
+			return []etre.Entity{{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "a": "1"}}, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	caller := auth.Caller{Name: "dn", Roles: []string{"rw"}, Trace: map[string]string{"app": "cron"}}
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return caller, nil
+	}
+
+	// ----------------------------------------------------------------------
+	// Write
+	payload, _ := json.Marshal([]etre.Entity{{"a": "1"}, {"b": "2"}})
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?setOp=op1&setId=id1&setSize=2"
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusCreated {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusCreated)
+	}
+	if len(server.audit.Events) != 1 {
+		t.Fatalf("got %d audit events, expected 1: %+v", len(server.audit.Events), server.audit.Events)
+	}
+	got := server.audit.Events[0]
+	got.Ts = 0
+	got.RemoteAddr = ""
+	expect := audit.Event{
+		Type:       audit.EVENT_WRITE,
+		Caller:     "dn",
+		Roles:      []string{"rw"},
+		Trace:      map[string]string{"app": "cron"},
+		Method:     "POST",
+		Path:       etre.API_ROOT + "/entities/" + entityType,
+		EntityType: entityType,
+		EntityIds:  []string{"id1", "id2"},
+		SetOp:      "op1",
+		SetId:      "id1",
+		SetSize:    2,
+		HTTPStatus: http.StatusCreated,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// ----------------------------------------------------------------------
+	// Read is not audited
+	server.audit.Events = nil
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=a"
+	var gotEntities []etre.Entity
+	if _, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.audit.Events) != 0 {
+		t.Errorf("got %d audit events for read, expected 0: %+v", len(server.audit.Events), server.audit.Events)
+	}
+
+	// ----------------------------------------------------------------------
+	// Bulk label rename records the labels and query from the payload
+	server.audit.Events = nil
+	payload, _ = json.Marshal(etre.LabelRename{From: "a", To: "b", Query: "a=1"})
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/rename"
+	if _, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.audit.Events) != 1 {
+		t.Fatalf("got %d audit events, expected 1: %+v", len(server.audit.Events), server.audit.Events)
+	}
+	got = server.audit.Events[0]
+	if got.RenameFrom != "a" || got.RenameTo != "b" || got.Query != "a=1" || got.HTTPStatus != http.StatusOK {
+		t.Errorf("wrong rename event: %+v", got)
+	}
+
+	server.audit.Events = nil
+
+	// ----------------------------------------------------------------------
+	// Authorization failure is audited once, not also as a write
+	caller.Roles = []string{"ro"}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=a"
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if len(server.audit.Events) != 1 {
+		t.Fatalf("got %d audit events, expected 1: %+v", len(server.audit.Events), server.audit.Events)
+	}
+	got = server.audit.Events[0]
+	if got.Type != audit.EVENT_AUTHORIZATION_FAILED || got.Caller != "dn" || got.Query != "a" ||
+		got.HTTPStatus != http.StatusForbidden || got.ErrorType != "not-authorized" || got.Error == "" {
+		t.Errorf("wrong authorization-failed event: %+v", got)
+	}
+
+	// ----------------------------------------------------------------------
+	// Authentication failure
+	server.audit.Events = nil
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{}, fmt.Errorf("bad password")
+	}
+	var gotErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusUnauthorized {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusUnauthorized)
+	}
+	if len(server.audit.Events) != 1 {
+		t.Fatalf("got %d audit events, expected 1: %+v", len(server.audit.Events), server.audit.Events)
+	}
+	got = server.audit.Events[0]
+	if got.Type != audit.EVENT_AUTHENTICATION_FAILED || got.Error != "bad password" || got.HTTPStatus != http.StatusUnauthorized {
+		t.Errorf("wrong authentication-failed event: %+v", got)
+	}
+}
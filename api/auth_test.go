@@ -12,6 +12,10 @@ import (
 
 	"github.com/square/etre"
 	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/metrics"
+	"github.com/square/etre/query"
 	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
 )
@@ -148,3 +152,420 @@ func TestAuthNotAuthorizedWNoACLs(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestAuthLabelACLs(t *testing.T) {
+	// Test that ACL.WriteLabels and ACL.DenyReadLabels are enforced: denied
+	// reads of label are stripped from results or return 403 if explicitly
+	// requested, and writes of labels not granted return 403
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role:           "prov",
+				Read:           []string{entityType},
+				Write:          []string{entityType},
+				WriteLabels:    []string{"status", "rack"},
+				DenyReadLabels: []string{"ipmi_password"},
+			},
+		},
+	}
+	updated := false
+	deleted := false
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{{"_id": testEntityIds[0], "host": "local", "ipmi_password": "secret"}}, nil
+		},
+		UpdateEntitiesFunc: func(wo entity.WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
+			updated = true
+			return []etre.Entity{{"_id": testEntityId0, "status": "old"}}, nil
+		},
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			deleted = true
+			return nil, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"prov"}, MetricGroups: []string{"prov"}}, nil
+	}
+
+	// ----------------------------------------------------------------------
+	// Read: denied label stripped
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host"
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expectEntities := []etre.Entity{{"_id": testEntityIds[0], "host": "local"}}
+	if diff := deep.Equal(gotEntities, expectEntities); diff != nil {
+		t.Error(diff)
+	}
+	if !authorizationFailed(server.metricsrec) {
+		t.Error("AuthorizationFailed metric not incremented for stripped label")
+	}
+
+	// Read: denied label explicitly requested
+	for _, q := range []string{"?query=host&labels=host,ipmi_password", "?query=ipmi_password"} {
+		server.metricsrec.Reset()
+		var etreErr etre.Error
+		statusCode, err = test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/entities/"+entityType+q, nil, &etreErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statusCode != http.StatusForbidden {
+			t.Errorf("%s: response status = %d, expected %d", q, statusCode, http.StatusForbidden)
+		}
+		if !authorizationFailed(server.metricsrec) {
+			t.Errorf("%s: AuthorizationFailed metric not incremented", q)
+		}
+	}
+
+	// ----------------------------------------------------------------------
+	// Write: label not granted
+	server.metricsrec.Reset()
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	payload, _ := json.Marshal(etre.Entity{"status": "ok", "owner": "me"})
+	var gotWR etre.WriteResult
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if gotWR.Error == nil || gotWR.Error.Type != "not-authorized" {
+		t.Errorf("WriteResult.Error = %+v, expected not-authorized", gotWR.Error)
+	}
+	if updated {
+		t.Error("entity updated, expected not-authorized error first")
+	}
+	if !authorizationFailed(server.metricsrec) {
+		t.Error("AuthorizationFailed metric not incremented")
+	}
+
+	// Write: labels granted
+	payload, _ = json.Marshal(etre.Entity{"status": "ok"})
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d: %+v", statusCode, http.StatusOK, gotWR.Error)
+	}
+	if !updated {
+		t.Error("entity not updated")
+	}
+
+	// Write: deleting an entity writes all labels
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if deleted {
+		t.Error("entity deleted, expected not-authorized error first")
+	}
+}
+
+func authorizationFailed(m *mock.MetricRecorder) bool {
+	for _, c := range m.Called {
+		if c.Method == "Inc" && c.Metric == metrics.AuthorizationFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAuthScope(t *testing.T) {
+	// Test that ACL.ReadScope and WriteScope are ANDed into queries, and new
+	// and patched entities must match the write scope
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role:       "team",
+				Read:       []string{entityType},
+				Write:      []string{entityType},
+				ReadScope:  "team=${caller.team}",
+				WriteScope: "team=${caller.team}",
+			},
+		},
+	}
+	var gotQuery query.Query
+	created := false
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotQuery = q
+			return []etre.Entity{}, nil
+		},
+		CreateEntitiesFunc: func(wo entity.WriteOp, entities []etre.Entity) ([]string, error) {
+			created = true
+			return []string{testEntityIds[0]}, nil
+		},
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			gotQuery = q
+			return nil, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"team"}, Attributes: map[string]string{"team": "payments"}}, nil
+	}
+	teamPredicate := query.Predicate{Label: "team", Operator: "=", Value: "payments"}
+
+	// ----------------------------------------------------------------------
+	// Read scope
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host"
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expectQuery := query.Query{Predicates: []query.Predicate{{Label: "host", Operator: "exists"}, teamPredicate}}
+	if diff := deep.Equal(gotQuery, expectQuery); diff != nil {
+		t.Error(diff)
+	}
+
+	// ----------------------------------------------------------------------
+	// Write scope: delete
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host"
+	var gotWR etre.WriteResult
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	if diff := deep.Equal(gotQuery, expectQuery); diff != nil {
+		t.Error(diff)
+	}
+
+	// Write scope: new entity not in scope
+	server.metricsrec.Reset()
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType
+	payload, _ := json.Marshal(etre.Entity{"host": "local", "team": "db"})
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if created {
+		t.Error("entity created, expected not-authorized error first")
+	}
+	if !authorizationFailed(server.metricsrec) {
+		t.Error("AuthorizationFailed metric not incremented")
+	}
+
+	// Write scope: new entity in scope
+	payload, _ = json.Marshal(etre.Entity{"host": "local", "team": "payments"})
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusCreated {
+		t.Errorf("response status = %d, expected %d: %+v", statusCode, http.StatusCreated, gotWR.Error)
+	}
+
+	// Write scope: patch moves entity out of scope
+	etreurl = server.url + etre.API_ROOT + "/entity/" + entityType + "/" + testEntityIds[0]
+	payload, _ = json.Marshal(etre.Entity{"team": "db"})
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("PUT", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+
+	// Write scope: caller without the scope attribute
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"team"}}, nil
+	}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host"
+	gotWR = etre.WriteResult{}
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+}
+
+func TestAuthExpand(t *testing.T) {
+	// Test that expanding a reference authorizes reading the referenced entity
+	// type, passes its read scope to the store, and strips its denied labels
+	cfg := defaultConfig
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{
+		entityType: {References: map[string]config.ReferenceConfig{"rack_id": {EntityType: "rack"}}},
+	}
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role: "team",
+				Read: []string{entityType},
+			},
+			{
+				Role:           "racks",
+				Read:           []string{"rack"},
+				ReadScope:      "team=${caller.team}",
+				DenyReadLabels: []string{"code"},
+			},
+		},
+	}
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return []etre.Entity{{"_id": testEntityIds[0], "code": "a", "rack_id.name": "r1", "rack_id.code": "secret"}}, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host&expand=rack_id"
+
+	// Caller cannot read racks
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"team"}}, nil
+	}
+	var etreErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+
+	// Caller can read racks in scope, but not label code of racks
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"team", "racks"}, Attributes: map[string]string{"team": "payments"}}, nil
+	}
+	var gotEntities []etre.Entity
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expectFilter := etre.QueryFilter{
+		Expand: []string{"rack_id"},
+		ExpandScope: map[string]query.Query{
+			"rack_id": {Predicates: []query.Predicate{{Label: "team", Operator: "=", Value: "payments"}}},
+		},
+	}
+	if diff := deep.Equal(gotFilter, expectFilter); diff != nil {
+		t.Error(diff)
+	}
+	expectEntities := []etre.Entity{{"_id": testEntityIds[0], "code": "a", "rack_id.name": "r1"}}
+	if diff := deep.Equal(gotEntities, expectEntities); diff != nil {
+		t.Error(diff)
+	}
+
+	// Explicitly returning a denied label of racks
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl+"&labels=rack_id.code", nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+}
+
+func TestAuthRateLimited(t *testing.T) {
+	// Test that requests over ACL.CallerLimit get HTTP 429 with Retry-After
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role:        "cron",
+				Read:        []string{entityType},
+				Write:       []string{entityType},
+				CallerLimit: config.Limit{Rate: 0.1, Burst: 1},
+			},
+		},
+	}
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{}, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "job", Roles: []string{"cron"}, MetricGroups: []string{"cron"}}, nil
+	}
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=host"
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+
+	// Bucket is empty, next request is rate limited
+	resp, err := http.Get(etreurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("response status = %d, expected %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = '%s', expected '10'", got)
+	}
+	var gotErr etre.Error
+	if err := json.NewDecoder(resp.Body).Decode(&gotErr); err != nil {
+		t.Fatal(err)
+	}
+	if gotErr.Type != "rate-limited" {
+		t.Errorf("error type = %s, expected rate-limited", gotErr.Type)
+	}
+	throttled := false
+	for _, c := range server.metricsrec.Called {
+		if c.Method == "Inc" && c.Metric == metrics.Throttled {
+			throttled = true
+		}
+	}
+	if !throttled {
+		t.Error("Throttled metric not incremented")
+	}
+
+	// Routes without an entity type are limited, too
+	resp2, err := http.Get(server.url + etre.API_ROOT + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("/status response status = %d, expected %d", resp2.StatusCode, http.StatusTooManyRequests)
+	}
+}
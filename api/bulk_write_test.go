@@ -895,3 +895,171 @@ func TestDeleteEntitiesErrors(t *testing.T) {
 		t.Error(diffs)
 	}
 }
+
+// --------------------------------------------------------------------------
+// Rename and delete label
+// --------------------------------------------------------------------------
+
+func TestRenameLabelOK(t *testing.T) {
+	var gotWO entity.WriteOp
+	var gotQuery query.Query
+	var gotFrom, gotTo string
+	store := mock.EntityStore{
+		RenameLabelFunc: func(wo entity.WriteOp, q query.Query, from, to string) ([]etre.Entity, error) {
+			gotWO = wo
+			gotQuery = q
+			gotFrom = from
+			gotTo = to
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "foo": "val"},
+			}
+			return diff, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	payload, err := json.Marshal(etre.LabelRename{From: "foo", To: "bar", Query: "a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/rename"
+
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("got HTTP status = %d, expected %d: %+v", statusCode, http.StatusOK, gotWR)
+	}
+
+	expectWR := etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: testEntityIds[0],
+				URI:      uri(testEntityIds[0]),
+				Diff: etre.Entity{
+					"_id":   testEntityIds[0],
+					"_type": entityType,
+					"_rev":  float64(0),
+					"foo":   "val",
+				},
+			},
+		},
+	}
+	if diff := deep.Equal(gotWR, expectWR); diff != nil {
+		t.Error(diff)
+	}
+	expectWO := entity.WriteOp{
+		Caller:     "test", // from mock.AuthPlugin
+		EntityType: entityType,
+	}
+	if diff := deep.Equal(gotWO, expectWO); diff != nil {
+		t.Error(diff)
+	}
+	expectQuery, _ := query.Translate("a=b")
+	if diff := deep.Equal(gotQuery, expectQuery); diff != nil {
+		t.Error(diff)
+	}
+	if gotFrom != "foo" || gotTo != "bar" {
+		t.Errorf("got from=%s to=%s, expected from=foo to=bar", gotFrom, gotTo)
+	}
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: entityType},
+		{Method: "Inc", Metric: metrics.Query, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Write, IntVal: 1},
+		{Method: "Inc", Metric: metrics.UpdateQuery, IntVal: 1},
+		{Method: "Val", Metric: metrics.Labels, IntVal: 1},
+		{Method: "IncLabel", Metric: metrics.LabelRead, StringVal: "a"},
+		{Method: "IncLabel", Metric: metrics.LabelDelete, StringVal: "foo"},
+		{Method: "IncLabel", Metric: metrics.LabelUpdate, StringVal: "bar"},
+		{Method: "Val", Metric: metrics.UpdateBulk, IntVal: 1},
+		{Method: "Inc", Metric: metrics.Updated, IntVal: 1},
+		{Method: "Val", Metric: metrics.LatencyMs, IntVal: 0},
+	}
+	if diffs := deep.Equal(server.metricsrec.Called, expectMetrics); diffs != nil {
+		t.Logf("   got: %+v", server.metricsrec.Called)
+		t.Logf("expect: %+v", expectMetrics)
+		t.Error(diffs)
+	}
+
+	// Metalabels cannot be renamed
+	for _, r := range []etre.LabelRename{{From: "_id", To: "id"}, {From: "foo", To: "_type"}, {From: "foo", To: "foo"}} {
+		payload, _ := json.Marshal(r)
+		gotWR = etre.WriteResult{}
+		statusCode, err := test.MakeHTTPRequest("POST", etreurl, payload, &gotWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statusCode != http.StatusBadRequest {
+			t.Errorf("%+v: got HTTP status = %d, expected %d", r, statusCode, http.StatusBadRequest)
+		}
+		if gotWR.Error == nil {
+			t.Errorf("%+v: WriteResult.Error is nil, expected error", r)
+		}
+	}
+}
+
+func TestDeleteLabelsOK(t *testing.T) {
+	var gotQuery query.Query
+	var gotLabel string
+	store := mock.EntityStore{
+		DeleteLabelsFunc: func(wo entity.WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+			gotQuery = q
+			gotLabel = label
+			diff := []etre.Entity{
+				{"_id": testEntityId0, "_type": entityType, "_rev": int64(0), "foo": "val"},
+				{"_id": testEntityId1, "_type": entityType, "_rev": int64(0), "foo": "val"},
+			}
+			return diff, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	// Query is optional
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/foo"
+	var gotWR etre.WriteResult
+	statusCode, err := test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("got HTTP status = %d, expected %d: %+v", statusCode, http.StatusOK, gotWR)
+	}
+	if len(gotWR.Writes) != 2 {
+		t.Errorf("got %d writes, expected 2: %+v", len(gotWR.Writes), gotWR)
+	}
+	if gotLabel != "foo" {
+		t.Errorf("got label %s, expected foo", gotLabel)
+	}
+	if len(gotQuery.Predicates) != 0 {
+		t.Errorf("got query %+v, expected no predicates", gotQuery)
+	}
+
+	etreurl += "?query=" + url.QueryEscape("a=b")
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("got HTTP status = %d, expected %d: %+v", statusCode, http.StatusOK, gotWR)
+	}
+	expectQuery, _ := query.Translate("a=b")
+	if diff := deep.Equal(gotQuery, expectQuery); diff != nil {
+		t.Error(diff)
+	}
+
+	// Metalabels cannot be deleted
+	gotWR = etre.WriteResult{}
+	etreurl = server.url + etre.API_ROOT + "/entities/" + entityType + "/labels/_id"
+	statusCode, err = test.MakeHTTPRequest("DELETE", etreurl, nil, &gotWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("got HTTP status = %d, expected %d", statusCode, http.StatusBadRequest)
+	}
+}
@@ -3,6 +3,10 @@
 package api_test
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
@@ -11,8 +15,14 @@ import (
 	"github.com/go-test/deep"
 
 	"github.com/square/etre"
+	"github.com/square/etre/auth"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
 	//"github.com/square/etre/metrics"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test"
 	"github.com/square/etre/test/mock"
 )
 
@@ -23,7 +33,7 @@ func TestChanges(t *testing.T) {
 	streamChan := make(chan etre.CDCEvent, 1)
 	var gotSinceTs int64
 	stream := mock.Stream{
-		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
 			gotSinceTs = sinceTs
 			return streamChan
 		},
@@ -108,3 +118,593 @@ func TestChanges(t *testing.T) {
 		}
 	*/
 }
+
+func TestChangesFilter(t *testing.T) {
+	// Test that the filter passed to CDCClient.StartWithOptions is sent to the
+	// server and passed to the Streamer
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	streamChan := make(chan etre.CDCEvent, 1)
+	var gotFilter changestream.Filter
+	startChan := make(chan struct{})
+	stream := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			gotFilter = filter
+			close(startChan)
+			return streamChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClient(wsURL, nil, 10, true).(etre.CDCClientV2)
+	_, err := client.StartWithOptions(etre.CDCStartOptions{
+		Filter: etre.CDCFilter{EntityTypes: []string{"node"}, Ops: []string{"u"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	select {
+	case <-startChan:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for Streamer.Start")
+	}
+	if _, ok := gotFilter.Apply(etre.CDCEvent{EntityType: "node", Op: "u"}); !ok {
+		t.Errorf("filter does not match node update, expected match")
+	}
+	if _, ok := gotFilter.Apply(etre.CDCEvent{EntityType: "node", Op: "i"}); ok {
+		t.Errorf("filter matches node insert, expected no match")
+	}
+	if _, ok := gotFilter.Apply(etre.CDCEvent{EntityType: "rack", Op: "u"}); ok {
+		t.Errorf("filter matches rack update, expected no match")
+	}
+
+	// Invalid filter is an API error
+	client2 := etre.NewCDCClient(wsURL, nil, 10, true).(etre.CDCClientV2)
+	_, err = client2.StartWithOptions(etre.CDCStartOptions{
+		Filter: etre.CDCFilter{Ops: []string{"x"}},
+	})
+	if err == nil {
+		client2.Stop()
+		t.Error("no error for invalid filter op, expected an error")
+	}
+}
+
+func TestChangesDurableConsumer(t *testing.T) {
+	// Test that a durable consumer resumes from its checkpoint and that
+	// CDCClient.Ack commits its position. Consumers are scoped to the caller.
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	written := make(chan cdc.Checkpoint, 1)
+	server.checkpoints.ReadCheckpointFunc = func(consumer string) (cdc.Checkpoint, error) {
+		return cdc.Checkpoint{Consumer: consumer, Ts: 13, EventIds: []string{"vno"}}, nil
+	}
+	server.checkpoints.WriteCheckpointFunc = func(cp cdc.Checkpoint) error {
+		written <- cp
+		return nil
+	}
+
+	streamChan := make(chan etre.CDCEvent, 2)
+	var gotSinceTs int64
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return mock.Stream{
+			StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+				gotSinceTs = sinceTs
+				return streamChan
+			},
+		}
+	}
+
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClient(wsURL, nil, 10, true).(etre.CDCClientV2)
+	eventsChan, err := client.StartWithOptions(etre.CDCStartOptions{Consumer: "c1", Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// vno was acked, 4pi has the same ts but was not
+	streamChan <- mock.CDCEvents[1]
+	streamChan <- mock.CDCEvents[2]
+	var e etre.CDCEvent
+	select {
+	case e = <-eventsChan:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	if diff := deep.Equal(e, mock.CDCEvents[2]); diff != nil {
+		t.Error(diff)
+	}
+	if gotSinceTs != 13 {
+		t.Errorf("got sinceTs = %d, expected checkpoint ts 13", gotSinceTs)
+	}
+
+	if err := client.Ack(e); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cp := <-written:
+		if cp.Consumer != "test/c1" || cp.Ts != 13 {
+			t.Errorf("wrong checkpoint: %+v", cp)
+		}
+		if diff := deep.Equal(cp.EventIds, []string{"vno", "4pi"}); diff != nil {
+			t.Error(diff)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for checkpoint write")
+	}
+
+	// Resume without consumer is an error
+	_, err = etre.NewCDCClient(wsURL, nil, 10, true).(etre.CDCClientV2).StartWithOptions(etre.CDCStartOptions{Resume: true})
+	if err == nil {
+		t.Error("no error for Resume without Consumer, expected an error")
+	}
+}
+
+func TestReplayCDC(t *testing.T) {
+	server := setup(t, adminConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	replayed := false
+	server.replayer.ReplayFunc = func() (cdc.ReplayResult, error) {
+		replayed = true
+		return cdc.ReplayResult{
+			File:     "/tmp/etre-cdc.json.replay",
+			Events:   2,
+			Inserted: 2,
+			Gaps:     []cdc.Gap{{EntityId: "e1", FromRev: 4, ToRev: 4}},
+		}, nil
+	}
+
+	// Admin only
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"dev"}}, nil
+	}
+	url := server.url + etre.API_ROOT + "/cdc/replay"
+	var etreErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("POST", url, nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if replayed {
+		t.Errorf("fallback file replayed, expected not-authorized error first")
+	}
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "finch", Roles: []string{"admin"}}, nil
+	}
+	var got cdc.ReplayResult
+	statusCode, err = test.MakeHTTPRequest("POST", url, nil, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expect := cdc.ReplayResult{
+		File:     "/tmp/etre-cdc.json.replay",
+		Events:   2,
+		Inserted: 2,
+		Gaps:     []cdc.Gap{{EntityId: "e1", FromRev: 4, ToRev: 4}},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestChangesPoll(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	streamChan := make(chan etre.CDCEvent, len(mock.CDCEvents))
+	for _, e := range mock.CDCEvents {
+		streamChan <- e
+	}
+	var gotSinceTs int64
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			gotSinceTs = sinceTs
+			return streamChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+
+	// Client has events up to "vno" (ts 13), so it gets the next 3 events:
+	// "4pi" (ts 13), "p34" (ts 22), and "vb0" (ts 35)
+	url := server.url + etre.API_ROOT + "/changes/poll?since=13:vno&limit=3&wait=1s"
+	var got etre.CDCPollResult
+	statusCode, err := test.MakeHTTPRequest("GET", url, nil, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	if gotSinceTs != 13 {
+		t.Errorf("sinceTs = %d, expected 13", gotSinceTs)
+	}
+	expect := etre.CDCPollResult{
+		Events: mock.CDCEvents[2:5],
+		Next:   "35:vb0",
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Invalid params are client errors
+	for _, params := range []string{"since=x", "limit=0", "wait=1", "ops=x"} {
+		var etreErr etre.Error
+		url = server.url + etre.API_ROOT + "/changes/poll?" + params
+		statusCode, err := test.MakeHTTPRequest("GET", url, nil, &etreErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statusCode != http.StatusBadRequest {
+			t.Errorf("%s: response status = %d, expected %d", params, statusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestChangesAuth(t *testing.T) {
+	// Test that change feeds apply the caller's ACLs: events of entity types
+	// the caller cannot read are dropped, and denied labels are removed from
+	// Old, New, and Full
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role:           "prov",
+				Read:           []string{entityType},
+				DenyReadLabels: []string{"ipmi_password"},
+			},
+		},
+	}
+	server := setup(t, cfg, mock.EntityStore{})
+	defer server.ts.Close()
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"prov"}}, nil
+	}
+
+	e := etre.CDCEvent{
+		Id:         "e1",
+		Ts:         10,
+		EntityType: entityType,
+		Op:         "u",
+		Old:        &etre.Entity{"ipmi_password": "old", "env": "dev"},
+		New:        &etre.Entity{"ipmi_password": "new", "env": "prod"},
+		Full:       &etre.Entity{"_id": "e1", "ipmi_password": "new", "env": "prod"},
+	}
+	streamChan := make(chan etre.CDCEvent, 2)
+	streamChan <- e
+	streamChan <- etre.CDCEvent{Id: "r1", Ts: 10, EntityType: "rack", Op: "i"}
+	close(streamChan)
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return streamChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+
+	// The rack event is dropped: entity type not readable
+	url := server.url + etre.API_ROOT + "/changes/poll?since=1&wait=1s"
+	var got etre.CDCPollResult
+	statusCode, err := test.MakeHTTPRequest("GET", url, nil, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expect := []etre.CDCEvent{
+		{
+			Id:         "e1",
+			Ts:         10,
+			EntityType: entityType,
+			Op:         "u",
+			Old:        &etre.Entity{"env": "dev"},
+			New:        &etre.Entity{"env": "prod"},
+			Full:       &etre.Entity{"_id": "e1", "env": "prod"},
+		},
+	}
+	if diff := deep.Equal(got.Events, expect); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := (*e.New)["ipmi_password"]; !ok {
+		t.Error("original event modified")
+	}
+	if !authorizationFailed(server.metricsrec) {
+		t.Error("AuthorizationFailed metric not incremented")
+	}
+}
+
+func TestChangesScope(t *testing.T) {
+	// Test that change feeds apply the caller's read scope: events are sent
+	// only for entities in scope before or after the write
+	cfg := defaultConfig
+	cfg.Security = config.SecurityConfig{
+		ACL: []config.ACL{
+			{
+				Role:      "team",
+				Read:      []string{entityType},
+				ReadScope: "team=${caller.team}",
+			},
+		},
+	}
+	// Scope is checked on the event, not by reading the entity which might
+	// have changed since
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			t.Errorf("entity read to check scope: %+v", q)
+			return nil, nil
+		},
+	}
+	server := setup(t, cfg, store)
+	defer server.ts.Close()
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"team"}, Attributes: map[string]string{"team": "payments"}}, nil
+	}
+
+	tests := []struct {
+		name    string
+		event   etre.CDCEvent
+		inScope bool
+	}{
+		{"insert in scope", etre.CDCEvent{EntityId: "e1", Op: "i", New: &etre.Entity{"team": "payments"}}, true},
+		{"insert not in scope", etre.CDCEvent{EntityId: "e1", Op: "i", New: &etre.Entity{"team": "db"}}, false},
+		{"delete not in scope", etre.CDCEvent{EntityId: "e1", Op: "d", Old: &etre.Entity{"team": "db"}}, false},
+		{"update moves out of scope", etre.CDCEvent{EntityId: "e2", Op: "u",
+			Old: &etre.Entity{"team": "payments"}, New: &etre.Entity{"team": "db"},
+			Full: &etre.Entity{"_id": "e2", "team": "db"}}, true},
+		{"update in scope", etre.CDCEvent{EntityId: "e3", Op: "u",
+			Old: &etre.Entity{"env": "dev"}, New: &etre.Entity{"env": "prod"},
+			Full: &etre.Entity{"_id": "e3", "team": "payments", "env": "prod"}}, true},
+		{"update not in scope", etre.CDCEvent{EntityId: "e4", Op: "u",
+			Old: &etre.Entity{"env": "dev"}, New: &etre.Entity{"env": "prod"},
+			Full: &etre.Entity{"_id": "e4", "team": "db", "env": "prod"}}, false},
+		{"update without full", etre.CDCEvent{EntityId: "e3", Op: "u",
+			Old: &etre.Entity{"env": "dev"}, New: &etre.Entity{"env": "prod"}}, false},
+	}
+	streamChan := make(chan etre.CDCEvent, len(tests))
+	for _, test := range tests {
+		test.event.Id = test.name
+		test.event.Ts = 10
+		test.event.EntityType = entityType
+		streamChan <- test.event
+	}
+	close(streamChan)
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return streamChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+	var got etre.CDCPollResult
+	if _, err := test.MakeHTTPRequest("GET", server.url+etre.API_ROOT+"/changes/poll?since=1&wait=1s", nil, &got); err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]bool{}
+	for _, e := range got.Events {
+		sent[e.Id] = true
+	}
+	for _, test := range tests {
+		if sent[test.name] != test.inScope {
+			t.Errorf("%s: sent = %t, expected %t", test.name, sent[test.name], test.inScope)
+		}
+	}
+}
+
+func TestChangesSSE(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	streamChan := make(chan etre.CDCEvent, len(mock.CDCEvents))
+	for _, e := range mock.CDCEvents[0:4] {
+		streamChan <- e
+	}
+	sinceTsChan := make(chan int64, 1)
+	gapChan := make(chan etre.CDCGap, 1)
+	stream := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			sinceTsChan <- sinceTs
+			return streamChan
+		},
+		GapsFunc: func() <-chan etre.CDCGap {
+			return gapChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+
+	// Last-Event-ID (client reconnecting) overrides since
+	req, err := http.NewRequest("GET", server.url+etre.API_ROOT+"/changes?format=sse&since=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "13:vno")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %s, expected text/event-stream", ct)
+	}
+	if sinceTs := <-sinceTsChan; sinceTs != 13 {
+		t.Errorf("sinceTs = %d, expected 13", sinceTs)
+	}
+
+	// "nru" and "vno" are skipped, so expect "4pi" and "p34"
+	scanner := bufio.NewScanner(resp.Body)
+	gotIds := []string{}
+	gotEvents := []etre.CDCEvent{}
+	for len(gotEvents) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			gotIds = append(gotIds, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			var e etre.CDCEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatal(err)
+			}
+			gotEvents = append(gotEvents, e)
+		}
+	}
+	if diff := deep.Equal(gotEvents, mock.CDCEvents[2:4]); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotIds, []string{"13:vno,4pi", "22:p34"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Gaps are "gap" events
+	expectGap := etre.CDCGap{EntityId: "e1", EntityType: "nodes", Revs: []int64{2}}
+	gapChan <- expectGap
+	gapEvent := false
+	var gotGap etre.CDCGap
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "event: gap" {
+			gapEvent = true
+			continue
+		}
+		if gapEvent && strings.HasPrefix(line, "data: ") {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &gotGap); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if diff := deep.Equal(gotGap, expectGap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	var gotEntityType string
+	var gotQuery query.Query
+	server.snapshotter.SnapshotFunc = func(ctx context.Context, entityType string, q query.Query) (entity.Snapshot, error) {
+		gotEntityType = entityType
+		gotQuery = q
+		return entity.Snapshot{
+			Entities: []etre.Entity{{"_id": "e1", "_rev": 2, "x": "1"}},
+			Position: cdc.Checkpoint{Ts: 35, EventIds: []string{"vb0", "bnu"}},
+		}, nil
+	}
+
+	url := server.url + etre.API_ROOT + "/snapshot/" + entityType + "?query=x"
+	var got etre.CDCSnapshot
+	statusCode, err := test.MakeHTTPRequest("GET", url, nil, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	if gotEntityType != entityType {
+		t.Errorf("entity type = %s, expected %s", gotEntityType, entityType)
+	}
+	if len(gotQuery.Predicates) != 1 || gotQuery.Predicates[0].Label != "x" {
+		t.Errorf("query = %+v, expected x", gotQuery)
+	}
+	expect := etre.CDCSnapshot{
+		Entities: []etre.Entity{{"_id": "e1", "_rev": float64(2), "x": "1"}},
+		Cursor:   "35:vb0,bnu",
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Invalid entity type
+	url = server.url + etre.API_ROOT + "/snapshot/foo"
+	var etreErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", url, nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusBadRequest)
+	}
+}
+
+func TestChangesBootstrap(t *testing.T) {
+	// Test that CDCClient.Bootstrap loads the snapshot, then starts the feed
+	// after the snapshot cursor
+	server := setup(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	snapEntities := []etre.Entity{{"_id": "e1", "_rev": float64(2), "x": "1"}}
+	server.snapshotter.SnapshotFunc = func(ctx context.Context, entityType string, q query.Query) (entity.Snapshot, error) {
+		return entity.Snapshot{
+			Entities: snapEntities,
+			Position: cdc.Checkpoint{Ts: 13, EventIds: []string{"vno"}},
+		}, nil
+	}
+
+	streamChan := make(chan etre.CDCEvent, len(mock.CDCEvents))
+	for _, e := range mock.CDCEvents[0:4] {
+		streamChan <- e
+	}
+	var gotSinceTs int64
+	var gotFilter changestream.Filter
+	stream := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			gotSinceTs = sinceTs
+			gotFilter = filter
+			return streamChan
+		},
+	}
+	server.streamerFactory.MakeFunc = func(clientId string) changestream.Streamer {
+		return stream
+	}
+
+	wsURL := strings.Replace(server.url, "http", "ws", 1)
+	client := etre.NewCDCClient(wsURL, nil, 10, true).(etre.CDCClientV2)
+	snap, events, err := client.Bootstrap(entityType, etre.CDCStartOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	expectSnap := etre.CDCSnapshot{Entities: snapEntities, Cursor: "13:vno"}
+	if diff := deep.Equal(snap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// "nru" and "vno" are in the snapshot, so the feed starts with "4pi"
+	got := []etre.CDCEvent{}
+	for len(got) < 2 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for events, got %v", got)
+		}
+	}
+	if diff := deep.Equal(got, mock.CDCEvents[2:4]); diff != nil {
+		t.Error(diff)
+	}
+	if gotSinceTs != 13 {
+		t.Errorf("sinceTs = %d, expected 13", gotSinceTs)
+	}
+	if _, ok := gotFilter.Apply(etre.CDCEvent{EntityType: "rack"}); ok {
+		t.Errorf("filter matches other entity type, expected feed filtered to %s", entityType)
+	}
+}
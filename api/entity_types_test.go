@@ -0,0 +1,154 @@
+// Copyright 2020, Square, Inc.
+
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/api"
+	"github.com/square/etre/auth"
+	"github.com/square/etre/config"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/test"
+	"github.com/square/etre/test/mock"
+)
+
+var adminConfig = config.Config{
+	Server: config.ServerConfig{
+		Addr: addr,
+	},
+	Datasource: config.DatasourceConfig{
+		QueryTimeout: config.DEFAULT_DB_QUERY_TIMEOUT,
+	},
+	Security: config.SecurityConfig{
+		ACL: []config.ACL{
+			{Role: "admin", Admin: true},
+			{Role: "dev", Read: []string{entityType}},
+		},
+	},
+}
+
+func TestEntityTypesAdminOnly(t *testing.T) {
+	server := setup(t, adminConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "dn", Roles: []string{"dev"}}, nil
+	}
+	created := false
+	server.entityTypes.CreateFunc = func(ctx context.Context, t entity.EntityType) error {
+		created = true
+		return nil
+	}
+
+	url := server.url + etre.API_ROOT + "/entity-types"
+	var etreErr etre.Error
+	statusCode, err := test.MakeHTTPRequest("GET", url, nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+
+	payload, _ := json.Marshal(entity.EntityType{Name: "rack"})
+	statusCode, err = test.MakeHTTPRequest("POST", url, payload, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusForbidden {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusForbidden)
+	}
+	if etreErr.Type != "not-authorized" {
+		t.Errorf("error type = %s, expected not-authorized", etreErr.Type)
+	}
+	if created {
+		t.Errorf("entity type created, expected not-authorized error first")
+	}
+}
+
+func TestEntityTypesCreateAndRetire(t *testing.T) {
+	server := setup(t, adminConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	server.auth.AuthenticateFunc = func(req *http.Request) (auth.Caller, error) {
+		return auth.Caller{Name: "finch", Roles: []string{"admin"}}, nil
+	}
+	var gotType entity.EntityType
+	server.entityTypes.CreateFunc = func(ctx context.Context, t entity.EntityType) error {
+		gotType = t
+		return nil
+	}
+	var gotName, gotCaller string
+	server.entityTypes.RetireFunc = func(ctx context.Context, name, caller string) error {
+		gotName = name
+		gotCaller = caller
+		if name == "rack" {
+			return nil
+		}
+		return entity.ErrEntityTypeNotFound
+	}
+
+	// Create
+	url := server.url + etre.API_ROOT + "/entity-types"
+	payload, _ := json.Marshal(entity.EntityType{Name: "rack", Read: []string{"dev"}})
+	var created entity.EntityType
+	statusCode, err := test.MakeHTTPRequest("POST", url, payload, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusCreated {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusCreated)
+	}
+	expectType := entity.EntityType{Name: "rack", Read: []string{"dev"}, CreatedBy: "finch"}
+	if diffs := deep.Equal(gotType, expectType); diffs != nil {
+		t.Error(diffs)
+	}
+
+	// Reserved and invalid names are not created
+	for _, name := range []string{"entities", config.ENTITY_TYPES_COLLECTION, "a/b", ""} {
+		gotType = entity.EntityType{}
+		payload, _ := json.Marshal(entity.EntityType{Name: name})
+		var etreErr etre.Error
+		statusCode, err := test.MakeHTTPRequest("POST", url, payload, &etreErr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statusCode != http.StatusBadRequest {
+			t.Errorf("%s: response status = %d, expected %d", name, statusCode, http.StatusBadRequest)
+		}
+		if gotType.Name != "" {
+			t.Errorf("%s: entity type created, expected invalid-param error", name)
+		}
+	}
+
+	// Retire
+	statusCode, err = test.MakeHTTPRequest("DELETE", url+"/rack", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusNoContent {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusNoContent)
+	}
+	if gotName != "rack" || gotCaller != "finch" {
+		t.Errorf("Retire called with %s, %s; expected rack, finch", gotName, gotCaller)
+	}
+
+	var etreErr etre.Error
+	statusCode, err = test.MakeHTTPRequest("DELETE", url+"/switch", nil, &etreErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusNotFound {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusNotFound)
+	}
+	if etreErr.Type != api.ErrEntityTypeNotFound.Type {
+		t.Errorf("error type = %s, expected %s", etreErr.Type, api.ErrEntityTypeNotFound.Type)
+	}
+}
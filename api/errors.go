@@ -24,6 +24,12 @@ var ErrNotFound = etre.Error{
 	Message:    "entity not found",
 }
 
+var ErrRateLimited = etre.Error{
+	Type:       "rate-limited",
+	HTTPStatus: http.StatusTooManyRequests,
+	Message:    "too many requests",
+}
+
 var ErrMissingParam = etre.Error{
 	Type:       "missing-param",
 	HTTPStatus: http.StatusBadRequest,
@@ -54,6 +60,12 @@ var ErrCDCDisabled = etre.Error{
 	Message:    "CDC disabled",
 }
 
+var ErrNoCDCFallbackFile = etre.Error{
+	Type:       "no-cdc-fallback-file",
+	HTTPStatus: http.StatusNotImplemented,
+	Message:    "CDC fallback file not configured (config.cdc.fallback_file)",
+}
+
 var ErrNoContent = etre.Error{
 	Message:    "no entities provided (PUT or POST with zero-length HTTP payload or JSON array)",
 	Type:       "no-content",
@@ -65,3 +77,21 @@ var ErrInvalidContent = etre.Error{
 	Type:       "invalid-content",
 	HTTPStatus: http.StatusBadRequest,
 }
+
+var ErrEntityTypeExists = etre.Error{
+	Type:       "entity-type-exists",
+	HTTPStatus: http.StatusConflict,
+	Message:    "entity type already exists",
+}
+
+var ErrEntityTypeNotFound = etre.Error{
+	Type:       "entity-type-not-found",
+	HTTPStatus: http.StatusNotFound,
+	Message:    "entity type not found or retired",
+}
+
+var ErrEntityTypesDisabled = etre.Error{
+	Type:       "entity-types-disabled",
+	HTTPStatus: http.StatusNotImplemented,
+	Message:    "runtime entity types disabled",
+}
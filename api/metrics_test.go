@@ -4,9 +4,11 @@ package api_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/go-test/deep"
@@ -92,6 +94,43 @@ func TestMetricsGet(t *testing.T) {
 	}
 }
 
+func TestMetricsPrometheus(t *testing.T) {
+	// GET /metrics/prometheus should return the same metrics in Prometheus
+	// text format
+	server := setupWithMetrics(t, defaultConfig, mock.EntityStore{})
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType + "?query=x"
+	if _, err := test.MakeHTTPRequest("GET", etreurl, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(server.url + etre.API_ROOT + "/metrics/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got HTTP status = %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != metrics.PROMETHEUS_CONTENT_TYPE {
+		t.Errorf("got Content-Type %s, expected %s", got, metrics.PROMETHEUS_CONTENT_TYPE)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE etre_system_query_total counter\n",
+		"etre_query_read_query_total{group=\"etre\",entity_type=\"" + entityType + "\"} 1\n",
+		"etre_label_read_total{group=\"etre\",entity_type=\"" + entityType + "\",label=\"x\"} 1\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("response does not contain %q:\n%s", line, body)
+		}
+	}
+}
+
 /*
 func TestMetricsInvalidEntityType(t *testing.T) {
 	// Invalid entity types should not generate metrics, i.e. don't pollute
@@ -231,6 +231,83 @@ func TestQueryNoMatches(t *testing.T) {
 	}
 }
 
+func TestQueryExpand(t *testing.T) {
+	// Test that ?expand=label is passed to the store in etre.QueryFilter.Expand,
+	// and that the store's invalid-expand ValidationError is a client error
+	var gotFilter etre.QueryFilter
+	var storeErr error
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return []etre.Entity{}, storeErr
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+		"?query=" + url.QueryEscape("host=local") + "&labels=x,rack_id.name&expand=rack_id"
+
+	var gotEntities []etre.Entity
+	statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+	}
+	expectFilter := etre.QueryFilter{
+		ReturnLabels: []string{"x", "rack_id.name"},
+		Expand:       []string{"rack_id"},
+	}
+	if diff := deep.Equal(gotFilter, expectFilter); diff != nil {
+		t.Error(diff)
+	}
+
+	storeErr = entity.ValidationError{Err: fmt.Errorf("not a reference"), Type: "invalid-expand"}
+	var gotError etre.Error
+	statusCode, err = test.MakeHTTPRequest("GET", etreurl, nil, &gotError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected %d", statusCode, http.StatusBadRequest)
+	}
+	if gotError.Type != "invalid-expand" {
+		t.Errorf("got error type %s, expected invalid-expand", gotError.Type)
+	}
+}
+
+func TestQueryIncludeDeleted(t *testing.T) {
+	// Test that ?includeDeleted=true is passed to the store in etre.QueryFilter
+	var gotFilter etre.QueryFilter
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			gotFilter = f
+			return []etre.Entity{}, nil
+		},
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	for _, v := range []string{"true", "false"} {
+		etreurl := server.url + etre.API_ROOT + "/entities/" + entityType +
+			"?query=" + url.QueryEscape("host=local") + "&includeDeleted=" + v
+		var gotEntities []etre.Entity
+		statusCode, err := test.MakeHTTPRequest("GET", etreurl, nil, &gotEntities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statusCode != http.StatusOK {
+			t.Errorf("response status = %d, expected %d", statusCode, http.StatusOK)
+		}
+		expectFilter := etre.QueryFilter{IncludeDeleted: v == "true"}
+		if diff := deep.Equal(gotFilter, expectFilter); diff != nil {
+			t.Errorf("includeDeleted=%s: %v", v, diff)
+		}
+	}
+}
+
 // --------------------------------------------------------------------------
 // Errors
 // --------------------------------------------------------------------------
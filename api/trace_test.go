@@ -0,0 +1,88 @@
+// Copyright 2020, Square, Inc.
+
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/square/etre"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test/mock"
+	"github.com/square/etre/trace"
+)
+
+func TestTraceParent(t *testing.T) {
+	// Test that the API continues the client trace from the traceparent header,
+	// records spans for the request phases, and passes the span to entity.Store
+	var gotCtx context.Context
+	store := mock.EntityStore{}
+	store.WithContextFunc = func(ctx context.Context) entity.Store {
+		gotCtx = ctx
+		return store
+	}
+	store.ReadEntitiesFunc = func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+		return testEntitiesWithObjectIDs[0:1], nil
+	}
+	server := setup(t, defaultConfig, store)
+	defer server.ts.Close()
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentId := "00f067aa0ba902b7"
+	req, _ := http.NewRequest("GET", server.url+etre.API_ROOT+"/entities/"+entityType+"?query=foo", nil)
+	req.Header.Set(etre.TRACEPARENT_HEADER, "00-"+traceId+"-"+parentId+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Child spans end before the request span, so it's last
+	spans := server.trace.Spans
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, expected 4: %+v", len(spans), spans)
+	}
+	root := spans[len(spans)-1]
+	if root.TraceId != traceId || root.ParentId != parentId || root.Kind != trace.KIND_SERVER {
+		t.Errorf("wrong request span: %+v", root)
+	}
+	if root.Name != "GET "+etre.API_ROOT+"/entities/:type" {
+		t.Errorf("request span name = %s, expected GET %s/entities/:type", root.Name, etre.API_ROOT)
+	}
+	if root.Attributes["http.status_code"] != "200" || root.Attributes["etre.entity_type"] != entityType {
+		t.Errorf("wrong request span attributes: %+v", root.Attributes)
+	}
+	expectNames := []string{"authenticate", "validate", "authorize"}
+	for i, span := range spans[0:3] {
+		if span.Name != expectNames[i] {
+			t.Errorf("span %d name = %s, expected %s", i, span.Name, expectNames[i])
+		}
+		if span.TraceId != traceId || span.ParentId != root.SpanId {
+			t.Errorf("span %s is not a child of the request span: %+v", span.Name, span)
+		}
+	}
+
+	// entity.Store gets the request span via the context so it can make child spans
+	if gotCtx == nil {
+		t.Fatal("entity.Store WithContext not called")
+	}
+	if span := trace.FromContext(gotCtx); span == nil || span.SpanId != root.SpanId {
+		t.Errorf("entity.Store context span = %+v, expected request span %s", span, root.SpanId)
+	}
+
+	// Not traced without a traceparent because sample rate is zero
+	server.trace.Spans = nil
+	resp, err = http.Get(server.url + etre.API_ROOT + "/entities/" + entityType + "?query=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(server.trace.Spans) != 0 {
+		t.Errorf("got %d spans, expected 0: %+v", len(server.trace.Spans), server.trace.Spans)
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"log"
 	"os"
 
+	"github.com/square/etre/audit"
 	"github.com/square/etre/auth"
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/config"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
+	"github.com/square/etre/trace"
 )
 
 // Context represents the config, core service singletons, and 3rd-party extensions.
@@ -24,13 +26,19 @@ type Context struct {
 
 	EntityStore     entity.Store
 	EntityValidator entity.Validator
+	EntityTypes     entity.TypeRegistry
+	Snapshotter     entity.Snapshotter // nil if CDC disabled
 	CDCStore        cdc.Store
+	CDCCheckpoints  cdc.CheckpointStore
+	CDCReplayer     cdc.Replayer // nil if no fallback file
 	ChangesServer   changestream.Server
 	StreamerFactory changestream.StreamerFactory
 	MetricsStore    metrics.Store
 	MetricsFactory  metrics.Factory
 	SystemMetrics   metrics.Metrics
 	Auth            auth.Manager
+	Audit           audit.Sink    // nil if audit log disabled
+	Tracer          *trace.Tracer // nil if tracing disabled
 
 	// 3rd-party extensions, all optional
 	Hooks   Hooks
@@ -66,6 +74,19 @@ type Hooks struct {
 // and custom system of authentication and authorization.
 type Plugins struct {
 	Auth auth.Plugin
+
+	// Audit receives audit log events. If not set, the built-in audit.FileSink
+	// is used if config.audit.file is set.
+	Audit audit.Sink
+
+	// TraceExporter receives trace spans. If not set, the built-in trace.FileExporter
+	// or trace.OTLPExporter is used if config.trace.file or .otlp_endpoint is set.
+	TraceExporter trace.Exporter
+
+	// CDCSinks receive every CDC event, in addition to built-in sinks in
+	// config.cdc.sinks. Implement cdc.Sink to publish events to a message bus,
+	// like Kafka. Sink names must be unique. Sinks are ignored if CDC is disabled.
+	CDCSinks []cdc.Sink
 }
 
 // Defaults returns a Context with default (built-in) hooks and plugins.
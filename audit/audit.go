@@ -0,0 +1,86 @@
+// Copyright 2020, Square, Inc.
+
+// Package audit provides an audit log of write requests and auth failures.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	EVENT_WRITE                 = "write"
+	EVENT_AUTHENTICATION_FAILED = "authentication-failed"
+	EVENT_AUTHORIZATION_FAILED  = "authorization-failed"
+)
+
+// Event is one audit log record: a write request (successful or not) or an
+// authentication or authorization failure.
+type Event struct {
+	Ts         int64             `json:"ts"` // Unix milliseconds
+	Type       string            `json:"type"`
+	Caller     string            `json:"caller,omitempty"`
+	Roles      []string          `json:"roles,omitempty"`
+	Trace      map[string]string `json:"trace,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	EntityType string            `json:"entity_type,omitempty"`
+	Query      string            `json:"query,omitempty"`
+	EntityIds  []string          `json:"entity_ids,omitempty"`  // written entities
+	RenameFrom string            `json:"rename_from,omitempty"` // bulk label rename
+	RenameTo   string            `json:"rename_to,omitempty"`
+	SetOp      string            `json:"set_op,omitempty"`
+	SetId      string            `json:"set_id,omitempty"`
+	SetSize    int               `json:"set_size,omitempty"`
+	HTTPStatus int               `json:"http_status"`
+	Error      string            `json:"error,omitempty"`
+	ErrorType  string            `json:"error_type,omitempty"`
+}
+
+// Sink records audit events. Implement this interface and set app.Plugins.Audit
+// to send events elsewhere. Write is called synchronously by the API for every
+// event, so it should be fast and safe for concurrent use.
+type Sink interface {
+	Write(Event) error
+}
+
+// FileSink is the default Sink. It appends events to a file as JSON lines.
+type FileSink struct {
+	*sync.Mutex
+	file *os.File
+}
+
+var _ Sink = &FileSink{}
+
+// NewFileSink opens the file for appending, creating it if needed.
+func NewFileSink(file string) (*FileSink, error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit file: %s", err)
+	}
+	return &FileSink{
+		Mutex: &sync.Mutex{},
+		file:  f,
+	}, nil
+}
+
+func (s *FileSink) Write(e Event) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(append(bytes, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,66 @@
+// Copyright 2020, Square, Inc.
+
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre/audit"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etre-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.json")
+
+	events := []audit.Event{
+		{Ts: 1, Type: audit.EVENT_WRITE, Caller: "dn", Method: "POST", EntityIds: []string{"id1"}, HTTPStatus: 201},
+		{Ts: 2, Type: audit.EVENT_AUTHORIZATION_FAILED, Caller: "dn", Method: "DELETE", HTTPStatus: 403, Error: "denied"},
+	}
+	sink, err := audit.NewFileSink(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(events[0]); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	// Reopen appends
+	sink, err = audit.NewFileSink(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(events[1]); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []audit.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid JSON line: %s: %s", scanner.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if diff := deep.Equal(got, events); diff != nil {
+		t.Error(diff)
+	}
+}
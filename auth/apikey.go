@@ -0,0 +1,174 @@
+// Copyright 2020, Square, Inc.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DEFAULT_API_KEY_RELOAD_INTERVAL is how often the API keys file is checked
+// for changes if APIKeyConfig.ReloadInterval is zero.
+const DEFAULT_API_KEY_RELOAD_INTERVAL = 10 * time.Second
+
+// APIKey is a hashed API key and the caller it authenticates. The API keys file
+// is a YAML list of APIKey.
+type APIKey struct {
+	Name         string   `yaml:"name"`
+	Hash         string   `yaml:"hash"` // HashAPIKey(key), like "sha256:9f86d0..."
+	Roles        []string `yaml:"roles"`
+	MetricGroups []string `yaml:"metric_groups"`
+}
+
+// APIKeyConfig configures the APIKeys plugin. It's mapped from config.APIKeyConfig.
+type APIKeyConfig struct {
+	Keys           []APIKey      // static keys
+	KeysFile       string        // YAML list of APIKey, reloaded on change
+	ReloadInterval time.Duration // how often KeysFile is checked for changes
+}
+
+// APIKeys is a Plugin that authenticates callers by API key in the Authorization
+// header ("Bearer <key>"). Only key hashes are stored. APIKeys does not authorize;
+// configure ACLs to authorize by caller roles.
+type APIKeys struct {
+	cfg APIKeyConfig
+	// --
+	*sync.Mutex
+	keys      map[string]APIKey // keyed on hash
+	modTime   time.Time         // of KeysFile when loaded
+	lastCheck time.Time         // of KeysFile mod time
+}
+
+var _ Plugin = &APIKeys{}
+
+// HashAPIKey returns the hash of an API key to store in APIKey.Hash.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// NewAPIKeys creates an APIKeys plugin and loads the keys file, if any.
+func NewAPIKeys(cfg APIKeyConfig) (*APIKeys, error) {
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = DEFAULT_API_KEY_RELOAD_INTERVAL
+	}
+	a := &APIKeys{
+		cfg:   cfg,
+		Mutex: &sync.Mutex{},
+	}
+	keys, modTime, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no API keys")
+	}
+	a.keys = keys
+	a.modTime = modTime
+	a.lastCheck = time.Now()
+	return a, nil
+}
+
+func (a *APIKeys) Authenticate(req *http.Request) (Caller, error) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return Caller{}, fmt.Errorf("no API key in Authorization header")
+	}
+	hash := HashAPIKey(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+
+	a.Lock()
+	a.reload()
+	key, ok := a.keys[hash]
+	a.Unlock()
+	if !ok {
+		return Caller{}, fmt.Errorf("invalid API key")
+	}
+
+	caller := Caller{
+		Name:         key.Name,
+		Roles:        key.Roles,
+		MetricGroups: key.MetricGroups,
+	}
+	if len(caller.MetricGroups) == 0 {
+		caller.MetricGroups = []string{DefaultMetricGroup}
+	}
+	return caller, nil
+}
+
+// Authorize allows all actions. ACLs authorize callers by API key roles.
+func (a *APIKeys) Authorize(Caller, Action) error {
+	return nil
+}
+
+// reload reloads the keys file if it changed. It's called with the mutex locked.
+// On error, the current keys are kept.
+func (a *APIKeys) reload() {
+	if a.cfg.KeysFile == "" || time.Since(a.lastCheck) < a.cfg.ReloadInterval {
+		return
+	}
+	a.lastCheck = time.Now()
+	fi, err := os.Stat(a.cfg.KeysFile)
+	if err != nil {
+		log.Printf("ERROR: API keys file %s: %s", a.cfg.KeysFile, err)
+		return
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return
+	}
+	keys, modTime, err := a.load()
+	if err != nil {
+		log.Printf("ERROR: reloading API keys file: %s (keeping current keys)", err)
+		return
+	}
+	log.Printf("Reloaded %d API keys from %s", len(keys), a.cfg.KeysFile)
+	a.keys = keys
+	a.modTime = modTime
+}
+
+// load returns the static keys and the keys from the file, if any, and the
+// file mod time.
+func (a *APIKeys) load() (map[string]APIKey, time.Time, error) {
+	all := append([]APIKey{}, a.cfg.Keys...)
+	var modTime time.Time
+	if a.cfg.KeysFile != "" {
+		fi, err := os.Stat(a.cfg.KeysFile)
+		if err != nil {
+			return nil, modTime, err
+		}
+		modTime = fi.ModTime()
+		bytes, err := ioutil.ReadFile(a.cfg.KeysFile)
+		if err != nil {
+			return nil, modTime, err
+		}
+		var fileKeys []APIKey
+		if err := yaml.Unmarshal(bytes, &fileKeys); err != nil {
+			return nil, modTime, fmt.Errorf("cannot decode YAML in %s: %s", a.cfg.KeysFile, err)
+		}
+		all = append(all, fileKeys...)
+	}
+	keys := make(map[string]APIKey, len(all))
+	for i, key := range all {
+		if key.Name == "" {
+			return nil, modTime, fmt.Errorf("API key %d has no name", i)
+		}
+		if !strings.HasPrefix(key.Hash, "sha256:") || len(key.Hash) != len("sha256:")+sha256.Size*2 {
+			return nil, modTime, fmt.Errorf("API key %s: invalid hash: must be sha256:<hex>", key.Name)
+		}
+		key.Hash = strings.ToLower(key.Hash)
+		if _, ok := keys[key.Hash]; ok {
+			return nil, modTime, fmt.Errorf("API key %s: duplicate hash", key.Name)
+		}
+		keys[key.Hash] = key
+	}
+	return keys, modTime, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020, Square, Inc.
+
+package auth_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/square/etre/auth"
+)
+
+func TestAPIKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etre-apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "keys.yaml")
+	writeKeys := func(yaml string, modTime time.Time) {
+		if err := ioutil.WriteFile(keysFile, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(keysFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("- name: ci\n  hash: "+auth.HashAPIKey("key2")+"\n  roles: [rw]\n", time.Now().Add(-time.Hour))
+
+	plugin, err := auth.NewAPIKeys(auth.APIKeyConfig{
+		Keys: []auth.APIKey{
+			{Name: "app1", Hash: auth.HashAPIKey("key1"), Roles: []string{"ro"}, MetricGroups: []string{"g1"}},
+		},
+		KeysFile:       keysFile,
+		ReloadInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Static key
+	caller, err := plugin.Authenticate(bearer("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := auth.Caller{Name: "app1", Roles: []string{"ro"}, MetricGroups: []string{"g1"}}
+	if diff := deep.Equal(caller, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Key from file, default metric group
+	caller, err = plugin.Authenticate(bearer("key2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = auth.Caller{Name: "ci", Roles: []string{"rw"}, MetricGroups: []string{auth.DefaultMetricGroup}}
+	if diff := deep.Equal(caller, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	if _, err := plugin.Authenticate(bearer("key3")); err == nil {
+		t.Errorf("no error for invalid key")
+	}
+	if _, err := plugin.Authenticate(&http.Request{Header: http.Header{}}); err == nil {
+		t.Errorf("no error without Authorization header")
+	}
+
+	// Reload on change: key2 revoked, key3 added
+	writeKeys("- name: ci2\n  hash: "+auth.HashAPIKey("key3")+"\n", time.Now())
+	time.Sleep(5 * time.Millisecond)
+	if _, err := plugin.Authenticate(bearer("key2")); err == nil {
+		t.Errorf("no error for revoked key")
+	}
+	caller, err = plugin.Authenticate(bearer("key3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Name != "ci2" {
+		t.Errorf("got caller %s, expected ci2", caller.Name)
+	}
+
+	// Invalid file keeps current keys
+	writeKeys("- name: bad\n  hash: md5:abc\n", time.Now().Add(time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	if _, err := plugin.Authenticate(bearer("key3")); err != nil {
+		t.Errorf("got error '%s' after invalid reload, expected nil", err)
+	}
+}
+
+func TestAPIKeysInvalid(t *testing.T) {
+	if _, err := auth.NewAPIKeys(auth.APIKeyConfig{}); err == nil {
+		t.Errorf("no error without keys")
+	}
+	if _, err := auth.NewAPIKeys(auth.APIKeyConfig{Keys: []auth.APIKey{{Name: "app1", Hash: "key1"}}}); err == nil {
+		t.Errorf("no error for unhashed key")
+	}
+}
@@ -17,8 +17,8 @@ type ACL struct {
 	// to match.
 	Role string
 
-	// Role grants admin access to request. The Authorize plugin method is not
-	// called. Authorization is always successful.
+	// Role grants admin access to request. ACL checks are skipped, but the
+	// Authorize plugin method is still called for final authorization.
 	Admin bool
 
 	// Read entity types granted to the role. Does not apply to admin roles.
@@ -27,6 +27,32 @@ type ACL struct {
 	// Write entity types granted to the role. Does not apply to admin roles.
 	Write []string
 
+	// WriteLabels restricts the labels the role can write (create, change, or
+	// delete) to these labels. If empty, the role can write all labels. Deleting
+	// entities requires ALL_LABELS. Does not apply to metalabels or admin roles.
+	WriteLabels []string
+
+	// DenyReadLabels are labels the role cannot read. They are removed from
+	// query results, and queries that explicitly read them are not authorized.
+	// Does not apply to admin roles.
+	DenyReadLabels []string
+
+	// ReadScope and WriteScope are label selectors (KLS) that limit reads and
+	// writes to matching entities, like "team=payments". They are ANDed into
+	// queries, and new and patched entities must match. ${caller.name} and
+	// ${caller.<attribute>} are replaced by Caller.Name and Caller.Attributes,
+	// like "team=${caller.team}". Substituted values must have only letters,
+	// digits, and _ . @ : / -, else the scope is an error. Read scopes apply to
+	// queries, expanded references, and change feeds. Do not apply to admin roles.
+	ReadScope  string
+	WriteScope string
+
+	// RoleLimit limits requests by all callers with the role, and CallerLimit
+	// limits requests by each caller (Caller.Name) with the role. Apply to
+	// entity requests and admin roles.
+	RoleLimit   Limit
+	CallerLimit Limit
+
 	// Trace keys required to be set. Applies to admin roles.
 	TraceKeysRequired []string
 }
@@ -38,6 +64,7 @@ type Caller struct {
 	Roles        []string          // caller roles to match against ACL roles
 	MetricGroups []string          // metric groups to add metric values to
 	Trace        map[string]string // key-value pairs to report in trace metrics
+	Attributes   map[string]string // caller attributes for ACL scopes, like team
 }
 
 // Action is what a Caller is trying to do. The Authorize method of the auth plugin
@@ -45,11 +72,18 @@ type Caller struct {
 type Action struct {
 	EntityType string
 	Op         string
+
+	// Labels read or written, if known. Requests are authorized first without
+	// labels, then again with labels once the request is parsed.
+	Labels []string
 }
 
 const (
 	OP_READ  = "r"
 	OP_WRITE = "w"
+	OP_ADMIN = "a" // admin API, e.g. managing entity types; EntityType is not set
+
+	ALL_LABELS = "*" // Action.Labels when writing all labels, e.g. deleting entities
 )
 
 // Plugin is the auth plugin. Implement this interface to enable custom auth.
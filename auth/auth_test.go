@@ -3,9 +3,11 @@
 package auth_test
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/square/etre"
@@ -171,6 +173,220 @@ func TestManager(t *testing.T) {
 	}
 }
 
+func TestManagerAdminAndSetACLs(t *testing.T) {
+	acls := []auth.ACL{
+		{Role: "finch", Admin: true},
+		{Role: "bar", Read: []string{"bar"}},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+
+	// Only admin roles are allowed admin ops
+	err := man.Authorize(auth.Caller{Name: "a", Roles: []string{"finch"}}, auth.Action{Op: auth.OP_ADMIN})
+	if err != nil {
+		t.Error(err)
+	}
+	caller := auth.Caller{Name: "b", Roles: []string{"bar"}}
+	err = man.Authorize(caller, auth.Action{Op: auth.OP_ADMIN})
+	if err == nil {
+		t.Error("no Authorize error for admin op, expected one")
+	}
+
+	// Plugin still does final authorization for admin roles
+	denied := errors.New("denied by plugin")
+	deny := auth.NewManager(acls, mock.AuthPlugin{
+		AuthorizeFunc: func(auth.Caller, auth.Action) error { return denied },
+	})
+	err = deny.Authorize(auth.Caller{Name: "a", Roles: []string{"finch"}}, auth.Action{EntityType: "rack", Op: auth.OP_WRITE})
+	if err != denied {
+		t.Errorf("got error %v, expected plugin error", err)
+	}
+
+	// New ACLs apply to copies of the manager, like the API's copy
+	cp := man
+	err = cp.Authorize(caller, auth.Action{EntityType: "rack", Op: auth.OP_READ})
+	if err == nil {
+		t.Error("no Authorize error, expected one")
+	}
+	man.SetACLs(append(acls, auth.ACL{Role: "bar", Read: []string{"bar", "rack"}}))
+	err = cp.Authorize(caller, auth.Action{EntityType: "rack", Op: auth.OP_READ})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManagerLabelACLs(t *testing.T) {
+	acls := []auth.ACL{
+		{Role: "prov", Read: []string{"node"}, Write: []string{"node"}, WriteLabels: []string{"status", "rack"}, DenyReadLabels: []string{"ipmi_password"}},
+		{Role: "ops", Read: []string{"node"}},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+	prov := auth.Caller{Name: "a", Roles: []string{"prov"}}
+
+	allowed := []auth.Action{
+		{EntityType: "node", Op: auth.OP_WRITE},                                     // no labels: entity type only
+		{EntityType: "node", Op: auth.OP_WRITE, Labels: []string{"status", "rack"}}, // granted labels
+		{EntityType: "node", Op: auth.OP_READ, Labels: []string{"status", "owner"}}, // not denied
+	}
+	for _, a := range allowed {
+		if err := man.Authorize(prov, a); err != nil {
+			t.Errorf("%+v: got error '%s', expected nil", a, err)
+		}
+	}
+
+	denied := []auth.Action{
+		{EntityType: "node", Op: auth.OP_WRITE, Labels: []string{"status", "owner"}},
+		{EntityType: "node", Op: auth.OP_WRITE, Labels: []string{auth.ALL_LABELS}},
+		{EntityType: "node", Op: auth.OP_READ, Labels: []string{"ipmi_password"}},
+		{EntityType: "node", Op: auth.OP_READ, Labels: []string{"bmc_id.ipmi_password"}}, // expanded
+	}
+	for _, a := range denied {
+		if err := man.Authorize(prov, a); err == nil {
+			t.Errorf("%+v: no error, expected one", a)
+		}
+	}
+
+	// Any role that allows the label allows it
+	both := auth.Caller{Name: "b", Roles: []string{"prov", "ops"}}
+	if err := man.Authorize(both, auth.Action{EntityType: "node", Op: auth.OP_READ, Labels: []string{"ipmi_password"}}); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+}
+
+func TestManagerScope(t *testing.T) {
+	acls := []auth.ACL{
+		{Role: "team", Read: []string{"node"}, Write: []string{"node"}, WriteScope: "team=${caller.team},owner!=${caller.name}"},
+		{Role: "ops", Read: []string{"node"}, Write: []string{"node"}, WriteScope: "env=dev"},
+		{Role: "rw", Read: []string{"node"}, Write: []string{"node"}},
+		{Role: "admin", Admin: true},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+	write := auth.Action{EntityType: "node", Op: auth.OP_WRITE}
+	read := auth.Action{EntityType: "node", Op: auth.OP_READ}
+
+	caller := auth.Caller{Name: "dn", Roles: []string{"team"}, Attributes: map[string]string{"team": "payments"}}
+	scope, err := man.Scope(caller, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scope != "team=payments,owner!=dn" {
+		t.Errorf("got scope %s, expected team=payments,owner!=dn", scope)
+	}
+
+	// No read scope
+	scope, err = man.Scope(caller, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scope != "" {
+		t.Errorf("got read scope %s, expected none", scope)
+	}
+
+	// Missing attribute is an error, not an empty value
+	_, err = man.Scope(auth.Caller{Name: "dn", Roles: []string{"team"}}, write)
+	if err == nil {
+		t.Error("no error for missing caller attribute, expected one")
+	}
+
+	// Attribute values with selector syntax are an error, else they could
+	// change the scope, like "payments,team!=x" matches all teams but x
+	for _, v := range []string{"payments,team!=x", "a b", "x)", "payments=1"} {
+		_, err = man.Scope(auth.Caller{Name: "dn", Roles: []string{"team"}, Attributes: map[string]string{"team": v}}, write)
+		if err == nil {
+			t.Errorf("no error for caller attribute value %q, expected one", v)
+		}
+	}
+	_, err = man.Scope(auth.Caller{Name: "dn,owner", Roles: []string{"team"}, Attributes: map[string]string{"team": "payments"}}, write)
+	if err == nil {
+		t.Error("no error for caller name with selector syntax, expected one")
+	}
+
+	// Roles with different scopes is an error
+	caller.Roles = []string{"team", "ops"}
+	if _, err = man.Scope(caller, write); err == nil {
+		t.Error("no error for roles with different scopes, expected one")
+	}
+
+	// Unscoped role or admin role is not scoped
+	for _, role := range []string{"rw", "admin"} {
+		caller.Roles = []string{"team", role}
+		scope, err = man.Scope(caller, write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scope != "" {
+			t.Errorf("role %s: got scope %s, expected none", role, scope)
+		}
+	}
+
+	if err := auth.ValidateScope("team=${caller.team}"); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+	if err := auth.ValidateScope("team=="); err == nil {
+		t.Error("no error for invalid scope, expected one")
+	}
+}
+
+func TestManagerAcquire(t *testing.T) {
+	acls := []auth.ACL{
+		{Role: "cron", Read: []string{"host"}, CallerLimit: auth.Limit{MaxConcurrent: 1}},
+		{Role: "ci", Read: []string{"host"}, RoleLimit: auth.Limit{Rate: 1, Burst: 2}},
+	}
+	man := auth.NewManager(acls, auth.NewAllowAll())
+
+	// Concurrency per caller: second request from same caller denied until
+	// first is released, but other callers with the role are not limited
+	cron1 := auth.Caller{Name: "job1", Roles: []string{"cron"}}
+	release, err := man.Acquire(cron1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = man.Acquire(cron1)
+	if err == nil {
+		t.Error("no error for second concurrent request, expected LimitError")
+	} else if limitErr, ok := err.(auth.LimitError); !ok || limitErr.RetryAfter <= 0 {
+		t.Errorf("got error %#v, expected LimitError with RetryAfter", err)
+	}
+	release2, err := man.Acquire(auth.Caller{Name: "job2", Roles: []string{"cron"}})
+	if err != nil {
+		t.Errorf("got error '%s' for other caller, expected nil", err)
+	} else {
+		release2()
+	}
+	release()
+	release, err = man.Acquire(cron1)
+	if err != nil {
+		t.Errorf("got error '%s' after release, expected nil", err)
+	}
+
+	// Change feeds don't take a concurrent request slot
+	if err := man.AcquireRate(cron1); err != nil {
+		t.Errorf("got error '%s' from AcquireRate, expected nil", err)
+	}
+	release()
+
+	// Rate per role: burst of 2 shared by all callers with the role
+	for _, name := range []string{"build1", "build2"} {
+		release, err := man.Acquire(auth.Caller{Name: name, Roles: []string{"ci"}})
+		if err != nil {
+			t.Fatalf("%s: got error '%s', expected nil", name, err)
+		}
+		release()
+	}
+	_, err = man.Acquire(auth.Caller{Name: "build3", Roles: []string{"ci"}})
+	if err == nil {
+		t.Error("no error after burst, expected LimitError")
+	} else if limitErr, ok := err.(auth.LimitError); !ok || limitErr.RetryAfter <= 0 || limitErr.RetryAfter > time.Second {
+		t.Errorf("got error %#v, expected LimitError with RetryAfter <= 1s", err)
+	}
+
+	// Roles without limits are not limited
+	for i := 0; i < 10; i++ {
+		if _, err := man.Acquire(auth.Caller{Name: "x", Roles: []string{"other"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestManagerNoACLs(t *testing.T) {
 	// Without ACLs, auth is effectively disabled. Authenticate still calls
 	// the plugin so that metric groups work, but it doesn't check required
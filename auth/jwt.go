@@ -0,0 +1,366 @@
+// Copyright 2020, Square, Inc.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures the JWT plugin. It's mapped from config.JWTConfig.
+type JWTConfig struct {
+	JWKSFile string   // JSON Web Key Set file
+	KeyFiles []string // PEM-encoded RSA or EC public keys
+
+	Issuer   string // required iss claim, if set
+	Audience string // required aud claim, if set
+	Leeway   time.Duration
+
+	// AllowNoExp allows tokens without an exp claim, which never expire.
+	// By default, tokens must have a numeric exp claim.
+	AllowNoExp bool
+
+	NameClaim         string   // Caller.Name, default "sub"
+	RolesClaim        string   // Caller.Roles, default "roles"
+	MetricGroupsClaim string   // Caller.MetricGroups, default DefaultMetricGroup
+	AttributeClaims   []string // Caller.Attributes
+}
+
+// JWT is a Plugin that authenticates callers by JWT bearer tokens in the
+// Authorization header ("Bearer <token>"). Tokens must be signed with RS256,
+// RS384, RS512, ES256, ES384, ES512, or (JWKS "oct" keys) HS256, HS384, HS512.
+// JWT does not authorize; configure ACLs to authorize by caller roles.
+type JWT struct {
+	cfg  JWTConfig
+	keys []jwk
+}
+
+var _ Plugin = &JWT{}
+
+// jwk is a verification key, from a JWKS file or a PEM key file.
+type jwk struct {
+	kid string
+	key interface{} // *rsa.PublicKey, *ecdsa.PublicKey, or []byte (HMAC)
+}
+
+var jwtAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+}
+
+// NewJWT creates a JWT plugin and loads its keys. At least one key is required.
+func NewJWT(cfg JWTConfig) (*JWT, error) {
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	j := &JWT{cfg: cfg}
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		j.keys = append(j.keys, keys...)
+	}
+	for _, file := range cfg.KeyFiles {
+		key, err := loadPEMKey(file)
+		if err != nil {
+			return nil, err
+		}
+		j.keys = append(j.keys, jwk{key: key})
+	}
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("no JWT keys: set jwks_file or key_files")
+	}
+	return j, nil
+}
+
+func (j *JWT) Authenticate(req *http.Request) (Caller, error) {
+	token := req.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return Caller{}, fmt.Errorf("no bearer token in Authorization header")
+	}
+	claims, err := j.verify(strings.TrimSpace(strings.TrimPrefix(token, "Bearer ")))
+	if err != nil {
+		return Caller{}, fmt.Errorf("invalid JWT: %s", err)
+	}
+
+	caller := Caller{
+		Name:         claimString(claims[j.cfg.NameClaim]),
+		Roles:        claimStrings(claims[j.cfg.RolesClaim]),
+		MetricGroups: []string{DefaultMetricGroup},
+	}
+	if caller.Name == "" {
+		return Caller{}, fmt.Errorf("invalid JWT: no %s claim for caller name", j.cfg.NameClaim)
+	}
+	if j.cfg.MetricGroupsClaim != "" {
+		if groups := claimStrings(claims[j.cfg.MetricGroupsClaim]); len(groups) > 0 {
+			caller.MetricGroups = groups
+		}
+	}
+	for _, claim := range j.cfg.AttributeClaims {
+		if v := claimString(claims[claim]); v != "" {
+			if caller.Attributes == nil {
+				caller.Attributes = map[string]string{}
+			}
+			caller.Attributes[claim] = v
+		}
+	}
+	return caller, nil
+}
+
+// Authorize allows all actions. ACLs authorize callers by roles from the token.
+func (j *JWT) Authorize(Caller, Action) error {
+	return nil
+}
+
+// verify verifies the token signature and registered claims (exp, nbf, iss, aud),
+// and returns all claims.
+func (j *JWT) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	hash, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg: %s", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %s", err)
+	}
+
+	// Try the key with the token kid, else every key
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range j.keys {
+		if header.Kid != "" && k.kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, hash, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("signature not verified")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %s", err)
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(j.cfg.Leeway)) {
+			return nil, errors.New("token expired")
+		}
+	} else if _, set := claims["exp"]; set || !j.cfg.AllowNoExp {
+		return nil, errors.New("token has no numeric exp claim")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.cfg.Issuer != "" && claimString(claims["iss"]) != j.cfg.Issuer {
+		return nil, fmt.Errorf("issuer is not %s", j.cfg.Issuer)
+	}
+	if j.cfg.Audience != "" && !inList(j.cfg.Audience, claimStrings(claims["aud"])) {
+		return nil, fmt.Errorf("audience does not include %s", j.cfg.Audience)
+	}
+	return claims, nil
+}
+
+// verifySignature returns true if the key verifies the signature. The key type
+// must match the alg, so an RSA public key is never used as an HMAC secret.
+func verifySignature(alg string, hash crypto.Hash, key interface{}, signed, sig []byte) bool {
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case []byte:
+		if alg[:2] != "HS" {
+			return false
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimString returns the claim value if it's a string, else an empty string.
+func claimString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// claimStrings returns the claim value as a list of strings. The value can be
+// a JSON array of strings or a string of space or comma-separated values.
+func claimStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return strings.FieldsFunc(val, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		s := make([]string, 0, len(val))
+		for _, e := range val {
+			if str, ok := e.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------
+// Keys
+// --------------------------------------------------------------------------
+
+func loadJWKS(file string) ([]jwk, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`   // RSA
+			E   string `json:"e"`   // RSA
+			Crv string `json:"crv"` // EC
+			X   string `json:"x"`   // EC
+			Y   string `json:"y"`   // EC
+			K   string `json:"k"`   // oct
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(bytes, &jwks); err != nil {
+		return nil, fmt.Errorf("%s: invalid JWKS: %s", file, err)
+	}
+	keys := []jwk{}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("%s: key %d: invalid RSA n or e", file, i)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("%s: key %d: unsupported EC curve: %s", file, i, k.Crv)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("%s: key %d: invalid EC x or y", file, i)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("%s: key %d: invalid oct k", file, i)
+			}
+			key = secret
+		default:
+			return nil, fmt.Errorf("%s: key %d: unsupported kty: %s", file, i, k.Kty)
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func loadPEMKey(file string) (interface{}, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T; expected RSA or EC public key", file, key)
+}
@@ -0,0 +1,228 @@
+// Copyright 2020, Square, Inc.
+
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/square/etre/auth"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a JWT signed with key: *rsa.PrivateKey (RS256),
+// *ecdsa.PrivateKey (ES256), or []byte (HS256).
+func sign(t *testing.T, key interface{}, kid string, claims map[string]interface{}) string {
+	header := map[string]string{"kid": kid}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		header["alg"] = "RS256"
+	case *ecdsa.PrivateKey:
+		header["alg"] = "ES256"
+	case []byte:
+		header["alg"] = "HS256"
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func bearer(token string) *http.Request {
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("test-secret")
+
+	dir, err := ioutil.TempDir("", "etre-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// JWKS with the RSA and HMAC keys
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "oct", "kid": "hmac1", "k": b64(secret)},
+		},
+	}
+	bytes, _ := json.Marshal(jwks)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, bytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// PEM file with the EC key
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "ec.pem")
+	if err := ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := auth.NewJWT(auth.JWTConfig{
+		JWKSFile:          jwksFile,
+		KeyFiles:          []string{pemFile},
+		Issuer:            "https://idp.local",
+		Audience:          "etre",
+		MetricGroupsClaim: "groups",
+		AttributeClaims:   []string{"team"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := map[string]interface{}{
+		"sub":    "dn",
+		"iss":    "https://idp.local",
+		"aud":    []string{"etre", "other"},
+		"exp":    exp,
+		"roles":  []string{"ro", "rw"},
+		"groups": "g1 g2",
+		"team":   "db",
+	}
+	expect := auth.Caller{
+		Name:         "dn",
+		Roles:        []string{"ro", "rw"},
+		MetricGroups: []string{"g1", "g2"},
+		Attributes:   map[string]string{"team": "db"},
+	}
+
+	// Valid tokens signed by each key
+	for _, key := range []interface{}{rsaKey, ecKey, secret} {
+		caller, err := plugin.Authenticate(bearer(sign(t, key, "", claims)))
+		if err != nil {
+			t.Errorf("%T key: got error '%s', expected nil", key, err)
+			continue
+		}
+		if diff := deep.Equal(caller, expect); diff != nil {
+			t.Errorf("%T key: %v", key, diff)
+		}
+	}
+
+	// Metric groups default if claim not set
+	noGroups := map[string]interface{}{"sub": "dn", "iss": "https://idp.local", "aud": "etre", "exp": exp}
+	caller, err := plugin.Authenticate(bearer(sign(t, rsaKey, "rsa1", noGroups)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(caller.MetricGroups, []string{auth.DefaultMetricGroup}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Invalid tokens
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(label string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for k, v := range claims {
+			c[k] = v
+		}
+		if v == nil {
+			delete(c, label)
+		} else {
+			c[label] = v
+		}
+		return c
+	}
+	h, _ := json.Marshal(map[string]string{"alg": "none"})
+	c, _ := json.Marshal(claims)
+	invalid := map[string]string{
+		"unknown key":  sign(t, otherKey, "", claims),
+		"wrong kid":    sign(t, rsaKey, "hmac1", claims),
+		"expired":      sign(t, rsaKey, "", with("exp", time.Now().Add(-time.Minute).Unix())),
+		"not before":   sign(t, rsaKey, "", with("nbf", time.Now().Add(time.Hour).Unix())),
+		"wrong issuer": sign(t, rsaKey, "", with("iss", "https://evil.local")),
+		"wrong aud":    sign(t, rsaKey, "", with("aud", "other")),
+		"no sub":       sign(t, rsaKey, "", with("sub", nil)),
+		"no exp":       sign(t, rsaKey, "", with("exp", nil)),
+		"string exp":   sign(t, rsaKey, "", with("exp", "never")),
+		"alg none":     b64(h) + "." + b64(c) + ".",
+		"malformed":    "not-a-jwt",
+	}
+	for name, token := range invalid {
+		if _, err := plugin.Authenticate(bearer(token)); err == nil {
+			t.Errorf("%s: no error, expected invalid token", name)
+		}
+	}
+	if _, err := plugin.Authenticate(&http.Request{Header: http.Header{}}); err == nil {
+		t.Errorf("no error without Authorization header")
+	}
+
+	// Tokens without exp only if explicitly allowed
+	plugin, err = auth.NewJWT(auth.JWTConfig{KeyFiles: []string{pemFile}, AllowNoExp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.Authenticate(bearer(sign(t, ecKey, "", map[string]interface{}{"sub": "dn"}))); err != nil {
+		t.Errorf("got error '%s' without exp, expected nil with AllowNoExp", err)
+	}
+	if _, err := plugin.Authenticate(bearer(sign(t, ecKey, "", map[string]interface{}{"sub": "dn", "exp": "never"}))); err == nil {
+		t.Error("no error for string exp with AllowNoExp, expected one")
+	}
+}
+
+func TestJWTNoKeys(t *testing.T) {
+	if _, err := auth.NewJWT(auth.JWTConfig{}); err == nil {
+		t.Errorf("no error without keys")
+	}
+}
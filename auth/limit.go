@@ -0,0 +1,190 @@
+// Copyright 2020, Square, Inc.
+
+package auth
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token-bucket rate limit and maximum concurrent requests. Zero
+// values are no limit.
+type Limit struct {
+	Rate          float64 // requests per second
+	Burst         int     // bucket size; if zero, Rate rounded up (min 1)
+	MaxConcurrent int     // maximum concurrent requests, excluding change feeds
+}
+
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0 && l.MaxConcurrent <= 0
+}
+
+// LimitError is returned by Manager.Acquire when a request exceeds a limit.
+type LimitError struct {
+	Err        error
+	RetryAfter time.Duration // when the caller can retry
+}
+
+func (e LimitError) Error() string {
+	return e.Err.Error()
+}
+
+// LIMIT_IDLE_TTL is how long a full token bucket is kept after its last request.
+// Idle buckets are removed so the limiter doesn't grow with every caller name.
+const LIMIT_IDLE_TTL = 10 * time.Minute
+
+// limiter tracks token buckets and concurrent requests, keyed on
+// "role" (ACL.RoleLimit) or "role/caller" (ACL.CallerLimit).
+type limiter struct {
+	*sync.Mutex
+	buckets map[string]*bucket
+	running map[string]int
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when tokens refill to burst
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		Mutex:   &sync.Mutex{},
+		buckets: map[string]*bucket{},
+		running: map[string]int{},
+		swept:   time.Now(),
+	}
+}
+
+type keyLimit struct {
+	key   string
+	limit Limit
+}
+
+// Acquire acquires a request slot for the caller from the role and caller limits
+// of the caller roles (ACL.RoleLimit and ACL.CallerLimit). The request is allowed
+// only if all limits allow it. On success, the returned func must be called to
+// release the slot when the request is done. On failure, the error is a LimitError.
+func (m Manager) Acquire(caller Caller) (func(), error) {
+	return m.acquire(caller, true)
+}
+
+// AcquireRate is like Acquire but only takes a token from rate limits, not a
+// concurrent request slot. It's used for long-lived change feeds, which would
+// otherwise hold a slot for as long as the client is connected.
+func (m Manager) AcquireRate(caller Caller) error {
+	_, err := m.acquire(caller, false)
+	return err
+}
+
+func (m Manager) acquire(caller Caller, concurrent bool) (func(), error) {
+	if m.disabled {
+		return func() {}, nil
+	}
+	var limits []keyLimit
+	for _, role := range caller.Roles {
+		acl, ok := m.roleACL(role)
+		if !ok {
+			continue
+		}
+		if !acl.RoleLimit.IsZero() {
+			limits = append(limits, keyLimit{key: role, limit: acl.RoleLimit})
+		}
+		if !acl.CallerLimit.IsZero() {
+			limits = append(limits, keyLimit{key: role + "/" + caller.Name, limit: acl.CallerLimit})
+		}
+	}
+	if len(limits) == 0 {
+		return func() {}, nil
+	}
+
+	l := m.limits
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > LIMIT_IDLE_TTL {
+		l.sweep(now)
+	}
+
+	// Check all limits before taking tokens or slots from any
+	for _, kl := range limits {
+		if concurrent && kl.limit.MaxConcurrent > 0 && l.running[kl.key] >= kl.limit.MaxConcurrent {
+			return nil, LimitError{
+				Err:        fmt.Errorf("caller %s exceeds %d concurrent requests limit of %s", caller.Name, kl.limit.MaxConcurrent, kl.key),
+				RetryAfter: time.Second,
+			}
+		}
+		if kl.limit.Rate > 0 {
+			b := l.bucket(kl, now)
+			if b.tokens < 1 {
+				wait := time.Duration((1 - b.tokens) / kl.limit.Rate * float64(time.Second))
+				return nil, LimitError{
+					Err:        fmt.Errorf("caller %s exceeds %.2f requests/second limit of %s", caller.Name, kl.limit.Rate, kl.key),
+					RetryAfter: wait,
+				}
+			}
+		}
+	}
+
+	for _, kl := range limits {
+		if kl.limit.Rate > 0 {
+			b := l.buckets[kl.key]
+			b.tokens--
+			b.full = now.Add(time.Duration((kl.limit.burst() - b.tokens) / kl.limit.Rate * float64(time.Second)))
+		}
+		if concurrent && kl.limit.MaxConcurrent > 0 {
+			l.running[kl.key]++
+		}
+	}
+	if !concurrent {
+		return func() {}, nil
+	}
+	return func() {
+		l.Lock()
+		defer l.Unlock()
+		for _, kl := range limits {
+			if kl.limit.MaxConcurrent > 0 {
+				if l.running[kl.key]--; l.running[kl.key] <= 0 {
+					delete(l.running, kl.key)
+				}
+			}
+		}
+	}, nil
+}
+
+// sweep removes token buckets that are full and idle longer than LIMIT_IDLE_TTL.
+// A removed bucket is recreated full, so removing it doesn't change the limit.
+// It's called with the limiter locked.
+func (l *limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.After(b.full) && now.Sub(b.last) > LIMIT_IDLE_TTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// bucket returns the token bucket for the key, refilled to now. It's called
+// with the limiter locked.
+func (l *limiter) bucket(kl keyLimit, now time.Time) *bucket {
+	b, ok := l.buckets[kl.key]
+	if !ok {
+		b = &bucket{tokens: kl.limit.burst(), last: now, full: now}
+		l.buckets[kl.key] = b
+		return b
+	}
+	b.tokens = math.Min(kl.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*kl.limit.Rate)
+	b.last = now
+	return b
+}
+
+// burst returns the bucket size: Burst, else Rate rounded up (min 1).
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
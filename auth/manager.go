@@ -5,25 +5,54 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/square/etre/query"
 )
 
 type Manager struct {
 	disabled bool
 	plugin   Plugin
-	acl      map[string]ACL
+	acl      *roleACLs // shared by copies, see SetACLs
+	limits   *limiter  // shared by copies, see Acquire
+}
+
+type roleACLs struct {
+	*sync.RWMutex
+	byRole map[string]ACL
 }
 
 func NewManager(acls []ACL, plugin Plugin) Manager {
+	m := Manager{
+		disabled: len(acls) == 0, // no auth if no acls
+		plugin:   plugin,
+		acl:      &roleACLs{RWMutex: &sync.RWMutex{}},
+		limits:   newLimiter(),
+	}
+	m.SetACLs(acls)
+	return m
+}
+
+// SetACLs replaces the ACLs. It's called when entity types are created or
+// retired at runtime. If the manager was created without ACLs, auth remains
+// disabled.
+func (m Manager) SetACLs(acls []ACL) {
 	byRole := map[string]ACL{}
 	for _, acl := range acls {
 		byRole[acl.Role] = acl
 	}
-	return Manager{
-		disabled: len(acls) == 0, // no auth if no acls
-		plugin:   plugin,
-		acl:      byRole,
-	}
+	m.acl.Lock()
+	m.acl.byRole = byRole
+	m.acl.Unlock()
+}
+
+func (m Manager) roleACL(role string) (ACL, bool) {
+	m.acl.RLock()
+	defer m.acl.RUnlock()
+	acl, ok := m.acl.byRole[role]
+	return acl, ok
 }
 
 func (m Manager) Authenticate(req *http.Request) (Caller, error) {
@@ -58,7 +87,7 @@ func (m Manager) Authenticate(req *http.Request) (Caller, error) {
 		return caller, nil
 	}
 	for _, role := range caller.Roles {
-		acl, ok := m.acl[role]
+		acl, ok := m.roleACL(role)
 		if !ok {
 			continue
 		}
@@ -83,13 +112,13 @@ func (m Manager) Authorize(caller Caller, a Action) error {
 	}
 
 	// Check each caller role against configured role ACLs
-	allowed := false
+	var allowed []ACL // roles that allow the action
 	opName := ""
 	for _, role := range caller.Roles {
-		acl := m.acl[role]
-		// Allow if admin role
+		acl, _ := m.roleACL(role)
+		// Allow if admin role, but plugin still does final authorization
 		if acl.Admin {
-			return nil
+			return m.plugin.Authorize(caller, a)
 		}
 
 		// Allow if role allows the action
@@ -101,20 +130,139 @@ func (m Manager) Authorize(caller Caller, a Action) error {
 		case OP_WRITE:
 			allowedEntityTypes = acl.Write
 			opName = "writing"
+		case OP_ADMIN:
+			continue // only admin roles
 		}
 		if inList(a.EntityType, allowedEntityTypes) {
-			allowed = true
-			break
+			allowed = append(allowed, acl)
 		}
 	}
-	if !allowed {
+	if len(allowed) == 0 {
+		if a.Op == OP_ADMIN {
+			return fmt.Errorf("caller %s has no admin role; caller roles: %v", caller.Name, caller.Roles)
+		}
 		return fmt.Errorf("caller %s has no role that allows %s %s entities; caller roles: %v", caller.Name, opName, a.EntityType, caller.Roles)
 	}
 
+	// Each label must be allowed by at least one role that allows the action
+	for _, label := range a.Labels {
+		if !labelAllowed(label, a.Op, allowed) {
+			return fmt.Errorf("caller %s has no role that allows %s label %s of %s entities; caller roles: %v", caller.Name, opName, label, a.EntityType, caller.Roles)
+		}
+	}
+
 	// Let plugin do final authorization
 	return m.plugin.Authorize(caller, a)
 }
 
+// Scope returns the scope of the action: a label selector that entities must
+// match, with caller attributes substituted (see ACL.ReadScope and WriteScope).
+// It returns an empty string if the action is not scoped: auth is disabled, the
+// caller has an admin role, or a role that allows the action is not scoped. It
+// returns an error if roles that allow the action have different scopes, or
+// the caller does not have an attribute in the scope or its value is not valid
+// (see reScopeValue).
+func (m Manager) Scope(caller Caller, a Action) (string, error) {
+	if m.disabled {
+		return "", nil
+	}
+	scope := ""
+	for _, role := range caller.Roles {
+		acl, ok := m.roleACL(role)
+		if !ok {
+			continue
+		}
+		if acl.Admin {
+			return "", nil
+		}
+		var allowedEntityTypes []string
+		var roleScope string
+		switch a.Op {
+		case OP_READ:
+			allowedEntityTypes, roleScope = acl.Read, acl.ReadScope
+		case OP_WRITE:
+			allowedEntityTypes, roleScope = acl.Write, acl.WriteScope
+		default:
+			continue
+		}
+		if !inList(a.EntityType, allowedEntityTypes) {
+			continue
+		}
+		if roleScope == "" {
+			return "", nil // not scoped
+		}
+		if scope != "" && scope != roleScope {
+			return "", fmt.Errorf("caller %s has roles with different scopes for %s entities: %s and %s; caller roles: %v",
+				caller.Name, a.EntityType, scope, roleScope, caller.Roles)
+		}
+		scope = roleScope
+	}
+	if scope == "" {
+		return "", nil
+	}
+
+	var err error
+	scope = reCallerVar.ReplaceAllStringFunc(scope, func(v string) string {
+		key := reCallerVar.FindStringSubmatch(v)[1]
+		val := caller.Attributes[key]
+		if key == "name" {
+			val = caller.Name
+		}
+		if err != nil {
+			return val
+		}
+		if val == "" {
+			err = fmt.Errorf("caller %s has no %s attribute for scope %s", caller.Name, key, scope)
+		} else if !reScopeValue.MatchString(val) {
+			err = fmt.Errorf("caller %s attribute %s value %q is not a valid scope value: must match %s", caller.Name, key, val, reScopeValue)
+		}
+		return val
+	})
+	if err != nil {
+		return "", err
+	}
+	return scope, nil
+}
+
+var reCallerVar = regexp.MustCompile(`\$\{caller\.([^}]+)\}`)
+
+// reScopeValue matches caller attribute values allowed in scopes. Values are
+// substituted into the label selector, so they cannot have selector syntax,
+// like "," or "=", which could change the scope.
+var reScopeValue = regexp.MustCompile(`^[\w.@:/-]+$`)
+
+// ValidateScope returns an error if the scope (ACL.ReadScope or WriteScope) is
+// not a valid label selector.
+func ValidateScope(scope string) error {
+	_, err := query.Translate(reCallerVar.ReplaceAllString(scope, "x"))
+	return err
+}
+
+// labelAllowed returns true if any of the ACLs allow reading or writing the label.
+// Reading label "rack_id.name" (an expanded reference) is denied if "name" is denied.
+func labelAllowed(label, op string, acls []ACL) bool {
+	for _, acl := range acls {
+		switch op {
+		case OP_READ:
+			denied := false
+			for _, d := range acl.DenyReadLabels {
+				if label == d || strings.HasSuffix(label, "."+d) {
+					denied = true
+					break
+				}
+			}
+			if !denied {
+				return true
+			}
+		case OP_WRITE:
+			if len(acl.WriteLabels) == 0 || inList(ALL_LABELS, acl.WriteLabels) || inList(label, acl.WriteLabels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func inList(s string, l []string) bool {
 	for _, v := range l {
 		if s == v {
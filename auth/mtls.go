@@ -0,0 +1,119 @@
+// Copyright 2020, Square, Inc.
+
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	MTLS_NAME_FROM_CN  = "cn"  // Caller.Name from certificate subject common name (default)
+	MTLS_NAME_FROM_SAN = "san" // Caller.Name from first DNS, URI, or email SAN
+
+	// MTLS_VERIFIED_ATTRIBUTE is set to "true" in Caller.Attributes when the
+	// caller presented a verified client certificate.
+	MTLS_VERIFIED_ATTRIBUTE = "mtls_verified"
+)
+
+// MTLSConfig configures the MTLS plugin. It's mapped from config.MTLSConfig.
+type MTLSConfig struct {
+	NameFrom    string // MTLS_NAME_FROM_CN (default) or MTLS_NAME_FROM_SAN
+	RolesFile   string // YAML map of caller name to roles; if not set, roles are certificate OUs
+	RequireCert bool   // deny callers without a verified certificate, else they can only read
+}
+
+// MTLS is a Plugin that authenticates callers by verified TLS client certificate.
+// The server must verify client certificates (server.tls_ca), so the plugin only
+// uses verified certificates. Callers without a verified certificate are denied
+// if RequireCert is true, else they have no name or roles and cannot write.
+// MTLS does not otherwise authorize; configure ACLs to authorize by caller roles.
+type MTLS struct {
+	cfg   MTLSConfig
+	roles map[string][]string // from RolesFile
+}
+
+var _ Plugin = &MTLS{}
+
+// NewMTLS creates an MTLS plugin and loads the roles file, if any.
+func NewMTLS(cfg MTLSConfig) (*MTLS, error) {
+	switch cfg.NameFrom {
+	case "":
+		cfg.NameFrom = MTLS_NAME_FROM_CN
+	case MTLS_NAME_FROM_CN, MTLS_NAME_FROM_SAN:
+	default:
+		return nil, fmt.Errorf("invalid name from: %s; valid values: %s, %s", cfg.NameFrom, MTLS_NAME_FROM_CN, MTLS_NAME_FROM_SAN)
+	}
+	m := &MTLS{cfg: cfg}
+	if cfg.RolesFile != "" {
+		bytes, err := ioutil.ReadFile(cfg.RolesFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(bytes, &m.roles); err != nil {
+			return nil, fmt.Errorf("cannot decode YAML in %s: %s", cfg.RolesFile, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *MTLS) Authenticate(req *http.Request) (Caller, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		if m.cfg.RequireCert {
+			return Caller{}, fmt.Errorf("no verified client certificate")
+		}
+		return Caller{
+			Name:         DefaultCallerName,
+			MetricGroups: []string{DefaultMetricGroup},
+		}, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0] // leaf
+
+	caller := Caller{
+		Name:         m.name(cert),
+		MetricGroups: []string{DefaultMetricGroup},
+		Attributes: map[string]string{
+			MTLS_VERIFIED_ATTRIBUTE: "true",
+			"cn":                    cert.Subject.CommonName,
+		},
+	}
+	if caller.Name == "" {
+		return Caller{}, fmt.Errorf("client certificate has no %s for caller name", m.cfg.NameFrom)
+	}
+	if len(cert.Subject.Organization) > 0 {
+		caller.Attributes["o"] = cert.Subject.Organization[0]
+	}
+	if m.roles != nil {
+		caller.Roles = m.roles[caller.Name]
+	} else {
+		caller.Roles = cert.Subject.OrganizationalUnit
+	}
+	return caller, nil
+}
+
+// Authorize denies writes by callers without a verified client certificate.
+func (m *MTLS) Authorize(caller Caller, a Action) error {
+	if a.Op != OP_READ && caller.Attributes[MTLS_VERIFIED_ATTRIBUTE] != "true" {
+		return fmt.Errorf("verified client certificate required to write")
+	}
+	return nil
+}
+
+func (m *MTLS) name(cert *x509.Certificate) string {
+	if m.cfg.NameFrom == MTLS_NAME_FROM_CN {
+		return cert.Subject.CommonName
+	}
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+// Copyright 2020, Square, Inc.
+
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/square/etre/auth"
+)
+
+// clientCert returns a request with a verified client certificate.
+func clientCert(t *testing.T, subject pkix.Name, dnsNames []string) *http.Request {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Request{
+		Header: http.Header{},
+		TLS: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		},
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	plugin, err := auth.NewMTLS(auth.MTLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Name from CN, roles from OUs
+	req := clientCert(t, pkix.Name{CommonName: "app1", Organization: []string{"payments"}, OrganizationalUnit: []string{"ro", "rw"}}, []string{"app1.local"})
+	caller, err := plugin.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := auth.Caller{
+		Name:         "app1",
+		Roles:        []string{"ro", "rw"},
+		MetricGroups: []string{auth.DefaultMetricGroup},
+		Attributes: map[string]string{
+			auth.MTLS_VERIFIED_ATTRIBUTE: "true",
+			"cn":                         "app1",
+			"o":                          "payments",
+		},
+	}
+	if diff := deep.Equal(caller, expect); diff != nil {
+		t.Error(diff)
+	}
+	if err := plugin.Authorize(caller, auth.Action{EntityType: "host", Op: auth.OP_WRITE}); err != nil {
+		t.Errorf("got error '%s', expected nil for verified write", err)
+	}
+
+	// No cert: can read but not write
+	caller, err = plugin.Authenticate(&http.Request{Header: http.Header{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Name != auth.DefaultCallerName || len(caller.Roles) != 0 {
+		t.Errorf("got caller %+v, expected default caller without roles", caller)
+	}
+	if err := plugin.Authorize(caller, auth.Action{EntityType: "host", Op: auth.OP_READ}); err != nil {
+		t.Errorf("got error '%s', expected nil for unverified read", err)
+	}
+	if err := plugin.Authorize(caller, auth.Action{EntityType: "host", Op: auth.OP_WRITE}); err == nil {
+		t.Errorf("no error for unverified write")
+	}
+
+	// Unless cert required
+	plugin, err = auth.NewMTLS(auth.MTLSConfig{RequireCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.Authenticate(&http.Request{Header: http.Header{}}); err == nil {
+		t.Errorf("no error without cert when cert required")
+	}
+}
+
+func TestMTLSRolesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etre-mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rolesFile := filepath.Join(dir, "roles.yaml")
+	if err := ioutil.WriteFile(rolesFile, []byte("app1.local: [admin]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin, err := auth.NewMTLS(auth.MTLSConfig{NameFrom: auth.MTLS_NAME_FROM_SAN, RolesFile: rolesFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, err := plugin.Authenticate(clientCert(t, pkix.Name{CommonName: "app1", OrganizationalUnit: []string{"ro"}}, []string{"app1.local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller.Name != "app1.local" {
+		t.Errorf("got name %s, expected app1.local", caller.Name)
+	}
+	if diff := deep.Equal(caller.Roles, []string{"admin"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Not in roles file = no roles, even with OUs
+	caller, err = plugin.Authenticate(clientCert(t, pkix.Name{CommonName: "app2", OrganizationalUnit: []string{"ro"}}, []string{"app2.local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caller.Roles) != 0 {
+		t.Errorf("got roles %v, expected none", caller.Roles)
+	}
+
+	// No SAN
+	if _, err := plugin.Authenticate(clientCert(t, pkix.Name{CommonName: "app3"}, nil)); err == nil {
+		t.Errorf("no error for cert without SAN")
+	}
+
+	if _, err := auth.NewMTLS(auth.MTLSConfig{NameFrom: "serial"}); err == nil {
+		t.Errorf("no error for invalid name from")
+	}
+}
@@ -7,40 +7,52 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/square/etre"
+	"github.com/square/etre/cdc"
 )
 
 var (
 	ErrWebsocketClosed = errors.New("websocket closed")
 	ErrAlreadyStarted  = errors.New("already started")
+	ErrNoConsumer      = errors.New("durable consumer not set: set consumer in start control message")
+	ErrNoCheckpoints   = errors.New("durable consumers are not supported: no checkpoint store")
 )
 
 type WebsocketClient struct {
-	clientId string // clientId for this client
-	wsConn   *websocket.Conn
-	stream   Streamer
+	clientId    string // clientId for this client
+	wsConn      *websocket.Conn
+	stream      Streamer
+	checkpoints cdc.CheckpointStore // nil if durable consumers not supported
+	auth        Authorizer          // nil if all events are allowed
 	// --
 	*sync.Mutex   // guards function calls
 	stopped       bool
 	streamStarted bool              // true once client sends start control msg
 	wsMutex       *sync.Mutex       // guards wsConn.Write
 	pingChan      chan etre.Latency // for Ping
-
+	checkpoint    cdc.Checkpoint    // durable consumer position, if consumer set
 }
 
-func NewWebsocketClient(clientId string, wsConn *websocket.Conn, stream Streamer) *WebsocketClient {
+// NewWebsocketClient makes a new WebsocketClient. The checkpoint store is
+// optional; if nil, durable consumers (start control message with a consumer)
+// are not supported. The authorizer is optional; if nil, the client is sent
+// all events.
+func NewWebsocketClient(clientId string, wsConn *websocket.Conn, stream Streamer, checkpoints cdc.CheckpointStore, auth Authorizer) *WebsocketClient {
 	return &WebsocketClient{
-		clientId: clientId,
-		wsConn:   wsConn,
-		stream:   stream,
-		wsMutex:  &sync.Mutex{},
-		Mutex:    &sync.Mutex{},
-		pingChan: make(chan etre.Latency, 1),
+		clientId:    clientId,
+		wsConn:      wsConn,
+		stream:      stream,
+		checkpoints: checkpoints,
+		auth:        auth,
+		wsMutex:     &sync.Mutex{},
+		Mutex:       &sync.Mutex{},
+		pingChan:    make(chan etre.Latency, 1),
 	}
 }
 
@@ -184,7 +196,72 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 			startTs = time.Now().Unix()
 		}
 		etre.Debug("startTs %d", startTs)
-		go f.runStreamer(startTs)
+
+		// Optional filter, sent as etre.CDCFilter
+		filter := NoFilter
+		if v, ok := msg["filter"]; ok && v != nil {
+			bytes, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			var cdcFilter etre.CDCFilter
+			if err := json.Unmarshal(bytes, &cdcFilter); err != nil {
+				return fmt.Errorf("invalid filter: %s", err)
+			}
+			if filter, err = NewFilter(cdcFilter); err != nil {
+				return err
+			}
+			etre.Debug("filter %+v", cdcFilter)
+		}
+		filter = filter.WithAuth(f.auth)
+
+		// Optional cursor (see FormatCursor): start after this position, like
+		// resuming a durable consumer but stateless. Used to start the feed
+		// after a snapshot.
+		var resume cdc.Checkpoint
+		if v, ok := msg["after"]; ok && v != nil {
+			cursor, _ := v.(string)
+			cp, err := ParseCursor(cursor)
+			if err != nil {
+				return err
+			}
+			startTs = cp.StartTs()
+			resume = cp
+		}
+
+		// Optional durable consumer. If resuming, start from the consumer's
+		// last committed position and skip events it already acked.
+		if v, ok := msg["consumer"]; ok && v != nil {
+			consumer, _ := v.(string)
+			if consumer == "" {
+				return fmt.Errorf("invalid consumer: %v", v)
+			}
+			if f.checkpoints == nil {
+				return ErrNoCheckpoints
+			}
+			cp, err := f.checkpoints.ReadCheckpoint(consumer)
+			if err != nil {
+				return fmt.Errorf("cannot read checkpoint for consumer %s: %s", consumer, err)
+			}
+			f.checkpoint = cp
+			if r, _ := msg["resume"].(bool); r && cp.Ts > 0 {
+				startTs = cp.StartTs()
+				resume = cp
+			}
+			etre.Debug("consumer %s checkpoint %+v", consumer, cp)
+		} else if r, _ := msg["resume"].(bool); r {
+			return ErrNoConsumer
+		}
+
+		// Optional gap control messages (see etre.CDCGap). Old clients do not
+		// handle them, so they're sent only if the client asks for them.
+		var gapChan <-chan etre.CDCGap
+		if g, _ := msg["gaps"].(bool); g {
+			if gr, ok := f.stream.(GapReporter); ok {
+				gapChan = gr.Gaps()
+			}
+		}
+		go f.runStreamer(startTs, filter, resume, gapChan)
 
 		// Client expects us to ack their start
 		ack := map[string]string{
@@ -194,24 +271,74 @@ func (f *WebsocketClient) control(msg map[string]interface{}, now time.Time) err
 		if err := f.send(ack); err != nil {
 			return err
 		}
+	case "ack":
+		// Durable consumer commits its position: it has processed this event
+		if f.checkpoint.Consumer == "" {
+			return ErrNoConsumer
+		}
+		id, _ := msg["eventId"].(string)
+		ts, _ := msg["ts"].(float64) // Go JSON makes all numbers float64
+		if id == "" || ts <= 0 {
+			return fmt.Errorf("eventId or ts not set in ack control message: %#v", msg)
+		}
+		var seq uint64
+		if v, ok := msg["seq"].(string); ok { // string: too big for JSON number
+			var err error
+			if seq, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("invalid seq in ack control message: %#v", msg)
+			}
+		}
+		cp := f.checkpoint.Ack(etre.CDCEvent{Id: id, Ts: int64(ts), Seq: seq})
+		if err := f.checkpoints.WriteCheckpoint(cp); err != nil {
+			return fmt.Errorf("cannot write checkpoint for consumer %s: %s", cp.Consumer, err)
+		}
+		f.checkpoint = cp
 	default:
 		return fmt.Errorf("client sent unknown control message: %s: %#v", msg["control"], msg)
 	}
 	return nil
 }
 
-func (f *WebsocketClient) runStreamer(startTs int64) {
+func (f *WebsocketClient) runStreamer(startTs int64, filter Filter, resume cdc.Checkpoint, gapChan <-chan etre.CDCGap) {
 	etre.Debug("runStreamer call")
 	defer etre.Debug("runStreamer return")
 
 	// Don't need to call "defer f.stream.Stop()" because a closed stream chan
 	// means Streamer has already stopped. Closing the chan is the last thing it
-	// does on shutdown.
+	// does on shutdown. gapChan is nil (blocks forever) if gaps not requested.
 	var sendErr error
-	eventsChan := f.stream.Start(startTs)
-	for event := range eventsChan {
-		if sendErr = f.send(event); sendErr != nil {
-			break
+	eventsChan, filter := start(f.stream, startTs, filter)
+STREAM:
+	for {
+		select {
+		case event, ok := <-eventsChan:
+			if !ok {
+				break STREAM
+			}
+			if resume.Ts > 0 && resume.Acked(event) {
+				continue // consumer already processed this event
+			}
+			if event, ok = filter.Apply(event); !ok {
+				continue
+			}
+			if sendErr = f.send(event); sendErr != nil {
+				break STREAM
+			}
+		case g := <-gapChan:
+			if !filter.ApplyGap(g) {
+				continue
+			}
+			control := "gap"
+			if g.Resync {
+				control = "resync"
+			}
+			msg := map[string]interface{}{
+				"control": control,
+				"gap":     g,
+			}
+			if sendErr = f.send(msg); sendErr != nil {
+				break STREAM
+			}
 		}
 	}
 
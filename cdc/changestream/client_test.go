@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/square/etre"
+	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
 	"github.com/square/etre/test/mock"
 )
@@ -40,6 +42,7 @@ type server struct {
 	clientRunning chan struct{}
 	doneChan      chan struct{}
 	err           error
+	checkpoints   cdc.CheckpointStore // set before connecting to test durable consumers
 }
 
 var clientNo int
@@ -61,7 +64,7 @@ func setupClient(t *testing.T, streamer changestream.Streamer) *server {
 		clientNo++
 		clientId := fmt.Sprintf("client%d", clientNo)
 		server.Lock()
-		server.Client = changestream.NewWebsocketClient(clientId, wsConn, streamer)
+		server.Client = changestream.NewWebsocketClient(clientId, wsConn, streamer, server.checkpoints, nil)
 		server.Unlock()
 		runChan := make(chan struct{})
 		go func() {
@@ -195,7 +198,7 @@ func TestClientStreamer(t *testing.T) {
 	// which makes the server-side Client start its Streamer
 	eventsChan := make(chan etre.CDCEvent, 1)
 	streamer := mock.Stream{
-		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
 			return eventsChan
 		},
 	}
@@ -280,11 +283,217 @@ func TestClientStreamer(t *testing.T) {
 	}
 }
 
+func TestClientGaps(t *testing.T) {
+	// Test that gaps from the Streamer are sent as control messages only if the
+	// client asks for them in the start control message
+	eventsChan := make(chan etre.CDCEvent, 1)
+	gapChan := make(chan etre.CDCGap, 1)
+	gapsCalled := make(chan struct{}, 1)
+	streamer := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			return eventsChan
+		},
+		GapsFunc: func() <-chan etre.CDCGap {
+			gapsCalled <- struct{}{}
+			return gapChan
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	start := map[string]interface{}{
+		"control": "start",
+		"startTs": 1,
+		"gaps":    true,
+	}
+	if err := clientConn.WriteJSON(start); err != nil {
+		t.Fatal(err)
+	}
+	var ack map[string]interface{}
+	if err := clientConn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack["control"] != "start" || ack["error"] != "" {
+		t.Fatalf("got ack %v, expected start without error", ack)
+	}
+	select {
+	case <-gapsCalled:
+	default:
+		t.Fatal("Streamer.Gaps not called")
+	}
+
+	// A lost gap is "gap"; if the stream could not read the missing revisions,
+	// it's "resync"
+	gaps := []etre.CDCGap{
+		{EntityId: "e1", EntityType: "node", Revs: []int64{2, 3}},
+		{EntityId: "e2", EntityType: "node", Revs: []int64{5}, Resync: true, Error: "db error"},
+	}
+	for i, expectControl := range []string{"gap", "resync"} {
+		gapChan <- gaps[i]
+		var msg struct {
+			Control string
+			Gap     etre.CDCGap
+		}
+		if err := clientConn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Control != expectControl {
+			t.Errorf("got control %s, expected %s", msg.Control, expectControl)
+		}
+		if diff := deep.Equal(msg.Gap, gaps[i]); diff != nil {
+			t.Error(diff)
+		}
+	}
+}
+
+func TestClientDurableConsumer(t *testing.T) {
+	// Test that a durable consumer resumes from its checkpoint, doesn't receive
+	// events it already acked, and that acks commit its new position
+	eventsChan := make(chan etre.CDCEvent, 4)
+	var gotSinceTs int64
+	streamer := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			gotSinceTs = sinceTs
+			return eventsChan
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	written := make(chan cdc.Checkpoint, 2)
+	server.checkpoints = mock.CDCCheckpointStore{
+		ReadCheckpointFunc: func(consumer string) (cdc.Checkpoint, error) {
+			return cdc.Checkpoint{Consumer: consumer, Ts: 3, EventIds: []string{"def"}}, nil
+		},
+		WriteCheckpointFunc: func(cp cdc.Checkpoint) error {
+			cp.Updated = 0
+			written <- cp
+			return nil
+		},
+	}
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	start := map[string]interface{}{
+		"control":  "start",
+		"startTs":  1,
+		"consumer": "c1",
+		"resume":   true,
+	}
+	if err := clientConn.WriteJSON(start); err != nil {
+		t.Fatal(err)
+	}
+	var ack map[string]interface{}
+	if err := clientConn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack["error"] != "" {
+		t.Fatalf("got error in start ack: %s", ack["error"])
+	}
+
+	// Events at or before the checkpoint are not sent again
+	events := []etre.CDCEvent{
+		etre.CDCEvent{Id: "abc", Ts: 2}, // before checkpoint
+		etre.CDCEvent{Id: "def", Ts: 3}, // acked
+		etre.CDCEvent{Id: "xyz", Ts: 3}, // same ts but not acked
+		etre.CDCEvent{Id: "ghi", Ts: 4, Seq: 7340032000001},
+	}
+	for _, event := range events {
+		eventsChan <- event
+	}
+	var gotEvents []etre.CDCEvent
+	for i := 0; i < 2; i++ {
+		var recvdEvent etre.CDCEvent
+		if err := clientConn.ReadJSON(&recvdEvent); err != nil {
+			t.Fatal(err)
+		}
+		gotEvents = append(gotEvents, recvdEvent)
+	}
+	if diff := deep.Equal(gotEvents, events[2:]); diff != nil {
+		t.Error(diff)
+	}
+	if gotSinceTs != 3 {
+		t.Errorf("Streamer started at %d, expected checkpoint ts 3", gotSinceTs)
+	}
+
+	// Ack commits the position
+	expect := []cdc.Checkpoint{
+		{Consumer: "c1", Ts: 3, EventIds: []string{"def", "xyz"}},
+		{Consumer: "c1", Ts: 4, EventIds: []string{"ghi"}, Seq: 7340032000001, Window: []cdc.AckedEvent{{Id: "ghi", Seq: 7340032000001}}},
+	}
+	for i, e := range gotEvents {
+		ack := map[string]interface{}{
+			"control": "ack",
+			"eventId": e.Id,
+			"ts":      e.Ts,
+		}
+		if e.Seq > 0 {
+			ack["seq"] = strconv.FormatUint(e.Seq, 10)
+		}
+		if err := clientConn.WriteJSON(ack); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cp := <-written:
+			if diff := deep.Equal(cp, expect[i]); diff != nil {
+				t.Error(diff)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for checkpoint write")
+		}
+	}
+}
+
+func TestClientAckWithoutConsumer(t *testing.T) {
+	// Test that ack is an error if the client did not start as a durable consumer
+	eventsChan := make(chan etre.CDCEvent, 1)
+	streamer := mock.Stream{
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+			return eventsChan
+		},
+	}
+	server := setupClient(t, streamer)
+	defer server.ts.Close()
+
+	clientConn, _, err := websocket.DefaultDialer.Dial(server.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	ack := map[string]interface{}{
+		"control": "ack",
+		"eventId": "abc",
+		"ts":      2,
+	}
+	if err := clientConn.WriteJSON(ack); err != nil {
+		t.Fatal(err)
+	}
+	var errControl map[string]interface{}
+	if err := clientConn.ReadJSON(&errControl); err != nil {
+		t.Fatal(err)
+	}
+	if errControl["control"] != "error" || errControl["error"] != changestream.ErrNoConsumer.Error() {
+		t.Errorf("got %v, expected error control message with ErrNoConsumer", errControl)
+	}
+	<-server.doneChan
+}
+
 func TestClientInvalidMessageType(t *testing.T) {
 	// Test that client returns an error control message if given an invalid message
 	eventsChan := make(chan etre.CDCEvent, 1)
 	streamer := mock.Stream{
-		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
 			return eventsChan
 		},
 	}
@@ -319,7 +528,7 @@ func TestClientInvalidMessageContent(t *testing.T) {
 	// struct that doesn't have "control"
 	eventsChan := make(chan etre.CDCEvent, 1)
 	streamer := mock.Stream{
-		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
 			return eventsChan
 		},
 	}
@@ -355,7 +564,7 @@ func TestClientClose(t *testing.T) {
 	// Test that Client stops nicely if the websocket client goes away unexpectedly.
 	eventsChan := make(chan etre.CDCEvent, 1)
 	streamer := mock.Stream{
-		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+		StartWithFilterFunc: func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
 			return eventsChan
 		},
 	}
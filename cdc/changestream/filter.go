@@ -0,0 +1,178 @@
+// Copyright 2020, Square, Inc.
+
+package changestream
+
+import (
+	"fmt"
+
+	"github.com/square/etre"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+)
+
+// Filter is a compiled etre.CDCFilter. ServerStream applies it to events after
+// ordering them, so filtered events do not cause revision gaps. The zero value
+// matches all events.
+type Filter struct {
+	entityTypes map[string]bool
+	ops         map[string]bool
+	query       query.Query
+	labels      map[string]bool
+	auth        Authorizer
+}
+
+// Authorizer authorizes a client to read events. The API implements it with the
+// ACLs of the caller. Filter applies it before matching, so a filter cannot
+// match labels that the client cannot read.
+type Authorizer interface {
+	// Event returns the event with the labels that the client cannot read
+	// removed from Old, New, and Full, or false if the client cannot read it.
+	Event(etre.CDCEvent) (etre.CDCEvent, bool)
+
+	// EntityType returns true if the client can read entities of the type.
+	EntityType(string) bool
+}
+
+// NoFilter matches all events.
+var NoFilter Filter
+
+// NewFilter validates and compiles the filter sent by a client.
+func NewFilter(f etre.CDCFilter) (Filter, error) {
+	filter := Filter{}
+	if len(f.EntityTypes) > 0 {
+		filter.entityTypes = map[string]bool{}
+		for _, t := range f.EntityTypes {
+			filter.entityTypes[t] = true
+		}
+	}
+	if len(f.Ops) > 0 {
+		filter.ops = map[string]bool{}
+		for _, op := range f.Ops {
+			if op != "i" && op != "u" && op != "d" && op != "p" {
+				return Filter{}, fmt.Errorf("invalid filter op: %s: valid ops: i, u, d, p", op)
+			}
+			filter.ops[op] = true
+		}
+	}
+	if f.Query != "" {
+		q, err := query.Translate(f.Query)
+		if err != nil {
+			return Filter{}, fmt.Errorf("invalid filter query: %s", err)
+		}
+		filter.query = q
+	}
+	if len(f.Labels) > 0 {
+		filter.labels = map[string]bool{}
+		for _, label := range f.Labels {
+			filter.labels[label] = true
+		}
+	}
+	return filter, nil
+}
+
+// WithAuth returns a copy of the filter that authorizes events with a, if not nil.
+func (f Filter) WithAuth(a Authorizer) Filter {
+	f.auth = a
+	return f
+}
+
+// Apply returns the event and true if it matches the filter. If the filter has
+// labels, the returned event has copies of New, Old, and Full with only those
+// labels and metalabels. The query matches the entity before or after the
+// write. Update events have only the changed labels in New and Old, so unless
+// the event has the whole entity (Full), the query matches only if it uses the
+// changed labels.
+func (f Filter) Apply(e etre.CDCEvent) (etre.CDCEvent, bool) {
+	if f.entityTypes != nil && !f.entityTypes[e.EntityType] {
+		return e, false
+	}
+	if f.auth != nil {
+		var ok bool
+		if e, ok = f.auth.Event(e); !ok {
+			return e, false
+		}
+	}
+	if f.ops != nil && !f.ops[e.Op] {
+		return e, false
+	}
+	if len(f.query.Predicates) > 0 && !f.matchesEvent(e) {
+		return e, false
+	}
+	if f.labels == nil {
+		return e, true
+	}
+	if !f.hasLabel(e.New) && !f.hasLabel(e.Old) {
+		return e, false
+	}
+	e.New = f.project(e.New)
+	e.Old = f.project(e.Old)
+	e.Full = f.project(e.Full)
+	return e, true
+}
+
+// ApplyGap returns true if the gap is for an entity type that matches the
+// filter and that the client can read.
+func (f Filter) ApplyGap(g etre.CDCGap) bool {
+	if f.entityTypes != nil && !f.entityTypes[g.EntityType] {
+		return false
+	}
+	return f.auth == nil || f.auth.EntityType(g.EntityType)
+}
+
+func (f Filter) matchesEvent(e etre.CDCEvent) bool {
+	if e.Op == "u" && e.Full != nil {
+		before := BeforeUpdate(e, *e.Full)
+		return entity.Matches(f.query, *e.Full) || entity.Matches(f.query, before)
+	}
+	return f.matches(e.New) || f.matches(e.Old)
+}
+
+func (f Filter) matches(e *etre.Entity) bool {
+	return e != nil && entity.Matches(f.query, *e)
+}
+
+// BeforeUpdate returns the entity before the update event, given the whole entity
+// after it (Full, or read from the store): labels set by the update are removed,
+// then old values in Old are restored.
+func BeforeUpdate(e etre.CDCEvent, after etre.Entity) etre.Entity {
+	before := etre.Entity{}
+	for label, v := range after {
+		if e.New != nil && e.New.Has(label) {
+			continue
+		}
+		before[label] = v
+	}
+	if e.Old != nil {
+		for label, v := range *e.Old {
+			before[label] = v
+		}
+	}
+	return before
+}
+
+func (f Filter) hasLabel(e *etre.Entity) bool {
+	if e == nil {
+		return false
+	}
+	for label := range *e {
+		if f.labels[label] {
+			return true
+		}
+	}
+	return false
+}
+
+// project returns a copy of the entity with only filter labels and metalabels.
+// It copies because the same event is sent to every stream.
+func (f Filter) project(e *etre.Entity) *etre.Entity {
+	if e == nil {
+		return nil
+	}
+	p := etre.Entity{}
+	for label, v := range *e {
+		if f.labels[label] || etre.IsMetalabel(label) {
+			p[label] = v
+		}
+	}
+	return &p
+}
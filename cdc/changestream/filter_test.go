@@ -0,0 +1,176 @@
+// Copyright 2020, Square, Inc.
+
+package changestream_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc/changestream"
+)
+
+func TestFilter(t *testing.T) {
+	insert := etre.CDCEvent{
+		Id:         "1",
+		EntityId:   "e1",
+		EntityType: "node",
+		Op:         "i",
+		New:        &etre.Entity{"_id": "e1", "_type": "node", "_rev": int64(0), "hostname": "host1", "env": "prod"},
+	}
+	update := etre.CDCEvent{
+		Id:         "2",
+		EntityId:   "e1",
+		EntityType: "node",
+		EntityRev:  1,
+		Op:         "u",
+		Old:        &etre.Entity{"env": "prod"},
+		New:        &etre.Entity{"env": "staging"},
+	}
+	rack := etre.CDCEvent{
+		Id:         "3",
+		EntityId:   "r1",
+		EntityType: "rack",
+		Op:         "d",
+		Old:        &etre.Entity{"_id": "r1", "_type": "rack", "_rev": int64(3), "zone": "west"},
+	}
+	full := etre.CDCEvent{
+		Id:         "4",
+		EntityId:   "e2",
+		EntityType: "node",
+		EntityRev:  1,
+		Op:         "u",
+		Old:        &etre.Entity{"env": "prod"},
+		New:        &etre.Entity{"env": "staging"},
+		Full:       &etre.Entity{"_id": "e2", "_type": "node", "_rev": int64(1), "hostname": "host2", "env": "staging"},
+	}
+	all := []etre.CDCEvent{insert, update, rack, full}
+
+	tests := []struct {
+		filter etre.CDCFilter
+		expect []string // event ids
+	}{
+		{etre.CDCFilter{}, []string{"1", "2", "3", "4"}},
+		{etre.CDCFilter{EntityTypes: []string{"node"}}, []string{"1", "2", "4"}},
+		{etre.CDCFilter{Ops: []string{"i", "d"}}, []string{"1", "3"}},
+		{etre.CDCFilter{Ops: []string{"p"}}, []string{}},
+		{etre.CDCFilter{Query: "env=prod"}, []string{"1", "2", "4"}},         // update matches Old
+		{etre.CDCFilter{Query: "env=staging"}, []string{"2", "4"}},           // update matches New
+		{etre.CDCFilter{Query: "hostname"}, []string{"1", "4"}},              // update without Full does not change hostname
+		{etre.CDCFilter{Query: "hostname=host2,env=prod"}, []string{"4"}},    // before update with Full
+		{etre.CDCFilter{Query: "hostname=host2,env=staging"}, []string{"4"}}, // after update with Full
+		{etre.CDCFilter{Labels: []string{"zone"}}, []string{"3"}},            // only rack has zone
+		{etre.CDCFilter{EntityTypes: []string{"node"}, Ops: []string{"u"}, Query: "env in (staging)"}, []string{"2", "4"}},
+	}
+	for _, test := range tests {
+		f, err := changestream.NewFilter(test.filter)
+		if err != nil {
+			t.Fatalf("%+v: %s", test.filter, err)
+		}
+		got := []string{}
+		for _, e := range all {
+			if _, ok := f.Apply(e); ok {
+				got = append(got, e.Id)
+			}
+		}
+		if diff := deep.Equal(got, test.expect); diff != nil {
+			t.Errorf("%+v: %v", test.filter, diff)
+		}
+	}
+
+	// Labels filter returns only those labels and metalabels, without modifying
+	// the original event because it's shared by all streams
+	f, _ := changestream.NewFilter(etre.CDCFilter{Labels: []string{"hostname"}})
+	got, ok := f.Apply(insert)
+	if !ok {
+		t.Fatal("insert event filtered, expected it to match")
+	}
+	expect := etre.Entity{"_id": "e1", "_type": "node", "_rev": int64(0), "hostname": "host1"}
+	if diff := deep.Equal(*got.New, expect); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := (*insert.New)["env"]; !ok {
+		t.Errorf("original event modified: %+v", insert.New)
+	}
+
+	// Including Full, the whole entity after the write
+	withFull := etre.CDCEvent{
+		EntityType: "node",
+		Op:         "u",
+		Old:        &etre.Entity{"hostname": "host1"},
+		New:        &etre.Entity{"hostname": "host2"},
+		Full:       &etre.Entity{"_id": "e1", "_type": "node", "_rev": int64(1), "hostname": "host2", "env": "prod"},
+	}
+	got, ok = f.Apply(withFull)
+	if !ok {
+		t.Fatal("update event filtered, expected it to match")
+	}
+	expect = etre.Entity{"_id": "e1", "_type": "node", "_rev": int64(1), "hostname": "host2"}
+	if diff := deep.Equal(*got.Full, expect); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := (*withFull.Full)["env"]; !ok {
+		t.Errorf("original event modified: %+v", withFull.Full)
+	}
+
+	// Invalid filters
+	for _, filter := range []etre.CDCFilter{{Ops: []string{"x"}}, {Query: "label%name=val"}} {
+		if _, err := changestream.NewFilter(filter); err == nil {
+			t.Errorf("no error for invalid filter %+v", filter)
+		}
+	}
+}
+
+// denyAuth is a changestream.Authorizer that denies entity type "rack" and
+// label "secret".
+type denyAuth struct{}
+
+func (denyAuth) EntityType(entityType string) bool {
+	return entityType != "rack"
+}
+
+func (a denyAuth) Event(e etre.CDCEvent) (etre.CDCEvent, bool) {
+	if !a.EntityType(e.EntityType) {
+		return e, false
+	}
+	if e.New != nil {
+		new := etre.Entity{}
+		for k, v := range *e.New {
+			if k != "secret" {
+				new[k] = v
+			}
+		}
+		e.New = &new
+	}
+	return e, true
+}
+
+func TestFilterAuth(t *testing.T) {
+	// Test that the authorizer is applied before matching, so a filter cannot
+	// match a label the client cannot read, and gaps of denied types are filtered
+	f, _ := changestream.NewFilter(etre.CDCFilter{Query: "secret=x"})
+	f = f.WithAuth(denyAuth{})
+	node := etre.CDCEvent{EntityType: "node", Op: "i", New: &etre.Entity{"env": "prod", "secret": "x"}}
+	if _, ok := f.Apply(node); ok {
+		t.Error("filter matched denied label")
+	}
+
+	f = changestream.NoFilter.WithAuth(denyAuth{})
+	got, ok := f.Apply(node)
+	if !ok {
+		t.Fatal("node event filtered, expected it to match")
+	}
+	if diff := deep.Equal(*got.New, etre.Entity{"env": "prod"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := f.Apply(etre.CDCEvent{EntityType: "rack", Op: "i"}); ok {
+		t.Error("rack event matched, expected denied entity type to be filtered")
+	}
+	if !f.ApplyGap(etre.CDCGap{EntityType: "node"}) {
+		t.Error("node gap filtered, expected it to match")
+	}
+	if f.ApplyGap(etre.CDCGap{EntityType: "rack"}) {
+		t.Error("rack gap matched, expected denied entity type to be filtered")
+	}
+}
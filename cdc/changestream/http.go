@@ -0,0 +1,252 @@
+// Copyright 2020, Square, Inc.
+
+package changestream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+)
+
+var (
+	// SSEKeepalive is how often SSEClient sends a comment line when there are
+	// no events, so proxies do not close an idle connection.
+	SSEKeepalive = 30 * time.Second
+
+	// PollBatchWait is how long Poll waits for more events after receiving one
+	// before returning the events it has.
+	PollBatchWait = 100 * time.Millisecond
+)
+
+// FormatCursor returns the cursor for a position in the change feed: the event
+// ts, the IDs of events at that ts already received, the seq of the last event
+// (see etre.CDCEvent.Seq), and the received events in the seq window (see
+// cdc.Checkpoint) as id.seq, like "1600000000000:id1,id2:123:id1.122,id2.123".
+// HTTP clients (SSE and long-poll) pass the cursor back to resume after that
+// position. It's a stateless cdc.Checkpoint.
+func FormatCursor(cp cdc.Checkpoint) string {
+	if len(cp.Window) > 0 {
+		window := make([]string, len(cp.Window))
+		for i, a := range cp.Window {
+			window[i] = a.Id + "." + strconv.FormatUint(a.Seq, 10)
+		}
+		return fmt.Sprintf("%d:%s:%d:%s", cp.Ts, strings.Join(cp.EventIds, ","), cp.Seq, strings.Join(window, ","))
+	}
+	if cp.Seq > 0 {
+		return fmt.Sprintf("%d:%s:%d", cp.Ts, strings.Join(cp.EventIds, ","), cp.Seq)
+	}
+	return fmt.Sprintf("%d:%s", cp.Ts, strings.Join(cp.EventIds, ","))
+}
+
+// ParseCursor parses a cursor returned by FormatCursor. A cursor can also be
+// only a ts (Unix milliseconds) to start from that time.
+func ParseCursor(cursor string) (cdc.Checkpoint, error) {
+	var cp cdc.Checkpoint
+	p := strings.SplitN(cursor, ":", 4)
+	ts, err := strconv.ParseInt(p[0], 10, 64)
+	if err != nil || ts < 0 {
+		return cp, fmt.Errorf("invalid cursor: %s: must be ts[:eventIds[:seq[:window]]]", cursor)
+	}
+	cp.Ts = ts
+	if len(p) > 1 && p[1] != "" {
+		cp.EventIds = strings.Split(p[1], ",")
+	}
+	if len(p) > 2 {
+		if cp.Seq, err = strconv.ParseUint(p[2], 10, 64); err != nil {
+			return cp, fmt.Errorf("invalid cursor: %s: invalid seq: %s", cursor, err)
+		}
+	}
+	if len(p) > 3 && p[3] != "" {
+		for _, a := range strings.Split(p[3], ",") {
+			n := strings.LastIndex(a, ".")
+			if n < 1 {
+				return cp, fmt.Errorf("invalid cursor: %s: invalid window event: %s", cursor, a)
+			}
+			seq, err := strconv.ParseUint(a[n+1:], 10, 64)
+			if err != nil {
+				return cp, fmt.Errorf("invalid cursor: %s: invalid window event: %s: %s", cursor, a, err)
+			}
+			cp.Window = append(cp.Window, cdc.AckedEvent{Id: a[:n], Seq: seq})
+		}
+	}
+	return cp, nil
+}
+
+// Poll starts the stream after the cursor position and returns up to limit
+// events, any revision gaps (see GapReporter) received while polling, and the
+// cursor after the last event read. It returns as soon as it has events or gaps
+// and no more arrive within PollBatchWait, or after waiting at most wait for
+// the first one. If no events, Events is an empty slice. It returns early if
+// doneChan is closed (the HTTP client went away). The caller must not reuse the
+// stream.
+//
+// The filter is applied here, not by the stream (see FilteredStreamer), so the
+// cursor moves past every event read, even those that don't match. Else, a
+// selective filter would read the same events on every poll.
+func Poll(stream Streamer, since cdc.Checkpoint, filter Filter, limit int, wait time.Duration, doneChan <-chan struct{}) (etre.CDCPollResult, error) {
+	gapChan := gaps(stream)
+	eventsChan := stream.Start(since.StartTs())
+	defer stream.Stop()
+
+	res := etre.CDCPollResult{Events: []etre.CDCEvent{}}
+	next := since
+	done := func() (etre.CDCPollResult, error) {
+		res.Next = FormatCursor(next)
+		return res, nil
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	var batch <-chan time.Time // nil until first event
+	for len(res.Events) < limit {
+		select {
+		case e, ok := <-eventsChan:
+			if !ok {
+				if len(res.Events) > 0 || len(res.Gaps) > 0 {
+					return done()
+				}
+				return etre.CDCPollResult{}, fmt.Errorf("stream closed: %v", stream.Error())
+			}
+			if since.Ts > 0 && since.Acked(e) {
+				continue // client already received this event
+			}
+			next = next.Ack(e)
+			if e, ok = filter.Apply(e); !ok {
+				continue
+			}
+			res.Events = append(res.Events, e)
+			batch = time.After(PollBatchWait)
+		case g := <-gapChan:
+			if !filter.ApplyGap(g) {
+				continue
+			}
+			res.Gaps = append(res.Gaps, g)
+			batch = time.After(PollBatchWait)
+		case <-batch:
+			return done()
+		case <-timeout.C:
+			return done()
+		case <-doneChan:
+			return done()
+		}
+	}
+	return done()
+}
+
+// gaps returns the gap channel of the stream if it's a GapReporter, else nil
+// which blocks forever. Call it before starting the stream.
+func gaps(stream Streamer) <-chan etre.CDCGap {
+	if gr, ok := stream.(GapReporter); ok {
+		return gr.Gaps()
+	}
+	return nil
+}
+
+// SSEClient sends events from a Streamer to an HTTP client as Server-Sent Events
+// (text/event-stream). It's an alternative to WebsocketClient for clients that
+// cannot use websockets. Each event is an SSE "message" with the event JSON as
+// data and its cursor as id, so a client that reconnects with the standard
+// Last-Event-ID header resumes after the last event it received. Revision gaps
+// (see etre.CDCGap) are SSE "gap" events with the gap JSON as data. Unlike
+// WebsocketClient, there are no control messages: the client is read-only.
+type SSEClient struct {
+	clientId string
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	stream   Streamer
+}
+
+// NewSSEClient makes a new SSEClient. The response writer must implement
+// http.Flusher.
+func NewSSEClient(clientId string, w http.ResponseWriter, stream Streamer) (*SSEClient, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer does not support flushing")
+	}
+	c := &SSEClient{
+		clientId: clientId,
+		w:        w,
+		flusher:  flusher,
+		stream:   stream,
+	}
+	return c, nil
+}
+
+// Run sends the SSE response headers and events after the cursor position until
+// doneChan is closed (the HTTP client went away), the stream stops, or a write
+// fails. If the stream stops, an "error" event is sent before returning.
+func (c *SSEClient) Run(since cdc.Checkpoint, filter Filter, doneChan <-chan struct{}) error {
+	etre.Debug("SSE %s: Run call", c.clientId)
+	defer etre.Debug("SSE %s: Run return", c.clientId)
+
+	h := c.w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // disable nginx buffering
+	c.w.WriteHeader(http.StatusOK)
+	c.flusher.Flush()
+
+	gapChan := gaps(c.stream)
+	eventsChan, filter := start(c.stream, since.StartTs(), filter)
+	defer c.stream.Stop()
+
+	cp := since
+	keepalive := time.NewTicker(SSEKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-eventsChan:
+			if !ok {
+				err := fmt.Errorf("Streamer closed channel (error: %v)", c.stream.Error())
+				bytes, _ := json.Marshal(map[string]string{"error": err.Error()})
+				c.write("event: error\ndata: %s\n\n", bytes)
+				return err
+			}
+			if since.Ts > 0 && since.Acked(e) {
+				continue // client already received this event
+			}
+			if e, ok = filter.Apply(e); !ok {
+				continue
+			}
+			bytes, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			cp = cp.Ack(e)
+			if err := c.write("id: %s\ndata: %s\n\n", FormatCursor(cp), bytes); err != nil {
+				return err
+			}
+		case g := <-gapChan:
+			if !filter.ApplyGap(g) {
+				continue
+			}
+			bytes, err := json.Marshal(g)
+			if err != nil {
+				return err
+			}
+			if err := c.write("event: gap\ndata: %s\n\n", bytes); err != nil {
+				return err
+			}
+		case <-keepalive.C:
+			if err := c.write(": keepalive\n\n"); err != nil {
+				return err
+			}
+		case <-doneChan:
+			return nil
+		}
+	}
+}
+
+func (c *SSEClient) write(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.w, format, args...); err != nil {
+		return fmt.Errorf("SSE write error: %s", err)
+	}
+	c.flusher.Flush()
+	return nil
+}
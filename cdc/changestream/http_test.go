@@ -0,0 +1,179 @@
+// Copyright 2020, Square, Inc.
+
+package changestream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/test/mock"
+)
+
+func TestCursor(t *testing.T) {
+	cp := cdc.Checkpoint{Ts: 35, EventIds: []string{"vb0", "bnu"}}
+	cursor := changestream.FormatCursor(cp)
+	if cursor != "35:vb0,bnu" {
+		t.Errorf("cursor = %s, expected 35:vb0,bnu", cursor)
+	}
+	got, err := changestream.ParseCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, cp); diff != nil {
+		t.Error(diff)
+	}
+
+	// Only ts is valid: start from that time
+	got, err = changestream.ParseCursor("1600000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, cdc.Checkpoint{Ts: 1600000000000}); diff != nil {
+		t.Error(diff)
+	}
+
+	// With seq
+	cp = cdc.Checkpoint{Ts: 35, EventIds: []string{"vb0"}, Seq: 7340032000001}
+	cursor = changestream.FormatCursor(cp)
+	if cursor != "35:vb0:7340032000001" {
+		t.Errorf("cursor = %s, expected 35:vb0:7340032000001", cursor)
+	}
+	got, err = changestream.ParseCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, cp); diff != nil {
+		t.Error(diff)
+	}
+
+	// With seq window
+	cp = cdc.Checkpoint{
+		Ts:       35,
+		EventIds: []string{"vb0"},
+		Seq:      7340032000001,
+		Window:   []cdc.AckedEvent{{Id: "bnu", Seq: 7340032000000}, {Id: "vb0", Seq: 7340032000001}},
+	}
+	cursor = changestream.FormatCursor(cp)
+	if cursor != "35:vb0:7340032000001:bnu.7340032000000,vb0.7340032000001" {
+		t.Errorf("cursor = %s, expected 35:vb0:7340032000001:bnu.7340032000000,vb0.7340032000001", cursor)
+	}
+	got, err = changestream.ParseCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, cp); diff != nil {
+		t.Error(diff)
+	}
+
+	for _, invalid := range []string{"", "abc", "-1:x", ":vb0", "35:vb0:x", "35:vb0:1:bnu", "35:vb0:1:bnu.x"} {
+		if _, err := changestream.ParseCursor(invalid); err == nil {
+			t.Errorf("no error for invalid cursor '%s'", invalid)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	events := make(chan etre.CDCEvent, len(mock.CDCEvents))
+	for _, e := range mock.CDCEvents {
+		events <- e
+	}
+	var gotSinceTs int64
+	stopped := false
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			gotSinceTs = sinceTs
+			return events
+		},
+		StopFunc: func() {
+			stopped = true
+		},
+	}
+
+	// Client already received events up to "vno" (ts 13), so "nru" and "vno"
+	// are skipped. Limit 3 returns the next 3 events.
+	since := cdc.Checkpoint{Ts: 13, EventIds: []string{"vno"}}
+	got, err := changestream.Poll(stream, since, changestream.NoFilter, 3, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSinceTs != 13 {
+		t.Errorf("sinceTs = %d, expected 13", gotSinceTs)
+	}
+	if diff := deep.Equal(got.Events, mock.CDCEvents[2:5]); diff != nil {
+		t.Error(diff)
+	}
+	next := since
+	for _, e := range mock.CDCEvents[2:5] {
+		next = next.Ack(e)
+	}
+	if got.Next != changestream.FormatCursor(next) {
+		t.Errorf("next = %s, expected %s", got.Next, changestream.FormatCursor(next))
+	}
+	if !stopped {
+		t.Error("stream not stopped")
+	}
+
+	// No events: returns empty list and the same cursor after waiting
+	empty := make(chan etre.CDCEvent)
+	stream.StartFunc = func(sinceTs int64) <-chan etre.CDCEvent {
+		return empty
+	}
+	t0 := time.Now()
+	got, err = changestream.Poll(stream, since, changestream.NoFilter, 3, 200*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) != 0 {
+		t.Errorf("got %d events, expected 0", len(got.Events))
+	}
+	if got.Next != changestream.FormatCursor(since) {
+		t.Errorf("next = %s, expected %s", got.Next, changestream.FormatCursor(since))
+	}
+	if d := time.Now().Sub(t0); d < 200*time.Millisecond {
+		t.Errorf("returned after %s, expected to wait 200ms", d)
+	}
+
+	// Gaps are returned with the events
+	gapChan := make(chan etre.CDCGap, 1)
+	gapChan <- etre.CDCGap{EntityId: "e1", EntityType: "node", Revs: []int64{2}}
+	stream.GapsFunc = func() <-chan etre.CDCGap {
+		return gapChan
+	}
+	got, err = changestream.Poll(stream, since, changestream.NoFilter, 3, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) != 0 {
+		t.Errorf("got %d events, expected 0", len(got.Events))
+	}
+	if diff := deep.Equal(got.Gaps, []etre.CDCGap{{EntityId: "e1", EntityType: "node", Revs: []int64{2}}}); diff != nil {
+		t.Error(diff)
+	}
+	stream.GapsFunc = nil
+
+	// Poll applies the filter, and the cursor moves past events that don't
+	// match so the next poll doesn't read them again
+	filtered := make(chan etre.CDCEvent, 3)
+	filtered <- etre.CDCEvent{Id: "a", Ts: 1, Op: "i"}
+	filtered <- etre.CDCEvent{Id: "b", Ts: 2, Op: "d"}
+	filtered <- etre.CDCEvent{Id: "c", Ts: 3, Op: "i"}
+	stream.StartFunc = func(sinceTs int64) <-chan etre.CDCEvent {
+		return filtered
+	}
+	filter, _ := changestream.NewFilter(etre.CDCFilter{Ops: []string{"d"}})
+	got, err = changestream.Poll(stream, cdc.Checkpoint{}, filter, 3, 200*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got.Events, []etre.CDCEvent{{Id: "b", Ts: 2, Op: "d"}}); diff != nil {
+		t.Error(diff)
+	}
+	if got.Next != "3:c" {
+		t.Errorf("next = %s, expected 3:c", got.Next)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/square/etre"
+	"github.com/square/etre/cdc"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -100,7 +101,7 @@ func (s *MongoDBServer) close(clientId string) {
 }
 
 type rawCDCEvent struct {
-	EtreCDCEvent etre.CDCEvent `bson:"fullDocument"`
+	EtreCDCEvent cdc.StoredEvent `bson:"fullDocument"`
 }
 
 func (s *MongoDBServer) Run() error {
@@ -145,11 +146,12 @@ func (s *MongoDBServer) Run() error {
 		if err := stream.Decode(&e); err != nil {
 			return err
 		}
-		etre.Debug("cdc event: %+v", e.EtreCDCEvent)
+		event := e.EtreCDCEvent.Event()
+		etre.Debug("cdc event: %+v", event)
 		s.Lock()
 		for clientId, c := range s.clients {
 			select {
-			case c.c <- e.EtreCDCEvent:
+			case c.c <- event:
 			default:
 				etre.Debug("client %s blocked, closing", clientId)
 				s.close(clientId)
@@ -0,0 +1,222 @@
+// Copyright 2020, Square, Inc.
+
+package changestream
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+)
+
+var (
+	ErrStreamClosed = errors.New("stream closed")
+	ErrLeaseHeld    = errors.New("sink lease held by another API node")
+)
+
+const (
+	// SINK_CHECKPOINT_INTERVAL is how often a SinkRunner commits the sink checkpoint.
+	SINK_CHECKPOINT_INTERVAL = 1 * time.Second
+
+	// SINK_RETRY_WAIT is how long a SinkRunner waits after an error before
+	// sending the event again or restarting the stream.
+	SINK_RETRY_WAIT = 5 * time.Second
+
+	// SINK_LEASE_TTL is how long the sink lease lasts. The SinkRunner renews it
+	// every SINK_CHECKPOINT_INTERVAL, even while retrying a send, so if the API
+	// node running the sink dies, another node runs it after this long.
+	SINK_LEASE_TTL = 30 * time.Second
+)
+
+// SinkRunner feeds a cdc.Sink from a Streamer, starting from the sink checkpoint.
+type SinkRunner struct {
+	sink        cdc.Sink
+	factory     StreamerFactory
+	checkpoints cdc.CheckpointStore
+	retryWait   time.Duration
+	owner       string // lease owner: this API node
+}
+
+// NewSinkRunner creates a SinkRunner that streams events to the sink. The sink
+// checkpoint is stored in the checkpoint store under consumer "sink:"+sink.Name().
+// If the checkpoint store is a cdc.Leaser, every API node runs a SinkRunner but
+// only the node with the sink lease streams events to the sink.
+func NewSinkRunner(sink cdc.Sink, factory StreamerFactory, checkpoints cdc.CheckpointStore) *SinkRunner {
+	hostname, _ := os.Hostname()
+	return &SinkRunner{
+		sink:        sink,
+		factory:     factory,
+		checkpoints: checkpoints,
+		retryWait:   SINK_RETRY_WAIT,
+		owner:       fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+}
+
+// Run streams events to the sink until stopChan is closed. On error, it waits
+// and restarts the stream from the last committed checkpoint. If another API
+// node has the sink lease, it waits and tries to lease the sink again.
+func (r *SinkRunner) Run(stopChan <-chan struct{}) {
+	for {
+		err := r.run(stopChan)
+		select {
+		case <-stopChan:
+			return
+		default:
+		}
+		if err == ErrLeaseHeld {
+			etre.Debug("sink %s: %s", r.sink.Name(), err)
+		} else {
+			log.Printf("ERROR: CDC sink %s: %s (restarting in %s)", r.sink.Name(), err, r.retryWait)
+		}
+		select {
+		case <-time.After(r.retryWait):
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func (r *SinkRunner) run(stopChan <-chan struct{}) error {
+	consumer := "sink:" + r.sink.Name()
+	leaser, _ := r.checkpoints.(cdc.Leaser)
+	if leaser != nil {
+		ok, err := leaser.Lease(consumer, r.owner, SINK_LEASE_TTL)
+		if err != nil {
+			return fmt.Errorf("cannot lease sink: %s", err)
+		}
+		if !ok {
+			return ErrLeaseHeld
+		}
+		log.Printf("CDC sink %s: leased by %s", r.sink.Name(), r.owner)
+		defer func() {
+			if err := leaser.Release(consumer, r.owner); err != nil {
+				log.Printf("ERROR: CDC sink %s: cannot release lease: %s", r.sink.Name(), err)
+			}
+		}()
+	}
+
+	resume, err := r.checkpoints.ReadCheckpoint(consumer)
+	if err != nil {
+		return err
+	}
+	cp := resume
+	dirty := false // cp has events not committed
+
+	// renew renews the sink lease. If another API node leased the sink, it
+	// owns the checkpoint now, so cp is dropped and ErrLeaseHeld returned.
+	renew := func() error {
+		if leaser == nil {
+			return nil
+		}
+		ok, err := leaser.Lease(consumer, r.owner, SINK_LEASE_TTL)
+		if err != nil {
+			return fmt.Errorf("cannot renew sink lease: %s", err)
+		}
+		if !ok {
+			log.Printf("CDC sink %s: lease lost", r.sink.Name())
+			dirty = false
+			return ErrLeaseHeld
+		}
+		return nil
+	}
+
+	// commit renews the lease, then writes the checkpoint if it has changed.
+	// Only lease errors are returned; checkpoint errors are logged and retried
+	// on the next commit.
+	commit := func() error {
+		if err := renew(); err != nil {
+			return err
+		}
+		if !dirty {
+			return nil
+		}
+		if err := r.checkpoints.WriteCheckpoint(cp); err != nil {
+			log.Printf("ERROR: CDC sink %s: cannot write checkpoint: %s", r.sink.Name(), err)
+			return nil
+		}
+		dirty = false
+		return nil
+	}
+	defer func() {
+		if dirty {
+			commit()
+		}
+	}()
+
+	// No checkpoint (Ts=0) starts from now, like a new websocket client
+	stream := r.factory.Make(consumer)
+	gapChan := gaps(stream)
+	events := stream.Start(resume.StartTs())
+	defer stream.Stop()
+	etre.Debug("sink %s started from %+v", r.sink.Name(), resume)
+
+	ticker := time.NewTicker(SINK_CHECKPOINT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if err := stream.Error(); err != nil {
+					return err
+				}
+				return ErrStreamClosed
+			}
+			if resume.Ts > 0 && resume.Acked(e) {
+				continue // sent before restart
+			}
+			for {
+				err := r.sink.Send(e)
+				if err == nil {
+					break
+				}
+				log.Printf("ERROR: CDC sink %s: event %s: %s (retrying in %s)", r.sink.Name(), e.Id, err, r.retryWait)
+				// Keep the lease while retrying, else another API node leases
+				// the sink and both send the same events
+				retry := time.After(r.retryWait)
+			WAIT:
+				for {
+					select {
+					case <-retry:
+						break WAIT
+					case <-ticker.C:
+						if err := commit(); err != nil {
+							return err
+						}
+					case <-stopChan:
+						return nil
+					}
+				}
+				if err := renew(); err != nil {
+					return err
+				}
+			}
+			cp = cp.Ack(e)
+			dirty = true
+		case g := <-gapChan:
+			r.sendGap(g)
+		case <-ticker.C:
+			if err := commit(); err != nil {
+				return err
+			}
+		case <-stopChan:
+			return nil
+		}
+	}
+}
+
+// sendGap sends the gap to the sink if it's a cdc.GapSink, else logs it.
+func (r *SinkRunner) sendGap(g etre.CDCGap) {
+	gs, ok := r.sink.(cdc.GapSink)
+	if !ok {
+		log.Printf("WARNING: CDC sink %s: entity %s revisions %v lost (resync: %t, compacted: %t, error: %s)",
+			r.sink.Name(), g.EntityId, g.Revs, g.Resync, g.Compacted, g.Error)
+		return
+	}
+	if err := gs.SendGap(g); err != nil {
+		log.Printf("ERROR: CDC sink %s: gap for entity %s: %s", r.sink.Name(), g.EntityId, err)
+	}
+}
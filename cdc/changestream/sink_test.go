@@ -0,0 +1,266 @@
+// Copyright 2020, Square, Inc.
+
+package changestream_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/test/mock"
+)
+
+func TestSinkRunner(t *testing.T) {
+	// Sink checkpoint is after "vno", so the runner should start at ts 13 and
+	// skip "nru" and "vno" which were already sent
+	var gotConsumer, released string
+	var gotCheckpoint cdc.Checkpoint
+	checkpoints := mock.CDCCheckpointStore{
+		ReleaseFunc: func(consumer, owner string) error {
+			released = consumer
+			return nil
+		},
+		ReadCheckpointFunc: func(consumer string) (cdc.Checkpoint, error) {
+			gotConsumer = consumer
+			return cdc.Checkpoint{Consumer: consumer, Ts: 13, EventIds: []string{"vno"}}, nil
+		},
+		WriteCheckpointFunc: func(cp cdc.Checkpoint) error {
+			gotCheckpoint = cp
+			return nil
+		},
+	}
+
+	var gotSinceTs int64
+	events := make(chan etre.CDCEvent, len(mock.CDCEvents))
+	for _, e := range mock.CDCEvents[1:6] { // vno-bnu, ts 13-35
+		events <- e
+	}
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			gotSinceTs = sinceTs
+			return events
+		},
+	}
+	factory := mock.StreamerFactory{
+		MakeFunc: func(clientId string) changestream.Streamer {
+			return stream
+		},
+	}
+
+	sent := []string{}
+	doneSending := make(chan struct{})
+	sink := mock.CDCSink{
+		NameFunc: func() string { return "test" },
+		SendFunc: func(e etre.CDCEvent) error {
+			sent = append(sent, e.Id)
+			if len(sent) == 4 {
+				close(doneSending)
+			}
+			return nil
+		},
+	}
+
+	runner := changestream.NewSinkRunner(sink, factory, checkpoints)
+	stopChan := make(chan struct{})
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		runner.Run(stopChan)
+	}()
+
+	select {
+	case <-doneSending:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for events, sent %v", sent)
+	}
+	close(stopChan)
+	select {
+	case <-runDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Run to return")
+	}
+
+	if gotConsumer != "sink:test" {
+		t.Errorf("consumer = %s, expected sink:test", gotConsumer)
+	}
+	if gotSinceTs != 13 {
+		t.Errorf("sinceTs = %d, expected 13", gotSinceTs)
+	}
+	if diff := deep.Equal(sent, []string{"4pi", "p34", "vb0", "bnu"}); diff != nil {
+		t.Error(diff)
+	}
+
+	if released != "sink:test" {
+		t.Errorf("released lease on %s, expected sink:test", released)
+	}
+
+	// On stop, the checkpoint is committed after the last event sent
+	gotCheckpoint.Updated = 0
+	expectCheckpoint := cdc.Checkpoint{Consumer: "sink:test", Ts: 35, EventIds: []string{"vb0", "bnu"}}
+	if diff := deep.Equal(gotCheckpoint, expectCheckpoint); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSinkRunnerLeaseHeld(t *testing.T) {
+	// Test that the sink is not run if another API node has the lease
+	leased := make(chan string, 1)
+	checkpoints := mock.CDCCheckpointStore{
+		LeaseFunc: func(consumer, owner string, ttl time.Duration) (bool, error) {
+			select {
+			case leased <- consumer:
+			default:
+			}
+			return false, nil
+		},
+		ReadCheckpointFunc: func(consumer string) (cdc.Checkpoint, error) {
+			t.Error("ReadCheckpoint called without lease")
+			return cdc.Checkpoint{Consumer: consumer}, nil
+		},
+	}
+	factory := mock.StreamerFactory{
+		MakeFunc: func(clientId string) changestream.Streamer {
+			t.Error("stream made without lease")
+			return mock.Stream{}
+		},
+	}
+	sink := mock.CDCSink{
+		NameFunc: func() string { return "test" },
+	}
+
+	runner := changestream.NewSinkRunner(sink, factory, checkpoints)
+	stopChan := make(chan struct{})
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		runner.Run(stopChan)
+	}()
+	select {
+	case consumer := <-leased:
+		if consumer != "sink:test" {
+			t.Errorf("leased %s, expected sink:test", consumer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Lease call")
+	}
+	close(stopChan)
+	select {
+	case <-runDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Run to return")
+	}
+}
+
+func TestSinkRunnerLeaseLostRetrying(t *testing.T) {
+	// Test that the lease is renewed while retrying a failed send, and that
+	// the runner stops without writing its checkpoint when the lease is lost
+	leases := 0
+	released := make(chan struct{})
+	checkpoints := mock.CDCCheckpointStore{
+		LeaseFunc: func(consumer, owner string, ttl time.Duration) (bool, error) {
+			leases++
+			return leases == 1, nil // lost on first renewal
+		},
+		ReleaseFunc: func(consumer, owner string) error {
+			close(released)
+			return nil
+		},
+		ReadCheckpointFunc: func(consumer string) (cdc.Checkpoint, error) {
+			return cdc.Checkpoint{Consumer: consumer}, nil
+		},
+		WriteCheckpointFunc: func(cp cdc.Checkpoint) error {
+			t.Errorf("checkpoint written after lease lost: %+v", cp)
+			return nil
+		},
+	}
+	events := make(chan etre.CDCEvent, 2)
+	events <- mock.CDCEvents[0]
+	events <- mock.CDCEvents[1]
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return events
+		},
+	}
+	factory := mock.StreamerFactory{
+		MakeFunc: func(clientId string) changestream.Streamer {
+			return stream
+		},
+	}
+	sink := mock.CDCSink{
+		NameFunc: func() string { return "test" },
+		SendFunc: func(e etre.CDCEvent) error {
+			if e.Id == mock.CDCEvents[1].Id {
+				return errors.New("sink down")
+			}
+			return nil
+		},
+	}
+
+	runner := changestream.NewSinkRunner(sink, factory, checkpoints)
+	stopChan := make(chan struct{})
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		runner.Run(stopChan)
+	}()
+	select {
+	case <-released:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for runner to stop on lease lost")
+	}
+	close(stopChan)
+	select {
+	case <-runDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Run to return")
+	}
+	if leases != 2 {
+		t.Errorf("leased %d times, expected 2", leases)
+	}
+}
+
+func TestSinkRunnerGaps(t *testing.T) {
+	// Test that gaps are sent to a cdc.GapSink
+	gapChan := make(chan etre.CDCGap, 1)
+	gapChan <- etre.CDCGap{EntityId: "e1", EntityType: "node", Revs: []int64{2}}
+	stream := mock.Stream{
+		StartFunc: func(sinceTs int64) <-chan etre.CDCEvent {
+			return make(chan etre.CDCEvent)
+		},
+		GapsFunc: func() <-chan etre.CDCGap {
+			return gapChan
+		},
+	}
+	factory := mock.StreamerFactory{
+		MakeFunc: func(clientId string) changestream.Streamer {
+			return stream
+		},
+	}
+	gotGap := make(chan etre.CDCGap, 1)
+	sink := mock.CDCSink{
+		NameFunc: func() string { return "test" },
+		SendGapFunc: func(g etre.CDCGap) error {
+			gotGap <- g
+			return nil
+		},
+	}
+
+	runner := changestream.NewSinkRunner(sink, factory, mock.CDCCheckpointStore{})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go runner.Run(stopChan)
+
+	select {
+	case g := <-gotGap:
+		if diff := deep.Equal(g, etre.CDCGap{EntityId: "e1", EntityType: "node", Revs: []int64{2}}); diff != nil {
+			t.Error(diff)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for gap")
+	}
+}
@@ -5,18 +5,26 @@ package changestream
 import (
 	"errors"
 	"fmt"
+	"log"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
+	"github.com/square/etre/metrics"
 )
 
 var (
 	ClientBufferSize = 10
 	ServerBufferSize = 1000
 	BacklogWait      = 100 * time.Millisecond
+
+	// GapWait is how long ServerStream waits for missing revisions of an entity
+	// (events received out of revision order) before reading them from the CDC
+	// store. GapLookback is how far before the first out-of-order event it reads.
+	GapWait     = 1 * time.Second
+	GapLookback = 5 * time.Minute
 )
 
 var (
@@ -56,12 +64,43 @@ type StreamerFactory interface {
 }
 
 type ServerStreamFactory struct {
-	Server Server
-	Store  cdc.Store
+	Server  Server
+	Store   cdc.Store
+	Metrics metrics.Metrics // optional system metrics for revision order counters
 }
 
 func (f ServerStreamFactory) Make(clientId string) Streamer {
-	return NewServerStream(clientId, f.Server, f.Store)
+	s := NewServerStream(clientId, f.Server, f.Store)
+	s.metrics = f.Metrics
+	return s
+}
+
+// A GapReporter reports revision gaps in the stream (see etre.CDCGap). ServerStream
+// implements it. Gaps are not ordered with respect to events on the stream channel.
+type GapReporter interface {
+	// Gaps returns a channel on which gaps are sent. It must be called before
+	// Start, and the caller must receive from the channel until the stream stops,
+	// else the stream blocks. If not called, gaps are not reported.
+	Gaps() <-chan etre.CDCGap
+}
+
+// A FilteredStreamer applies a Filter to events before sending them, after
+// ordering revisions, so filtered events do not cause revision gaps. ServerStream
+// implements it. Events from other Streamers are filtered as received.
+type FilteredStreamer interface {
+	// StartWithFilter is like Start but only sends events and gaps that match
+	// the filter.
+	StartWithFilter(sinceTs int64, filter Filter) <-chan etre.CDCEvent
+}
+
+// start starts the stream with the filter. It returns the filter that the caller
+// must apply to events and gaps received from the stream: NoFilter if the stream
+// is a FilteredStreamer, else the given filter.
+func start(s Streamer, sinceTs int64, filter Filter) (<-chan etre.CDCEvent, Filter) {
+	if fs, ok := s.(FilteredStreamer); ok {
+		return fs.StartWithFilter(sinceTs, filter), NoFilter
+	}
+	return s.Start(sinceTs), filter
 }
 
 type Status struct {
@@ -76,16 +115,23 @@ type Status struct {
 }
 
 var _ Streamer = &ServerStream{}
+var _ GapReporter = &ServerStream{}
+var _ FilteredStreamer = &ServerStream{}
 
 type ServerStream struct {
 	clientId string
 	server   Server
 	store    cdc.Store
+	metrics  metrics.Metrics // nil if not set by ServerStreamFactory
 	// --
 	toClientChan chan etre.CDCEvent // to WebsocketClient or plugin code using streamer directly
+	filter       Filter             // set once by StartWithFilter
+	gapChan      chan etre.CDCGap   // nil unless Gaps called
 
 	revorder *etre.RevOrder
-	stopChan chan struct{} // channel that gets closed when Stop is called
+	gaps     map[string]gap // keyed on entity ID, waiting for missing revisions
+	gapWait  time.Duration  // GapWait when created
+	stopChan chan struct{}  // channel that gets closed when Stop is called
 	wg       *sync.WaitGroup
 
 	runMux   *sync.Mutex
@@ -114,10 +160,32 @@ func NewServerStream(clientId string, server Server, store cdc.Store) *ServerStr
 		wg:           &sync.WaitGroup{},
 		buffMux:      &sync.Mutex{},
 		revorder:     etre.NewRevOrder(etre.DEFAULT_MAX_ENTITIES, true),
+		gaps:         map[string]gap{},
+		gapWait:      GapWait,
 	}
 }
 
+// gap is an entity with out-of-order revisions waiting for missing revisions.
+type gap struct {
+	since      time.Time // when first out-of-order revision received
+	ts         int64     // ts of first out-of-order revision
+	entityType string
+}
+
+func (s *ServerStream) Gaps() <-chan etre.CDCGap {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if s.gapChan == nil {
+		s.gapChan = make(chan etre.CDCGap)
+	}
+	return s.gapChan
+}
+
 func (s *ServerStream) Start(sinceTs int64) <-chan etre.CDCEvent {
+	return s.StartWithFilter(sinceTs, NoFilter)
+}
+
+func (s *ServerStream) StartWithFilter(sinceTs int64, filter Filter) <-chan etre.CDCEvent {
 	s.runMux.Lock()
 	defer s.runMux.Unlock()
 
@@ -129,6 +197,7 @@ func (s *ServerStream) Start(sinceTs int64) <-chan etre.CDCEvent {
 		panic("ServerStream.Start called after Stop")
 	default:
 	}
+	s.filter = filter
 
 	go func() {
 		defer func() {
@@ -243,6 +312,8 @@ func (s *ServerStream) stream(sinceTs int64) error {
 	close(s.syncChan)
 	etre.Debug("in sync")
 	s.runMux.Unlock()
+	gapTicker := time.NewTicker(s.gapWait)
+	defer gapTicker.Stop()
 	for {
 		select {
 		case e, ok := <-serverStreamChan:
@@ -256,6 +327,10 @@ func (s *ServerStream) stream(sinceTs int64) error {
 			if err := s.sendToClient(e); err != nil {
 				return err
 			}
+		case <-gapTicker.C:
+			if err := s.repairGaps(); err != nil {
+				return err
+			}
 		case <-s.stopChan:
 			return ErrStopped
 		}
@@ -392,7 +467,10 @@ func (s *ServerStream) streamBacklog(sinceTs int64, backlogDoneChan chan struct{
 		Order:   cdc.ByTsAsc{},
 	})
 	if err != nil {
-		return err
+		if !errors.Is(err, cdc.ErrCompacted) {
+			return err
+		}
+		log.Printf("CDC stream %s: backlog has only the latest event of some entities: %s", s.clientId, err)
 	}
 	etre.Debug("%d backlog events", len(events))
 	for _, e := range events {
@@ -408,24 +486,139 @@ func (s *ServerStream) streamBacklog(sinceTs int64, backlogDoneChan chan struct{
 // event. This means a single call to sendToClient can send zero or more events.
 // If the streamer is stopped, the event is not sent and ErrStopped is returned.
 func (s *ServerStream) sendToClient(e etre.CDCEvent) error {
+	last, seen := s.revorder.Last(e.EntityId)
 	inOrder, prevEvents := s.revorder.InOrder(e)
+	if err := s.sendEvicted(); err != nil {
+		return err
+	}
 
 	// inOrder is false when this e is not rev+1 of its previous rev.
 	// revorder saved this e and will return it later in prevEvents
 	// once the complete sequence of revs between prev.Rev and e.Rev
-	// is received.
+	// is received. If the missing revs are not received within GapWait,
+	// repairGaps reads them from the store.
 	if !inOrder {
+		if seen && e.EntityRev <= last {
+			etre.Debug("event dropped (duplicate or past rev): %+v", e)
+			s.inc(metrics.CDCDropped)
+			return nil
+		}
 		etre.Debug("event out of order: %+v", e)
+		s.inc(metrics.CDCOutOfOrder)
+		if _, ok := s.gaps[e.EntityId]; !ok {
+			s.gaps[e.EntityId] = gap{since: time.Now(), ts: e.Ts, entityType: e.EntityType}
+		}
 		return nil
 	}
+	delete(s.gaps, e.EntityId) // in order again, if it was out of order
+
+	// Normal case: e is in sync and there are no past revs. Else, past e were
+	// out of sync and revorder just got them in sync. prevEvents include this e.
+	return s.sendAll(e, prevEvents)
+}
 
-	// Normal case: e is in sync and there are no past revs
+// repairGaps reads the missing revisions of entities that have been waiting
+// longer than GapWait from the store. If a revision is not in the store, the
+// gap is lost: the client is sent a gap (if it called Gaps) and the events after
+// the gap are sent. If the store cannot be read, the client is sent a resync gap.
+// If the revisions were compacted by retention, the gap is compacted, not lost.
+func (s *ServerStream) repairGaps() error {
+	for id, g := range s.gaps {
+		if time.Since(g.since) < s.gapWait {
+			continue
+		}
+		delete(s.gaps, id)
+		missing := s.revorder.Missing(id)
+		if len(missing) == 0 {
+			continue
+		}
+		etre.Debug("repair gap: id %s revs %v", id, missing)
+		lost := etre.CDCGap{EntityId: id, EntityType: g.entityType}
+		events, err := s.store.Read(cdc.Filter{
+			SinceTs:  g.ts - int64(GapLookback/time.Millisecond),
+			EntityId: id,
+			Order:    cdc.ByEntityIdRevAsc{},
+		})
+		lost.Compacted = errors.Is(err, cdc.ErrCompacted)
+		if err != nil && !lost.Compacted {
+			lost.Revs = missing
+			lost.Resync = true
+			lost.Error = fmt.Sprintf("cannot read missing revisions from CDC store: %s", err)
+		} else {
+			need := map[int64]bool{}
+			for _, rev := range missing {
+				need[rev] = true
+			}
+			for _, e := range events {
+				if !need[e.EntityRev] {
+					continue
+				}
+				inOrder, prevEvents := s.revorder.InOrder(e)
+				if err := s.sendEvicted(); err != nil {
+					return err
+				}
+				if inOrder {
+					if err := s.sendAll(e, prevEvents); err != nil {
+						return err
+					}
+				}
+			}
+			lost.Revs = s.revorder.Missing(id)
+		}
+		if len(lost.Revs) == 0 {
+			s.inc(metrics.CDCGapsRepaired)
+			continue
+		}
+
+		// Missing revisions are lost or compacted. Report the gap, then send
+		// the events after it
+		if lost.Compacted {
+			log.Printf("CDC stream %s: entity %s revisions %v compacted", s.clientId, id, lost.Revs)
+		} else {
+			s.inc(metrics.CDCGapsLost)
+			log.Printf("CDC stream %s: entity %s revisions %v lost (resync: %t, error: %s)", s.clientId, id, lost.Revs, lost.Resync, lost.Error)
+		}
+		if err := s.sendGap(lost); err != nil {
+			return err
+		}
+		skipped := s.revorder.Skip(id)
+		if err := s.sendEvicted(); err != nil {
+			return err
+		}
+		for _, e := range skipped {
+			if err := s.send(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendEvicted sends the gaps and events of entities evicted from revorder while
+// waiting for missing revisions (see RevOrder.Evicted), like lost gaps in repairGaps.
+func (s *ServerStream) sendEvicted() error {
+	for _, ev := range s.revorder.Evicted() {
+		delete(s.gaps, ev.Gap.EntityId)
+		s.inc(metrics.CDCGapsLost)
+		log.Printf("CDC stream %s: entity %s revisions %v lost (%s)", s.clientId, ev.Gap.EntityId, ev.Gap.Revs, ev.Gap.Error)
+		if err := s.sendGap(ev.Gap); err != nil {
+			return err
+		}
+		for _, e := range ev.Events {
+			if err := s.send(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendAll sends the in-order events returned by RevOrder.InOrder for e: e if
+// prevEvents is nil, else prevEvents which include e.
+func (s *ServerStream) sendAll(e etre.CDCEvent, prevEvents []etre.CDCEvent) error {
 	if prevEvents == nil {
 		return s.send(e)
 	}
-
-	// Past e were out of sync and revorder just got them in sync.
-	// prevEvents include this e (it wasn't sent above).
 	etre.Debug("sending %d ordered events", len(prevEvents))
 	for _, e := range prevEvents {
 		if err := s.send(e); err != nil {
@@ -435,10 +628,40 @@ func (s *ServerStream) sendToClient(e etre.CDCEvent) error {
 	return nil
 }
 
-// send actually sends the event to the client, unless the streamer is stopped.
-// Do not call this fucntion directly; always call sendToClient to ensure proper
-// event ordering.
+// sendGap sends the gap to the client if it called Gaps and the gap matches
+// the filter.
+func (s *ServerStream) sendGap(g etre.CDCGap) error {
+	s.runMux.Lock()
+	gapChan := s.gapChan
+	s.runMux.Unlock()
+	if gapChan == nil || !s.filter.ApplyGap(g) {
+		return nil
+	}
+	select {
+	case gapChan <- g:
+	case <-s.stopChan:
+		return ErrStopped
+	}
+	return nil
+}
+
+func (s *ServerStream) inc(mn byte) {
+	if s.metrics != nil {
+		s.metrics.Inc(mn, 1)
+	}
+}
+
+// send actually sends the event to the client, unless the streamer is stopped
+// or the event does not match the filter. Do not call this fucntion directly;
+// always call sendToClient to ensure proper event ordering.
 func (s *ServerStream) send(e etre.CDCEvent) error {
+	// Filter after ordering: revorder must see every event, else filtered
+	// revs would look like gaps
+	e, ok := s.filter.Apply(e)
+	if !ok {
+		return nil
+	}
+
 	// Don't send if already stopped
 	select {
 	case <-s.stopChan:
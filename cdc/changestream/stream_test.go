@@ -4,6 +4,7 @@ package changestream_test
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
+	"github.com/square/etre/metrics"
 	"github.com/square/etre/test/mock"
 )
 
@@ -550,3 +552,208 @@ func TestStreamServerClosedStreamDuringSync(t *testing.T) {
 			err, changestream.ErrServerClosedStream)
 	}
 }
+
+func TestStreamGaps(t *testing.T) {
+	// Test that revision gaps are repaired by reading the missing revisions from
+	// the store, and reported if lost. Entity e1 rev 1 is missing but in the store
+	// (repaired). Entity e2 revs 1 and 2 are missing but only rev 1 is in the
+	// store, so rev 2 is lost.
+	defer func(d time.Duration) { changestream.GapWait = d }(changestream.GapWait)
+	changestream.GapWait = 50 * time.Millisecond
+
+	serverChan := make(chan etre.CDCEvent, 10)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	e2 := func(rev int64) etre.CDCEvent {
+		return etre.CDCEvent{Id: fmt.Sprintf("e2-%d", rev), EntityId: "e2", EntityType: "node", EntityRev: rev, Ts: 1000 + rev, Op: "u"}
+	}
+	var mux sync.Mutex
+	gotFilters := map[string]cdc.Filter{}
+	store := &mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			mux.Lock()
+			gotFilters[f.EntityId] = f
+			mux.Unlock()
+			switch f.EntityId {
+			case "e1":
+				return events1[1:2], nil
+			case "e2":
+				return []etre.CDCEvent{e2(1)}, nil
+			}
+			return nil, nil
+		},
+	}
+	sm := metrics.NewSystemMetrics()
+	factory := changestream.ServerStreamFactory{Server: srv, Store: store, Metrics: sm}
+	stream := factory.Make("client1")
+	gapChan := stream.(changestream.GapReporter).Gaps()
+	streamChan := stream.Start(0)
+	defer stream.Stop()
+
+	// e1 rev 0 again is a duplicate (dropped)
+	for _, e := range []etre.CDCEvent{events1[0], events1[2], e2(0), e2(3), events1[0]} {
+		serverChan <- e
+	}
+
+	var gotGap etre.CDCGap
+	select {
+	case gotGap = <-gapChan:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for gap")
+	}
+	expectGap := etre.CDCGap{EntityId: "e2", EntityType: "node", Revs: []int64{2}}
+	if diff := deep.Equal(gotGap, expectGap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Events in rev order per entity, but entities can be in any order
+	gotRevs := map[string][]int64{}
+	for i := 0; i < 6; i++ {
+		select {
+		case e := <-streamChan:
+			gotRevs[e.EntityId] = append(gotRevs[e.EntityId], e.EntityRev)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timeout waiting for event %d, got %v", i+1, gotRevs)
+		}
+	}
+	expectRevs := map[string][]int64{
+		"e1": {0, 1, 2},
+		"e2": {0, 1, 3},
+	}
+	if diff := deep.Equal(gotRevs, expectRevs); diff != nil {
+		t.Error(diff)
+	}
+
+	stream.Stop()
+	mux.Lock()
+	if f := gotFilters["e2"]; f.SinceTs != 1003-int64(changestream.GapLookback/time.Millisecond) {
+		t.Errorf("got SinceTs %d, expected ts of e2 rev 3 - GapLookback", f.SinceTs)
+	}
+	mux.Unlock()
+	r := sm.Report(false).System
+	gotCounts := []int64{r.CDCOutOfOrder, r.CDCDropped, r.CDCGapsRepaired, r.CDCGapsLost}
+	if diff := deep.Equal(gotCounts, []int64{2, 1, 1, 1}); diff != nil {
+		t.Errorf("wrong metric counts [out-of-order, dropped, repaired, lost]: %v", diff)
+	}
+}
+
+func TestStreamGapsCompacted(t *testing.T) {
+	// Test that missing revisions compacted by retention are reported as a
+	// compacted gap, not lost. Entity e2 revs 1 and 2 are missing, but the
+	// store read is compacted and has only rev 1.
+	defer func(d time.Duration) { changestream.GapWait = d }(changestream.GapWait)
+	changestream.GapWait = 50 * time.Millisecond
+
+	serverChan := make(chan etre.CDCEvent, 10)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	e2 := func(rev int64) etre.CDCEvent {
+		return etre.CDCEvent{Id: fmt.Sprintf("e2-%d", rev), EntityId: "e2", EntityType: "node", EntityRev: rev, Ts: 1000 + rev, Op: "u"}
+	}
+	store := &mock.CDCStore{
+		ReadFunc: func(f cdc.Filter) ([]etre.CDCEvent, error) {
+			if f.EntityId == "" {
+				return nil, nil // backlog
+			}
+			return []etre.CDCEvent{e2(1)}, fmt.Errorf("%w: test", cdc.ErrCompacted)
+		},
+	}
+	sm := metrics.NewSystemMetrics()
+	factory := changestream.ServerStreamFactory{Server: srv, Store: store, Metrics: sm}
+	stream := factory.Make("client1")
+	gapChan := stream.(changestream.GapReporter).Gaps()
+	streamChan := stream.Start(0)
+	defer stream.Stop()
+
+	serverChan <- e2(0)
+	serverChan <- e2(3)
+
+	select {
+	case g := <-gapChan:
+		expectGap := etre.CDCGap{EntityId: "e2", EntityType: "node", Revs: []int64{2}, Compacted: true}
+		if diff := deep.Equal(g, expectGap); diff != nil {
+			t.Error(diff)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for gap")
+	}
+	var gotRevs []int64
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-streamChan:
+			gotRevs = append(gotRevs, e.EntityRev)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timeout waiting for event %d, got %v", i+1, gotRevs)
+		}
+	}
+	if diff := deep.Equal(gotRevs, []int64{0, 1, 3}); diff != nil {
+		t.Error(diff)
+	}
+
+	stream.Stop()
+	if r := sm.Report(false).System; r.CDCGapsLost != 0 {
+		t.Errorf("CDCGapsLost = %d, expected 0", r.CDCGapsLost)
+	}
+}
+
+func TestStreamGapsEvicted(t *testing.T) {
+	// Test that an entity evicted from revorder while waiting for missing
+	// revisions is reported as a lost gap, then its buffered revisions are sent.
+	// Entity e1 rev 1 is missing, then DEFAULT_MAX_ENTITIES other entities evict it.
+	n := etre.DEFAULT_MAX_ENTITIES
+	serverChan := make(chan etre.CDCEvent, n+2)
+	srv := mock.ChangeStreamServer{
+		WatchFunc: func(clientId string) (<-chan etre.CDCEvent, error) {
+			return serverChan, nil
+		},
+	}
+	sm := metrics.NewSystemMetrics()
+	factory := changestream.ServerStreamFactory{Server: srv, Store: &mock.CDCStore{}, Metrics: sm}
+	stream := factory.Make("client1")
+	gapChan := stream.(changestream.GapReporter).Gaps()
+	streamChan := stream.Start(0)
+	defer stream.Stop()
+
+	serverChan <- etre.CDCEvent{Id: "e1-0", EntityId: "e1", EntityType: "node", EntityRev: 0}
+	serverChan <- etre.CDCEvent{Id: "e1-2", EntityId: "e1", EntityType: "node", EntityRev: 2}
+	for i := 0; i < n; i++ {
+		serverChan <- etre.CDCEvent{Id: fmt.Sprintf("x%d", i), EntityId: fmt.Sprintf("x%d", i), EntityType: "node"}
+	}
+
+	var gotGap etre.CDCGap
+	gotE1 := []int64{}
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < n+2; {
+		select {
+		case e := <-streamChan:
+			if e.EntityId == "e1" {
+				gotE1 = append(gotE1, e.EntityRev)
+			}
+			i++
+		case gotGap = <-gapChan:
+			i++
+		case <-timeout:
+			t.Fatalf("timeout waiting for events and gap, got %d", i)
+		}
+	}
+	if gotGap.EntityId != "e1" || gotGap.EntityType != "node" {
+		t.Errorf("wrong gap: %+v", gotGap)
+	}
+	if diff := deep.Equal(gotGap.Revs, []int64{1}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotE1, []int64{0, 2}); diff != nil {
+		t.Error(diff)
+	}
+
+	stream.Stop()
+	if r := sm.Report(false).System; r.CDCGapsLost != 1 {
+		t.Errorf("CDCGapsLost = %d, expected 1", r.CDCGapsLost)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2020, Square, Inc.
+
+package cdc
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/square/etre"
+)
+
+// ClockSkew is the maximum difference between API node clocks. Event timestamps
+// are set by the API node that wrote the event, so an event inserted after
+// another (higher Seq) can have an earlier timestamp. See Checkpoint.StartTs.
+var ClockSkew = 5 * time.Second
+
+// A Checkpoint is the last committed position of a durable CDC consumer. The
+// position is the Seq of the last acked event (see etre.CDCEvent.Seq) which is
+// the insert order of events. Seq is set when an event is written, not when it's
+// committed, so events can commit (and be received) out of Seq order. Therefore,
+// the checkpoint also has the acked events in Window: events with Seq within
+// ClockSkew of the checkpoint Seq are acked only if they're in Window. Events
+// without a Seq (not read from the CDC collection) fall back to the timestamp
+// of the last acked event plus the IDs of acked events with that timestamp
+// because event timestamps have millisecond resolution, so several events can
+// have the same timestamp.
+type Checkpoint struct {
+	Consumer string       `bson:"_id"`
+	Ts       int64        `bson:"ts"`               // ts of last acked event
+	EventIds []string     `bson:"eventIds"`         // acked events with ts
+	Seq      uint64       `bson:"seq"`              // seq of last acked event
+	Window   []AckedEvent `bson:"window,omitempty"` // acked events within ClockSkew of seq
+	Updated  int64        `bson:"updated"`          // Unix milliseconds
+}
+
+// AckedEvent is an acked event in Checkpoint.Window.
+type AckedEvent struct {
+	Id  string `bson:"id"`
+	Seq uint64 `bson:"seq"`
+}
+
+// Ack returns a new checkpoint advanced to the given event. Acking an event
+// at or before the checkpoint is a no-op because the position only moves forward.
+func (c Checkpoint) Ack(e etre.CDCEvent) Checkpoint {
+	if c.Acked(e) {
+		return c
+	}
+	if e.Seq > 0 {
+		if e.Seq > c.Seq {
+			c.Seq = e.Seq
+		}
+		start := c.windowStart()
+		window := make([]AckedEvent, 0, len(c.Window)+1)
+		for _, a := range c.Window {
+			if a.Seq > start {
+				window = append(window, a)
+			}
+		}
+		if e.Seq > start {
+			window = append(window, AckedEvent{Id: e.Id, Seq: e.Seq})
+		}
+		c.Window = window
+	}
+	switch {
+	case e.Ts > c.Ts:
+		c.Ts = e.Ts
+		c.EventIds = []string{e.Id}
+	case e.Ts == c.Ts:
+		ids := make([]string, len(c.EventIds), len(c.EventIds)+1)
+		copy(ids, c.EventIds)
+		c.EventIds = append(ids, e.Id)
+	}
+	c.Updated = time.Now().UnixNano() / int64(time.Millisecond)
+	return c
+}
+
+// Acked returns true if the event is at or before the checkpoint, i.e. the
+// consumer has already processed it and it should not be sent again.
+func (c Checkpoint) Acked(e etre.CDCEvent) bool {
+	if c.Seq > 0 && e.Seq > 0 {
+		if e.Seq > c.Seq {
+			return false
+		}
+		if e.Seq <= c.windowStart() {
+			return true
+		}
+		// Might have committed after the checkpoint
+		for _, a := range c.Window {
+			if a.Id == e.Id {
+				return true
+			}
+		}
+		return false
+	}
+	if e.Ts != c.Ts {
+		return e.Ts < c.Ts
+	}
+	for _, id := range c.EventIds {
+		if id == e.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// windowStart returns the Seq before which all events are acked: ClockSkew
+// before the checkpoint Seq. Seq is a MongoDB timestamp: seconds in the high
+// 32 bits.
+func (c Checkpoint) windowStart() uint64 {
+	skew := uint64(ClockSkew/time.Second) << 32
+	if c.Seq <= skew {
+		return 0
+	}
+	return c.Seq - skew
+}
+
+// StartTs returns the timestamp to start reading events from to resume after
+// the checkpoint. If the checkpoint has a Seq, it's ClockSkew before Ts because
+// events after the checkpoint can have earlier timestamps; use Acked to skip
+// events already acked.
+func (c Checkpoint) StartTs() int64 {
+	if c.Seq == 0 || c.Ts == 0 {
+		return c.Ts
+	}
+	ts := c.Ts - int64(ClockSkew/time.Millisecond)
+	if ts < 1 {
+		ts = 1
+	}
+	return ts
+}
+
+// A CheckpointStore reads and writes durable CDC consumer checkpoints.
+type CheckpointStore interface {
+	// ReadCheckpoint returns the consumer checkpoint. If the consumer has no
+	// checkpoint, a zero value Checkpoint with only Consumer set is returned.
+	ReadCheckpoint(consumer string) (Checkpoint, error)
+
+	// WriteCheckpoint writes (commits) the checkpoint, replacing any previous
+	// checkpoint for the consumer.
+	WriteCheckpoint(Checkpoint) error
+}
+
+// A Leaser is an optional CheckpointStore interface that grants exclusive,
+// expiring leases on consumers, so only one API node runs a consumer like a
+// CDC sink. The lease is stored in the consumer checkpoint.
+type Leaser interface {
+	// Lease acquires or renews the lease on the consumer for owner until ttl
+	// from now. It returns false if another owner has the lease.
+	Lease(consumer, owner string, ttl time.Duration) (bool, error)
+
+	// Release releases the lease if owner has it.
+	Release(consumer, owner string) error
+}
+
+// checkpointStore implements the CheckpointStore and Leaser interfaces with MongoDB.
+type checkpointStore struct {
+	coll *mongo.Collection
+}
+
+func NewCheckpointStore(coll *mongo.Collection) CheckpointStore {
+	return &checkpointStore{
+		coll: coll,
+	}
+}
+
+func (s *checkpointStore) ReadCheckpoint(consumer string) (Checkpoint, error) {
+	var c Checkpoint
+	err := s.coll.FindOne(context.TODO(), bson.M{"_id": consumer}).Decode(&c)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Checkpoint{Consumer: consumer}, nil
+		}
+		return Checkpoint{}, err
+	}
+	return c, nil
+}
+
+func (s *checkpointStore) WriteCheckpoint(c Checkpoint) error {
+	// Set, not replace, so the lease (if any) is kept
+	update := bson.M{
+		"$set": bson.M{
+			"ts":       c.Ts,
+			"eventIds": c.EventIds,
+			"seq":      c.Seq,
+			"window":   c.Window,
+			"updated":  c.Updated,
+		},
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := s.coll.UpdateOne(context.TODO(), bson.M{"_id": c.Consumer}, update, opts)
+	return err
+}
+
+func (s *checkpointStore) Lease(consumer, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	q := bson.M{
+		"_id": consumer,
+		"$or": bson.A{
+			bson.M{"lease.owner": owner},
+			bson.M{"lease.expires": bson.M{"$lt": now}},
+			bson.M{"lease": bson.M{"$exists": false}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"lease": bson.M{"owner": owner, "expires": now + int64(ttl/time.Millisecond)}},
+	}
+	opts := options.Update().SetUpsert(true)
+	if _, err := s.coll.UpdateOne(context.TODO(), q, update, opts); err != nil {
+		// Checkpoint exists but didn't match the query, so the upsert tried
+		// to insert it again: another owner has the lease
+		if isDupeKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *checkpointStore) Release(consumer, owner string) error {
+	q := bson.M{"_id": consumer, "lease.owner": owner}
+	_, err := s.coll.UpdateOne(context.TODO(), q, bson.M{"$unset": bson.M{"lease": ""}})
+	return err
+}
+
+func isDupeKeyError(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadPosition returns the position of the latest event in the CDC collection:
+// the highest seq (see etre.CDCEvent.Seq), its ts, and the IDs of all events with
+// that ts. If no event has a seq (written by an older version), it's the highest
+// ts. Window has all events with a seq in the window (see Checkpoint). If the
+// collection is empty, the zero value is returned. ctx can be a
+// mongo.SessionContext to read the position in a transaction.
+func ReadPosition(ctx context.Context, coll *mongo.Collection) (Checkpoint, error) {
+	var last StoredEvent
+	opts := options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"ts": 1, "seq": 1})
+	if err := coll.FindOne(ctx, bson.M{}, opts).Decode(&last); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Checkpoint{}, nil
+		}
+		return Checkpoint{}, err
+	}
+	if last.Event().Seq == 0 {
+		opts.SetSort(bson.M{"ts": -1})
+		if err := coll.FindOne(ctx, bson.M{}, opts).Decode(&last); err != nil {
+			return Checkpoint{}, err
+		}
+	}
+	cursor, err := coll.Find(ctx, bson.M{"ts": last.Ts}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	var events []etre.CDCEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return Checkpoint{}, err
+	}
+	cp := Checkpoint{Ts: last.Ts, Seq: last.Event().Seq, EventIds: make([]string, len(events))}
+	for i, e := range events {
+		cp.EventIds[i] = e.Id
+	}
+	if cp.Seq == 0 {
+		return cp, nil
+	}
+
+	// Events in the window that aren't committed yet aren't in the position
+	start := cp.windowStart()
+	q := bson.M{"seq": bson.M{"$gt": primitive.Timestamp{T: uint32(start >> 32), I: uint32(start)}}}
+	cursor, err = coll.Find(ctx, q, options.Find().SetProjection(bson.M{"_id": 1, "seq": 1}))
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	var window []StoredEvent
+	if err := cursor.All(ctx, &window); err != nil {
+		return Checkpoint{}, err
+	}
+	for _, e := range window {
+		cp.Window = append(cp.Window, AckedEvent{Id: e.Id, Seq: e.Event().Seq})
+	}
+	return cp, nil
+}
+
+// CallerCheckpoints returns a CheckpointStore that scopes consumers to the
+// caller so a client can only read and write its own checkpoints. Consumers
+// are stored as "<caller>/<consumer>", but Consumer in checkpoints passed to
+// and returned from the store is the name without the caller.
+func CallerCheckpoints(s CheckpointStore, caller string) CheckpointStore {
+	return callerCheckpoints{
+		CheckpointStore: s,
+		prefix:          caller + "/",
+	}
+}
+
+type callerCheckpoints struct {
+	CheckpointStore
+	prefix string
+}
+
+func (s callerCheckpoints) ReadCheckpoint(consumer string) (Checkpoint, error) {
+	c, err := s.CheckpointStore.ReadCheckpoint(s.prefix + consumer)
+	if err != nil {
+		return c, err
+	}
+	c.Consumer = consumer
+	return c, nil
+}
+
+func (s callerCheckpoints) WriteCheckpoint(c Checkpoint) error {
+	c.Consumer = s.prefix + c.Consumer
+	return s.CheckpointStore.WriteCheckpoint(c)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020, Square, Inc.
+
+package cdc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/test/mock"
+)
+
+func TestCheckpoint(t *testing.T) {
+	var cp cdc.Checkpoint
+	cp.Consumer = "c1"
+
+	// Events with the same ts accumulate; a newer ts resets the event IDs
+	cp = cp.Ack(etre.CDCEvent{Id: "a", Ts: 10})
+	cp = cp.Ack(etre.CDCEvent{Id: "b", Ts: 10})
+	cp = cp.Ack(etre.CDCEvent{Id: "b", Ts: 10}) // dupe
+	if diff := deep.Equal(cp.EventIds, []string{"a", "b"}); diff != nil {
+		t.Error(diff)
+	}
+	cp2 := cp.Ack(etre.CDCEvent{Id: "c", Ts: 11})
+	if cp2.Ts != 11 || len(cp2.EventIds) != 1 || cp2.EventIds[0] != "c" {
+		t.Errorf("wrong checkpoint after newer event: %+v", cp2)
+	}
+	if cp2.Updated == 0 {
+		t.Errorf("Updated not set")
+	}
+
+	// Older events don't move the position back
+	cp3 := cp2.Ack(etre.CDCEvent{Id: "z", Ts: 5})
+	if diff := deep.Equal(cp3, cp2); diff != nil {
+		t.Error(diff)
+	}
+
+	acked := map[etre.CDCEvent]bool{
+		{Id: "x", Ts: 9}:  true,  // before checkpoint
+		{Id: "a", Ts: 10}: true,  // same ts, acked
+		{Id: "d", Ts: 10}: false, // same ts, not acked
+		{Id: "e", Ts: 11}: false, // after checkpoint
+	}
+	for e, expect := range acked {
+		if got := cp.Acked(e); got != expect {
+			t.Errorf("Acked(%+v) = %t, expected %t", e, got, expect)
+		}
+	}
+}
+
+func TestCheckpointSeq(t *testing.T) {
+	seq := func(sec, i uint64) uint64 { return sec<<32 | i } // MongoDB timestamp
+	cp := cdc.Checkpoint{Consumer: "c1"}
+
+	// Seq is the insert order, so an event with a higher seq but an earlier ts
+	// (API node clock skew) is not acked and advances the position
+	cp = cp.Ack(etre.CDCEvent{Id: "a", Ts: 10, Seq: seq(1000, 2)})
+	if cp.Acked(etre.CDCEvent{Id: "b", Ts: 9, Seq: seq(1000, 3)}) {
+		t.Errorf("event with higher seq and earlier ts is acked")
+	}
+	cp = cp.Ack(etre.CDCEvent{Id: "b", Ts: 9, Seq: seq(1000, 3)})
+	if cp.Seq != seq(1000, 3) || cp.Ts != 10 {
+		t.Errorf("wrong checkpoint after skewed event: %+v", cp)
+	}
+
+	// Events can commit out of seq order, so an event with a lower seq within
+	// ClockSkew of the checkpoint is acked only if it was acked, but events
+	// before that are acked by seq
+	late := etre.CDCEvent{Id: "late", Ts: 12, Seq: seq(1000, 1)}
+	if cp.Acked(late) {
+		t.Errorf("event with lower seq in window is acked but wasn't")
+	}
+	cp = cp.Ack(late)
+	if !cp.Acked(late) {
+		t.Errorf("event with lower seq in window is not acked after Ack")
+	}
+	if cp.Seq != seq(1000, 3) {
+		t.Errorf("seq = %d after late event, expected %d", cp.Seq, seq(1000, 3))
+	}
+	if !cp.Acked(etre.CDCEvent{Id: "x", Ts: 12, Seq: seq(990, 1)}) {
+		t.Errorf("event with seq before window is not acked")
+	}
+
+	// Window is pruned as seq advances
+	cp = cp.Ack(etre.CDCEvent{Id: "c", Ts: 20, Seq: seq(1010, 1)})
+	if diff := deep.Equal(cp.Window, []cdc.AckedEvent{{Id: "c", Seq: seq(1010, 1)}}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reading resumes before ts to catch skewed events
+	cp = cdc.Checkpoint{Ts: 1600000000000, Seq: 1}
+	if got, expect := cp.StartTs(), 1600000000000-int64(cdc.ClockSkew/time.Millisecond); got != expect {
+		t.Errorf("StartTs = %d, expected %d", got, expect)
+	}
+	cp = cdc.Checkpoint{Ts: 1600000000000}
+	if got := cp.StartTs(); got != 1600000000000 {
+		t.Errorf("StartTs = %d without seq, expected ts", got)
+	}
+}
+
+func TestCallerCheckpoints(t *testing.T) {
+	stored := map[string]cdc.Checkpoint{}
+	store := mock.CDCCheckpointStore{
+		ReadCheckpointFunc: func(consumer string) (cdc.Checkpoint, error) {
+			if cp, ok := stored[consumer]; ok {
+				return cp, nil
+			}
+			return cdc.Checkpoint{Consumer: consumer}, nil
+		},
+		WriteCheckpointFunc: func(cp cdc.Checkpoint) error {
+			stored[cp.Consumer] = cp
+			return nil
+		},
+	}
+
+	// Same consumer name, different callers: separate checkpoints
+	alice := cdc.CallerCheckpoints(store, "alice")
+	bob := cdc.CallerCheckpoints(store, "bob")
+	if err := alice.WriteCheckpoint(cdc.Checkpoint{Consumer: "c1", Ts: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["alice/c1"]; !ok {
+		t.Errorf("checkpoint not stored as alice/c1: %+v", stored)
+	}
+	cp, err := bob.ReadCheckpoint("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(cp, cdc.Checkpoint{Consumer: "c1"}); diff != nil {
+		t.Error(diff)
+	}
+	cp, err = alice.ReadCheckpoint("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(cp, cdc.Checkpoint{Consumer: "c1", Ts: 10}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestReadPosition(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// Last test event is "2oi" at ts 44. Test events don't have a seq, so the
+	// position is the highest ts.
+	got, err := cdc.ReadPosition(context.TODO(), coll[entityType])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := cdc.Checkpoint{Ts: 44, EventIds: []string{"2oi"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// An event written by Store.Write has a seq, so it's the position even
+	// though its ts is earlier (API node clock skew)
+	if err := cdcs.Write(context.TODO(), etre.CDCEvent{Id: "skw", EntityId: "e9", Ts: 40}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = cdc.ReadPosition(context.TODO(), coll[entityType])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq == 0 {
+		t.Errorf("Seq not set: %+v", got)
+	}
+	// Events in the seq window are in the position window
+	if diff := deep.Equal(got.Window, []cdc.AckedEvent{{Id: "skw", Seq: got.Seq}}); diff != nil {
+		t.Error(diff)
+	}
+	got.Seq = 0
+	got.Window = nil
+	if diff := deep.Equal(got, cdc.Checkpoint{Ts: 40, EventIds: []string{"skw"}}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Empty collection: zero position
+	if _, err := coll[entityType].DeleteMany(context.TODO(), bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = cdc.ReadPosition(context.TODO(), coll[entityType])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, cdc.Checkpoint{}); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2020, Square, Inc.
+
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/square/etre"
+)
+
+// ReplayResult is the result of replaying the CDC fallback file.
+type ReplayResult struct {
+	File       string `json:"file"`
+	Events     int    `json:"events"`     // read from the file
+	Inserted   int    `json:"inserted"`   // into the CDC collection
+	Duplicates int    `json:"duplicates"` // skipped: event with same entity ID and rev, or same _id, exists
+	Bad        int    `json:"bad"`        // lines that are not valid events, moved to BadFile
+	BadFile    string `json:"badFile,omitempty"`
+	Gaps       []Gap  `json:"gaps,omitempty"`
+}
+
+// Gap is a range of entity revisions, inclusive, that are missing from the CDC
+// collection after replay.
+type Gap struct {
+	EntityId string `json:"entityId"`
+	FromRev  int64  `json:"fromRev"`
+	ToRev    int64  `json:"toRev"`
+}
+
+// A Replayer reinserts CDC events from the fallback file (see Store.Write)
+// into the CDC collection.
+type Replayer interface {
+	// Replay reinserts events from the fallback file, skipping duplicates (same
+	// entity ID and rev), and reports gaps: missing revisions before or between
+	// the replayed events. Lines that are not valid events, like a truncated last
+	// line, are skipped and appended to the fallback file + ".bad". If successful,
+	// the events are removed from the file. If the file does not exist or is
+	// empty, it does nothing.
+	Replay() (ReplayResult, error)
+}
+
+type replayer struct {
+	coll *mongo.Collection
+	file string
+	*sync.Mutex
+}
+
+// NewReplayer creates a Replayer that replays the fallback file into the CDC
+// collection.
+func NewReplayer(coll *mongo.Collection, fallbackFile string) Replayer {
+	return &replayer{
+		coll:  coll,
+		file:  fallbackFile,
+		Mutex: &sync.Mutex{},
+	}
+}
+
+func (r *replayer) Replay() (ReplayResult, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	res := ReplayResult{File: r.file}
+
+	// Move the file aside so events written while replaying (if MongoDB is
+	// still failing) are not lost. If a previous replay failed, the file is
+	// already moved; replay it first and the new file next time.
+	replayFile := r.file + ".replay"
+	if _, err := os.Stat(replayFile); err != nil {
+		if !os.IsNotExist(err) {
+			return res, err
+		}
+		if err := os.Rename(r.file, replayFile); err != nil {
+			if os.IsNotExist(err) {
+				return res, nil // no fallback file, nothing to replay
+			}
+			return res, err
+		}
+	}
+	res.File = replayFile
+
+	events, bad, err := readFallbackFile(replayFile)
+	res.Events = len(events)
+	res.Bad = len(bad)
+	if err != nil {
+		return res, err
+	}
+
+	ctx := context.TODO()
+	revs := map[string][]int64{} // replayed revs keyed on entity ID
+	for _, e := range events {
+		q := bson.M{"entityId": e.EntityId, "entityRev": e.EntityRev}
+		n, err := r.coll.CountDocuments(ctx, q, options.Count().SetLimit(1))
+		if err != nil {
+			return res, err
+		}
+		revs[e.EntityId] = append(revs[e.EntityId], e.EntityRev)
+		if n > 0 {
+			res.Duplicates++
+			continue
+		}
+		inserted, err := insert(ctx, r.coll, eventId(e), e)
+		if err != nil {
+			return res, err
+		}
+		if !inserted {
+			res.Duplicates++ // same _id
+			continue
+		}
+		res.Inserted++
+	}
+
+	if res.Gaps, err = r.gaps(ctx, revs); err != nil {
+		return res, err
+	}
+	for _, g := range res.Gaps {
+		log.Printf("WARNING: CDC replay: entity %s missing revisions %d-%d", g.EntityId, g.FromRev, g.ToRev)
+	}
+
+	// Keep bad lines for an admin to inspect, but don't replay them again
+	if len(bad) > 0 {
+		res.BadFile = r.file + ".bad"
+		if err := appendLines(res.BadFile, bad); err != nil {
+			return res, err
+		}
+		log.Printf("WARNING: CDC replay: %d invalid lines moved to %s", len(bad), res.BadFile)
+	}
+
+	if err := os.Remove(replayFile); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// gaps returns missing revisions in the CDC collection from the revision before
+// the first replayed revision to the last replayed revision for each entity.
+// Revisions before that might be missing because of retention; that's not a gap.
+func (r *replayer) gaps(ctx context.Context, replayed map[string][]int64) ([]Gap, error) {
+	ids := make([]string, 0, len(replayed))
+	for id := range replayed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	gaps := []Gap{}
+	for _, id := range ids {
+		min, max := replayed[id][0], replayed[id][0]
+		for _, rev := range replayed[id] {
+			if rev < min {
+				min = rev
+			}
+			if rev > max {
+				max = rev
+			}
+		}
+		if min > 0 {
+			min-- // previous rev should exist too
+		}
+		q := bson.M{"entityId": id, "entityRev": bson.M{"$gte": min, "$lte": max}}
+		cursor, err := r.coll.Find(ctx, q, options.Find().SetProjection(bson.M{"entityRev": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var events []etre.CDCEvent
+		if err := cursor.All(ctx, &events); err != nil {
+			return nil, err
+		}
+		have := make(map[int64]bool, len(events))
+		for _, e := range events {
+			have[e.EntityRev] = true
+		}
+		for rev := min; rev <= max; rev++ {
+			if have[rev] {
+				continue
+			}
+			if n := len(gaps); n > 0 && gaps[n-1].EntityId == id && gaps[n-1].ToRev == rev-1 {
+				gaps[n-1].ToRev = rev
+				continue
+			}
+			gaps = append(gaps, Gap{EntityId: id, FromRev: rev, ToRev: rev})
+		}
+	}
+	return gaps, nil
+}
+
+// readFallbackFile reads CDC events from the fallback file. Events are JSON
+// lines, but older versions wrote events without newlines, which the JSON
+// decoder also handles. Lines with an invalid event, like a truncated last line
+// if the API crashed while writing, are returned as bad lines.
+func readFallbackFile(file string) ([]etre.CDCEvent, [][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	events := []etre.CDCEvent{}
+	bad := [][]byte{}
+	rd := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := rd.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return events, bad, err
+		}
+		if l := bytes.TrimSpace(line); len(l) > 0 {
+			if lineEvents, derr := decodeLine(l); derr != nil {
+				log.Printf("WARNING: CDC replay: invalid event on line %d in %s: %s", lineNo, file, derr)
+				bad = append(bad, l)
+			} else {
+				events = append(events, lineEvents...)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return events, bad, nil
+}
+
+// decodeLine decodes all events in one line of the fallback file. All or none
+// are returned: if one is invalid, the line is bad.
+func decodeLine(line []byte) ([]etre.CDCEvent, error) {
+	events := []etre.CDCEvent{}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	for {
+		var e etre.CDCEvent
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return nil, err
+		}
+		events = append(events, e)
+	}
+}
+
+// appendLines appends the lines to the file, creating it if needed.
+func appendLines(file string, lines [][]byte) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if _, err := f.Write(append(l, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
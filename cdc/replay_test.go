@@ -0,0 +1,77 @@
+// Copyright 2020, Square, Inc.
+
+package cdc_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre/cdc"
+)
+
+func TestReplay(t *testing.T) {
+	setup(t, "", cdc.NoRetryPolicy)
+
+	dir, err := ioutil.TempDir("", "etre-cdc-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "etre-cdc.json")
+
+	// e1 rev 1 is a duplicate of mock.CDCEvents p34. e1 rev 5 leaves a gap
+	// (rev 4) because mock.CDCEvents has e1 revs 0-3. e9 rev 3 leaves a gap
+	// (rev 2, the previous rev) because there are no e9 events. The first two
+	// events are written without a newline like older versions. The last line
+	// is truncated (API crashed while writing): skipped and moved to .bad.
+	data := `{"eventId":"","ts":50,"op":"u","entityId":"e1","rev":1}{"eventId":"","ts":51,"op":"u","entityId":"e1","rev":5}
+{"eventId":"","ts":52,"op":"u","entityId":"e9","rev":3}
+{"eventId":"","ts":53,"op":"u","entity`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := cdc.NewReplayer(coll[entityType], file)
+	got, err := r.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := cdc.ReplayResult{
+		File:       file + ".replay",
+		Events:     3,
+		Inserted:   2,
+		Duplicates: 1,
+		Bad:        1,
+		BadFile:    file + ".bad",
+		Gaps: []cdc.Gap{
+			{EntityId: "e1", FromRev: 4, ToRev: 4},
+			{EntityId: "e9", FromRev: 2, ToRev: 2},
+		},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+	if _, err := os.Stat(file + ".replay"); !os.IsNotExist(err) {
+		t.Errorf("replay file not removed: %v", err)
+	}
+	bad, err := ioutil.ReadFile(file + ".bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bad) != `{"eventId":"","ts":53,"op":"u","entity`+"\n" {
+		t.Errorf("wrong .bad file: %s", bad)
+	}
+
+	// No file, nothing to replay
+	got, err = r.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Events != 0 {
+		t.Errorf("replayed %d events, expected 0", got.Events)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2020, Square, Inc.
+
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/square/etre"
+	"github.com/square/etre/metrics"
+)
+
+// ErrTrimmed is returned by a retention Store when reading events before the
+// retention horizon: events that might have been deleted by the Retainer.
+var ErrTrimmed = errors.New("CDC events trimmed by retention")
+
+// ErrCompacted is returned by a retention Store with the events read when
+// reading events older than the policy CompactAge: only the latest event per
+// entity, so revisions before it are missing but were not lost.
+var ErrCompacted = errors.New("CDC events compacted by retention")
+
+// RETENTION_HORIZON is the _id of the retention horizon in the checkpoint
+// collection. See Retainer.Horizon.
+const RETENTION_HORIZON = "cdc:retention:horizon"
+
+// RetentionPolicy determines which CDC events the Retainer deletes. Zero values
+// are disabled.
+type RetentionPolicy struct {
+	MaxAge     time.Duration // delete events older than this
+	MaxEvents  int64         // delete oldest events when there are more than this
+	CompactAge time.Duration // keep only latest event per entity older than this
+}
+
+// RetentionResult is the number of events deleted by one Retainer.Enforce.
+type RetentionResult struct {
+	Trimmed   int64 // by MaxAge or MaxEvents
+	Compacted int64 // by CompactAge
+}
+
+// Retainer enforces a RetentionPolicy on the CDC collection. Every API node
+// runs a Retainer, like entity.Reaper. Enforcing retention is idempotent, so
+// it's safe for several nodes to do it at the same time.
+type Retainer struct {
+	coll     *mongo.Collection
+	cpColl   *mongo.Collection // checkpoint collection, stores the horizon
+	policy   RetentionPolicy
+	interval time.Duration
+	metrics  metrics.Metrics // system metrics
+	// --
+	*sync.Mutex
+	horizon int64 // last known horizon
+}
+
+// NewRetainer creates a Retainer that enforces the policy every interval,
+// recording metrics in the system metrics. The horizon is stored in the
+// checkpoint collection, cpColl, so it's shared by all API nodes.
+func NewRetainer(coll, cpColl *mongo.Collection, policy RetentionPolicy, interval time.Duration, sm metrics.Metrics) *Retainer {
+	return &Retainer{
+		coll:     coll,
+		cpColl:   cpColl,
+		policy:   policy,
+		interval: interval,
+		metrics:  sm,
+		Mutex:    &sync.Mutex{},
+	}
+}
+
+// Run enforces retention now and every interval until stopChan is closed. It
+// also refreshes the horizon every interval, so it includes trims by other
+// API nodes.
+func (r *Retainer) Run(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.Horizon()
+		if _, err := r.Enforce(); err != nil {
+			log.Printf("ERROR: enforcing CDC retention: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Horizon returns the timestamp (Unix milliseconds) before which events have
+// been trimmed by any API node. It's read from the checkpoint collection, so
+// it survives restarts. If it cannot be read, the last known horizon is returned.
+// It is zero if retention has never trimmed events (only compacts).
+func (r *Retainer) Horizon() int64 {
+	var h Checkpoint
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := r.cpColl.FindOne(ctx, bson.M{"_id": RETENTION_HORIZON}).Decode(&h)
+	cancel()
+	r.Lock()
+	defer r.Unlock()
+	switch err {
+	case nil:
+		if h.Ts > r.horizon {
+			r.horizon = h.Ts
+		}
+	case mongo.ErrNoDocuments:
+	default:
+		log.Printf("ERROR: reading CDC retention horizon: %s", err)
+	}
+	return r.horizon
+}
+
+// knownHorizon returns the last known horizon without reading it. Run refreshes
+// it every interval.
+func (r *Retainer) knownHorizon() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.horizon
+}
+
+// compacted returns the timestamp (Unix milliseconds) before which events are
+// compacted, or zero if compaction is disabled.
+func (r *Retainer) compacted() int64 {
+	if r.policy.CompactAge == 0 {
+		return 0
+	}
+	return time.Now().Add(-r.policy.CompactAge).UnixNano() / int64(time.Millisecond)
+}
+
+// Enforce trims and compacts events once. The first error stops enforcement
+// and is returned with the number of events deleted until then.
+func (r *Retainer) Enforce() (RetentionResult, error) {
+	var res RetentionResult
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	now := time.Now()
+
+	// Trim by age: delete events older than max age
+	if r.policy.MaxAge > 0 {
+		cutoff := now.Add(-r.policy.MaxAge).UnixNano() / int64(time.Millisecond)
+		n, err := r.trim(ctx, cutoff)
+		res.Trimmed += n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// Trim by count: find ts of the oldest event to keep, then delete older
+	// events. There can be a few more events than max events because several
+	// events can have the same ts.
+	if r.policy.MaxEvents > 0 {
+		count, err := r.coll.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return res, err
+		}
+		if count > r.policy.MaxEvents {
+			opts := options.FindOne().SetSort(bson.M{"ts": 1}).SetSkip(count - r.policy.MaxEvents)
+			var oldest etre.CDCEvent
+			if err := r.coll.FindOne(ctx, bson.M{}, opts).Decode(&oldest); err != nil {
+				if err != mongo.ErrNoDocuments {
+					return res, err
+				}
+			} else {
+				n, err := r.trim(ctx, oldest.Ts)
+				res.Trimmed += n
+				if err != nil {
+					return res, err
+				}
+			}
+		}
+	}
+
+	// Compact: keep only the latest event per entity older than compact age
+	if r.policy.CompactAge > 0 {
+		cutoff := now.Add(-r.policy.CompactAge).UnixNano() / int64(time.Millisecond)
+		n, err := r.compact(ctx, cutoff)
+		res.Compacted = n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if r.metrics != nil {
+		r.metrics.Inc(metrics.CDCTrimmed, res.Trimmed)
+		r.metrics.Inc(metrics.CDCCompacted, res.Compacted)
+		r.collStats(ctx)
+	}
+	if res.Trimmed > 0 || res.Compacted > 0 {
+		log.Printf("CDC retention: trimmed %d events, compacted %d events", res.Trimmed, res.Compacted)
+	}
+	return res, nil
+}
+
+// trim advances the horizon to ts, then deletes events before ts. The horizon
+// is advanced first so reads never return incomplete results without ErrTrimmed.
+// Other API nodes see the new horizon when their Retainer.Run refreshes it.
+func (r *Retainer) trim(ctx context.Context, ts int64) (int64, error) {
+	update := bson.M{
+		"$max": bson.M{"ts": ts},
+		"$set": bson.M{"updated": time.Now().UnixNano() / int64(time.Millisecond)},
+	}
+	opts := options.Update().SetUpsert(true)
+	if _, err := r.cpColl.UpdateOne(ctx, bson.M{"_id": RETENTION_HORIZON}, update, opts); err != nil {
+		return 0, fmt.Errorf("cannot write horizon: %s", err)
+	}
+	r.Lock()
+	if ts > r.horizon {
+		r.horizon = ts
+	}
+	r.Unlock()
+	res, err := r.coll.DeleteMany(ctx, bson.M{"ts": bson.M{"$lt": ts}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// compact deletes all but the latest event (highest entity revision) of each
+// entity for events before ts.
+func (r *Retainer) compact(ctx context.Context, ts int64) (int64, error) {
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.M{"ts": bson.M{"$lt": ts}}}},
+		{{"$sort", bson.D{{"entityId", 1}, {"entityRev", -1}}}},
+		{{"$group", bson.M{"_id": "$entityId", "ids": bson.M{"$push": "$_id"}, "n": bson.M{"$sum": 1}}}},
+		{{"$match", bson.M{"n": bson.M{"$gt": 1}}}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var compacted int64
+	for cursor.Next(ctx) {
+		var group struct {
+			Ids []interface{} `bson:"ids"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return compacted, err
+		}
+		res, err := r.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.Ids[1:]}}) // [0] is latest
+		if err != nil {
+			return compacted, err
+		}
+		compacted += res.DeletedCount
+	}
+	return compacted, cursor.Err()
+}
+
+// collStats records the number and size of events in the CDC collection.
+// Errors are logged, not returned, because metrics are not critical.
+func (r *Retainer) collStats(ctx context.Context) {
+	var stats struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	cmd := bson.D{{"collStats", r.coll.Name()}}
+	if err := r.coll.Database().RunCommand(ctx, cmd).Decode(&stats); err != nil {
+		log.Printf("ERROR: CDC collection stats: %s", err)
+		return
+	}
+	r.metrics.Val(metrics.CDCEvents, stats.Count)
+	r.metrics.Val(metrics.CDCBytes, stats.Size)
+}
+
+// --------------------------------------------------------------------------
+
+// retentionStore is a Store that returns ErrTrimmed or ErrCompacted from Read
+// rather than silently returning incomplete results.
+type retentionStore struct {
+	Store
+	r *Retainer
+}
+
+// NewRetentionStore returns a Store that reads and writes the given store but
+// returns ErrTrimmed from Read if Filter.SinceTs is before the Retainer horizon
+// (the last known horizon, refreshed by Retainer.Run).
+// If Filter.SinceTs is before the policy CompactAge, Read returns the events and
+// ErrCompacted because events are compacted: only the latest event per entity,
+// so the first event read for an entity might not be its first revision.
+func NewRetentionStore(store Store, r *Retainer) Store {
+	return retentionStore{
+		Store: store,
+		r:     r,
+	}
+}
+
+func (s retentionStore) Read(f Filter) ([]etre.CDCEvent, error) {
+	// SinceTs 0 is before both: reading from the beginning
+	if h := s.r.knownHorizon(); h > 0 && f.SinceTs < h {
+		return nil, fmt.Errorf("%w: events before %d deleted, cannot read since %d", ErrTrimmed, h, f.SinceTs)
+	}
+	events, err := s.Store.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	if c := s.r.compacted(); c > 0 && f.SinceTs < c {
+		return events, fmt.Errorf("%w: events before %d are only the latest per entity, read since %d", ErrCompacted, c, f.SinceTs)
+	}
+	return events, nil
+}
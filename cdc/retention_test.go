@@ -0,0 +1,152 @@
+// Copyright 2020, Square, Inc.
+
+package cdc_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+)
+
+func remainingIds(t *testing.T) []string {
+	cursor, err := coll[entityType].Find(context.TODO(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []etre.CDCEvent
+	if err := cursor.All(context.TODO(), &events); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(events))
+	for i := range events {
+		ids[i] = events[i].Id
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// cpColl returns the empty checkpoint collection which stores the horizon.
+func cpColl(t *testing.T) *mongo.Collection {
+	c := coll[entityType].Database().Collection("cdc_checkpoints")
+	if _, err := c.DeleteMany(context.TODO(), bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetentionMaxEvents(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// mock.CDCEvents ts: 10, 13, 13, 22, 35, 35, 39, 42, 44. Keeping 5 events
+	// keeps events with ts >= 35.
+	r := cdc.NewRetainer(coll[entityType], cpColl(t), cdc.RetentionPolicy{MaxEvents: 5}, time.Minute, nil)
+	res, err := r.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Trimmed != 4 || res.Compacted != 0 {
+		t.Errorf("got %+v, expected 4 trimmed", res)
+	}
+	if r.Horizon() != 35 {
+		t.Errorf("horizon = %d, expected 35", r.Horizon())
+	}
+	expectIds := []string{"2oi", "61p", "bnu", "qwp", "vb0"}
+	if diff := deep.Equal(remainingIds(t), expectIds); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reading before the horizon is an error, not incomplete results
+	rs := cdc.NewRetentionStore(cdcs, r)
+	if _, err := rs.Read(cdc.Filter{SinceTs: 13}); !errors.Is(err, cdc.ErrTrimmed) {
+		t.Errorf("got error %v, expected ErrTrimmed", err)
+	}
+	if _, err := rs.Read(cdc.Filter{}); !errors.Is(err, cdc.ErrTrimmed) {
+		t.Errorf("got error %v reading from the beginning, expected ErrTrimmed", err)
+	}
+	events, err := rs.Read(cdc.Filter{SinceTs: 35})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Errorf("got %d events, expected 5", len(events))
+	}
+
+	// Horizon is persisted: a new Retainer (e.g. another API node) has it
+	r2 := cdc.NewRetainer(coll[entityType], coll[entityType].Database().Collection("cdc_checkpoints"), cdc.RetentionPolicy{MaxEvents: 5}, time.Minute, nil)
+	if r2.Horizon() != 35 {
+		t.Errorf("new Retainer horizon = %d, expected 35", r2.Horizon())
+	}
+	if _, err := cdc.NewRetentionStore(cdcs, r2).Read(cdc.Filter{SinceTs: 13}); !errors.Is(err, cdc.ErrTrimmed) {
+		t.Errorf("got error %v from new Retainer store, expected ErrTrimmed", err)
+	}
+
+	// Idempotent
+	res, err = r.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Trimmed != 0 {
+		t.Errorf("trimmed %d events on second run, expected 0", res.Trimmed)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	setup(t, "", cdc.NoRetryPolicy)
+
+	// All test events are very old (ts near zero)
+	r := cdc.NewRetainer(coll[entityType], cpColl(t), cdc.RetentionPolicy{MaxAge: time.Hour}, time.Minute, nil)
+	res, err := r.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Trimmed != 9 {
+		t.Errorf("trimmed %d events, expected 9", res.Trimmed)
+	}
+	if r.Horizon() < time.Now().Add(-2*time.Hour).UnixNano()/int64(time.Millisecond) {
+		t.Errorf("horizon %d is not about 1h ago", r.Horizon())
+	}
+}
+
+func TestRetentionCompact(t *testing.T) {
+	cdcs := setup(t, "", cdc.NoRetryPolicy)
+
+	// Only latest rev of each entity is kept: e1 rev 3 (qwp), e2 rev 1 (2oi),
+	// e3 rev 0 (4pi), e5 rev 1 (bnu)
+	r := cdc.NewRetainer(coll[entityType], cpColl(t), cdc.RetentionPolicy{CompactAge: time.Hour}, time.Minute, nil)
+	res, err := r.Enforce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Compacted != 5 || res.Trimmed != 0 {
+		t.Errorf("got %+v, expected 5 compacted", res)
+	}
+	expectIds := []string{"2oi", "4pi", "bnu", "qwp"}
+	if diff := deep.Equal(remainingIds(t), expectIds); diff != nil {
+		t.Error(diff)
+	}
+	if r.Horizon() != 0 {
+		t.Errorf("horizon = %d, expected 0 because compaction does not trim", r.Horizon())
+	}
+
+	// Reading compacted events returns them and ErrCompacted
+	rs := cdc.NewRetentionStore(cdcs, r)
+	events, err := rs.Read(cdc.Filter{SinceTs: 1})
+	if !errors.Is(err, cdc.ErrCompacted) {
+		t.Errorf("got error %v, expected ErrCompacted", err)
+	}
+	if len(events) != 4 {
+		t.Errorf("got %d events, expected 4", len(events))
+	}
+	if _, err := rs.Read(cdc.Filter{SinceTs: time.Now().UnixNano() / int64(time.Millisecond)}); err != nil {
+		t.Errorf("got error %v reading after compaction, expected nil", err)
+	}
+}
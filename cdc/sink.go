@@ -0,0 +1,135 @@
+// Copyright 2020, Square, Inc.
+
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/square/etre"
+)
+
+// A Sink receives CDC events from the change stream, like a websocket client
+// but inside Etre. Implement this interface and add it to app.Plugins.CDCSinks
+// to publish events elsewhere, like a Kafka topic.
+//
+// Send is called sequentially, in event order. If it returns an error, the same
+// event is sent again after a wait, so delivery is at least once. Each sink has
+// a checkpoint (see Checkpoint) under consumer name "sink:"+Name(), so on restart
+// it resumes where it left off. The checkpoint is committed periodically, not
+// after every event, so a few events can be sent again after a crash.
+type Sink interface {
+	// Name returns the unique name of the sink.
+	Name() string
+
+	// Send sends one event.
+	Send(etre.CDCEvent) error
+}
+
+// A GapSink is an optional Sink interface to receive revision gaps (see
+// etre.CDCGap). Gaps are not ordered with respect to events. If SendGap returns
+// an error, the gap is logged and not sent again. Gaps are logged for sinks that
+// do not implement it.
+type GapSink interface {
+	SendGap(etre.CDCGap) error
+}
+
+// FileSinkConfig configures a FileSink.
+type FileSinkConfig struct {
+	Name     string
+	File     string
+	MaxSize  int64 // bytes; rotate file when it would exceed this size; zero disables rotation
+	MaxFiles int   // number of rotated files to keep: File.1 (newest) to File.N (oldest)
+}
+
+// FileSink is a built-in Sink that writes events to a file as JSON lines and
+// rotates the file by size.
+type FileSink struct {
+	cfg FileSinkConfig
+	// --
+	*sync.Mutex
+	file *os.File
+	size int64
+}
+
+var _ Sink = &FileSink{}
+
+// NewFileSink opens the file for appending, creating it if needed.
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	s := &FileSink{
+		cfg:   cfg,
+		Mutex: &sync.Mutex{},
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return s.cfg.Name
+}
+
+func (s *FileSink) Send(e etre.CDCEvent) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	bytes = append(bytes, '\n')
+	s.Lock()
+	defer s.Unlock()
+	if s.cfg.MaxSize > 0 && s.size > 0 && s.size+int64(len(bytes)) > s.cfg.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(bytes)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open CDC sink file: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames File.N-1 to File.N, ..., File to File.1 and opens a new File.
+// The oldest file (File.MaxFiles) is overwritten, i.e. removed.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.cfg.MaxFiles > 0 {
+		for n := s.cfg.MaxFiles - 1; n > 0; n-- {
+			old := fmt.Sprintf("%s.%d", s.cfg.File, n)
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", s.cfg.File, n+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.cfg.File, s.cfg.File+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.cfg.File); err != nil {
+		return err
+	}
+	return s.open()
+}
@@ -0,0 +1,81 @@
+// Copyright 2020, Square, Inc.
+
+package cdc_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/test/mock"
+)
+
+func readSinkFile(t *testing.T, file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ids := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e etre.CDCEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid JSON line: %s: %s", scanner.Text(), err)
+		}
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etre-cdc-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cdc.json")
+
+	// Each test event is 100-120 bytes, so 250 bytes is 2 events per file
+	sink, err := cdc.NewFileSink(cdc.FileSinkConfig{
+		Name:     "archive",
+		File:     file,
+		MaxSize:  250,
+		MaxFiles: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.Name() != "archive" {
+		t.Errorf("Name() = %s, expected archive", sink.Name())
+	}
+	for _, e := range mock.CDCEvents[0:7] {
+		if err := sink.Send(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	// 7 events, 2 per file: [nru vno] [4pi p34] [vb0 bnu] [qwp]. Only 2 rotated
+	// files are kept, so the oldest [nru vno] was removed.
+	expect := map[string][]string{
+		file:        {"qwp"},
+		file + ".1": {"vb0", "bnu"},
+		file + ".2": {"4pi", "p34"},
+	}
+	for f, ids := range expect {
+		if diff := deep.Equal(readSinkFile(t, f), ids); diff != nil {
+			t.Errorf("%s: %v", f, diff)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, expected only 2 rotated files", file)
+	}
+}
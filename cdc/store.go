@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -25,6 +26,9 @@ type Filter struct {
 	UntilTs int64 // Only read events that have a timestamp less than this value.
 	Limit   int64
 	Order   sort.Interface
+
+	// EntityId reads only events for this entity, if set.
+	EntityId string
 }
 
 // NoFilter is a convenience var for calls like Read(cdc.NoFilter). Other
@@ -64,6 +68,60 @@ func (a ByTsAsc) Len() int           { return len(a) }
 func (a ByTsAsc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTsAsc) Less(i, j int) bool { return a[i].Ts < a[j].Ts }
 
+// StoredEvent is a CDC event as stored in the CDC collection: the event plus
+// seq, the MongoDB timestamp set by the server when the event is inserted (see
+// etre.CDCEvent.Seq). Decode events from the collection or a change stream into
+// a StoredEvent, then call Event.
+type StoredEvent struct {
+	etre.CDCEvent `bson:",inline"`
+	Seq           primitive.Timestamp `bson:"seq"`
+}
+
+// Event returns the CDC event with Seq set.
+func (e StoredEvent) Event() etre.CDCEvent {
+	event := e.CDCEvent
+	event.Seq = uint64(e.Seq.T)<<32 | uint64(e.Seq.I)
+	return event
+}
+
+// insert inserts the event with the given _id and has the server set seq. It
+// returns false if the event already exists, e.g. a retry of an insert that
+// succeeded but returned an error; the existing event, including its seq, is
+// not changed.
+func insert(ctx context.Context, coll *mongo.Collection, id interface{}, event etre.CDCEvent) (bool, error) {
+	event.Id = "" // _id set below
+	b, err := bson.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(b, &fields); err != nil {
+		return false, err
+	}
+	// MongoDB replaces an empty timestamp with the current timestamp when it's
+	// one of the first two top-level fields, so seq must follow _id
+	doc := append(bson.D{{"_id", id}, {"seq", primitive.Timestamp{}}}, fields...)
+	if _, err := coll.InsertOne(ctx, doc); err != nil {
+		if isDupeKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// eventId returns the event _id: a new ObjectID if not set, else the ObjectID
+// or string it was stored as.
+func eventId(event etre.CDCEvent) interface{} {
+	if event.Id == "" {
+		return primitive.NewObjectID()
+	}
+	if id, err := primitive.ObjectIDFromHex(event.Id); err == nil {
+		return id
+	}
+	return event.Id
+}
+
 // A Store reads and writes CDC events to/from a persistent data store.
 type Store interface {
 	// Write writes the CDC event to a persisitent data store. If writing
@@ -102,6 +160,9 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 		ts["$lt"] = f.UntilTs
 	}
 	q := bson.M{"ts": ts}
+	if f.EntityId != "" {
+		q["entityId"] = f.EntityId
+	}
 
 	// Count number of docs we're about to fetch so we can make a slice of
 	// etre.CDC to match so, below, cursor.All() doesn't have to realloc the
@@ -121,10 +182,14 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 	if err != nil {
 		return nil, err
 	}
-	events := make([]etre.CDCEvent, count)
-	if err := cursor.All(context.TODO(), &events); err != nil {
+	stored := make([]StoredEvent, count)
+	if err := cursor.All(context.TODO(), &stored); err != nil {
 		return nil, err
 	}
+	events := make([]etre.CDCEvent, len(stored))
+	for i := range stored {
+		events[i] = stored[i].Event()
+	}
 
 	// Sort events here rather than having Mongo do it because 1) if we fetch
 	// too many events, it might exceed Mongo's sort limit and throw an error;
@@ -145,10 +210,22 @@ func (s *store) Read(f Filter) ([]etre.CDCEvent, error) {
 }
 
 func (s *store) Write(ctx context.Context, event etre.CDCEvent) error {
+	// Set _id once so retries and the fallback file (see Replayer) have the
+	// same event
+	id := eventId(event)
+	if oid, ok := id.(primitive.ObjectID); ok {
+		event.Id = oid.Hex()
+	}
+
 	var werr error
 	tries := 1 + s.wrp.RetryCount
 	for tryNo := 1; tryNo <= tries; tryNo++ {
-		if _, werr = s.coll.InsertOne(ctx, event); werr != nil {
+		var inserted bool
+		if inserted, werr = insert(ctx, s.coll, id, event); werr == nil && !inserted && tryNo == 1 {
+			werr = fmt.Errorf("duplicate CDC event _id %s", event.Id)
+			break // don't retry, event exists
+		}
+		if werr != nil {
 			if ctxErr := ctx.Err(); ctxErr != nil {
 				break // don't retry when context is done
 			}
@@ -180,12 +257,13 @@ func (s *store) Write(ctx context.Context, event etre.CDCEvent) error {
 		return fmt.Errorf("cannot marshal CDCEvent as JSON: %s", ferr)
 	}
 
-	// If the file doesn't exist, create it, or append to the file.
+	// If the file doesn't exist, create it, or append to the file. One event
+	// per line (JSON lines) so the file can be replayed (see Replayer).
 	f, ferr := os.OpenFile(s.fallbackFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if ferr != nil {
 		return fmt.Errorf("cannot open CDC fallback file: %s", ferr)
 	}
-	if _, ferr := f.Write(bytes); ferr != nil {
+	if _, ferr := f.Write(append(bytes, '\n')); ferr != nil {
 		return fmt.Errorf("cannot write to CDC fallback file: %s", ferr)
 	}
 	if ferr := f.Close(); ferr != nil {
@@ -158,12 +158,30 @@ func TestWriteSuccess(t *testing.T) {
 	}
 
 	if len(actualEvents) != 1 {
-		t.Errorf("got back %d events, expected 1", len(actualEvents))
+		t.Fatalf("got back %d events, expected 1", len(actualEvents))
 	}
 
+	// Seq is set by MongoDB on insert
+	if actualEvents[0].Seq == 0 {
+		t.Errorf("Seq not set")
+	}
+	seq := actualEvents[0].Seq
+	actualEvents[0].Seq = 0
 	if diff := deep.Equal(event, actualEvents[0]); diff != nil {
 		t.Error(diff)
 	}
+
+	// Writing the event again is an error and doesn't change its seq
+	if err := cdcs.Write(context.TODO(), event); err == nil {
+		t.Error("no error writing duplicate event")
+	}
+	actualEvents, err = cdcs.Read(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actualEvents) != 1 || actualEvents[0].Seq != seq {
+		t.Errorf("seq changed on duplicate write: %+v, expected seq %d", actualEvents, seq)
+	}
 }
 
 func TestWriteFallbackFile(t *testing.T) {
@@ -192,6 +210,9 @@ func TestWriteFallbackFile(t *testing.T) {
 	}
 
 	bytes, err := ioutil.ReadFile(fallbackFile.Name())
+	if len(bytes) == 0 || bytes[len(bytes)-1] != '\n' {
+		t.Errorf("fallback file event does not end with newline: %s", bytes)
+	}
 	var gotEvent etre.CDCEvent
 	if err := json.Unmarshal(bytes, &gotEvent); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,103 @@
+// Copyright 2020, Square, Inc.
+
+package cdc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/square/etre"
+)
+
+const (
+	// WEBHOOK_SIGNATURE_HEADER is the HMAC-SHA256 signature of the request body
+	// if WebhookSinkConfig.Secret is set: "sha256=" + hex(hmac(secret, body)).
+	WEBHOOK_SIGNATURE_HEADER = "X-Etre-Signature"
+
+	// WEBHOOK_EVENT_ID_HEADER is the CDC event ID so the receiver can dedupe.
+	WEBHOOK_EVENT_ID_HEADER = "X-Etre-Event-Id"
+)
+
+// WebhookSinkConfig configures a WebhookSink.
+type WebhookSinkConfig struct {
+	Name       string
+	URL        string
+	Secret     string // HMAC signing key; no signature if empty
+	Timeout    time.Duration
+	RetryCount int
+	RetryWait  time.Duration
+}
+
+// WebhookSink is a built-in Sink that POSTs each event as JSON to a URL. A 2xx
+// response is success; any other response or error is retried RetryCount times.
+type WebhookSink struct {
+	cfg    WebhookSinkConfig
+	client *http.Client
+}
+
+var _ Sink = &WebhookSink{}
+
+func NewWebhookSink(cfg WebhookSinkConfig) *WebhookSink {
+	return &WebhookSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return s.cfg.Name
+}
+
+func (s *WebhookSink) Send(e etre.CDCEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var signature string
+	if s.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.cfg.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tries := 1 + s.cfg.RetryCount
+	for tryNo := 1; tryNo <= tries; tryNo++ {
+		if err = s.post(body, e.Id, signature); err == nil {
+			return nil // success
+		}
+		if tryNo < tries {
+			time.Sleep(s.cfg.RetryWait)
+		}
+	}
+	return fmt.Errorf("webhook %s: %s", s.cfg.Name, err)
+}
+
+func (s *WebhookSink) post(body []byte, eventId, signature string) error {
+	req, err := http.NewRequest("POST", s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_ID_HEADER, eventId)
+	if signature != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signature)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // so the connection can be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: response status %d", s.cfg.URL, resp.StatusCode)
+	}
+	return nil
+}
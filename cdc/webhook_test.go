@@ -0,0 +1,86 @@
+// Copyright 2020, Square, Inc.
+
+package cdc_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/test/mock"
+)
+
+func TestWebhookSink(t *testing.T) {
+	// Fail the first request to test retry, then return 200
+	var gotBody []byte
+	var gotHeader http.Header
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		gotHeader = r.Header
+	}))
+	defer ts.Close()
+
+	sink := cdc.NewWebhookSink(cdc.WebhookSinkConfig{
+		Name:       "hook",
+		URL:        ts.URL,
+		Secret:     "shh",
+		Timeout:    time.Second,
+		RetryCount: 1,
+		RetryWait:  10 * time.Millisecond,
+	})
+	if sink.Name() != "hook" {
+		t.Errorf("Name() = %s, expected hook", sink.Name())
+	}
+
+	event := mock.CDCEvents[0]
+	if err := sink.Send(event); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, expected 2 (1 retry)", requests)
+	}
+
+	var gotEvent etre.CDCEvent
+	if err := json.Unmarshal(gotBody, &gotEvent); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotEvent, event); diff != nil {
+		t.Error(diff)
+	}
+	if id := gotHeader.Get(cdc.WEBHOOK_EVENT_ID_HEADER); id != event.Id {
+		t.Errorf("event ID header = %s, expected %s", id, event.Id)
+	}
+	mac := hmac.New(sha256.New, []byte("shh"))
+	mac.Write(gotBody)
+	expectSig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := gotHeader.Get(cdc.WEBHOOK_SIGNATURE_HEADER); sig != expectSig {
+		t.Errorf("signature header = %s, expected %s", sig, expectSig)
+	}
+
+	// Retries exhausted: error
+	requests = 0
+	sink = cdc.NewWebhookSink(cdc.WebhookSinkConfig{
+		Name:    "hook",
+		URL:     ts.URL,
+		Timeout: time.Second,
+	})
+	if err := sink.Send(event); err == nil {
+		t.Error("Send returned nil error, expected error on status 500")
+	}
+}
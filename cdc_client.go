@@ -7,9 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,14 +45,71 @@ type CDCClient interface {
 	Error() error
 }
 
-var _ CDCClient = &cdcClient{}
+// CDCClientV2 is a CDCClient with server-side filtering, durable consumers, and
+// bootstrapping. The CDCClient returned by NewCDCClient and NewCDCClientWithConfig
+// implements it, so type-assert the client to use it:
+//
+//	client := etre.NewCDCClient(addr, nil, 10, false).(etre.CDCClientV2)
+//
+// It is a separate interface so that existing implementations of CDCClient,
+// like caller mocks, do not have to implement these methods.
+type CDCClientV2 interface {
+	CDCClient
+
+	// StartWithOptions is like Start but with options, like a server-side filter
+	// that sends only matching events.
+	StartWithOptions(CDCStartOptions) (<-chan CDCEvent, error)
+
+	// Ack commits the position of a durable consumer: the caller has processed
+	// the event and all events received before it. The feed must be started
+	// with CDCStartOptions.Consumer. Starting with Resume then resumes after the
+	// last acked event, so the consumer receives every event exactly once.
+	Ack(CDCEvent) error
+
+	// Bootstrap loads a snapshot of all entities of the type, then starts the
+	// feed after the snapshot position, so the caller can build a local mirror
+	// without missing or double-applying events. If opts.Filter.EntityTypes is
+	// empty, the feed is filtered to the entity type. opts.StartTime and
+	// opts.After are ignored. The feed can send events for writes already in the
+	// snapshot; ignore events with a rev less than or equal to the entity _rev.
+	Bootstrap(entityType string, opts CDCStartOptions) (CDCSnapshot, <-chan CDCEvent, error)
+}
+
+// CDCStartOptions are options for CDCClientV2.StartWithOptions.
+type CDCStartOptions struct {
+	StartTime time.Time // start feed from this time; zero value is now
+	Filter    CDCFilter // optional server-side filter
+
+	// Consumer is an optional durable consumer name. The server stores the
+	// position of the consumer when it calls Ack. Consumer names are scoped to
+	// the authenticated caller, so different callers can use the same name.
+	// Only one feed per consumer should be running at a time.
+	Consumer string
+
+	// Resume starts the feed after the last acked event of the Consumer instead
+	// of StartTime. If the consumer has no position yet, StartTime is used.
+	Resume bool
+
+	// After starts the feed after this cursor instead of StartTime, like
+	// CDCSnapshot.Cursor or CDCPollResult.Next. Resume overrides it.
+	After string
+
+	// GapHandler is called with revision gaps in the feed (see CDCGap). If nil,
+	// the API does not send gaps. It is called from the goroutine receiving
+	// events, so it must not block.
+	GapHandler func(CDCGap)
+}
+
+var _ CDCClientV2 = &cdcClient{}
 
 // Internal implementation of CDCClient over a websocket.
 type cdcClient struct {
-	addr       string
-	tlsConfig  *tls.Config
-	bufferSize int
-	dbg        bool
+	addr        string
+	tlsConfig   *tls.Config
+	bufferSize  int
+	apiKey      string
+	traceParent string
+	dbg         bool
 	// --
 	*sync.Mutex             // guard function calls
 	wsMutex     *sync.Mutex // guard ws send/write
@@ -59,6 +119,7 @@ type cdcClient struct {
 	started     bool         // Start called and successful
 	stopped     bool         // Stop called
 	pingChan    chan Latency // for Ping
+	gapHandler  func(CDCGap) // CDCStartOptions.GapHandler
 }
 
 // NewCDCClient creates a CDC feed consumer on the given websocket address.
@@ -73,12 +134,35 @@ type cdcClient struct {
 // The client does not automatically ping the server. The caller should run a
 // separate goroutine to periodically call Ping. Every 10-60s is reasonable.
 func NewCDCClient(addr string, tlsConfig *tls.Config, bufferSize int, debug bool) CDCClient {
-	addr += API_ROOT + "/changes"
+	return NewCDCClientWithConfig(CDCClientConfig{
+		Addr:       addr,
+		TLSConfig:  tlsConfig,
+		BufferSize: bufferSize,
+		Debug:      debug,
+	})
+}
+
+// CDCClientConfig represents required and optional configuration for a CDCClient.
+// This is used to make a CDCClient by calling NewCDCClientWithConfig.
+type CDCClientConfig struct {
+	Addr        string      // ws://host:port or wss://host:port
+	TLSConfig   *tls.Config // optional TLS config
+	BufferSize  int         // feed channel buffer size, see NewCDCClient
+	APIKey      string      // optional API key sent as Authorization: Bearer <key>
+	TraceParent string      // optional W3C traceparent sent when connecting
+	Debug       bool
+}
+
+// NewCDCClientWithConfig creates a CDC feed consumer. See NewCDCClient.
+func NewCDCClientWithConfig(cfg CDCClientConfig) CDCClient {
+	addr := cfg.Addr + API_ROOT + "/changes"
 	c := &cdcClient{
-		addr:       addr,
-		tlsConfig:  tlsConfig,
-		bufferSize: bufferSize,
-		dbg:        debug,
+		addr:        addr,
+		tlsConfig:   cfg.TLSConfig,
+		bufferSize:  cfg.BufferSize,
+		apiKey:      cfg.APIKey,
+		traceParent: cfg.TraceParent,
+		dbg:         cfg.Debug,
 		// --
 		Mutex:    &sync.Mutex{},
 		wsMutex:  &sync.Mutex{},
@@ -89,6 +173,10 @@ func NewCDCClient(addr string, tlsConfig *tls.Config, bufferSize int, debug bool
 }
 
 func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
+	return c.StartWithOptions(CDCStartOptions{StartTime: startTime})
+}
+
+func (c *cdcClient) StartWithOptions(opts CDCStartOptions) (<-chan CDCEvent, error) {
 	c.debug("Start call")
 	defer c.debug("Start return")
 	c.Lock()
@@ -99,6 +187,9 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 		c.debug("already started")
 		return c.events, nil
 	}
+	if opts.Resume && opts.Consumer == "" {
+		return nil, fmt.Errorf("CDCStartOptions.Resume requires Consumer")
+	}
 
 	// Connect
 	u, err := url.Parse(c.addr)
@@ -109,7 +200,14 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 	dialer := &websocket.Dialer{
 		TLSClientConfig: c.tlsConfig,
 	}
-	conn, resp, err := dialer.Dial(u.String(), nil)
+	header := http.Header{}
+	if c.apiKey != "" {
+		header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.traceParent != "" {
+		header.Set(TRACEPARENT_HEADER, c.traceParent)
+	}
+	conn, resp, err := dialer.Dial(u.String(), header)
 	if err != nil {
 		if resp != nil {
 			defer resp.Body.Close()
@@ -122,8 +220,8 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 	c.wsConn = conn
 
 	startTs := int64(0)
-	if !startTime.IsZero() {
-		startTs = startTime.UnixNano() / int64(time.Millisecond)
+	if !opts.StartTime.IsZero() {
+		startTs = opts.StartTime.UnixNano() / int64(time.Millisecond)
 	}
 
 	// Send start control message
@@ -131,6 +229,20 @@ func (c *cdcClient) Start(startTime time.Time) (<-chan CDCEvent, error) {
 		"control": "start",
 		"startTs": startTs,
 	}
+	if !opts.Filter.IsZero() {
+		start["filter"] = opts.Filter
+	}
+	if opts.After != "" {
+		start["after"] = opts.After
+	}
+	if opts.Consumer != "" {
+		start["consumer"] = opts.Consumer
+		start["resume"] = opts.Resume
+	}
+	if opts.GapHandler != nil {
+		start["gaps"] = true
+	}
+	c.gapHandler = opts.GapHandler
 	c.debug("sending start")
 	if err := c.send(start); err != nil {
 		c.wsConn.Close()
@@ -205,6 +317,90 @@ func (c *cdcClient) Ping(timeout time.Duration) Latency {
 	return lag
 }
 
+func (c *cdcClient) Ack(e CDCEvent) error {
+	c.debug("Ack call")
+	defer c.debug("Ack return")
+
+	// Like Ping, only send() needs to guard the ws write. If the ack fails on
+	// the API side, it sends an error control message which shuts down the feed.
+	c.Lock()
+	started := c.started
+	c.Unlock()
+	if !started {
+		return fmt.Errorf("feed not started")
+	}
+	ack := map[string]interface{}{
+		"control": "ack",
+		"eventId": e.Id,
+		"ts":      e.Ts,
+	}
+	if e.Seq > 0 {
+		ack["seq"] = strconv.FormatUint(e.Seq, 10) // string: too big for JSON number
+	}
+	return c.send(ack)
+}
+
+func (c *cdcClient) Bootstrap(entityType string, opts CDCStartOptions) (CDCSnapshot, <-chan CDCEvent, error) {
+	c.debug("Bootstrap call")
+	defer c.debug("Bootstrap return")
+
+	// Snapshot URL from feed URL: ws://host/api/v1/changes -> http://host/api/v1/snapshot/type
+	var snap CDCSnapshot
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return snap, nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/changes") + "/snapshot/" + url.PathEscape(entityType)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return snap, nil, err
+	}
+	req.Header.Set(VERSION_HEADER, VERSION)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.traceParent != "" {
+		req.Header.Set(TRACEPARENT_HEADER, c.traceParent)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: c.tlsConfig}}
+	c.debug("GET %s", u.String())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return snap, nil, fmt.Errorf("http.Client.Do: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return snap, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, err = readError(resp, body)
+		return snap, nil, err
+	}
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return snap, nil, fmt.Errorf("cannot decode snapshot: %s", err)
+	}
+	c.debug("snapshot: %d entities, cursor %s", len(snap.Entities), snap.Cursor)
+
+	opts.StartTime = time.Time{}
+	opts.After = snap.Cursor
+	if len(opts.Filter.EntityTypes) == 0 {
+		opts.Filter.EntityTypes = []string{entityType}
+	}
+	events, err := c.StartWithOptions(opts)
+	if err != nil {
+		return snap, nil, err
+	}
+	return snap, events, nil
+}
+
 func (c *cdcClient) Error() error {
 	// Need to guard this because we never know when shutdown() will write c.err
 	c.Lock()
@@ -322,6 +518,19 @@ func (c *cdcClient) control(msg map[string]interface{}, now time.Time) error {
 		default:
 			c.debug("pingChan blocked")
 		}
+	case "gap", "resync":
+		// Revision gap in the feed, sent only if GapHandler is set
+		bytes, err := json.Marshal(msg["gap"])
+		if err != nil {
+			return err
+		}
+		var gap CDCGap
+		if err := json.Unmarshal(bytes, &gap); err != nil {
+			return fmt.Errorf("invalid %s control message: %s: %#v", msg["control"], err, msg)
+		}
+		if c.gapHandler != nil {
+			c.gapHandler(gap)
+		}
 	default:
 		return fmt.Errorf("API sent unknown control message: %s: %#v", msg["control"], msg)
 	}
@@ -369,13 +578,16 @@ func (c *cdcClient) debug(msg string, v ...interface{}) {
 // Mock client
 // //////////////////////////////////////////////////////////////////////////
 
-var _ CDCClient = MockCDCClient{}
+var _ CDCClientV2 = MockCDCClient{}
 
 type MockCDCClient struct {
-	StartFunc func(time.Time) (<-chan CDCEvent, error)
-	StopFunc  func()
-	PingFunc  func(time.Duration) Latency
-	ErrorFunc func() error
+	StartFunc            func(time.Time) (<-chan CDCEvent, error)
+	StartWithOptionsFunc func(CDCStartOptions) (<-chan CDCEvent, error)
+	AckFunc              func(CDCEvent) error
+	BootstrapFunc        func(string, CDCStartOptions) (CDCSnapshot, <-chan CDCEvent, error)
+	StopFunc             func()
+	PingFunc             func(time.Duration) Latency
+	ErrorFunc            func() error
 }
 
 func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
@@ -385,6 +597,27 @@ func (c MockCDCClient) Start(startTs time.Time) (<-chan CDCEvent, error) {
 	return nil, nil
 }
 
+func (c MockCDCClient) StartWithOptions(opts CDCStartOptions) (<-chan CDCEvent, error) {
+	if c.StartWithOptionsFunc != nil {
+		return c.StartWithOptionsFunc(opts)
+	}
+	return nil, nil
+}
+
+func (c MockCDCClient) Ack(e CDCEvent) error {
+	if c.AckFunc != nil {
+		return c.AckFunc(e)
+	}
+	return nil
+}
+
+func (c MockCDCClient) Bootstrap(entityType string, opts CDCStartOptions) (CDCSnapshot, <-chan CDCEvent, error) {
+	if c.BootstrapFunc != nil {
+		return c.BootstrapFunc(entityType, opts)
+	}
+	return CDCSnapshot{}, nil, nil
+}
+
 func (c MockCDCClient) Stop() {
 	if c.StopFunc != nil {
 		c.StopFunc()
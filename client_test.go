@@ -27,6 +27,7 @@ var (
 	gotPath   string
 	gotQuery  string
 	gotBody   []byte
+	gotHeader http.Header
 
 	// Response to test
 	respData       interface{}
@@ -40,6 +41,7 @@ func init() {
 		gotMethod = r.Method
 		gotPath = r.URL.Path
 		gotQuery, _ = url.QueryUnescape(r.URL.RawQuery)
+		gotHeader = r.Header
 
 		if r.Method == "POST" || r.Method == "PUT" {
 			var err error
@@ -77,6 +79,7 @@ func setup(t *testing.T) {
 	gotPath = ""
 	gotQuery = ""
 	gotBody = nil
+	gotHeader = nil
 	respError = nil
 	respData = nil
 	respStatusCode = http.StatusOK
@@ -131,6 +134,52 @@ func TestQueryAndIdRequired(t *testing.T) {
 	}
 }
 
+func TestAPIKey(t *testing.T) {
+	setup(t)
+	respData = []etre.Entity{}
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		APIKey:     "k1",
+	})
+	if _, err := ec.Query("x=y", etre.QueryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gotHeader.Get("Authorization"); got != "Bearer k1" {
+		t.Errorf("got Authorization header '%s', expected 'Bearer k1'", got)
+	}
+
+	// No API key, no header
+	ec = etre.NewEntityClient("node", ts.URL, httpClient)
+	if _, err := ec.Query("x=y", etre.QueryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gotHeader.Get("Authorization"); got != "" {
+		t.Errorf("got Authorization header '%s', expected none", got)
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	setup(t)
+	respData = []etre.Entity{}
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType:  "node",
+		Addr:        ts.URL,
+		HTTPClient:  httpClient,
+		TraceParent: traceParent,
+	})
+	if _, err := ec.Query("x=y", etre.QueryFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gotHeader.Get(etre.TRACEPARENT_HEADER); got != traceParent {
+		t.Errorf("got traceparent header '%s', expected '%s'", got, traceParent)
+	}
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Query
 // //////////////////////////////////////////////////////////////////////////
@@ -169,6 +218,57 @@ func TestQueryOK(t *testing.T) {
 	}
 }
 
+func TestQueryExpand(t *testing.T) {
+	setup(t)
+
+	respData = []etre.Entity{
+		{
+			"hostname":     "localhost",
+			"rack_id.name": "r1",
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	f := etre.QueryFilter{
+		ReturnLabels: []string{"hostname", "rack_id.name"},
+		Expand:       []string{"rack_id"},
+	}
+	got, err := ec.Query("x=y", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectQuery := "query=x=y&labels=hostname,rack_id.name&expand=rack_id"
+	if gotQuery != expectQuery {
+		t.Errorf("got query %s, expected %s", gotQuery, expectQuery)
+	}
+	if diff := deep.Equal(got, respData); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestQueryIncludeDeleted(t *testing.T) {
+	setup(t)
+
+	respData = []etre.Entity{
+		{"hostname": "localhost", "_deleted": true},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	got, err := ec.Query("x=y", etre.QueryFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectQuery := "query=x=y&includeDeleted=true"
+	if gotQuery != expectQuery {
+		t.Errorf("got query %s, expected %s", gotQuery, expectQuery)
+	}
+	if diff := deep.Equal(got, respData); diff != nil {
+		t.Error(diff)
+	}
+}
+
 func TestQueryNoResults(t *testing.T) {
 	// Same test as TestQueryOK but no results to make sure client handles
 	// status code 200 but an empty list.
@@ -723,6 +823,89 @@ func TestDeleteLabelOK(t *testing.T) {
 	}
 }
 
+func TestRenameLabelOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	got, err := ec.RenameLabel("a=b", "foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotMethod != "POST" {
+		t.Errorf("got method %s, expected POST", gotMethod)
+	}
+	expectPath := etre.API_ROOT + "/entities/node/labels/rename"
+	if gotPath != expectPath {
+		t.Errorf("got path %s, expected %s", gotPath, expectPath)
+	}
+	var gotRename etre.LabelRename
+	if err := json.Unmarshal(gotBody, &gotRename); err != nil {
+		t.Fatal(err)
+	}
+	expectRename := etre.LabelRename{From: "foo", To: "bar", Query: "a=b"}
+	if diff := deep.Equal(gotRename, expectRename); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(got, respData); diff != nil {
+		t.Error(diff)
+	}
+
+	if _, err := ec.RenameLabel("", "foo", ""); err != etre.ErrNoLabel {
+		t.Errorf("got err %v, expected etre.ErrNoLabel", err)
+	}
+}
+
+func TestDeleteLabelsOK(t *testing.T) {
+	setup(t)
+
+	respData = etre.WriteResult{
+		Writes: []etre.Write{
+			{
+				EntityId: "abc",
+				URI:      "http://localhost/entity/abc",
+				Diff: map[string]interface{}{
+					"foo": "foo",
+				},
+			},
+		},
+	}
+
+	ec := etre.NewEntityClient("node", ts.URL, httpClient)
+
+	got, err := ec.DeleteLabels("a=b", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotMethod != "DELETE" {
+		t.Errorf("got method %s, expected DELETE", gotMethod)
+	}
+	expectPath := etre.API_ROOT + "/entities/node/labels/foo"
+	if gotPath != expectPath {
+		t.Errorf("got path %s, expected %s", gotPath, expectPath)
+	}
+	if gotQuery != "query=a=b" {
+		t.Errorf("got query %s, expected query=a=b", gotQuery)
+	}
+	if diff := deep.Equal(got, respData); diff != nil {
+		t.Error(diff)
+	}
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // CDC
 // //////////////////////////////////////////////////////////////////////////
@@ -951,3 +1134,50 @@ func TestCDCClient(t *testing.T) {
 		t.Errorf("got error '%s', expected 'fake error'", gotError)
 	}
 }
+
+func TestRetryAfter(t *testing.T) {
+	// Test that the client retries HTTP 429 after the Retry-After wait
+	tries := 0
+	var retryTime time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(etre.Error{Type: "rate-limited", Message: "too many requests", HTTPStatus: http.StatusTooManyRequests})
+			return
+		}
+		retryTime = time.Now()
+		json.NewEncoder(w).Encode([]etre.Entity{{"_id": "abc"}})
+	}))
+	defer ts.Close()
+
+	ec := etre.NewEntityClientWithConfig(etre.EntityClientConfig{
+		EntityType: "node",
+		Addr:       ts.URL,
+		HTTPClient: httpClient,
+		Retry:      1,
+		RetryWait:  10 * time.Millisecond,
+	})
+	t0 := time.Now()
+	entities, err := ec.Query("x=y", etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tries != 2 {
+		t.Errorf("got %d tries, expected 2", tries)
+	}
+	if len(entities) != 1 {
+		t.Errorf("got %d entities, expected 1", len(entities))
+	}
+	if d := retryTime.Sub(t0); d < time.Second {
+		t.Errorf("retried after %s, expected >= 1s (Retry-After)", d)
+	}
+
+	// Without retry, 429 is returned as an error
+	tries = 0
+	ec = etre.NewEntityClient("node", ts.URL, httpClient)
+	if _, err := ec.Query("x=y", etre.QueryFilter{}); err == nil {
+		t.Error("no error, expected rate-limited error")
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/square/etre"
 )
 
 const (
@@ -28,16 +31,30 @@ const (
 	DEFAULT_QUERY_LATENCY_SLA              = "1s"
 	DEFAULT_QUERY_PROFILE_SAMPLE_RATE      = 0.2
 	DEFAULT_QUERY_PROFILE_REPORT_THRESHOLD = "500ms"
+	DEFAULT_ENTITY_TYPE_REFRESH_INTERVAL   = "10s"
+	DEFAULT_REAPER_INTERVAL                = "1m"
+	DEFAULT_SOFT_DELETE_RETENTION          = "168h" // 7 days
+	DEFAULT_TRACE_SERVICE_NAME             = "etre"
+	DEFAULT_CDC_RETENTION_INTERVAL         = "1h"
+	DEFAULT_CDC_SINK_TIMEOUT               = "5s"
+	DEFAULT_CDC_SINK_RETRY_WAIT            = "1s"
+)
+
+const (
+	CDC_COLLECTION            = "cdc"
+	CDC_CHECKPOINT_COLLECTION = "cdc_checkpoints"
+	ENTITY_TYPES_COLLECTION   = "entity_types"
 )
 
-const CDC_COLLECTION = "cdc"
+var reservedNames = []string{"entity", "entities", "cdc", "etre", ENTITY_TYPES_COLLECTION, CDC_CHECKPOINT_COLLECTION}
 
-var reservedNames = []string{"entity", "entities", "cdc", "etre"}
+var onDeleteActions = []string{"restrict", "allow"}
 
 func Default() Config {
 	return Config{
 		Entity: EntityConfig{
-			Types: []string{DEFAULT_ENTITY_TYPE},
+			Types:               []string{DEFAULT_ENTITY_TYPE},
+			TypeRefreshInterval: DEFAULT_ENTITY_TYPE_REFRESH_INTERVAL,
 		},
 		Server: ServerConfig{
 			Addr: DEFAULT_ADDR,
@@ -66,6 +83,9 @@ func Default() Config {
 			QueryProfileSampleRate:      DEFAULT_QUERY_PROFILE_SAMPLE_RATE,
 			QueryProfileReportThreshold: DEFAULT_QUERY_PROFILE_REPORT_THRESHOLD,
 		},
+		Trace: TraceConfig{
+			ServiceName: DEFAULT_TRACE_SERVICE_NAME,
+		},
 	}
 }
 
@@ -92,24 +112,197 @@ func Validate(config Config) error {
 	}
 
 	for _, t := range config.Entity.Types {
-		for _, r := range reservedNames {
-			if t != r {
-				continue
+		if err := ValidateEntityType(t); err != nil {
+			return err
+		}
+	}
+
+	for t, schema := range config.Entity.Schemas {
+		if !inList(t, config.Entity.Types) {
+			return fmt.Errorf("entity.schemas.%s: %s is not an entity type (entity.types)", t, t)
+		}
+		for label, ref := range schema.References {
+			if !inList(ref.EntityType, config.Entity.Types) {
+				return fmt.Errorf("entity.schemas.%s.references.%s: entity_type %s is not an entity type (entity.types)", t, label, ref.EntityType)
+			}
+			if ref.OnDelete != "" && !inList(ref.OnDelete, onDeleteActions) {
+				return fmt.Errorf("entity.schemas.%s.references.%s: invalid on_delete value: %s; valid values: %s", t, label, ref.OnDelete, strings.Join(onDeleteActions, ", "))
+			}
+		}
+		for label, v := range schema.Defaults {
+			if etre.IsMetalabel(label) {
+				return fmt.Errorf("entity.schemas.%s.defaults: cannot set default value for metalabel %s", t, label)
+			}
+			switch v.(type) {
+			case string, int, bool:
+			default:
+				return fmt.Errorf("entity.schemas.%s.defaults.%s: invalid value type %T; valid types: string, int, bool", t, label, v)
+			}
+		}
+		for _, label := range schema.ComputedLabels {
+			if !etre.IsComputedLabel(label) {
+				return fmt.Errorf("entity.schemas.%s.computed_labels: %s is not a computed label", t, label)
+			}
+		}
+		if schema.TTL != "" {
+			if d, err := time.ParseDuration(schema.TTL); err != nil || d <= 0 {
+				return fmt.Errorf("entity.schemas.%s.ttl: invalid duration: %s: must be greater than zero, like 24h", t, schema.TTL)
+			}
+		}
+		if schema.SoftDeleteRetention != "" {
+			if !schema.SoftDelete {
+				return fmt.Errorf("entity.schemas.%s.soft_delete_retention: set but soft_delete is false", t)
+			}
+			if d, err := time.ParseDuration(schema.SoftDeleteRetention); err != nil || d <= 0 {
+				return fmt.Errorf("entity.schemas.%s.soft_delete_retention: invalid duration: %s: must be greater than zero, like 168h", t, schema.SoftDeleteRetention)
+			}
+		}
+	}
+
+	if config.Entity.ReaperInterval != "" {
+		if d, err := time.ParseDuration(config.Entity.ReaperInterval); err != nil || d <= 0 {
+			return fmt.Errorf("entity.reaper_interval: invalid duration: %s: must be greater than zero, like 1m", config.Entity.ReaperInterval)
+		}
+	}
+
+	retention := config.CDC.Retention
+	var maxAge, compactAge time.Duration
+	if retention.MaxAge != "" {
+		d, err := time.ParseDuration(retention.MaxAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("cdc.retention.max_age: invalid duration: %s: must be greater than zero, like 720h", retention.MaxAge)
+		}
+		maxAge = d
+	}
+	if retention.MaxEvents < 0 {
+		return fmt.Errorf("cdc.retention.max_events: invalid value: %d: must be greater than zero", retention.MaxEvents)
+	}
+	if retention.CompactAge != "" {
+		d, err := time.ParseDuration(retention.CompactAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("cdc.retention.compact_age: invalid duration: %s: must be greater than zero, like 168h", retention.CompactAge)
+		}
+		compactAge = d
+	}
+	if maxAge > 0 && compactAge >= maxAge {
+		return fmt.Errorf("cdc.retention.compact_age: %s must be less than max_age %s", retention.CompactAge, retention.MaxAge)
+	}
+	if retention.Interval != "" {
+		if d, err := time.ParseDuration(retention.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("cdc.retention.interval: invalid duration: %s: must be greater than zero, like 1h", retention.Interval)
+		}
+	}
+
+	sinkNames := map[string]bool{}
+	for i, sink := range config.CDC.Sinks {
+		if sink.Name == "" {
+			return fmt.Errorf("cdc.sinks[%d].name: required", i)
+		}
+		if sinkNames[sink.Name] {
+			return fmt.Errorf("cdc.sinks[%d].name: duplicate name: %s", i, sink.Name)
+		}
+		sinkNames[sink.Name] = true
+		switch sink.Type {
+		case "webhook":
+			if sink.URL == "" {
+				return fmt.Errorf("cdc.sinks.%s.url: required for webhook sink", sink.Name)
+			}
+			if sink.RetryCount < 0 {
+				return fmt.Errorf("cdc.sinks.%s.retry_count: must be zero or greater", sink.Name)
+			}
+			for _, d := range []string{sink.Timeout, sink.RetryWait} {
+				if d == "" {
+					continue
+				}
+				if _, err := time.ParseDuration(d); err != nil {
+					return fmt.Errorf("cdc.sinks.%s: invalid duration: %s", sink.Name, d)
+				}
+			}
+		case "file":
+			if sink.File == "" {
+				return fmt.Errorf("cdc.sinks.%s.file: required for file sink", sink.Name)
+			}
+			if sink.MaxSizeMB < 0 || sink.MaxFiles < 0 {
+				return fmt.Errorf("cdc.sinks.%s: max_size_mb and max_files must be zero or greater", sink.Name)
+			}
+		default:
+			return fmt.Errorf("cdc.sinks.%s.type: invalid value: %s; valid values: webhook, file", sink.Name, sink.Type)
+		}
+	}
+
+	switch config.Security.Plugin {
+	case "":
+	case "jwt":
+		jwt := config.Security.JWT
+		if jwt.JWKSFile == "" && len(jwt.KeyFiles) == 0 {
+			return fmt.Errorf("security.jwt: jwks_file or key_files required")
+		}
+		if jwt.Leeway != "" {
+			if d, err := time.ParseDuration(jwt.Leeway); err != nil || d < 0 {
+				return fmt.Errorf("security.jwt.leeway: invalid duration: %s: must be zero or greater, like 30s", jwt.Leeway)
+			}
+		}
+	case "mtls":
+		if config.Server.TLSCert == "" || config.Server.TLSKey == "" || config.Server.TLSCA == "" {
+			return fmt.Errorf("security.plugin: mtls requires server.tls_cert, server.tls_key, and server.tls_ca")
+		}
+		if n := config.Security.MTLS.NameFrom; n != "" && n != "cn" && n != "san" {
+			return fmt.Errorf("security.mtls.name_from: invalid value: %s; valid values: cn, san", n)
+		}
+	case "api-key":
+		apiKey := config.Security.APIKey
+		if len(apiKey.Keys) == 0 && apiKey.KeysFile == "" {
+			return fmt.Errorf("security.api_key: keys or keys_file required")
+		}
+		if apiKey.ReloadInterval != "" {
+			if d, err := time.ParseDuration(apiKey.ReloadInterval); err != nil || d <= 0 {
+				return fmt.Errorf("security.api_key.reload_interval: invalid duration: %s: must be greater than zero, like 10s", apiKey.ReloadInterval)
 			}
-			return fmt.Errorf("entity type %s is a reserved word: %s", t, strings.Join(reservedNames, ","))
 		}
+	default:
+		return fmt.Errorf("security.plugin: invalid value: %s; valid values: jwt, mtls, api-key", config.Security.Plugin)
+	}
+
+	if r := config.Trace.SampleRate; r < 0 || r > 1 {
+		return fmt.Errorf("trace.sample_rate: invalid value: %f: must be between 0.0 and 1.0", r)
+	}
+	if config.Trace.File != "" && config.Trace.OTLPEndpoint != "" {
+		return fmt.Errorf("trace: file and otlp_endpoint are mutually exclusive")
 	}
 
 	return nil
 }
 
+// ValidateEntityType returns an error if the entity type is a reserved word.
+// It's used for types in the config and types created at runtime.
+func ValidateEntityType(t string) error {
+	for _, r := range reservedNames {
+		if t != r {
+			continue
+		}
+		return fmt.Errorf("entity type %s is a reserved word: %s", t, strings.Join(reservedNames, ","))
+	}
+	return nil
+}
+
+func inList(s string, l []string) bool {
+	for _, v := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
 type Config struct {
 	Server     ServerConfig     `yaml:"server"`
 	Datasource DatasourceConfig `yaml:"datasource"`
 	Entity     EntityConfig     `yaml:"entity"`
 	CDC        CDCConfig        `yaml:"cdc"`
-	Security   SecurityConfig   `yaml: "security"`
+	Security   SecurityConfig   `yaml:"security"`
 	Metrics    MetricsConfig    `yaml:"metrics"`
+	Audit      AuditConfig      `yaml:"audit"`
+	Trace      TraceConfig      `yaml:"trace"`
 }
 
 type DatasourceConfig struct {
@@ -179,6 +372,69 @@ func (c DatasourceConfig) WithDefaults(d DatasourceConfig) DatasourceConfig {
 
 type EntityConfig struct {
 	Types []string `yaml:"types"`
+
+	// TypeRefreshInterval is how often each API node reloads entity types
+	// created or retired at runtime. Default: 10s.
+	TypeRefreshInterval string `yaml:"type_refresh_interval"`
+
+	// ReaperInterval is how often the server deletes expired entities: entities
+	// with metalabel _expires less than or equal to now, and soft-deleted entities
+	// older than the retention. The reaper is disabled unless this is set or a
+	// schema has a TTL or soft delete, which defaults to 1m. Each entity type
+	// should have an index on _expires (and _deleted_ts if soft delete is enabled).
+	ReaperInterval string `yaml:"reaper_interval"`
+
+	// Schemas are optional settings per entity type, keyed on entity type.
+	Schemas map[string]SchemaConfig `yaml:"schemas"`
+}
+
+type SchemaConfig struct {
+	// References are labels whose value is the _id of an entity of another
+	// type, keyed on label. For example, label rack_id references rack._id.
+	References map[string]ReferenceConfig `yaml:"references"`
+
+	// Defaults are label values set on insert if the entity does not have
+	// the label, keyed on label. Values must be string, int, or bool.
+	Defaults map[string]interface{} `yaml:"defaults"`
+
+	// ComputedLabels are metalabels set by the server on every write, like
+	// _created_ts and _created_by. See etre.IsComputedLabel. They are opt-in:
+	// the server sets only the computed labels listed here, so none are set
+	// if this is empty (the default). For example:
+	//
+	//   computed_labels: [_ts, _created_ts, _created_by, _updated_ts, _updated_by]
+	//
+	ComputedLabels []string `yaml:"computed_labels"`
+
+	// TTL is a duration, like "24h", used to set metalabel _expires on insert
+	// if the entity does not have it. Expired entities are deleted by the reaper
+	// (see EntityConfig.ReaperInterval).
+	TTL string `yaml:"ttl"`
+
+	// SoftDelete enables soft delete: deleted entities are not removed but set
+	// metalabels _deleted=true and _deleted_ts, and they are not returned unless
+	// queried with includeDeleted=true. Soft-deleted entities are purged by the
+	// reaper after SoftDeleteRetention (default: 168h). Until purged, they still
+	// count against unique indexes.
+	SoftDelete          bool   `yaml:"soft_delete"`
+	SoftDeleteRetention string `yaml:"soft_delete_retention"`
+
+	// CDCFullEntity includes the whole entity after the write in CDC events
+	// (etre.CDCEvent.Full), not only the changed labels, so consumers do not
+	// have to query the entity. It makes CDC events larger. It's always enabled
+	// for entity types with an ACL read_scope because change feeds need the
+	// whole entity to check scope.
+	CDCFullEntity bool `yaml:"cdc_full_entity"`
+}
+
+type ReferenceConfig struct {
+	// Entity type referenced by the label.
+	EntityType string `yaml:"entity_type"`
+
+	// OnDelete determines what happens when a referenced entity is deleted:
+	// "restrict" (default) fails the delete if any entity references it;
+	// "allow" deletes it and leaves dangling references.
+	OnDelete string `yaml:"on_delete"`
 }
 
 type CDCConfig struct {
@@ -196,6 +452,54 @@ type CDCConfig struct {
 	// The collection that delays are stored in.
 
 	ChangeStream ChangeStreamConfig `yaml:"change_stream"`
+
+	Retention CDCRetentionConfig `yaml:"retention"`
+
+	// Sinks are built-in sinks that receive every CDC event. Only enable sinks
+	// on one API node, else every node sends every event.
+	Sinks []CDCSinkConfig `yaml:"sinks"`
+}
+
+// CDCSinkConfig configures a built-in CDC sink: webhook or file. Each sink
+// needs a unique name because it's used for the sink checkpoint.
+type CDCSinkConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // webhook or file
+
+	// Webhook sink: POST each event as JSON to the URL. If Secret is set, the
+	// X-Etre-Signature header is "sha256=" + hex HMAC-SHA256 of the body.
+	URL        string `yaml:"url"`
+	Secret     string `yaml:"secret"`
+	Timeout    string `yaml:"timeout"`     // default: 5s
+	RetryCount int    `yaml:"retry_count"` // default: 0
+	RetryWait  string `yaml:"retry_wait"`  // default: 1s
+
+	// File sink: write events as JSON lines, rotating the file when it would
+	// exceed MaxSizeMB. MaxFiles rotated files are kept: File.1 to File.N.
+	File      string `yaml:"file"`
+	MaxSizeMB int64  `yaml:"max_size_mb"`
+	MaxFiles  int    `yaml:"max_files"`
+}
+
+// CDCRetentionConfig configures how long CDC events are kept. By default, all
+// events are kept forever. Reading events (change feed start time or durable
+// consumer position) before the trimmed events returns an error.
+type CDCRetentionConfig struct {
+	// MaxAge is a duration, like "720h": events older than this are deleted.
+	MaxAge string `yaml:"max_age"`
+
+	// MaxEvents is the max number of events: when there are more, the oldest
+	// events are deleted.
+	MaxEvents int64 `yaml:"max_events"`
+
+	// CompactAge is a duration, like "168h": for events older than this, only
+	// the latest event per entity is kept. Must be less than MaxAge, if set.
+	CompactAge string `yaml:"compact_age"`
+
+	// Interval is how often the server enforces retention. Default: 1h if
+	// MaxAge, MaxEvents, or CompactAge is set. The collection should have
+	// an index on ts, and on entityId if CompactAge is set.
+	Interval string `yaml:"interval"`
 }
 
 type ChangeStreamConfig struct {
@@ -215,7 +519,47 @@ type ServerConfig struct {
 }
 
 type SecurityConfig struct {
-	ACL []ACL `yaml:"acl"`
+	ACL    []ACL        `yaml:"acl"`
+	Plugin string       `yaml:"plugin"` // built-in auth plugin: "jwt", "mtls", or "api-key"
+	JWT    JWTConfig    `yaml:"jwt"`
+	MTLS   MTLSConfig   `yaml:"mtls"`
+	APIKey APIKeyConfig `yaml:"api_key"`
+}
+
+// JWTConfig configures the built-in JWT auth plugin (security.plugin: jwt).
+type JWTConfig struct {
+	JWKSFile          string   `yaml:"jwks_file"`
+	KeyFiles          []string `yaml:"key_files"` // PEM-encoded public keys
+	Issuer            string   `yaml:"issuer"`
+	Audience          string   `yaml:"audience"`
+	Leeway            string   `yaml:"leeway"`       // duration string
+	AllowNoExp        bool     `yaml:"allow_no_exp"` // allow tokens without exp (never expire)
+	NameClaim         string   `yaml:"name_claim"`
+	RolesClaim        string   `yaml:"roles_claim"`
+	MetricGroupsClaim string   `yaml:"metric_groups_claim"`
+	AttributeClaims   []string `yaml:"attribute_claims"`
+}
+
+// MTLSConfig configures the built-in mTLS client certificate auth plugin
+// (security.plugin: mtls). It requires server.tls_ca.
+type MTLSConfig struct {
+	NameFrom    string `yaml:"name_from"`    // "cn" (default) or "san"
+	RolesFile   string `yaml:"roles_file"`   // YAML map of caller name to roles, else roles are OUs
+	RequireCert bool   `yaml:"require_cert"` // deny callers without cert, else they can only read
+}
+
+// APIKeyConfig configures the built-in API key auth plugin (security.plugin: api-key).
+type APIKeyConfig struct {
+	Keys           []APIKey `yaml:"keys"`
+	KeysFile       string   `yaml:"keys_file"`       // YAML list of keys, reloaded on change
+	ReloadInterval string   `yaml:"reload_interval"` // duration string
+}
+
+type APIKey struct {
+	Name         string   `yaml:"name"`
+	Hash         string   `yaml:"hash"` // sha256:<hex> of key
+	Roles        []string `yaml:"roles"`
+	MetricGroups []string `yaml:"metric_groups"`
 }
 
 type ACL struct {
@@ -223,9 +567,38 @@ type ACL struct {
 	Admin             bool     `yaml:"admin"`
 	Read              []string `yaml:"read"`
 	Write             []string `yaml:"write"`
+	WriteLabels       []string `yaml:"write_labels"`     // if set, only these labels can be written
+	DenyReadLabels    []string `yaml:"deny_read_labels"` // labels that cannot be read
+	ReadScope         string   `yaml:"read_scope"`       // KLS, like "team=${caller.team}"
+	WriteScope        string   `yaml:"write_scope"`      // KLS, like "team=${caller.team}"
+	RoleLimit         Limit    `yaml:"role_limit"`       // all callers with the role
+	CallerLimit       Limit    `yaml:"caller_limit"`     // each caller with the role
 	TraceKeysRequired []string `yaml:"trace_keys_required"`
 }
 
+// Limit is a token-bucket rate limit and maximum concurrent requests.
+type Limit struct {
+	Rate          float64 `yaml:"rate"` // requests per second
+	Burst         int     `yaml:"burst"`
+	MaxConcurrent int     `yaml:"max_concurrent"` // excludes change feeds (GET /changes)
+}
+
+// AuditConfig configures the audit log of write requests and auth failures.
+// The audit log is disabled unless File is set or app.Plugins.Audit is provided.
+type AuditConfig struct {
+	File string `yaml:"file"` // JSON lines
+}
+
+// TraceConfig configures distributed tracing. Tracing is disabled unless File
+// or OTLPEndpoint is set or app.Plugins.TraceExporter is provided. Requests with
+// a sampled W3C traceparent header are always traced; others are traced at SampleRate.
+type TraceConfig struct {
+	SampleRate   float64 `yaml:"sample_rate"`   // 0.0 to 1.0
+	File         string  `yaml:"file"`          // JSON lines
+	OTLPEndpoint string  `yaml:"otlp_endpoint"` // OTLP/HTTP JSON, like http://localhost:4318/v1/traces
+	ServiceName  string  `yaml:"service_name"`
+}
+
 type MetricsConfig struct {
 	QueryLatencySLA             string  `yaml:"query_latency_sla"` // duration string
 	QueryProfileSampleRate      float64 `yaml:"query_profile_sample_rate"`
@@ -54,3 +54,242 @@ func TestDatasourceConfigDefaults(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestValidateEntityType(t *testing.T) {
+	for _, name := range []string{"entity", "entities", "cdc", "etre", config.ENTITY_TYPES_COLLECTION} {
+		if err := config.ValidateEntityType(name); err == nil {
+			t.Errorf("no error for reserved name %s", name)
+		}
+		cfg := config.Default()
+		cfg.Entity.Types = []string{"host", name}
+		if err := config.Validate(cfg); err == nil {
+			t.Errorf("no error for reserved name %s in entity.types", name)
+		}
+	}
+	if err := config.ValidateEntityType("host"); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+}
+
+func TestValidateSchemas(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Types = []string{"host", "rack"}
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{
+		"host": config.SchemaConfig{
+			References: map[string]config.ReferenceConfig{
+				"rack_id": {EntityType: "rack"},
+			},
+		},
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	// Referenced entity type must be valid
+	cfg.Entity.Schemas["host"].References["rack_id"] = config.ReferenceConfig{EntityType: "racks"}
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid referenced entity type")
+	}
+
+	// on_delete must be restrict or allow
+	cfg.Entity.Schemas["host"].References["rack_id"] = config.ReferenceConfig{EntityType: "rack", OnDelete: "cascade"}
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid on_delete value")
+	}
+
+	// Schemas must be for valid entity types
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{"node": config.SchemaConfig{}}
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for schema of invalid entity type")
+	}
+}
+
+func TestValidateTTL(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.ReaperInterval = "30s"
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{
+		config.DEFAULT_ENTITY_TYPE: config.SchemaConfig{TTL: "24h"},
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	for _, ttl := range []string{"1 day", "0s", "-1h"} {
+		cfg.Entity.Schemas[config.DEFAULT_ENTITY_TYPE] = config.SchemaConfig{TTL: ttl}
+		if err := config.Validate(cfg); err == nil {
+			t.Errorf("no error for invalid ttl %s", ttl)
+		}
+	}
+
+	cfg.Entity.Schemas = nil
+	cfg.Entity.ReaperInterval = "0s"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid reaper_interval")
+	}
+}
+
+func TestValidateSoftDelete(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{
+		config.DEFAULT_ENTITY_TYPE: config.SchemaConfig{SoftDelete: true, SoftDeleteRetention: "72h"},
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	cfg.Entity.Schemas[config.DEFAULT_ENTITY_TYPE] = config.SchemaConfig{SoftDelete: true, SoftDeleteRetention: "3 days"}
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid soft_delete_retention")
+	}
+
+	// Retention requires soft delete
+	cfg.Entity.Schemas[config.DEFAULT_ENTITY_TYPE] = config.SchemaConfig{SoftDeleteRetention: "72h"}
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for soft_delete_retention without soft_delete")
+	}
+}
+
+func TestValidateSecurityPlugin(t *testing.T) {
+	cfg := config.Default()
+	cfg.Security.Plugin = "jwt"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for jwt plugin without keys")
+	}
+
+	cfg.Security.JWT = config.JWTConfig{JWKSFile: "/etc/etre/jwks.json", Leeway: "30s"}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	cfg.Security.JWT.Leeway = "30 seconds"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid jwt.leeway")
+	}
+
+	cfg.Security.Plugin = "mtls"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for mtls plugin without server.tls_ca")
+	}
+	cfg.Server.TLSCert = "/etc/etre/server.crt"
+	cfg.Server.TLSKey = "/etc/etre/server.key"
+	cfg.Server.TLSCA = "/etc/etre/ca.crt"
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	cfg.Security.Plugin = "api-key"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for api-key plugin without keys")
+	}
+	cfg.Security.APIKey = config.APIKeyConfig{KeysFile: "/etc/etre/keys.yaml", ReloadInterval: "1m"}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	cfg.Security.Plugin = "kerberos"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for invalid security.plugin")
+	}
+}
+
+func TestValidateSchemasDefaultsAndComputedLabels(t *testing.T) {
+	cfg := config.Default()
+	cfg.Entity.Schemas = map[string]config.SchemaConfig{
+		config.DEFAULT_ENTITY_TYPE: config.SchemaConfig{
+			Defaults:       map[string]interface{}{"status": "provisioning", "n": 1, "ok": true},
+			ComputedLabels: []string{"_ts", "_created_ts", "_created_by"},
+		},
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	invalid := []config.SchemaConfig{
+		{Defaults: map[string]interface{}{"_id": "x"}},            // metalabel
+		{Defaults: map[string]interface{}{"list": []string{"a"}}}, // value type
+		{ComputedLabels: []string{"_id"}},                         // not computed
+	}
+	for _, sc := range invalid {
+		cfg.Entity.Schemas[config.DEFAULT_ENTITY_TYPE] = sc
+		if err := config.Validate(cfg); err == nil {
+			t.Errorf("no error for invalid schema: %+v", sc)
+		}
+	}
+}
+
+func TestValidateTrace(t *testing.T) {
+	cfg := config.Default()
+	cfg.Trace.SampleRate = 1.5
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for trace.sample_rate > 1")
+	}
+
+	cfg.Trace.SampleRate = 0.1
+	cfg.Trace.File = "/tmp/etre-trace.json"
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	cfg.Trace.OTLPEndpoint = "http://localhost:4318/v1/traces"
+	if err := config.Validate(cfg); err == nil {
+		t.Errorf("no error for trace.file and trace.otlp_endpoint")
+	}
+}
+
+func TestValidateCDCRetention(t *testing.T) {
+	cfg := config.Default()
+	cfg.CDC.Retention = config.CDCRetentionConfig{
+		MaxAge:     "720h",
+		MaxEvents:  1000000,
+		CompactAge: "168h",
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	invalid := []config.CDCRetentionConfig{
+		{MaxAge: "forever"},
+		{MaxAge: "-1h"},
+		{MaxEvents: -1},
+		{CompactAge: "0s"},
+		{MaxAge: "24h", CompactAge: "48h"}, // compact_age >= max_age
+		{MaxAge: "24h", Interval: "x"},
+	}
+	for _, r := range invalid {
+		cfg.CDC.Retention = r
+		if err := config.Validate(cfg); err == nil {
+			t.Errorf("no error for invalid cdc.retention %+v", r)
+		}
+	}
+}
+
+func TestValidateCDCSinks(t *testing.T) {
+	cfg := config.Default()
+	cfg.CDC.Sinks = []config.CDCSinkConfig{
+		{Name: "hook", Type: "webhook", URL: "http://localhost/etre", Timeout: "2s", RetryCount: 3},
+		{Name: "archive", Type: "file", File: "/var/log/etre/cdc.json", MaxSizeMB: 100, MaxFiles: 5},
+	}
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("got error '%s', expected nil", err)
+	}
+
+	invalid := [][]config.CDCSinkConfig{
+		{{Type: "webhook", URL: "http://localhost"}},                    // no name
+		{{Name: "s", Type: "kafka"}},                                    // invalid type
+		{{Name: "s", Type: "webhook"}},                                  // no url
+		{{Name: "s", Type: "webhook", URL: "http://x", Timeout: "5"}},   // invalid duration
+		{{Name: "s", Type: "webhook", URL: "http://x", RetryCount: -1}}, // negative retry count
+		{{Name: "s", Type: "file"}},                                     // no file
+		{{Name: "s", Type: "file", File: "f", MaxFiles: -1}},            // negative max files
+		{ // duplicate name
+			{Name: "s", Type: "file", File: "f1"},
+			{Name: "s", Type: "file", File: "f2"},
+		},
+	}
+	for _, sinks := range invalid {
+		cfg.CDC.Sinks = sinks
+		if err := config.Validate(cfg); err == nil {
+			t.Errorf("no error for invalid cdc.sinks %+v", sinks)
+		}
+	}
+}
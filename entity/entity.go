@@ -54,40 +54,59 @@ var operatorMap = map[string]string{
 }
 
 // Filter translates a query.Query into a mongo-driver filter paramter.
+// Predicates on the same label, like a query ANDed with an ACL scope, are
+// combined with $and.
 func Filter(q query.Query) bson.M {
 	filter := bson.M{}
+	and := []bson.M{}
 	for _, p := range q.Predicates {
+		var cond bson.M
 		switch p.Operator {
 		case "exists":
-			filter[p.Label] = bson.M{"$exists": true}
+			cond = bson.M{"$exists": true}
 		case "notexists":
-			filter[p.Label] = bson.M{"$exists": false}
+			cond = bson.M{"$exists": false}
 		default:
 			if p.Label == etre.META_LABEL_ID {
 				switch p.Value.(type) {
 				case string:
 					id, _ := primitive.ObjectIDFromHex(p.Value.(string))
-					filter[p.Label] = bson.M{operatorMap[p.Operator]: id}
+					cond = bson.M{operatorMap[p.Operator]: id}
 				case []string:
 					vals := p.Value.([]string)
 					oids := make([]primitive.ObjectID, len(vals))
 					for i, v := range vals {
 						oids[i], _ = primitive.ObjectIDFromHex(v)
 					}
-					filter[p.Label] = bson.M{operatorMap[p.Operator]: oids}
+					cond = bson.M{operatorMap[p.Operator]: oids}
 				case primitive.ObjectID:
-					filter[p.Label] = bson.M{operatorMap[p.Operator]: p.Value}
+					cond = bson.M{operatorMap[p.Operator]: p.Value}
 				default:
 					panic(fmt.Sprintf("invalid _id value type: %T", p.Value))
 				}
 			} else {
-				filter[p.Label] = bson.M{operatorMap[p.Operator]: p.Value}
+				cond = bson.M{operatorMap[p.Operator]: p.Value}
 			}
 		}
+		if _, ok := filter[p.Label]; ok {
+			and = append(and, bson.M{p.Label: cond})
+		} else {
+			filter[p.Label] = cond
+		}
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
 	}
 	return filter
 }
 
+// Matches returns true if the entity matches the query. It's the in-memory
+// equivalent of Filter for entities not in the db, like new entities checked
+// against an ACL scope. See query.Matches.
+func Matches(q query.Query, e etre.Entity) bool {
+	return query.Matches(q, e)
+}
+
 const dupeKeyCode = 11000
 
 func IsDupeKeyError(err error) error {
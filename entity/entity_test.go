@@ -0,0 +1,75 @@
+// Copyright 2020, Square, Inc.
+
+package entity_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/square/etre"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+)
+
+func TestFilterSameLabel(t *testing.T) {
+	// A query ANDed with a scope on the same label must not overwrite the
+	// query predicate, else the scope widens the query
+	q, _ := query.Translate("team=db,x")
+	scope, _ := query.Translate("team=payments")
+	q.Predicates = append(q.Predicates, scope.Predicates...)
+	got := entity.Filter(q)
+	expect := bson.M{
+		"team": bson.M{"$eq": "db"},
+		"x":    bson.M{"$exists": true},
+		"$and": []bson.M{
+			{"team": bson.M{"$eq": "payments"}},
+		},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	e := etre.Entity{"team": "payments", "env": "prod", "n": int64(5)}
+	match := []string{
+		"team=payments",
+		"team==payments,env",
+		"team!=db",
+		"team in (db,payments)",
+		"team notin (db,web)",
+		"owner notin (db)",
+		"!owner",
+		"n>4,n<=5",
+	}
+	for _, s := range match {
+		q, err := query.Translate(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if !entity.Matches(q, e) {
+			t.Errorf("%s does not match, expected match", s)
+		}
+	}
+	noMatch := []string{
+		"team=db",
+		"owner=payments",
+		"team!=payments",
+		"team in (db,web)",
+		"!team",
+		"owner",
+		"n>5",
+		"team>1", // not a number
+	}
+	for _, s := range noMatch {
+		q, err := query.Translate(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if entity.Matches(q, e) {
+			t.Errorf("%s matches, expected no match", s)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020, Square, Inc.
+
+package entity
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/square/etre"
+	"github.com/square/etre/metrics"
+	"github.com/square/etre/query"
+)
+
+// REAPER_CALLER is the caller (CDC event Caller) of deletes by the Reaper.
+const REAPER_CALLER = "etre-reaper"
+
+// Reaper deletes expired entities: entities with metalabel _expires less than
+// or equal to now (Unix milliseconds). It deletes with Store.DeleteEntities, not
+// a Mongo TTL index, so a CDC delete event is written for each entity. It also
+// purges soft-deleted entities with Store.PurgeEntities.
+type Reaper struct {
+	store        Store
+	entityTypes  func() []string
+	metrics      metrics.Factory
+	metricGroups []string
+	interval     time.Duration
+}
+
+// NewReaper creates a Reaper that reaps the entity types returned by entityTypes
+// every interval, recording metrics in the metric groups.
+func NewReaper(store Store, entityTypes func() []string, mf metrics.Factory, metricGroups []string, interval time.Duration) *Reaper {
+	return &Reaper{
+		store:        store,
+		entityTypes:  entityTypes,
+		metrics:      mf,
+		metricGroups: metricGroups,
+		interval:     interval,
+	}
+}
+
+// Run reaps every interval until stopChan is closed.
+func (r *Reaper) Run(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Reap()
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Reap deletes expired entities and purges soft-deleted entities of all types
+// once. It returns the number of expired entities deleted per entity type.
+// Errors and panics are logged, not returned, so one entity type does not block
+// reaping others.
+func (r *Reaper) Reap() map[string]int {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	q := query.Query{
+		Predicates: []query.Predicate{
+			{Label: etre.META_LABEL_EXPIRES, Operator: "<=", Value: now},
+		},
+	}
+	reaped := map[string]int{}
+	for _, entityType := range r.entityTypes() {
+		if n := r.reap(entityType, q); n > 0 {
+			reaped[entityType] = n
+		}
+	}
+	return reaped
+}
+
+// reap deletes expired entities and purges soft-deleted entities of one type.
+// It returns the number of expired entities deleted.
+func (r *Reaper) reap(entityType string, q query.Query) int {
+	defer func() {
+		if v := recover(); v != nil {
+			b := make([]byte, 4096)
+			n := runtime.Stack(b, false)
+			log.Printf("PANIC: reaping %s entities: %v\n%s", entityType, v, string(b[0:n]))
+		}
+	}()
+	wo := WriteOp{
+		EntityType: entityType,
+		Caller:     REAPER_CALLER,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	deleted, err := r.store.WithContext(ctx).DeleteEntities(wo, q)
+	if err != nil {
+		// DeleteEntities stops on the first entity it can't delete, like one
+		// still referenced (on_delete=restrict), so delete the rest one by one
+		log.Printf("ERROR: reaping expired %s entities: %s (deleted %d, deleting the rest one by one)", entityType, err, len(deleted))
+		deleted = append(deleted, r.reapEach(ctx, wo, q)...)
+	}
+	purged, err := r.store.WithContext(ctx).PurgeEntities(wo)
+	if err != nil {
+		log.Printf("ERROR: purging soft-deleted %s entities: %s (purged %d)", entityType, err, len(purged))
+	}
+	if len(purged) > 0 {
+		log.Printf("Purged %d soft-deleted %s entities", len(purged), entityType)
+	}
+	if len(deleted) == 0 {
+		return 0
+	}
+	gm := r.metrics.Make(r.metricGroups)
+	gm.EntityType(entityType)
+	gm.Inc(metrics.Deleted, int64(len(deleted)))
+	gm.Inc(metrics.Expired, int64(len(deleted)))
+	return len(deleted)
+}
+
+// reapEach deletes expired entities one by one, skipping (and logging) those
+// that can't be deleted so they don't block reaping the others. It returns the
+// entities deleted.
+func (r *Reaper) reapEach(ctx context.Context, wo WriteOp, q query.Query) []etre.Entity {
+	f := etre.QueryFilter{ReturnLabels: []string{etre.META_LABEL_ID}}
+	expired, err := r.store.WithContext(ctx).ReadEntities(wo.EntityType, q, f)
+	if err != nil {
+		log.Printf("ERROR: reading expired %s entities: %s", wo.EntityType, err)
+		return nil
+	}
+	deleted := []etre.Entity{}
+	for _, e := range expired {
+		// Keep the _expires predicate in case the entity was updated since read
+		qe := query.Query{Predicates: append([]query.Predicate{
+			{Label: etre.META_LABEL_ID, Operator: "=", Value: e[etre.META_LABEL_ID]},
+		}, q.Predicates...)}
+		d, err := r.store.WithContext(ctx).DeleteEntities(wo, qe)
+		deleted = append(deleted, d...)
+		if err != nil {
+			log.Printf("ERROR: reaping expired %s entity %v: %s", wo.EntityType, e[etre.META_LABEL_ID], err)
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,144 @@
+// Copyright 2020, Square, Inc.
+
+package entity_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/metrics"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test/mock"
+)
+
+func TestReaper(t *testing.T) {
+	var gotWO []entity.WriteOp
+	var gotQuery query.Query
+	var gotPurge []string
+	store := mock.EntityStore{
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			gotWO = append(gotWO, wo)
+			gotQuery = q
+			if wo.EntityType == "rack" {
+				return nil, nil // nothing expired
+			}
+			return []etre.Entity{{"_id": "a"}, {"_id": "b"}}, nil
+		},
+		PurgeEntitiesFunc: func(wo entity.WriteOp) ([]etre.Entity, error) {
+			gotPurge = append(gotPurge, wo.EntityType)
+			return nil, nil
+		},
+	}
+	store.WithContextFunc = func(context.Context) entity.Store { return store }
+	m := mock.NewMetricsRecorder()
+	mf := mock.MetricsFactory{MetricRecorder: m}
+
+	r := entity.NewReaper(store, func() []string { return []string{"node", "rack"} }, mf, []string{"etre"}, time.Second)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	reaped := r.Reap()
+	if diff := deep.Equal(reaped, map[string]int{"node": 2}); diff != nil {
+		t.Error(diff)
+	}
+
+	expectWO := []entity.WriteOp{
+		{EntityType: "node", Caller: entity.REAPER_CALLER},
+		{EntityType: "rack", Caller: entity.REAPER_CALLER},
+	}
+	if diff := deep.Equal(gotWO, expectWO); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotPurge, []string{"node", "rack"}); diff != nil {
+		t.Error(diff)
+	}
+	if len(gotQuery.Predicates) != 1 {
+		t.Fatalf("got %d query predicates, expected 1: %+v", len(gotQuery.Predicates), gotQuery)
+	}
+	p := gotQuery.Predicates[0]
+	if p.Label != "_expires" || p.Operator != "<=" {
+		t.Errorf("got predicate %+v, expected _expires <= now", p)
+	}
+	if v, ok := p.Value.(int64); !ok || v < now {
+		t.Errorf("got predicate value %v (%T), expected int64 >= %d", p.Value, p.Value, now)
+	}
+
+	expectMetrics := []mock.MetricMethodArgs{
+		{Method: "EntityType", StringVal: "node"},
+		{Method: "Inc", Metric: metrics.Deleted, IntVal: 2},
+		{Method: "Inc", Metric: metrics.Expired, IntVal: 2},
+	}
+	if diff := deep.Equal(m.Called, expectMetrics); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestReaperPanic(t *testing.T) {
+	// A panic reaping one entity type, like a type retired while reaping,
+	// must not stop reaping other types or crash the server
+	store := mock.EntityStore{
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			if wo.EntityType == "rack" {
+				panic("rack retired")
+			}
+			return []etre.Entity{{"_id": "a"}}, nil
+		},
+		PurgeEntitiesFunc: func(wo entity.WriteOp) ([]etre.Entity, error) {
+			return nil, nil
+		},
+	}
+	store.WithContextFunc = func(context.Context) entity.Store { return store }
+	mf := mock.MetricsFactory{MetricRecorder: mock.NewMetricsRecorder()}
+
+	r := entity.NewReaper(store, func() []string { return []string{"rack", "node"} }, mf, []string{"etre"}, time.Second)
+	reaped := r.Reap()
+	if diff := deep.Equal(reaped, map[string]int{"node": 1}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestReaperReferenced(t *testing.T) {
+	// Expired entity "a" is still referenced (on_delete=restrict), so it can't
+	// be deleted, but it must not stop reaping expired entity "b"
+	restrictErr := entity.ValidationError{Err: errors.New("cannot delete node a: referenced by rack.node_id (on_delete=restrict)")}
+	idOf := func(q query.Query) interface{} {
+		for _, p := range q.Predicates {
+			if p.Label == "_id" {
+				return p.Value
+			}
+		}
+		return nil
+	}
+	store := mock.EntityStore{
+		ReadEntitiesFunc: func(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
+			return []etre.Entity{{"_id": "a"}, {"_id": "b"}}, nil
+		},
+		DeleteEntitiesFunc: func(wo entity.WriteOp, q query.Query) ([]etre.Entity, error) {
+			switch idOf(q) {
+			case nil, "a": // all expired stops on "a" first
+				return []etre.Entity{}, restrictErr
+			case "b":
+				if len(q.Predicates) != 2 || q.Predicates[1].Label != "_expires" {
+					t.Errorf("delete b without _expires predicate: %+v", q)
+				}
+				return []etre.Entity{{"_id": "b"}}, nil
+			}
+			return nil, nil
+		},
+		PurgeEntitiesFunc: func(wo entity.WriteOp) ([]etre.Entity, error) {
+			return nil, nil
+		},
+	}
+	store.WithContextFunc = func(context.Context) entity.Store { return store }
+	mf := mock.MetricsFactory{MetricRecorder: mock.NewMetricsRecorder()}
+
+	r := entity.NewReaper(store, func() []string { return []string{"node"} }, mf, []string{"etre"}, time.Second)
+	reaped := r.Reap()
+	if diff := deep.Equal(reaped, map[string]int{"node": 1}); diff != nil {
+		t.Error(diff)
+	}
+}
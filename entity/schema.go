@@ -0,0 +1,50 @@
+// Copyright 2020, Square, Inc.
+
+package entity
+
+import (
+	"time"
+)
+
+const (
+	ON_DELETE_RESTRICT = "restrict"
+	ON_DELETE_ALLOW    = "allow"
+)
+
+// Schema represents optional settings for one entity type. Schemas are mapped
+// from config.SchemaConfig and passed to NewStore keyed on entity type.
+type Schema struct {
+	// References are labels that reference other entities, keyed on label.
+	References map[string]Reference
+
+	// Defaults are label values set on insert if not set, keyed on label.
+	Defaults map[string]interface{}
+
+	// ComputedLabels are metalabels set on write. See etre.IsComputedLabel.
+	ComputedLabels []string
+
+	// TTL sets metalabel _expires on insert if not set. Zero disables.
+	TTL time.Duration
+
+	// SoftDelete marks entities deleted (metalabel _deleted) instead of removing
+	// them. Soft-deleted entities are purged after SoftDeleteRetention.
+	SoftDelete          bool
+	SoftDeleteRetention time.Duration
+
+	// CDCFullEntity sets etre.CDCEvent.Full: the whole entity after the write.
+	CDCFullEntity bool
+}
+
+// Reference is a label whose value is the _id (hex string) of an entity of
+// another type. For example, label host.rack_id references rack._id.
+type Reference struct {
+	EntityType string // referenced entity type
+	OnDelete   string // ON_DELETE_RESTRICT (default) or ON_DELETE_ALLOW
+}
+
+// referrer is a label of an entity type that references another entity type.
+// It's the inverse of a Reference, used to protect deletes.
+type referrer struct {
+	entityType string
+	label      string
+}
@@ -0,0 +1,109 @@
+// Copyright 2020, Square, Inc.
+
+package entity
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/query"
+)
+
+// Snapshot is entities and the CDC position they correspond to. A consumer
+// bootstraps a mirror by loading the entities, then streaming CDC events after
+// Position.
+type Snapshot struct {
+	Entities []etre.Entity
+	Position cdc.Checkpoint
+}
+
+// A Snapshotter reads a Snapshot.
+type Snapshotter interface {
+	// Snapshot reads entities of the type that match the query (all entities if
+	// the query is empty) and the CDC position of the entities.
+	Snapshot(ctx context.Context, entityType string, q query.Query) (Snapshot, error)
+}
+
+type snapshotter struct {
+	store   Store
+	client  *mongo.Client
+	cdcColl *mongo.Collection
+	txn     bool
+}
+
+// NewSnapshotter creates a Snapshotter that reads entities from the store using
+// the client, which must be the client of the store collections.
+//
+// The position is the last CDC event by seq (see cdc.ReadPosition), and every
+// event up to it is in the entities. CDC events are written after entity writes,
+// not in the same transaction, so entities can have newer writes too: events
+// after the position with a revision less than or equal to the entity _rev are
+// already applied, and the consumer must skip them.
+//
+// If txn is true, the CDC collection must be accessed through the same client.
+// Entities and position are read in a transaction with snapshot read concern,
+// so the only newer writes are those whose CDC event was not yet written. This
+// requires a replica set, and the snapshot must be read within the transaction
+// lifetime limit (transactionLifetimeLimitSeconds, default 60s), so it can fail
+// for entity types with many entities; use txn false for those.
+//
+// If txn is false (the CDC collection is on another cluster), the position is
+// read first, then entities, both with majority read concern, so entities can
+// also have writes made while reading.
+func NewSnapshotter(store Store, client *mongo.Client, cdcColl *mongo.Collection, txn bool) Snapshotter {
+	return snapshotter{
+		store:   store,
+		client:  client,
+		cdcColl: cdcColl,
+		txn:     txn,
+	}
+}
+
+func (s snapshotter) Snapshot(ctx context.Context, entityType string, q query.Query) (Snapshot, error) {
+	var snap Snapshot
+	sess, err := s.client.StartSession(options.Session().SetDefaultReadConcern(readconcern.Majority()))
+	if err != nil {
+		return snap, DbError{Err: err, Type: "db-snapshot"}
+	}
+	defer sess.EndSession(ctx)
+
+	// If the CDC collection is empty, the position is when the snapshot started
+	// so the consumer does not miss events written after it
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	read := func(sc mongo.SessionContext) (interface{}, error) {
+		pos, err := cdc.ReadPosition(sc, s.cdcColl)
+		if err != nil {
+			return nil, DbError{Err: err, Type: "db-snapshot-position"}
+		}
+		entities, err := s.store.WithContext(sc).ReadEntities(entityType, q, etre.QueryFilter{})
+		if err != nil {
+			return nil, err
+		}
+		if pos.Ts == 0 {
+			pos.Ts = now
+		}
+		snap = Snapshot{Entities: entities, Position: pos}
+		return nil, nil
+	}
+
+	if s.txn {
+		opts := options.Transaction().SetReadConcern(readconcern.Snapshot())
+		_, err = sess.WithTransaction(ctx, read, opts)
+	} else {
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			_, err := read(sc)
+			return err
+		})
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2020, Square, Inc.
+
+package entity_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/square/etre"
+	"github.com/square/etre/cdc"
+	"github.com/square/etre/entity"
+	"github.com/square/etre/query"
+	"github.com/square/etre/test/mock"
+)
+
+func TestSnapshot(t *testing.T) {
+	store := setup(t, &mock.CDCStore{})
+
+	cdcColl := client.Database("etre_test").Collection("cdc_snapshot")
+	if _, err := cdcColl.DeleteMany(context.TODO(), bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	events := []interface{}{
+		etre.CDCEvent{Id: "a", EntityId: "e1", Ts: 10},
+		etre.CDCEvent{Id: "b", EntityId: "e2", Ts: 20},
+		etre.CDCEvent{Id: "c", EntityId: "e3", Ts: 20},
+	}
+	if _, err := cdcColl.InsertMany(context.TODO(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test MongoDB is not a replica set, so no transaction
+	s := entity.NewSnapshotter(store, client, cdcColl, false)
+	q, _ := query.Translate("y=b")
+	got, err := s.Snapshot(context.TODO(), entityType, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := entity.Snapshot{
+		Entities: testNodes[1:3],
+		Position: cdc.Checkpoint{Ts: 20, EventIds: []string{"b", "c"}},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -4,6 +4,9 @@ package entity
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,6 +17,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/query"
+	"github.com/square/etre/trace"
 )
 
 // Store interface has methods needed to do CRUD operations on entities.
@@ -29,42 +33,115 @@ type Store interface {
 	DeleteEntities(WriteOp, query.Query) ([]etre.Entity, error)
 
 	DeleteLabel(WriteOp, string) (etre.Entity, error)
+
+	RenameLabel(WriteOp, query.Query, string, string) ([]etre.Entity, error)
+
+	DeleteLabels(WriteOp, query.Query, string) ([]etre.Entity, error)
+
+	PurgeEntities(WriteOp) ([]etre.Entity, error)
 }
 
 type store struct {
-	coll map[string]*mongo.Collection
-	cdcs cdc.Store
-	ctx  context.Context
+	coll    *collections
+	cdcs    cdc.Store
+	schemas map[string]Schema
+	ctx     context.Context
 }
 
-// NewStore creates a Store.
-func NewStore(entities map[string]*mongo.Collection, cdcStore cdc.Store) store {
+// NewStore creates a Store. schemas are optional, keyed on entity type.
+func NewStore(entities map[string]*mongo.Collection, cdcStore cdc.Store, schemas map[string]Schema) store {
 	return store{
-		coll: entities,
-		cdcs: cdcStore,
-		ctx:  context.Background(),
+		coll:    &collections{RWMutex: &sync.RWMutex{}, m: entities},
+		cdcs:    cdcStore,
+		schemas: schemas,
+		ctx:     context.Background(),
 	}
 }
 
+// collections maps entity types to collections. It's a pointer in store so
+// SetCollections changes all copies of the store (see WithContext).
+type collections struct {
+	*sync.RWMutex
+	m map[string]*mongo.Collection
+}
+
+// SetCollections sets the entity type collections. It's called when entity
+// types are created or retired at runtime.
+func (s store) SetCollections(entities map[string]*mongo.Collection) {
+	s.coll.Lock()
+	s.coll.m = entities
+	s.coll.Unlock()
+}
+
+// collection returns the collection for the entity type, or a ValidationError
+// if the type is invalid. A type validated by the API can still be invalid if
+// it was retired at runtime (see SetCollections) before the store uses it.
+func (s store) collection(entityType string) (*mongo.Collection, error) {
+	s.coll.RLock()
+	defer s.coll.RUnlock()
+	c := s.coll.m[entityType]
+	if c == nil {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("invalid entity type: %s", entityType),
+			Type: "invalid-entity-type",
+		}
+	}
+	return c, nil
+}
+
 func (s store) WithContext(ctx context.Context) Store {
 	s.ctx = ctx
 	return s
 }
 
+// span starts a child of the span in s.ctx, if any. The returned store has the
+// child span in its context, so nested spans like cdc.Store.Write are its children.
+func (s store) span(name, entityType string) (store, *trace.Span) {
+	ctx, span := trace.Start(s.ctx, name)
+	span.SetAttribute("etre.entity_type", entityType)
+	s.ctx = ctx
+	return s, span
+}
+
 // ReadEntities queries the db and returns a slice of Entity objects if
 // something is found, a nil slice if nothing is found, and an error if one
 // occurs.
 func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter) ([]etre.Entity, error) {
-	c, ok := s.coll[entityType]
-	if !ok {
-		panic("invalid entity type passed to ReadEntities: " + entityType)
+	s, span := s.span("entity.Store.ReadEntities", entityType)
+	defer span.End()
+
+	c, err := s.collection(entityType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(f.Expand) > 0 {
+		if f.Distinct {
+			return nil, ValidationError{
+				Err:  fmt.Errorf("distinct and expand are mutually exclusive"),
+				Type: "invalid-expand",
+			}
+		}
+		for _, label := range f.Expand {
+			if _, ok := s.schemas[entityType].References[label]; !ok {
+				return nil, ValidationError{
+					Err:  fmt.Errorf("cannot expand label %s: not a reference (config.entity.schemas.%s.references)", label, entityType),
+					Type: "invalid-expand",
+				}
+			}
+		}
+	}
+
+	filter := Filter(q)
+	if !f.IncludeDeleted {
+		s.notDeleted(entityType, filter)
 	}
 
 	// Distinct optimizaiton: unique values for the one return label. For example,
 	// "es -u node.metacluster zone=pd" returns a list of unique metacluster names.
 	// This is 10x faster than "es node.metacluster zone=pd | sort -u".
 	if len(f.ReturnLabels) == 1 && f.Distinct {
-		values, err := c.Distinct(s.ctx, f.ReturnLabels[0], Filter(q))
+		values, err := c.Distinct(s.ctx, f.ReturnLabels[0], filter)
 		if err != nil {
 			return nil, s.dbError(err, "db-read-distinct")
 		}
@@ -79,6 +156,12 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 	p := bson.M{}
 	if len(f.ReturnLabels) > 0 {
 		for _, label := range f.ReturnLabels {
+			// Return label of an expanded reference, like "rack_id.name",
+			// requires the reference label (rack_id), which is removed after
+			// expanding if not explicitly returned
+			if ref := expandedBy(label, f.Expand); ref != "" {
+				label = ref
+			}
 			p[label] = 1
 		}
 		// Only include _id if explicitly set in f.ReturnLabels. If not,
@@ -90,7 +173,7 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 	}
 
 	opts := options.Find().SetProjection(p)
-	cursor, err := c.Find(s.ctx, Filter(q), opts)
+	cursor, err := c.Find(s.ctx, filter, opts)
 	if err != nil {
 		return nil, s.dbError(err, "db-query")
 	}
@@ -98,6 +181,11 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 	if err := cursor.All(s.ctx, &entities); err != nil {
 		return nil, s.dbError(err, "db-read-cursor")
 	}
+	for _, label := range f.Expand {
+		if err := s.expand(entityType, label, entities, f.ReturnLabels, f.ExpandScope[label]); err != nil {
+			return nil, err
+		}
+	}
 	return entities, nil
 }
 
@@ -117,9 +205,12 @@ func (s store) ReadEntities(entityType string, q query.Query, f etre.QueryFilter
 // inserting one by one), caller should only return subset of entities that
 // failed to be inserted.
 func (s store) CreateEntities(wo WriteOp, entities []etre.Entity) ([]string, error) {
-	c, ok := s.coll[wo.EntityType]
-	if !ok {
-		panic("invalid entity type passed to CreateEntities: " + wo.EntityType)
+	s, span := s.span("entity.Store.CreateEntities", wo.EntityType)
+	defer span.End()
+
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
 	}
 
 	// A slice of IDs we generate to insert along with entities into DB
@@ -130,6 +221,23 @@ func (s store) CreateEntities(wo WriteOp, entities []etre.Entity) ([]string, err
 		entities[i]["_type"] = wo.EntityType
 		entities[i]["_rev"] = int64(0)
 
+		// Default values for labels the entity does not have
+		for label, v := range s.schemas[wo.EntityType].Defaults {
+			if _, ok := entities[i][label]; !ok {
+				entities[i][label] = v
+			}
+		}
+		for label, v := range s.computedLabels(wo, true) {
+			entities[i][label] = v
+		}
+		if ttl := s.schemas[wo.EntityType].TTL; ttl > 0 && !entities[i].Has(etre.META_LABEL_EXPIRES) {
+			entities[i][etre.META_LABEL_EXPIRES] = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+		}
+
+		if err := s.checkReferences(wo.EntityType, entities[i]); err != nil {
+			return newIds, err
+		}
+
 		res, err := c.InsertOne(s.ctx, entities[i])
 		if err != nil {
 			return newIds, s.dbError(err, "db-insert")
@@ -145,6 +253,9 @@ func (s store) CreateEntities(wo WriteOp, entities []etre.Entity) ([]string, err
 			old: nil,
 			rev: int64(0),
 		}
+		if s.schemas[wo.EntityType].CDCFullEntity {
+			cp.full = &entities[i] // same as new on insert
+		}
 		if err := s.cdcWrite(entities[i], wo, cp); err != nil {
 			return newIds, err
 		}
@@ -169,13 +280,20 @@ func (s store) CreateEntities(wo WriteOp, entities []etre.Entity) ([]string, err
 //   diffs, err := c.UpdateEntities(q, update)
 //
 func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]etre.Entity, error) {
-	c, ok := s.coll[wo.EntityType]
-	if !ok {
-		panic("invalid entity type passed to UpdateEntities: " + wo.EntityType)
+	s, span := s.span("entity.Store.UpdateEntities", wo.EntityType)
+	defer span.End()
+
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkReferences(wo.EntityType, patch); err != nil {
+		return nil, err
 	}
 
 	fopts := options.Find().SetProjection(bson.M{"_id": 1})
-	cursor, err := c.Find(s.ctx, Filter(q), fopts)
+	cursor, err := c.Find(s.ctx, s.notDeleted(wo.EntityType, Filter(q)), fopts)
 	if err != nil {
 		return nil, s.dbError(err, "db-query")
 	}
@@ -184,18 +302,37 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 	// diffs is a slice made up of a diff for each doc updated
 	diffs := []etre.Entity{}
 
+	// Computed labels are set with the patch, so they're part of the diff
+	// and the CDC event like user-defined labels
+	set := patch
+	if computed := s.computedLabels(wo, false); len(computed) > 0 {
+		set = etre.Entity{}
+		for label, v := range patch {
+			set[label] = v
+		}
+		for label, v := range computed {
+			set[label] = v
+		}
+	}
+
 	updates := bson.M{
-		"$set": patch,
+		"$set": set,
 		"$inc": bson.M{
 			"_rev": 1, // increment the revision
 		},
 	}
 
 	p := bson.M{"_id": 1, "_type": 1, "_rev": 1}
-	for label := range patch {
+	for label := range set {
 		p[label] = 1
 	}
-	opts := options.FindOneAndUpdate().SetProjection(p)
+	// With full entity CDC events, the whole entity is returned to make the
+	// full entity after the update, then projected to the diff
+	full := s.schemas[wo.EntityType].CDCFullEntity
+	opts := options.FindOneAndUpdate()
+	if !full {
+		opts.SetProjection(p)
+	}
 
 	nextId := map[string]primitive.ObjectID{}
 	for cursor.Next(s.ctx) {
@@ -205,13 +342,18 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 		uq, _ := query.Translate("_id=" + nextId["_id"].Hex())
 
 		var orig etre.Entity
-		err := c.FindOneAndUpdate(s.ctx, Filter(uq), updates, opts).Decode(&orig)
+		err := c.FindOneAndUpdate(s.ctx, s.notDeleted(wo.EntityType, Filter(uq)), updates, opts).Decode(&orig)
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
 				break
 			}
 			return diffs, s.dbError(err, "db-update")
 		}
+		var after *etre.Entity
+		if full {
+			after = fullEntity(orig, nil, set)
+			orig = project(orig, p)
+		}
 		diffs = append(diffs, orig)
 
 		old := etre.Entity{}
@@ -223,11 +365,12 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 		}
 
 		cp := cdcPartial{
-			op:  "u",
-			id:  orig["_id"].(primitive.ObjectID),
-			rev: orig.Rev() + 1,
-			old: &old,
-			new: &patch,
+			op:   "u",
+			id:   orig["_id"].(primitive.ObjectID),
+			rev:  orig.Rev() + 1,
+			old:  &old,
+			new:  &set,
+			full: after,
 		}
 		if err := s.cdcWrite(patch, wo, cp); err != nil {
 			return diffs, err
@@ -249,18 +392,72 @@ func (s store) UpdateEntities(wo WriteOp, q query.Query, patch etre.Entity) ([]e
 // Returns a slice of successfully deleted entities an error if there is one.
 // For example, if 4 entities were supposed to be deleted and 3 are ok and the
 // 4th fails, a slice with 3 deleted entities and an error will be returned.
+//
+// If soft delete is enabled for the entity type, entities are updated, not
+// removed: metalabels _deleted=true and _deleted_ts are set. The CDC event is
+// a delete with the metalabels in New. PurgeEntities removes them later.
 func (s store) DeleteEntities(wo WriteOp, q query.Query) ([]etre.Entity, error) {
-	c, ok := s.coll[wo.EntityType]
-	if !ok {
-		panic("invalid entity type passed to DeleteEntities: " + wo.EntityType)
+	s, span := s.span("entity.Store.DeleteEntities", wo.EntityType)
+	defer span.End()
+
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	// If other entities reference this type and restrict deletes, check each
+	// entity before deleting it, then delete it by _id
+	referrers := s.referrers(wo.EntityType)
+
+	// Soft delete sets metalabels (and computed labels) like an update
+	softDelete := s.schemas[wo.EntityType].SoftDelete
+	var set etre.Entity
+	var softUpdate bson.M
+	if softDelete {
+		set = etre.Entity{
+			etre.META_LABEL_DELETED:    true,
+			etre.META_LABEL_DELETED_TS: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+		for label, v := range s.computedLabels(wo, false) {
+			set[label] = v
+		}
+		softUpdate = bson.M{
+			"$set": set,
+			"$inc": bson.M{"_rev": 1}, // increment the revision
+		}
 	}
 
 	deleted := []etre.Entity{}
 	for {
+		filter := s.notDeleted(wo.EntityType, Filter(q))
+		if len(referrers) > 0 {
+			var next etre.Entity
+			opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+			if err := c.FindOne(s.ctx, filter, opts).Decode(&next); err != nil {
+				if err == mongo.ErrNoDocuments {
+					break
+				}
+				return deleted, s.dbError(err, "db-query")
+			}
+			id := next["_id"].(primitive.ObjectID)
+			if err := s.checkReferrers(wo.EntityType, id, referrers); err != nil {
+				return deleted, err
+			}
+			filter = s.notDeleted(wo.EntityType, bson.M{"_id": id})
+		}
+
 		var old etre.Entity
-		err := c.FindOneAndDelete(s.ctx, Filter(q)).Decode(&old)
+		var err error
+		if softDelete {
+			err = c.FindOneAndUpdate(s.ctx, filter, softUpdate).Decode(&old) // returns doc before update
+		} else {
+			err = c.FindOneAndDelete(s.ctx, filter).Decode(&old)
+		}
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
+				if len(referrers) > 0 {
+					continue // deleted by another caller, check next
+				}
 				break
 			}
 			return deleted, s.dbError(err, "db-delete")
@@ -273,6 +470,9 @@ func (s store) DeleteEntities(wo WriteOp, q query.Query) ([]etre.Entity, error)
 			new: nil,
 			rev: old.Rev() + 1,
 		}
+		if softDelete {
+			ce.new = &set // marks a soft delete
+		}
 		if err := s.cdcWrite(old, wo, ce); err != nil {
 			return deleted, err
 		}
@@ -281,33 +481,104 @@ func (s store) DeleteEntities(wo WriteOp, q query.Query) ([]etre.Entity, error)
 	return deleted, nil
 }
 
+// PurgeEntities removes soft-deleted entities that were deleted longer ago than
+// the retention (Schema.SoftDeleteRetention), writing the final CDC event (op
+// "p", purge) for each. It does nothing if soft delete is not enabled for the entity
+// type. Like DeleteEntities, it allows for partial success and failure.
+func (s store) PurgeEntities(wo WriteOp) ([]etre.Entity, error) {
+	s, span := s.span("entity.Store.PurgeEntities", wo.EntityType)
+	defer span.End()
+
+	schema := s.schemas[wo.EntityType]
+	if !schema.SoftDelete {
+		return nil, nil
+	}
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	before := time.Now().Add(-schema.SoftDeleteRetention).UnixNano() / int64(time.Millisecond)
+	filter := bson.M{
+		etre.META_LABEL_DELETED:    true,
+		etre.META_LABEL_DELETED_TS: bson.M{"$lte": before},
+	}
+	purged := []etre.Entity{}
+	for {
+		var old etre.Entity
+		err := c.FindOneAndDelete(s.ctx, filter).Decode(&old)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			return purged, s.dbError(err, "db-delete")
+		}
+		purged = append(purged, old)
+		ce := cdcPartial{
+			op:  "p",
+			id:  old["_id"].(primitive.ObjectID),
+			old: &old,
+			new: nil,
+			rev: old.Rev() + 1,
+		}
+		if err := s.cdcWrite(old, wo, ce); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
 // DeleteLabel deletes a label from an entity.
 func (s store) DeleteLabel(wo WriteOp, label string) (etre.Entity, error) {
-	c, ok := s.coll[wo.EntityType]
-	if !ok {
-		panic("invalid entity type passed to DeleteLabel: " + wo.EntityType)
+	s, span := s.span("entity.Store.DeleteLabel", wo.EntityType)
+	defer span.End()
+
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
 	}
 
 	id, _ := primitive.ObjectIDFromHex(wo.EntityId)
-	filter := bson.M{"_id": id}
+	filter := s.notDeleted(wo.EntityType, bson.M{"_id": id})
 	update := bson.M{
 		"$unset": bson.M{label: ""}, // removes label, Mongo expects "" (see $unset docs)
 		"$inc":   bson.M{"_rev": 1}, // increment the revision
 	}
-	opts := options.FindOneAndUpdate().
-		SetProjection(bson.M{"_id": 1, "_type": 1, "_rev": 1, label: 1}).
-		SetReturnDocument(options.Before)
+	p := bson.M{"_id": 1, "_type": 1, "_rev": 1, label: 1}
+	var new *etre.Entity // not on delete label, unless computed labels
+	if computed := s.computedLabels(wo, false); len(computed) > 0 {
+		update["$set"] = computed
+		for l := range computed {
+			p[l] = 1
+		}
+		new = &computed
+	}
+	full := s.schemas[wo.EntityType].CDCFullEntity
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	if !full {
+		opts.SetProjection(p)
+	}
 	var old etre.Entity
-	err := c.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&old)
+	err = c.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&old)
 	if err != nil {
 		return nil, s.dbError(err, "db-update")
 	}
+	var after *etre.Entity
+	if full {
+		var set etre.Entity
+		if new != nil {
+			set = *new
+		}
+		after = fullEntity(old, []string{label}, set)
+		old = project(old, p)
+	}
 	cp := cdcPartial{
-		op:  "u",
-		id:  old["_id"].(primitive.ObjectID),
-		new: nil, // not on delete label
-		old: &old,
-		rev: old.Rev() + 1,
+		op:   "u",
+		id:   old["_id"].(primitive.ObjectID),
+		new:  new,
+		old:  &old,
+		rev:  old.Rev() + 1,
+		full: after,
 	}
 	if err := s.cdcWrite(etre.Entity{}, wo, cp); err != nil {
 		return old, err
@@ -316,6 +587,379 @@ func (s store) DeleteLabel(wo WriteOp, label string) (etre.Entity, error) {
 	return old, nil
 }
 
+// RenameLabel renames label from to label to on all entities that match the
+// query and have label from. If an entity already has label to, its value is
+// overwritten. Like UpdateEntities, it allows for partial success and failure.
+// It returns the old from and to labels of each updated entity.
+func (s store) RenameLabel(wo WriteOp, q query.Query, from, to string) ([]etre.Entity, error) {
+	s, span := s.span("entity.Store.RenameLabel", wo.EntityType)
+	defer span.End()
+
+	refs := s.schemas[wo.EntityType].References
+	if _, ok := refs[from]; ok {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("cannot rename reference label %s (config.entity.schemas.%s.references)", from, wo.EntityType),
+			Type: "invalid-rename",
+		}
+	}
+	if _, ok := refs[to]; ok {
+		return nil, ValidationError{
+			Err:  fmt.Errorf("cannot rename label to reference label %s (config.entity.schemas.%s.references)", to, wo.EntityType),
+			Type: "invalid-rename",
+		}
+	}
+	update := bson.M{
+		"$rename": bson.M{from: to},
+	}
+	return s.updateLabel(wo, q, from, update, []string{from, to}, func(old etre.Entity) etre.Entity {
+		return etre.Entity{to: old[from]}
+	})
+}
+
+// DeleteLabels deletes the label from all entities that match the query and
+// have the label. Like UpdateEntities, it allows for partial success and failure.
+// It returns the old label of each updated entity.
+func (s store) DeleteLabels(wo WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	s, span := s.span("entity.Store.DeleteLabels", wo.EntityType)
+	defer span.End()
+
+	update := bson.M{
+		"$unset": bson.M{label: ""}, // removes label, Mongo expects "" (see $unset docs)
+	}
+	return s.updateLabel(wo, q, label, update, []string{label}, func(old etre.Entity) etre.Entity {
+		return nil
+	})
+}
+
+// updateLabel applies the update to each entity that matches the query and has
+// the label, one at a time to write a CDC event for each. labels are changed by
+// the update, and new returns the new labels for the CDC event, if any.
+func (s store) updateLabel(wo WriteOp, q query.Query, label string, update bson.M, labels []string, new func(old etre.Entity) etre.Entity) ([]etre.Entity, error) {
+	c, err := s.collection(wo.EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := s.notDeleted(wo.EntityType, Filter(q))
+	if _, ok := filter[label]; !ok {
+		filter[label] = bson.M{"$exists": true}
+	}
+	fopts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := c.Find(s.ctx, filter, fopts)
+	if err != nil {
+		return nil, s.dbError(err, "db-query")
+	}
+	defer cursor.Close(s.ctx)
+
+	update["$inc"] = bson.M{"_rev": 1} // increment the revision
+	p := bson.M{"_id": 1, "_type": 1, "_rev": 1}
+	for _, l := range labels {
+		p[l] = 1
+	}
+	computed := s.computedLabels(wo, false)
+	if len(computed) > 0 {
+		update["$set"] = computed
+		for l := range computed {
+			p[l] = 1
+		}
+	}
+	full := s.schemas[wo.EntityType].CDCFullEntity
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	if !full {
+		opts.SetProjection(p)
+	}
+
+	diffs := []etre.Entity{}
+	nextId := map[string]primitive.ObjectID{}
+	for cursor.Next(s.ctx) {
+		if err := cursor.Decode(&nextId); err != nil {
+			return diffs, s.dbError(err, "db-cursor-decode")
+		}
+
+		var orig etre.Entity
+		uf := s.notDeleted(wo.EntityType, bson.M{"_id": nextId["_id"], label: bson.M{"$exists": true}})
+		err := c.FindOneAndUpdate(s.ctx, uf, update, opts).Decode(&orig)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue // changed by another caller
+			}
+			return diffs, s.dbError(err, "db-update")
+		}
+		whole := orig
+		if full {
+			orig = project(orig, p)
+		}
+		diffs = append(diffs, orig)
+
+		old := etre.Entity{}
+		for k, v := range orig {
+			if k == "_id" || k == "_type" || k == "_rev" {
+				continue
+			}
+			old[k] = v
+		}
+		cp := cdcPartial{
+			op:  "u",
+			id:  orig["_id"].(primitive.ObjectID),
+			rev: orig.Rev() + 1,
+			old: &old,
+		}
+		newLabels := new(old)
+		if len(computed) > 0 {
+			if newLabels == nil {
+				newLabels = etre.Entity{}
+			}
+			for l, v := range computed {
+				newLabels[l] = v
+			}
+		}
+		if newLabels != nil {
+			cp.new = &newLabels
+		}
+		if full {
+			cp.full = fullEntity(whole, labels, newLabels)
+		}
+		if err := s.cdcWrite(etre.Entity{}, wo, cp); err != nil {
+			return diffs, err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return diffs, s.dbError(err, "db-cursor-next")
+	}
+
+	return diffs, nil
+}
+
+// computedLabels returns the computed labels enabled for the entity type and
+// their values for an insert (create=true) or an update. It returns nil if no
+// computed labels are enabled.
+func (s store) computedLabels(wo WriteOp, create bool) etre.Entity {
+	labels := s.schemas[wo.EntityType].ComputedLabels
+	if len(labels) == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	computed := etre.Entity{}
+	for _, label := range labels {
+		switch label {
+		case etre.META_LABEL_TS:
+			computed[label] = now
+		case etre.META_LABEL_CREATED_TS:
+			if create {
+				computed[label] = now
+			}
+		case etre.META_LABEL_CREATED_BY:
+			if create {
+				computed[label] = wo.Caller
+			}
+		case etre.META_LABEL_UPDATED_TS:
+			if !create {
+				computed[label] = now
+			}
+		case etre.META_LABEL_UPDATED_BY:
+			if !create {
+				computed[label] = wo.Caller
+			}
+		}
+	}
+	return computed
+}
+
+// notDeleted adds a condition to the filter to exclude soft-deleted entities if
+// soft delete is enabled for the entity type. It returns the filter.
+func (s store) notDeleted(entityType string, filter bson.M) bson.M {
+	if s.schemas[entityType].SoftDelete {
+		filter[etre.META_LABEL_DELETED] = bson.M{"$ne": true}
+	}
+	return filter
+}
+
+// --------------------------------------------------------------------------
+// References
+// --------------------------------------------------------------------------
+
+// checkReferences returns a ValidationError if a reference label in the entity
+// has an invalid value or references an entity that does not exist. Null values
+// are allowed; they reference nothing.
+func (s store) checkReferences(entityType string, e etre.Entity) error {
+	for label, ref := range s.schemas[entityType].References {
+		v, ok := e[label]
+		if !ok || v == nil {
+			continue
+		}
+		id, ok := v.(string)
+		if !ok {
+			return ValidationError{
+				Err:  fmt.Errorf("label %s references %s._id: value must be a string, got %T", label, ref.EntityType, v),
+				Type: "invalid-reference",
+			}
+		}
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return ValidationError{
+				Err:  fmt.Errorf("label %s references %s._id: %s is not a valid ObjectID", label, ref.EntityType, id),
+				Type: "invalid-reference",
+			}
+		}
+		c, err := s.collection(ref.EntityType)
+		if err != nil {
+			return ValidationError{
+				Err:  fmt.Errorf("label %s references %s._id: %s", label, ref.EntityType, err),
+				Type: "invalid-reference",
+			}
+		}
+		n, err := c.CountDocuments(s.ctx, s.notDeleted(ref.EntityType, bson.M{"_id": oid}), options.Count().SetLimit(1))
+		if err != nil {
+			return s.dbError(err, "db-read-reference")
+		}
+		if n == 0 {
+			return ValidationError{
+				Err:  fmt.Errorf("label %s references %s %s which does not exist", label, ref.EntityType, id),
+				Type: "invalid-reference",
+			}
+		}
+	}
+	return nil
+}
+
+// referrers returns the labels of all entity types that reference the given
+// entity type and restrict deleting it.
+func (s store) referrers(entityType string) []referrer {
+	var r []referrer
+	for t, schema := range s.schemas {
+		for label, ref := range schema.References {
+			if ref.EntityType != entityType || ref.OnDelete == ON_DELETE_ALLOW {
+				continue
+			}
+			r = append(r, referrer{entityType: t, label: label})
+		}
+	}
+	return r
+}
+
+// checkReferrers returns a ValidationError if any referrer references the entity.
+func (s store) checkReferrers(entityType string, id primitive.ObjectID, referrers []referrer) error {
+	for _, r := range referrers {
+		c, err := s.collection(r.entityType)
+		if err != nil {
+			return ValidationError{
+				Err:  fmt.Errorf("cannot delete %s %s: cannot check referrer %s.%s: %s", entityType, id.Hex(), r.entityType, r.label, err),
+				Type: "entity-referenced",
+			}
+		}
+		n, err := c.CountDocuments(s.ctx, s.notDeleted(r.entityType, bson.M{r.label: id.Hex()}), options.Count().SetLimit(1))
+		if err != nil {
+			return s.dbError(err, "db-read-reference")
+		}
+		if n > 0 {
+			return ValidationError{
+				Err: fmt.Errorf("cannot delete %s %s: referenced by %s.%s (on_delete=%s)",
+					entityType, id.Hex(), r.entityType, r.label, ON_DELETE_RESTRICT),
+				Type: "entity-referenced",
+			}
+		}
+	}
+	return nil
+}
+
+// expand inlines the labels of the entities referenced by label. Inlined labels
+// are prefixed with the reference label, like "rack_id.name". If returnLabels
+// has labels like "rack_id.name", only those labels are inlined, and the reference
+// label (rack_id) is removed unless it's also a return label. Only referenced
+// entities matching scope are inlined, if scope has predicates.
+func (s store) expand(entityType, label string, entities []etre.Entity, returnLabels []string, scope query.Query) error {
+	ref := s.schemas[entityType].References[label]
+
+	keepLabel := len(returnLabels) == 0
+	var refLabels []string
+	for _, rl := range returnLabels {
+		if rl == label {
+			keepLabel = true
+		} else if expandedBy(rl, []string{label}) != "" {
+			refLabels = append(refLabels, strings.TrimPrefix(rl, label+"."))
+		}
+	}
+
+	// Unique, valid _id of referenced entities. Invalid or dangling references
+	// are not an error on read; there's nothing to inline.
+	ids := []primitive.ObjectID{}
+	seen := map[string]bool{}
+	for _, e := range entities {
+		v, ok := e[label].(string)
+		if !ok || seen[v] {
+			continue
+		}
+		seen[v] = true
+		if oid, err := primitive.ObjectIDFromHex(v); err == nil {
+			ids = append(ids, oid)
+		}
+	}
+
+	refs := map[string]etre.Entity{}
+	if len(ids) > 0 {
+		p := bson.M{}
+		for _, rl := range refLabels {
+			p[rl] = 1
+		}
+		filter := bson.M{"_id": bson.M{"$in": ids}}
+		if len(scope.Predicates) > 0 {
+			filter = bson.M{"$and": []bson.M{filter, Filter(scope)}}
+		}
+		c, err := s.collection(ref.EntityType)
+		if err != nil {
+			return ValidationError{
+				Err:  fmt.Errorf("cannot expand label %s: %s", label, err),
+				Type: "invalid-expand",
+			}
+		}
+		opts := options.Find().SetProjection(p)
+		cursor, err := c.Find(s.ctx, s.notDeleted(ref.EntityType, filter), opts)
+		if err != nil {
+			return s.dbError(err, "db-query-reference")
+		}
+		found := []etre.Entity{}
+		if err := cursor.All(s.ctx, &found); err != nil {
+			return s.dbError(err, "db-read-cursor")
+		}
+		for _, r := range found {
+			refs[r["_id"].(primitive.ObjectID).Hex()] = r
+		}
+	}
+
+	for _, e := range entities {
+		v, _ := e[label].(string)
+		if r, ok := refs[v]; ok {
+			if len(refLabels) > 0 {
+				for _, rl := range refLabels {
+					e[label+"."+rl] = r[rl]
+				}
+			} else {
+				for k, val := range r {
+					e[label+"."+k] = val
+				}
+			}
+		}
+		if !keepLabel {
+			delete(e, label)
+		}
+	}
+
+	return nil
+}
+
+// expandedBy returns the expand label that the return label is expanded by,
+// or an empty string. For example, return label "rack_id.name" is expanded by
+// "rack_id".
+func expandedBy(returnLabel string, expand []string) string {
+	for _, label := range expand {
+		if strings.HasPrefix(returnLabel, label+".") {
+			return label
+		}
+	}
+	return ""
+}
+
 func (s store) dbError(err error, errType string) error {
 	if ctxErr := s.ctx.Err(); ctxErr != nil {
 		return DbError{Err: ctxErr, Type: errType}
@@ -341,6 +985,42 @@ type cdcPartial struct {
 	old *etre.Entity
 	new *etre.Entity
 	rev int64
+
+	// full is the whole entity after the write if Schema.CDCFullEntity
+	full *etre.Entity
+}
+
+// fullEntity returns the whole entity after a write: the entity before the
+// write without the unset labels, with the set labels, and the next revision.
+// It's computed from the document returned atomically by the write instead of
+// read again after the write so it's exactly the state of the revision.
+func fullEntity(before etre.Entity, unset []string, set etre.Entity) *etre.Entity {
+	after := etre.Entity{}
+	for k, v := range before {
+		after[k] = v
+	}
+	for _, label := range unset {
+		delete(after, label)
+	}
+	for k, v := range set {
+		after[k] = v
+	}
+	if _, ok := set["_rev"]; !ok {
+		after["_rev"] = before.Rev() + 1
+	}
+	return &after
+}
+
+// project returns only the labels of the entity in the projection, like the
+// db projection would.
+func project(e etre.Entity, p bson.M) etre.Entity {
+	projected := etre.Entity{}
+	for label := range p {
+		if v, ok := e[label]; ok {
+			projected[label] = v
+		}
+	}
+	return projected
 }
 
 func (s store) cdcWrite(e etre.Entity, wo WriteOp, cp cdcPartial) error {
@@ -361,12 +1041,17 @@ func (s store) cdcWrite(e etre.Entity, wo WriteOp, cp cdcPartial) error {
 		EntityRev:  cp.rev,
 		Old:        cp.old,
 		New:        cp.new,
+		Full:       cp.full,
 
 		SetId:   set.Id,
 		SetOp:   set.Op,
 		SetSize: set.Size,
 	}
-	if err := s.cdcs.Write(s.ctx, event); err != nil {
+	ctx, span := trace.Start(s.ctx, "cdc.Store.Write")
+	err := s.cdcs.Write(ctx, event)
+	span.SetError(err)
+	span.End()
+	if err != nil {
 		return DbError{Err: err, Type: "cdc-write", EntityId: cp.id.Hex()}
 	}
 	return nil
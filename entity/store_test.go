@@ -5,6 +5,7 @@ package entity_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"go.mongodb.org/mongo-driver/bson"
@@ -81,7 +82,7 @@ func setup(t *testing.T, cdcm *mock.CDCStore) entity.Store {
 		testNodes[i]["_id"] = id.(primitive.ObjectID)
 	}
 
-	return entity.NewStore(coll, cdcm)
+	return entity.NewStore(coll, cdcm, nil)
 }
 
 func docs(entities []etre.Entity) []interface{} {
@@ -845,3 +846,600 @@ func TestDeleteLabel(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestRenameLabel(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// Rename bar to baz on y=b (testNodes[1] and [2])
+	q, _ := query.Translate("y=b")
+	gotOld, err := store.RenameLabel(wo, q, "bar", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotOld) != 2 {
+		t.Fatalf("got %d diffs, expected 2: %+v", len(gotOld), gotOld)
+	}
+	expectOld := []etre.Entity{
+		{"_id": testNodes[1]["_id"], "_type": entityType, "_rev": int64(0), "bar": ""},
+		{"_id": testNodes[2]["_id"], "_type": entityType, "_rev": int64(0), "bar": ""},
+	}
+	if diff := deep.Equal(gotOld, expectOld); diff != nil {
+		t.Error(diff)
+	}
+
+	gotNew, err := store.ReadEntities(entityType, q, etre.QueryFilter{ReturnLabels: []string{"x", "bar", "baz", "_rev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNew := []etre.Entity{
+		{"x": int64(4), "baz": "", "_rev": int64(1)},
+		{"x": int64(6), "baz": "", "_rev": int64(1)},
+	}
+	if diff := deep.Equal(gotNew, expectNew); diff != nil {
+		t.Error(diff)
+	}
+
+	// One CDC event per entity
+	if len(gotEvents) != 2 {
+		t.Fatalf("got %d CDC events, expected 2", len(gotEvents))
+	}
+	expectEventNew := &etre.Entity{"baz": ""}
+	expectEventOld := &etre.Entity{"bar": ""}
+	for _, e := range gotEvents {
+		if e.Op != "u" || e.EntityRev != 1 {
+			t.Errorf("got CDC event op %s rev %d, expected op u rev 1", e.Op, e.EntityRev)
+		}
+		if diff := deep.Equal(e.New, expectEventNew); diff != nil {
+			t.Error(diff)
+		}
+		if diff := deep.Equal(e.Old, expectEventOld); diff != nil {
+			t.Error(diff)
+		}
+	}
+
+	// Nothing to rename now
+	gotOld, err = store.RenameLabel(wo, q, "bar", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotOld) != 0 {
+		t.Errorf("got %d diffs, expected 0: %+v", len(gotOld), gotOld)
+	}
+}
+
+func TestDeleteLabels(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	store := setup(t, cdcm)
+
+	// Empty query matches all entities with the label: testNodes[1] and [2]
+	gotOld, err := store.DeleteLabels(wo, query.Query{}, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotOld) != 2 {
+		t.Fatalf("got %d diffs, expected 2: %+v", len(gotOld), gotOld)
+	}
+	q, _ := query.Translate("bar")
+	gotNew, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotNew) != 0 {
+		t.Errorf("got %d entities with label bar, expected 0: %+v", len(gotNew), gotNew)
+	}
+	if len(gotEvents) != 2 {
+		t.Fatalf("got %d CDC events, expected 2", len(gotEvents))
+	}
+	for _, e := range gotEvents {
+		if e.New != nil {
+			t.Errorf("CDC event New = %+v, expected nil", e.New)
+		}
+		if diff := deep.Equal(e.Old, &etre.Entity{"bar": ""}); diff != nil {
+			t.Error(diff)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+// References
+// --------------------------------------------------------------------------
+
+func setupReferences(t *testing.T, onDelete string) (entity.Store, etre.Entity) {
+	store := setup(t, &mock.CDCStore{})
+
+	// nodes.rack_id references racks._id
+	_, refColl, err := test.DbCollections([]string{"racks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll["racks"] = refColl["racks"]
+	if _, err := coll["racks"].DeleteMany(context.TODO(), bson.D{{}}); err != nil {
+		t.Fatal(err)
+	}
+	rack := etre.Entity{"_type": "racks", "_rev": int64(0), "name": "r1", "zone": "east"}
+	res, err := coll["racks"].InsertOne(context.TODO(), rack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rack["_id"] = res.InsertedID.(primitive.ObjectID)
+
+	schemas := map[string]entity.Schema{
+		entityType: entity.Schema{
+			References: map[string]entity.Reference{
+				"rack_id": {EntityType: "racks", OnDelete: onDelete},
+			},
+		},
+	}
+	store = entity.NewStore(coll, &mock.CDCStore{}, schemas)
+	return store, rack
+}
+
+func TestReferencesWrite(t *testing.T) {
+	store, rack := setupReferences(t, entity.ON_DELETE_RESTRICT)
+	rackId := rack["_id"].(primitive.ObjectID).Hex()
+
+	// Valid reference
+	ids, err := store.CreateEntities(wo, []etre.Entity{{"x": int64(8), "rack_id": rackId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("got %d ids, expected 1", len(ids))
+	}
+
+	// Reference to entity that does not exist
+	missingId := primitive.NewObjectID().Hex()
+	_, err = store.CreateEntities(wo, []etre.Entity{{"x": int64(9), "rack_id": missingId}})
+	if err == nil {
+		t.Fatal("no error creating entity with invalid reference, expected ValidationError")
+	}
+	if verr, ok := err.(entity.ValidationError); !ok || verr.Type != "invalid-reference" {
+		t.Errorf("got error %#v, expected ValidationError type invalid-reference", err)
+	}
+
+	// Same on update
+	q, _ := query.Translate("y=a")
+	_, err = store.UpdateEntities(wo, q, etre.Entity{"rack_id": "not-an-id"})
+	if verr, ok := err.(entity.ValidationError); !ok || verr.Type != "invalid-reference" {
+		t.Errorf("got error %#v, expected ValidationError type invalid-reference", err)
+	}
+	gotDiffs, err := store.UpdateEntities(wo, q, etre.Entity{"rack_id": rackId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotDiffs) != 1 {
+		t.Errorf("got %d diffs, expected 1", len(gotDiffs))
+	}
+}
+
+func TestReferencesExpand(t *testing.T) {
+	store, rack := setupReferences(t, entity.ON_DELETE_RESTRICT)
+	rackId := rack["_id"].(primitive.ObjectID).Hex()
+
+	q, _ := query.Translate("y=a")
+	if _, err := store.UpdateEntities(wo, q, etre.Entity{"rack_id": rackId}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Return label of the referenced entity only
+	f := etre.QueryFilter{
+		ReturnLabels: []string{"x", "rack_id.name"},
+		Expand:       []string{"rack_id"},
+	}
+	got, err := store.ReadEntities(entityType, q, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []etre.Entity{{"x": int64(2), "rack_id.name": "r1"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Logf("got: %+v", got)
+		t.Error(diff)
+	}
+
+	// All labels of the referenced entity
+	f = etre.QueryFilter{
+		ReturnLabels: []string{"rack_id"},
+		Expand:       []string{"rack_id"},
+	}
+	got, err = store.ReadEntities(entityType, q, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []etre.Entity{
+		{
+			"rack_id":       rackId,
+			"rack_id._id":   rack["_id"],
+			"rack_id._type": "racks",
+			"rack_id._rev":  int64(0),
+			"rack_id.name":  "r1",
+			"rack_id.zone":  "east",
+		},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Logf("got: %+v", got)
+		t.Error(diff)
+	}
+
+	// Can only expand references
+	f = etre.QueryFilter{Expand: []string{"y"}}
+	_, err = store.ReadEntities(entityType, q, f)
+	if verr, ok := err.(entity.ValidationError); !ok || verr.Type != "invalid-expand" {
+		t.Errorf("got error %#v, expected ValidationError type invalid-expand", err)
+	}
+}
+
+func TestReferencesDelete(t *testing.T) {
+	store, rack := setupReferences(t, entity.ON_DELETE_RESTRICT)
+	rackId := rack["_id"].(primitive.ObjectID).Hex()
+
+	q, _ := query.Translate("y=a")
+	if _, err := store.UpdateEntities(wo, q, etre.Entity{"rack_id": rackId}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rack is referenced by node, so it cannot be deleted
+	rackWo := entity.WriteOp{EntityType: "racks", Caller: username}
+	rq, _ := query.Translate("name=r1")
+	deleted, err := store.DeleteEntities(rackWo, rq)
+	if verr, ok := err.(entity.ValidationError); !ok || verr.Type != "entity-referenced" {
+		t.Errorf("got error %#v, expected ValidationError type entity-referenced", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("deleted %d entities, expected 0", len(deleted))
+	}
+
+	// Delete the referencing node, then the rack can be deleted
+	if _, err := store.DeleteEntities(wo, q); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = store.DeleteEntities(rackWo, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("deleted %d entities, expected 1", len(deleted))
+	}
+
+	// With on_delete=allow, rack can be deleted leaving a dangling reference
+	store, rack = setupReferences(t, entity.ON_DELETE_ALLOW)
+	if _, err := store.UpdateEntities(wo, q, etre.Entity{"rack_id": rack["_id"].(primitive.ObjectID).Hex()}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = store.DeleteEntities(rackWo, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("deleted %d entities, expected 1", len(deleted))
+	}
+}
+
+// --------------------------------------------------------------------------
+// Defaults and computed labels
+// --------------------------------------------------------------------------
+
+func TestDefaultsAndComputedLabels(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	schemas := map[string]entity.Schema{
+		entityType: entity.Schema{
+			Defaults:       map[string]interface{}{"status": "provisioning", "y": "default"},
+			ComputedLabels: []string{"_ts", "_created_ts", "_created_by", "_updated_ts", "_updated_by"},
+		},
+	}
+	store := entity.NewStore(coll, cdcm, schemas)
+
+	// Defaults set only if label not set, and computed labels set on insert
+	ids, err := store.CreateEntities(wo, []etre.Entity{{"x": int64(8), "y": "y8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := query.Translate("_id=" + ids[0])
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d entities, expected 1", len(got))
+	}
+	e := got[0]
+	if e["status"] != "provisioning" {
+		t.Errorf("status = %v, expected default value provisioning", e["status"])
+	}
+	if e["y"] != "y8" {
+		t.Errorf("y = %v, expected y8 (default value should not override)", e["y"])
+	}
+	if e["_created_by"] != username {
+		t.Errorf("_created_by = %v, expected %s", e["_created_by"], username)
+	}
+	createdTs, ok := e["_created_ts"].(int64)
+	if !ok || createdTs == 0 {
+		t.Errorf("_created_ts = %v, expected Unix ms timestamp", e["_created_ts"])
+	}
+	if e["_ts"] != e["_created_ts"] {
+		t.Errorf("_ts = %v, expected same as _created_ts %v", e["_ts"], e["_created_ts"])
+	}
+	if e.Has("_updated_ts") || e.Has("_updated_by") {
+		t.Errorf("_updated_ts or _updated_by set on insert: %+v", e)
+	}
+
+	// Computed labels set on update and in CDC event
+	wo2 := entity.WriteOp{EntityType: entityType, Caller: "updater"}
+	if _, err := store.UpdateEntities(wo2, q, etre.Entity{"y": "y9"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = got[0]
+	if e["_updated_by"] != "updater" {
+		t.Errorf("_updated_by = %v, expected updater", e["_updated_by"])
+	}
+	if e["_created_by"] != username {
+		t.Errorf("_created_by = %v, expected %s (should not change on update)", e["_created_by"], username)
+	}
+	if e["_ts"] != e["_updated_ts"] {
+		t.Errorf("_ts = %v, expected same as _updated_ts %v", e["_ts"], e["_updated_ts"])
+	}
+	if len(gotEvents) != 2 {
+		t.Fatalf("got %d CDC events, expected 2", len(gotEvents))
+	}
+	if !gotEvents[1].New.Has("_updated_ts") {
+		t.Errorf("CDC update event new values do not have _updated_ts: %+v", gotEvents[1].New)
+	}
+}
+
+func TestTTLAndReaper(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	schemas := map[string]entity.Schema{
+		entityType: entity.Schema{TTL: time.Hour},
+	}
+	store := entity.NewStore(coll, cdcm, schemas)
+
+	// _expires set from TTL on insert unless already set
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	past := now - 1000
+	ids, err := store.CreateEntities(wo, []etre.Entity{{"x": int64(8)}, {"x": int64(9), "_expires": past}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := query.Translate("x in (8,9)")
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d entities, expected 2", len(got))
+	}
+	for _, e := range got {
+		expires, ok := e["_expires"].(int64)
+		if !ok {
+			t.Fatalf("_expires = %v (%T), expected int64", e["_expires"], e["_expires"])
+		}
+		switch e.Id() {
+		case ids[0]:
+			if expires < now+time.Hour.Milliseconds()-1000 {
+				t.Errorf("_expires = %d, expected now + 1h", expires)
+			}
+		case ids[1]:
+			if expires != past {
+				t.Errorf("_expires = %d, expected %d (TTL should not override)", expires, past)
+			}
+		}
+	}
+
+	// Reaper deletes only the expired entity, which writes a CDC delete event
+	m := mock.NewMetricsRecorder()
+	r := entity.NewReaper(store, func() []string { return entityTypes }, mock.MetricsFactory{MetricRecorder: m}, []string{"etre"}, time.Second)
+	if diff := deep.Equal(r.Reap(), map[string]int{entityType: 1}); diff != nil {
+		t.Error(diff)
+	}
+	got, err = store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id() != ids[0] {
+		t.Errorf("got %+v, expected only entity %s", got, ids[0])
+	}
+	last := gotEvents[len(gotEvents)-1]
+	if last.Op != "d" || last.EntityId != ids[1] || last.Caller != entity.REAPER_CALLER {
+		t.Errorf("got CDC event %+v, expected delete of %s by %s", last, ids[1], entity.REAPER_CALLER)
+	}
+}
+
+func TestSoftDeleteAndPurge(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	schemas := map[string]entity.Schema{
+		entityType: entity.Schema{SoftDelete: true, SoftDeleteRetention: time.Hour},
+	}
+	store := entity.NewStore(coll, cdcm, schemas)
+
+	// Soft delete updates the entity and writes a CDC delete event with the
+	// soft-delete metalabels in New
+	q, _ := query.Translate("x=2")
+	deleted, err := store.DeleteEntities(wo, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Fatalf("got %d deleted entities, expected 1", len(deleted))
+	}
+	id := deleted[0].Id()
+	if len(gotEvents) != 1 {
+		t.Fatalf("got %d CDC events, expected 1", len(gotEvents))
+	}
+	if gotEvents[0].Op != "d" || gotEvents[0].EntityRev != deleted[0].Rev()+1 || gotEvents[0].New == nil || !gotEvents[0].New.Has("_deleted") {
+		t.Errorf("got CDC event %+v, expected delete with new _deleted", gotEvents[0])
+	}
+
+	// Excluded from reads unless IncludeDeleted
+	got, err := store.ReadEntities(entityType, q, etre.QueryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %d entities, expected 0: %+v", len(got), got)
+	}
+	got, err = store.ReadEntities(entityType, q, etre.QueryFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d entities, expected 1 with IncludeDeleted", len(got))
+	}
+	if got[0]["_deleted"] != true || !got[0].Has("_deleted_ts") {
+		t.Errorf("got %+v, expected _deleted=true and _deleted_ts", got[0])
+	}
+
+	// Soft-deleted entities cannot be updated or deleted again
+	diffs, err := store.UpdateEntities(wo, q, etre.Entity{"y": "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("updated %d soft-deleted entities, expected 0", len(diffs))
+	}
+	deleted, err = store.DeleteEntities(wo, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("deleted %d soft-deleted entities, expected 0", len(deleted))
+	}
+
+	// Not purged before retention
+	purged, err := store.PurgeEntities(wo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("purged %d entities before retention, expected 0", len(purged))
+	}
+
+	// Purged after retention, which writes the final CDC purge event
+	schemas[entityType] = entity.Schema{SoftDelete: true, SoftDeleteRetention: -time.Second}
+	purged, err = store.PurgeEntities(wo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].Id() != id {
+		t.Fatalf("got purged %+v, expected entity %s", purged, id)
+	}
+	last := gotEvents[len(gotEvents)-1]
+	if last.Op != "p" || last.EntityId != id || last.EntityRev != purged[0].Rev()+1 {
+		t.Errorf("got CDC event %+v, expected purge of %s", last, id)
+	}
+	got, err = store.ReadEntities(entityType, q, etre.QueryFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %d entities after purge, expected 0", len(got))
+	}
+}
+
+func TestCDCFullEntity(t *testing.T) {
+	gotEvents := []etre.CDCEvent{}
+	cdcm := &mock.CDCStore{
+		WriteFunc: func(ctx context.Context, e etre.CDCEvent) error {
+			gotEvents = append(gotEvents, e)
+			return nil
+		},
+	}
+	setup(t, cdcm)
+	schemas := map[string]entity.Schema{
+		entityType: entity.Schema{CDCFullEntity: true},
+	}
+	store := entity.NewStore(coll, cdcm, schemas)
+
+	// Diffs are still only the changed labels, but the CDC event has the
+	// whole entity after the update
+	q, _ := query.Translate("y=a")
+	diffs, err := store.UpdateEntities(wo, q, etre.Entity{"y": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiffs := []etre.Entity{
+		{"_id": testNodes[0]["_id"], "_type": entityType, "_rev": int64(0), "y": "a"},
+	}
+	if diff := deep.Equal(diffs, expectDiffs); diff != nil {
+		t.Error(diff)
+	}
+	if len(gotEvents) != 1 {
+		t.Fatalf("got %d CDC events, expected 1", len(gotEvents))
+	}
+	expectFull := &etre.Entity{
+		"_id":   testNodes[0]["_id"],
+		"_type": entityType,
+		"_rev":  int64(1),
+		"x":     int64(2),
+		"y":     "new",
+		"z":     int64(9),
+		"foo":   "",
+	}
+	if diff := deep.Equal(gotEvents[0].Full, expectFull); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotEvents[0].New, &etre.Entity{"y": "new"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Same for deleting a label
+	wo1 := wo
+	wo1.EntityId = testNodes[0]["_id"].(primitive.ObjectID).Hex()
+	old, err := store.DeleteLabel(wo1, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(old, etre.Entity{"_id": testNodes[0]["_id"], "_type": entityType, "_rev": int64(1), "foo": ""}); diff != nil {
+		t.Error(diff)
+	}
+	delete(*expectFull, "foo")
+	(*expectFull)["_rev"] = int64(2)
+	if diff := deep.Equal(gotEvents[1].Full, expectFull); diff != nil {
+		t.Error(diff)
+	}
+
+	// Not set on delete
+	q, _ = query.Translate("x=2")
+	if _, err := store.DeleteEntities(wo, q); err != nil {
+		t.Fatal(err)
+	}
+	if gotEvents[2].Full != nil {
+		t.Errorf("got full entity %+v on delete, expected nil", gotEvents[2].Full)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2020, Square, Inc.
+
+package entity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrEntityTypeExists   = errors.New("entity type already exists")
+	ErrEntityTypeNotFound = errors.New("entity type not found")
+)
+
+// EntityType is an entity type in the TypeRegistry. Static types are from
+// config.entity.types; others are created at runtime and stored in Mongo.
+type EntityType struct {
+	Name      string   `json:"name" bson:"_id"`
+	Read      []string `json:"read,omitempty" bson:"read,omitempty"`   // roles granted read
+	Write     []string `json:"write,omitempty" bson:"write,omitempty"` // roles granted write
+	Static    bool     `json:"static" bson:"-"`
+	Retired   bool     `json:"retired" bson:"retired"`
+	CreatedBy string   `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	CreatedTs int64    `json:"createdTs,omitempty" bson:"createdTs,omitempty"` // Unix ms
+	RetiredBy string   `json:"retiredBy,omitempty" bson:"retiredBy,omitempty"`
+	RetiredTs int64    `json:"retiredTs,omitempty" bson:"retiredTs,omitempty"` // Unix ms
+}
+
+// TypeRegistry manages entity types at runtime. Types are stored in Mongo so
+// every API node has the same types. Each node calls Refresh periodically to
+// load types created or retired by other nodes.
+type TypeRegistry interface {
+	// List returns all types, static and runtime, including retired types.
+	List() []EntityType
+
+	// Create creates a new type, or reactivates a retired type.
+	Create(ctx context.Context, t EntityType) error
+
+	// Retire retires a runtime type. Its entities are not deleted, but they
+	// cannot be read or written until the type is created again.
+	Retire(ctx context.Context, name, caller string) error
+
+	// Refresh reloads types from Mongo.
+	Refresh(ctx context.Context) error
+}
+
+type typeRegistry struct {
+	coll     *mongo.Collection
+	static   []string
+	onChange func([]EntityType)
+	*sync.Mutex
+	types []EntityType
+}
+
+// NewTypeRegistry creates a TypeRegistry. static are the types from the config.
+// onChange is called with all types when Refresh loads new or retired types;
+// the server uses it to set the store collections, validator, and ACLs.
+func NewTypeRegistry(coll *mongo.Collection, static []string, onChange func([]EntityType)) *typeRegistry {
+	return &typeRegistry{
+		coll:     coll,
+		static:   static,
+		onChange: onChange,
+		Mutex:    &sync.Mutex{},
+		types:    staticTypes(static),
+	}
+}
+
+func (r *typeRegistry) List() []EntityType {
+	r.Lock()
+	defer r.Unlock()
+	types := make([]EntityType, len(r.types))
+	copy(types, r.types)
+	return types
+}
+
+func (r *typeRegistry) Create(ctx context.Context, t EntityType) error {
+	for _, s := range r.static {
+		if t.Name == s {
+			return ErrEntityTypeExists
+		}
+	}
+	t.Static = false
+	t.Retired = false
+	t.CreatedTs = time.Now().UnixNano() / int64(time.Millisecond)
+	t.RetiredBy = ""
+	t.RetiredTs = 0
+	_, err := r.coll.InsertOne(ctx, t)
+	if err != nil {
+		if IsDupeKeyError(err) == nil {
+			return DbError{Err: err, Type: "db-insert-entity-type"}
+		}
+		// Type exists, but if it's retired, reactivate it
+		res, err := r.coll.ReplaceOne(ctx, bson.M{"_id": t.Name, "retired": true}, t)
+		if err != nil {
+			return DbError{Err: err, Type: "db-update-entity-type"}
+		}
+		if res.MatchedCount == 0 {
+			return ErrEntityTypeExists
+		}
+	}
+	return r.Refresh(ctx)
+}
+
+func (r *typeRegistry) Retire(ctx context.Context, name, caller string) error {
+	for _, s := range r.static {
+		if name == s {
+			return ValidationError{
+				Err:  errors.New("cannot retire entity type " + name + ": remove it from config.entity.types instead"),
+				Type: "cannot-retire-entity-type",
+			}
+		}
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"retired":   true,
+			"retiredBy": caller,
+			"retiredTs": time.Now().UnixNano() / int64(time.Millisecond),
+		},
+	}
+	res, err := r.coll.UpdateOne(ctx, bson.M{"_id": name, "retired": false}, update)
+	if err != nil {
+		return DbError{Err: err, Type: "db-update-entity-type"}
+	}
+	if res.MatchedCount == 0 {
+		return ErrEntityTypeNotFound
+	}
+	return r.Refresh(ctx)
+}
+
+func (r *typeRegistry) Refresh(ctx context.Context) error {
+	cursor, err := r.coll.Find(ctx, bson.M{})
+	if err != nil {
+		return DbError{Err: err, Type: "db-query-entity-types"}
+	}
+	var runtime []EntityType
+	if err := cursor.All(ctx, &runtime); err != nil {
+		return DbError{Err: err, Type: "db-read-cursor"}
+	}
+	sort.Slice(runtime, func(i, j int) bool { return runtime[i].Name < runtime[j].Name })
+
+	types := staticTypes(r.static)
+	for _, t := range runtime {
+		static := false
+		for _, s := range r.static {
+			if t.Name == s {
+				static = true // config takes precedence
+				break
+			}
+		}
+		if !static {
+			types = append(types, t)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if reflect.DeepEqual(types, r.types) {
+		return nil
+	}
+	r.types = types
+	if r.onChange != nil {
+		r.onChange(types) // under lock so changes are applied in order
+	}
+	return nil
+}
+
+// ActiveTypes returns the names of types that are not retired.
+func ActiveTypes(types []EntityType) []string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		if !t.Retired {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+func staticTypes(static []string) []EntityType {
+	types := make([]EntityType, len(static))
+	for i, name := range static {
+		types[i] = EntityType{Name: name, Static: true}
+	}
+	return types
+}
@@ -0,0 +1,83 @@
+// Copyright 2020, Square, Inc.
+
+package entity_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/square/etre/entity"
+	"github.com/square/etre/test"
+)
+
+func TestTypeRegistry(t *testing.T) {
+	_, typesColl, err := test.DbCollections([]string{"entity_types"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := typesColl["entity_types"]
+	if _, err := c.DeleteMany(context.TODO(), bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotActive []string
+	r := entity.NewTypeRegistry(c, []string{"nodes"}, func(types []entity.EntityType) {
+		gotActive = entity.ActiveTypes(types)
+	})
+	ctx := context.TODO()
+
+	// Static types cannot be created or retired
+	if err := r.Create(ctx, entity.EntityType{Name: "nodes"}); err != entity.ErrEntityTypeExists {
+		t.Errorf("got err '%v', expected ErrEntityTypeExists", err)
+	}
+	if err := r.Retire(ctx, "nodes", username); err == nil {
+		t.Errorf("no error retiring static type, expected one")
+	}
+
+	// Create calls onChange with the new type
+	if err := r.Create(ctx, entity.EntityType{Name: "rack", Read: []string{"dev"}, CreatedBy: username}); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(gotActive, []string{"nodes", "rack"}); diffs != nil {
+		t.Error(diffs)
+	}
+	if err := r.Create(ctx, entity.EntityType{Name: "rack"}); err != entity.ErrEntityTypeExists {
+		t.Errorf("got err '%v', expected ErrEntityTypeExists", err)
+	}
+
+	// Another node (registry) sees the type on Refresh
+	r2 := entity.NewTypeRegistry(c, []string{"nodes"}, nil)
+	if err := r2.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	types := r2.List()
+	if len(types) != 2 || types[1].Name != "rack" || types[1].CreatedBy != username {
+		t.Errorf("got types %+v, expected nodes and rack", types)
+	}
+
+	// Retire calls onChange without the type, but List still returns it
+	if err := r.Retire(ctx, "rack", username); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(gotActive, []string{"nodes"}); diffs != nil {
+		t.Error(diffs)
+	}
+	types = r.List()
+	if len(types) != 2 || !types[1].Retired || types[1].RetiredBy != username {
+		t.Errorf("got types %+v, expected rack retired", types)
+	}
+	if err := r.Retire(ctx, "rack", username); err != entity.ErrEntityTypeNotFound {
+		t.Errorf("got err '%v', expected ErrEntityTypeNotFound", err)
+	}
+
+	// Retired type can be created again
+	if err := r.Create(ctx, entity.EntityType{Name: "rack"}); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := deep.Equal(gotActive, []string{"nodes", "rack"}); diffs != nil {
+		t.Error(diffs)
+	}
+}
@@ -75,7 +75,7 @@ func setupV09(t *testing.T, cdcm *mock.CDCStore) entity.Store {
 		v09testNodes_int32[i]["_id"] = id.(primitive.ObjectID)
 	}
 
-	return entity.NewStore(coll, cdcm)
+	return entity.NewStore(coll, cdcm, nil)
 }
 
 // --------------------------------------------------------------------------
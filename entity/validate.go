@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/square/etre"
 )
@@ -29,28 +30,46 @@ type Validator interface {
 	Entities([]etre.Entity, byte) error
 	WriteOp(WriteOp) error
 	DeleteLabel(string) error
+	RenameLabel(string, string) error
 }
 
 type validator struct {
+	types *validTypes // shared by copies, see SetEntityTypes
+}
+
+type validTypes struct {
+	*sync.RWMutex
 	entityTypes []string
 	validType   map[string]bool
 }
 
 func NewValidator(entityTypes []string) validator {
+	v := validator{
+		types: &validTypes{RWMutex: &sync.RWMutex{}},
+	}
+	v.SetEntityTypes(entityTypes)
+	return v
+}
+
+// SetEntityTypes sets the valid entity types. It's called when entity types
+// are created or retired at runtime.
+func (v validator) SetEntityTypes(entityTypes []string) {
 	validType := map[string]bool{}
 	for _, t := range entityTypes {
 		validType[t] = true
 	}
-	return validator{
-		entityTypes: entityTypes,
-		validType:   validType,
-	}
+	v.types.Lock()
+	v.types.entityTypes = entityTypes
+	v.types.validType = validType
+	v.types.Unlock()
 }
 
 func (v validator) EntityType(entityType string) error {
-	if !v.validType[entityType] {
+	v.types.RLock()
+	defer v.types.RUnlock()
+	if !v.types.validType[entityType] {
 		return ValidationError{
-			Err:  fmt.Errorf("invalid entity type: %s; valid types (config.entity.types): %s", entityType, strings.Join(v.entityTypes, ", ")),
+			Err:  fmt.Errorf("invalid entity type: %s; valid types: %s", entityType, strings.Join(v.types.entityTypes, ", ")),
 			Type: "invalid-entity-type",
 		}
 	}
@@ -76,20 +95,16 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 			switch op {
 			case VALIDATE_ON_CREATE:
 				// User cannot set these metalabels on create
-				for _, ml := range []string{"_id", "_type", "_rev", "_ts"} {
-					if label != ml {
-						continue
-					}
-					if _, ok := e[ml]; ok {
-						return ValidationError{
-							Err:  fmt.Errorf("cannot set metalabel %s on create (entity index %d)", ml, i),
-							Type: "cannot-set-metalabel",
-						}
+				if label == "_id" || label == "_type" || label == "_rev" || etre.IsComputedLabel(label) ||
+					label == etre.META_LABEL_DELETED || label == etre.META_LABEL_DELETED_TS {
+					return ValidationError{
+						Err:  fmt.Errorf("cannot set metalabel %s on create (entity index %d)", label, i),
+						Type: "cannot-set-metalabel",
 					}
 				}
 			case VALIDATE_ON_UPDATE:
-				// Cannot patch (change) metalabel values
-				if etre.IsMetalabel(label) {
+				// Cannot patch (change) metalabel values, except _expires
+				if etre.IsMetalabel(label) && label != etre.META_LABEL_EXPIRES {
 					return ValidationError{
 						Err:  fmt.Errorf("cannot change metalabel %s on patch (entity index %d)", label, i),
 						Type: "cannot-change-metalabel",
@@ -106,6 +121,22 @@ func (v validator) Entities(entities []etre.Entity, op byte) error {
 			if val == nil {
 				continue
 			}
+			if label == etre.META_LABEL_EXPIRES {
+				// Unix milliseconds, from JSON (float64) or Go (int, int64)
+				switch v := val.(type) {
+				case float64:
+					entities[i][label] = int64(v)
+				case int:
+					entities[i][label] = int64(v)
+				case int64:
+				default:
+					return ValidationError{
+						Err:  fmt.Errorf("invalid value type %T for %s (value: %v); must be Unix milliseconds (entity index %d)", val, label, val, i),
+						Type: "invalid-value-type",
+					}
+				}
+				continue
+			}
 			if reflect.TypeOf(val).Kind() == reflect.Float64 {
 				entities[i][label] = int(val.(float64))
 			} else {
@@ -134,7 +165,7 @@ func (v validator) WriteOp(wo WriteOp) error {
 }
 
 func (v validator) DeleteLabel(label string) error {
-	if etre.IsMetalabel(label) {
+	if etre.IsMetalabel(label) && label != etre.META_LABEL_EXPIRES {
 		return ValidationError{
 			Err:  fmt.Errorf("cannot delete metalabel %s", label),
 			Type: "cannot-delete-metalabel",
@@ -142,3 +173,33 @@ func (v validator) DeleteLabel(label string) error {
 	}
 	return nil
 }
+
+func (v validator) RenameLabel(from, to string) error {
+	for _, label := range []string{from, to} {
+		if label == "" {
+			return ValidationError{
+				Err:  fmt.Errorf("empty string label"),
+				Type: "empty-string-label",
+			}
+		}
+		if strings.IndexAny(label, " \t") != -1 {
+			return ValidationError{
+				Err:  fmt.Errorf("label cannot have whitesspace: '%s'", label),
+				Type: "label-has-whitespace",
+			}
+		}
+		if etre.IsMetalabel(label) {
+			return ValidationError{
+				Err:  fmt.Errorf("cannot rename metalabel %s", label),
+				Type: "cannot-rename-metalabel",
+			}
+		}
+	}
+	if from == to {
+		return ValidationError{
+			Err:  fmt.Errorf("cannot rename label %s to itself", from),
+			Type: "invalid-rename",
+		}
+	}
+	return nil
+}
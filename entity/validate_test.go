@@ -28,6 +28,11 @@ func TestValidateCreateEntitiesErrorsMetalabels(t *testing.T) {
 		etre.Entity{"a": "b", "_id": "59f10d2a5669fc79103a1111"}, // _id not allowed
 		etre.Entity{"a": "b", "_type": "node"},                   // _type not allowed
 		etre.Entity{"a": "b", "_rev": int64(0)},                  // _rev not allowed
+		etre.Entity{"a": "b", "_ts": int64(1)},                   // computed labels not allowed
+		etre.Entity{"a": "b", "_created_by": "me"},               //
+		etre.Entity{"a": "b", "_updated_ts": int64(1)},           //
+		etre.Entity{"a": "b", "_deleted": true},                  // soft delete metalabels not allowed
+		etre.Entity{"a": "b", "_deleted_ts": int64(1)},           //
 	}
 
 	for _, e := range invalid {
@@ -150,3 +155,63 @@ func TestValidateDeleteLabel(t *testing.T) {
 		t.Fatal("err is nill, expected an enitty.ValidationError")
 	}
 }
+
+func TestValidateSetEntityTypes(t *testing.T) {
+	v := entity.NewValidator([]string{"node"})
+	if err := v.EntityType("rack"); err == nil {
+		t.Fatal("no error for invalid entity type rack")
+	}
+
+	// Copies share entity types, like the API's copy of the validator
+	c := v
+	v.SetEntityTypes([]string{"node", "rack"})
+	if err := c.EntityType("rack"); err != nil {
+		t.Errorf("got err '%v', expected nil", err)
+	}
+
+	v.SetEntityTypes([]string{"node"})
+	if err := c.EntityType("rack"); err == nil {
+		t.Error("no error for retired entity type rack")
+	}
+}
+
+func TestValidateRenameLabel(t *testing.T) {
+	if err := validate.RenameLabel("foo", "bar"); err != nil {
+		t.Errorf("got err '%v', expected nil", err)
+	}
+	invalid := [][]string{
+		{"_id", "id"},   // metalabel
+		{"foo", "_rev"}, // metalabel
+		{"foo", "foo"},  // same label
+		{"foo", ""},     // empty label
+		{"foo", "b r"},  // whitespace
+	}
+	for _, r := range invalid {
+		if err := validate.RenameLabel(r[0], r[1]); err == nil {
+			t.Errorf("no error renaming %s to %s, expected one", r[0], r[1])
+		}
+	}
+}
+
+func TestValidateExpires(t *testing.T) {
+	// _expires is the only metalabel callers can set, change, and delete
+	e := etre.Entity{"a": "b", "_expires": float64(1600000000000)} // JSON number
+	if err := validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_UPDATE); err != nil {
+		t.Errorf("got err '%v', expected nil", err)
+	}
+	if _, ok := e["_expires"].(int64); !ok {
+		t.Errorf("_expires is type %T, expected int64", e["_expires"])
+	}
+	if err := validate.DeleteLabel("_expires"); err != nil {
+		t.Errorf("got err '%v', expected nil", err)
+	}
+
+	e = etre.Entity{"a": "b", "_expires": "tomorrow"}
+	err := validate.Entities([]etre.Entity{e}, entity.VALIDATE_ON_UPDATE)
+	if err == nil {
+		t.Fatal("no error for string _expires value, expected one")
+	}
+	if ve, ok := err.(entity.ValidationError); !ok || ve.Type != "invalid-value-type" {
+		t.Errorf("got error %#v, expected entity.ValidationError invalid-value-type", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -41,9 +42,17 @@ type EntityClient interface {
 	Labels(id string) ([]string, error)
 
 	// DeleteLabel removes the given label from the given entity by internal ID.
-	// Labels should be stable, long-lived. Consequently, there's no bulk label delete.
 	DeleteLabel(id string, label string) (WriteResult, error)
 
+	// RenameLabel is a bulk operation that renames label from to label to on
+	// entities that match the query. If the query is empty, it renames the label
+	// on all entities that have it.
+	RenameLabel(query, from, to string) (WriteResult, error)
+
+	// DeleteLabels is a bulk operation that removes the label from entities that
+	// match the query. If the query is empty, it removes the label from all entities.
+	DeleteLabels(query, label string) (WriteResult, error)
+
 	// EntityType returns the entity type of the client.
 	EntityType() string
 
@@ -73,6 +82,8 @@ type EntityClientConfig struct {
 	RetryWait    time.Duration // optional wait time between retries
 	RetryLogging bool          // log error on retry to stderr
 	QueryTimeout time.Duration // timeout passed to API via etre.QUERY_TIMEOUT_HEADER
+	APIKey       string        // optional API key sent as Authorization: Bearer <key>
+	TraceParent  string        // optional W3C traceparent sent with every request
 	Debug        bool
 }
 
@@ -100,10 +111,12 @@ type entityClient struct {
 	httpClient       *http.Client
 	set              Set
 	traceHeaderValue string
+	traceParent      string
 	retry            uint
 	retryWait        time.Duration
 	retryLogging     bool
 	queryTimeout     time.Duration
+	apiKey           string
 }
 
 // NewEntityClient creates a new type-specific Etre API client that makes requests
@@ -130,6 +143,8 @@ func NewEntityClientWithConfig(c EntityClientConfig) EntityClient {
 		retryWait:    c.RetryWait,
 		retryLogging: c.RetryLogging,
 		queryTimeout: c.QueryTimeout,
+		apiKey:       c.APIKey,
+		traceParent:  c.TraceParent,
 	}
 }
 
@@ -160,6 +175,12 @@ func (c entityClient) Query(query string, filter QueryFilter) ([]Entity, error)
 	if filter.Distinct {
 		path += "&distinct"
 	}
+	if len(filter.Expand) > 0 {
+		path += "&expand=" + strings.Join(filter.Expand, ",")
+	}
+	if filter.IncludeDeleted {
+		path += "&includeDeleted=true"
+	}
 
 	var entities []Entity
 	err := c.apiRetry(func() (bool, error) {
@@ -275,6 +296,28 @@ func (c entityClient) DeleteLabel(id string, label string) (WriteResult, error)
 	return wr, nil
 }
 
+func (c entityClient) RenameLabel(query, from, to string) (WriteResult, error) {
+	if from == "" || to == "" {
+		return WriteResult{}, ErrNoLabel
+	}
+	Debug("query='%s', from=%s, to=%s", query, from, to)
+	r := LabelRename{
+		From:  from,
+		To:    to,
+		Query: query,
+	}
+	return c.write(r, -1, "POST", "/entities/"+c.entityType+"/labels/rename")
+}
+
+func (c entityClient) DeleteLabels(query, label string) (WriteResult, error) {
+	if label == "" {
+		return WriteResult{}, ErrNoLabel
+	}
+	Debug("query='%s', label=%s", query, label)
+	query = url.QueryEscape(query) // always escape the query
+	return c.write(nil, -1, "DELETE", "/entities/"+c.entityType+"/labels/"+label+"?query="+query)
+}
+
 func (c entityClient) EntityType() string {
 	return c.entityType
 }
@@ -315,6 +358,9 @@ func (c entityClient) write(payload interface{}, n int, method, endpoint string)
 		}
 
 		done := resp.StatusCode >= 400 && resp.StatusCode < 500
+		if resp.StatusCode == http.StatusTooManyRequests {
+			done = false // retry after Retry-After
+		}
 
 		// On write, API should return an etre.WriteResult, but if API crashes
 		// there won't be response data
@@ -329,6 +375,13 @@ func (c entityClient) write(payload interface{}, n int, method, endpoint string)
 		if resp.StatusCode == http.StatusNotFound {
 			return done, ErrEntityNotFound
 		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			var err error
+			if wr.Error != nil {
+				err = fmt.Errorf("Client error: %s: %s (HTTP status %d)", wr.Error.Type, wr.Error.Message, resp.StatusCode)
+			}
+			return done, rateLimited(resp, err)
+		}
 		if wr.IsZero() && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 			if resp.StatusCode >= 500 {
 				return done, fmt.Errorf("Server error: HTTP status %d, response: '%s'", resp.StatusCode, string(bytes))
@@ -370,6 +423,12 @@ func (c entityClient) do(method, endpoint string, payload []byte) (*http.Respons
 	if c.traceHeaderValue != "" {
 		req.Header.Set(TRACE_HEADER, c.traceHeaderValue)
 	}
+	if c.traceParent != "" {
+		req.Header.Set(TRACEPARENT_HEADER, c.traceParent)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
 
 	// Send request
 	Debug("request: %+v", req)
@@ -398,6 +457,14 @@ func (c entityClient) url(endpoint string) string {
 }
 
 func readError(resp *http.Response, bytes []byte) (bool, error) {
+	done, err := apiError(resp, bytes)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return false, rateLimited(resp, err) // retry after Retry-After
+	}
+	return done, err
+}
+
+func apiError(resp *http.Response, bytes []byte) (bool, error) {
 	done := resp.StatusCode >= 400 && resp.StatusCode < 500
 
 	if resp.StatusCode == http.StatusNotFound {
@@ -423,12 +490,43 @@ func readError(resp *http.Response, bytes []byte) (bool, error) {
 	return done, fmt.Errorf("Client error: %s: %s (HTTP staeus %d)", errResp.Type, errResp.Message, resp.StatusCode)
 }
 
+// retryAfterError is an error with the wait time from a Retry-After header.
+type retryAfterError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+// rateLimited returns err (an API error response) with the wait time from the
+// Retry-After header, if set. The API returns HTTP status 429 when the caller
+// exceeds a rate limit or concurrency quota.
+func rateLimited(resp *http.Response, err error) error {
+	if err == nil {
+		err = fmt.Errorf("Client error: rate limited (HTTP status %d)", resp.StatusCode)
+	}
+	secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if secs <= 0 {
+		return err
+	}
+	return retryAfterError{err: err, wait: time.Duration(secs) * time.Second}
+}
+
 func (c entityClient) apiRetry(f func() (bool, error)) error {
 	tries := 1 + c.retry
 	var err error
 	var done bool
 	for tryNo := uint(1); tryNo <= tries; tryNo++ {
 		done, err = f()
+		wait := c.retryWait
+		if ra, ok := err.(retryAfterError); ok {
+			err = ra.err
+			if ra.wait > wait {
+				wait = ra.wait // honor Retry-After
+			}
+		}
 		if done {
 			return err
 		}
@@ -437,9 +535,9 @@ func (c entityClient) apiRetry(f func() (bool, error)) error {
 		}
 		if tryNo < tries { // don't log or sleep on last try
 			if c.retryLogging {
-				log.Printf("Error querying Etre: %s (try %d of %d, retry in %s)", err, tryNo, tries, c.retryWait)
+				log.Printf("Error querying Etre: %s (try %d of %d, retry in %s)", err, tryNo, tries, wait)
 			}
-			time.Sleep(c.retryWait)
+			time.Sleep(wait)
 		}
 	}
 	return err // last error
@@ -454,17 +552,19 @@ func (c entityClient) apiRetry(f func() (bool, error)) error {
 // return empty slices and no error. Defining a callback function allows tests
 // to intercept, save, and inspect Client calls and simulate Etre API returns.
 type MockEntityClient struct {
-	QueryFunc       func(string, QueryFilter) ([]Entity, error)
-	InsertFunc      func([]Entity) (WriteResult, error)
-	UpdateFunc      func(query string, patch Entity) (WriteResult, error)
-	UpdateOneFunc   func(id string, patch Entity) (WriteResult, error)
-	DeleteFunc      func(query string) (WriteResult, error)
-	DeleteOneFunc   func(id string) (WriteResult, error)
-	LabelsFunc      func(id string) ([]string, error)
-	DeleteLabelFunc func(id string, label string) (WriteResult, error)
-	EntityTypeFunc  func() string
-	WithSetFunc     func(Set) EntityClient
-	WithTraceFunc   func(string) EntityClient
+	QueryFunc        func(string, QueryFilter) ([]Entity, error)
+	InsertFunc       func([]Entity) (WriteResult, error)
+	UpdateFunc       func(query string, patch Entity) (WriteResult, error)
+	UpdateOneFunc    func(id string, patch Entity) (WriteResult, error)
+	DeleteFunc       func(query string) (WriteResult, error)
+	DeleteOneFunc    func(id string) (WriteResult, error)
+	LabelsFunc       func(id string) ([]string, error)
+	DeleteLabelFunc  func(id string, label string) (WriteResult, error)
+	RenameLabelFunc  func(query, from, to string) (WriteResult, error)
+	DeleteLabelsFunc func(query, label string) (WriteResult, error)
+	EntityTypeFunc   func() string
+	WithSetFunc      func(Set) EntityClient
+	WithTraceFunc    func(string) EntityClient
 }
 
 func (c MockEntityClient) Query(query string, filter QueryFilter) ([]Entity, error) {
@@ -523,6 +623,20 @@ func (c MockEntityClient) DeleteLabel(id string, label string) (WriteResult, err
 	return WriteResult{}, nil
 }
 
+func (c MockEntityClient) RenameLabel(query, from, to string) (WriteResult, error) {
+	if c.RenameLabelFunc != nil {
+		return c.RenameLabelFunc(query, from, to)
+	}
+	return WriteResult{}, nil
+}
+
+func (c MockEntityClient) DeleteLabels(query, label string) (WriteResult, error) {
+	if c.DeleteLabelsFunc != nil {
+		return c.DeleteLabelsFunc(query, label)
+	}
+	return WriteResult{}, nil
+}
+
 func (c MockEntityClient) EntityType() string {
 	if c.EntityTypeFunc != nil {
 		return c.EntityTypeFunc()
@@ -43,6 +43,8 @@ func (f ecFactory) Make(ctx app.Context) (etre.EntityClient, error) {
 		RetryWait:    retryWait,
 		RetryLogging: true,
 		QueryTimeout: queryTimeout,
+		APIKey:       ctx.Options.APIKey,
+		TraceParent:  ctx.Options.TraceParent,
 		Debug:        ctx.Options.Debug,
 	}
 	ec := etre.NewEntityClientWithConfig(c)
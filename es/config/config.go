@@ -35,17 +35,21 @@ var (
 // Options represents typical command line options: --addr, --config, etc.
 type Options struct {
 	Addr         string `arg:"env:ES_ADDR" yaml:"addr"`
+	APIKey       string `arg:"--api-key,env:ES_API_KEY" yaml:"api_key"`
 	Config       string `arg:"env:ES_CONFIG"`
 	Debug        bool   `arg:"env:ES_DEBUG" yaml:"debug"`
 	Delete       bool
 	DeleteLabel  bool   `arg:"--delete-label"`
+	DeleteLabels bool   `arg:"--delete-labels"`
 	Env          string `arg:"env:ES_ENV" yaml:"env"`
+	Expand       string `arg:"env:ES_EXPAND" yaml:"expand"`
 	Help         bool
 	JSON         bool   `arg:"env:ES_JSON" yaml:"json"`
 	IFS          string `arg:"env" yaml:"ifs"`
 	Labels       bool   `arg:"env:ES_LABELS" yaml:"labels"`
 	Old          bool   `arg:"env:ES_OLD" yaml:"old"`
 	QueryTimeout string `arg:"--query-timeout,env:ES_QUERY_TIMEOUT" yaml:"query_timeout"`
+	RenameLabel  bool   `arg:"--rename-label"`
 	Retry        uint   `arg:"env:ES_RETRY" yaml:"retry"`
 	RetryWait    string `arg:"--retry-wait,env:ES_RETRY_WAIT" yaml:"retry_wait"`
 	SetOp        string `arg:"--set-op,env:ES_SET_OP"`
@@ -54,6 +58,7 @@ type Options struct {
 	Strict       bool   `arg:"env:ES_STRICT" yaml:"strict"`
 	Timeout      string `arg:"env:ES_TIMEOUT" yaml:"timeout"`
 	Trace        string `arg:"env:ES_TRACE" yaml:"trace"`
+	TraceParent  string `arg:"--traceparent,env:TRACEPARENT"`
 	Update       bool
 	Unique       bool `arg:"-u"`
 	Version      bool `arg:"-v"`
@@ -103,26 +108,33 @@ func Help() {
 		" Update Entity: es [options] --update entity id patches\n"+
 		" Delete Entity: es [options] --delete entity id\n\n"+
 		"  Delete Label: es [options] --delete-label label entity id\n"+
+		" Delete Labels: es [options] --delete-labels entity label [query]\n"+
+		"  Rename Label: es [options] --rename-label entity from to [query]\n"+
 		" Watch Changes: es [options] --watch cdc\n\n"+
 		"Args:\n"+
 		"  entity     Valid entity type (Etre API config.entity.types)\n"+
 		"  label      Comma-separated list of return labels, like: host.zone,env\n"+
+		"             Reference labels in --expand are expanded by label.ref_label, like: host.rack_id.name\n"+
 		"  query      Query string, like: env=production, zone in (east, west)\n"+
 		"  id         Internal ID (_id) of an entity, like: 507f1f77bcf86cd799439011\n"+
 		"  patches    New label=value pairs, like: zone=west status=online\n\n"+
 		"Options:\n"+
 		"  --addr          Etre API address (default: %s)\n"+
+		"  --api-key       API key for authentication\n"+
 		"  --config        Config files (default: %s)\n"+
 		"  --debug         Print debug to stderr\n"+
 		"  --delete        Delete one entity by id\n"+
 		"  --delete-label  Delete entity label\n"+
+		"  --delete-labels Delete label from all entities matching query\n"+
 		"  --env           Environment (dev, staging, production)\n"+
+		"  --expand        Comma-separated list of reference labels to expand\n"+
 		"  --help          Print help\n"+
 		"  --ifs           Character to print between label values (default: %s)\n"+
 		"  --json          Print entities as JSON\n"+
 		"  --labels        Print label: before value\n"+
 		"  --old           Print old values on --update\n"+
 		"  --query-timeout Query timeout on server (default: %s)\n"+
+		"  --rename-label  Rename label on all entities matching query\n"+
 		"  --retry         Retry count on network or API error (default: %d)\n"+
 		"  --retry-wait    Wait time between retries (default: %s)\n"+
 		"  --set-id        User-defined set ID for --update and --delete\n"+
@@ -131,6 +143,7 @@ func Help() {
 		"  --strict        Error if query or --delete does not match entities\n"+
 		"  --timeout       Response timeout per try, includes --query-timeout (default: %s)\n"+
 		"  --trace         Comma-separated key=val pairs for server metrics\n"+
+		"  --traceparent   W3C traceparent to continue a trace, or \"new\" to start one\n"+
 		"  --update        Apply patches to one entity by id\n"+
 		"  --unique (-u)   Return distinct values of a single return label\n"+
 		"  --version       Print version\n"+
@@ -174,6 +187,9 @@ func ParseConfigFiles(files string) Options {
 		if o.Timeout != "" {
 			def.Timeout = o.Timeout
 		}
+		if o.APIKey != "" {
+			def.APIKey = o.APIKey
+		}
 	}
 	return def
 }
@@ -189,11 +205,14 @@ func ParseArgs(args []string) (string, []string, string) {
 	//      node.x   a=b
 	//      node.x,y a=b
 	//      node.z   a=b c=d
+	//      node.r.z a=b
 
 	entityType := args[0]
 	var returnLabels []string
 
-	p := strings.Split(entityType, ".")
+	// Split on first "." only because return labels can be expanded references,
+	// like host.rack_id.name
+	p := strings.SplitN(entityType, ".", 2)
 	if len(p) == 2 {
 		entityType = p[0]
 		returnLabels = strings.Split(p[1], ",")
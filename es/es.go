@@ -13,6 +13,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/es/app"
 	"github.com/square/etre/es/config"
+	"github.com/square/etre/trace"
 )
 
 // Run runs es and exits when done. When using a standard es bin, Run is
@@ -78,12 +79,18 @@ func Run(ctx app.Context) {
 	if cmdLine.Options.DeleteLabel {
 		writeOptions++
 	}
+	if cmdLine.Options.DeleteLabels {
+		writeOptions++
+	}
+	if cmdLine.Options.RenameLabel {
+		writeOptions++
+	}
 	if cmdLine.Options.Update {
 		writeOptions++
 	}
 	if writeOptions > 1 {
 		config.Help()
-		fmt.Fprintf(os.Stderr, "--update, --delete, and --delete-label are mutually exclusive\n")
+		fmt.Fprintf(os.Stderr, "--update, --delete, --delete-label, --delete-labels, and --rename-label are mutually exclusive\n")
 		os.Exit(1)
 	}
 
@@ -111,6 +118,18 @@ func Run(ctx app.Context) {
 				len(cmdLine.Args[3:]), cmdLine.Args[3:])
 			os.Exit(1)
 		}
+	} else if cmdLine.Options.DeleteLabels { // --delete-labels
+		if len(cmdLine.Args) < 2 {
+			config.Help()
+			fmt.Fprintf(os.Stderr, "Not enough arguments for --delete-labels: entity and label are required\n")
+			os.Exit(1)
+		}
+	} else if cmdLine.Options.RenameLabel { // --rename-label
+		if len(cmdLine.Args) < 3 {
+			config.Help()
+			fmt.Fprintf(os.Stderr, "Not enough arguments for --rename-label: entity, from, and to labels are required\n")
+			os.Exit(1)
+		}
 	} else if cmdLine.Options.Update { // --update
 		if len(cmdLine.Args) < 3 {
 			config.Help()
@@ -197,6 +216,20 @@ func Run(ctx app.Context) {
 	entityType := strings.SplitN(cmdLine.Args[0], ".", 2)
 	ctx.EntityType = entityType[0]
 
+	// W3C traceparent for distributed tracing. "new" starts a new trace; print
+	// it so the user can find the trace.
+	traceParent := ctx.Options.TraceParent
+	if traceParent == "new" {
+		traceParent = trace.NewTraceParent()
+		fmt.Fprintf(os.Stderr, "traceparent: %s\n", traceParent)
+	} else if traceParent != "" {
+		if _, err := trace.ParseTraceParent(traceParent); err != nil {
+			printAndExit(fmt.Errorf("invalid --traceparent: %s", err), ctx)
+		}
+	}
+	etre.Debug("traceparent: %s", traceParent)
+	ctx.Options.TraceParent = traceParent // for EntityClientFactory
+
 	// //////////////////////////////////////////////////////////////////////
 	// Make etre.CDCClient
 	// //////////////////////////////////////////////////////////////////////
@@ -207,7 +240,13 @@ func Run(ctx app.Context) {
 			os.Exit(1)
 		}
 		wsAddr := "ws" + strings.TrimPrefix(ctx.Options.Addr, "http")
-		cdcClient := etre.NewCDCClient(wsAddr, nil, 100, ctx.Options.Debug)
+		cdcClient := etre.NewCDCClientWithConfig(etre.CDCClientConfig{
+			Addr:        wsAddr,
+			BufferSize:  100,
+			APIKey:      ctx.Options.APIKey,
+			TraceParent: traceParent,
+			Debug:       ctx.Options.Debug,
+		})
 		eventsChan, err := cdcClient.Start(time.Time{}) // now, no historical backlog
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
@@ -238,7 +277,7 @@ func Run(ctx app.Context) {
 		ec = ec.WithSet(set)
 	}
 
-	var trace string
+	var traceValue string
 	if ctx.Options.Trace != "" {
 		// Validate --trace because client and server do not
 		keyValPairs := strings.Split(ctx.Options.Trace, ",")
@@ -258,12 +297,12 @@ func Run(ctx app.Context) {
 				os.Exit(1)
 			}
 		}
-		trace = ctx.Options.Trace
+		traceValue = ctx.Options.Trace
 	} else {
-		trace = config.DefaultTrace() // user,app,host
+		traceValue = config.DefaultTrace() // user,app,host
 	}
-	etre.Debug("trace: %s", trace)
-	ec = ec.WithTrace(trace)
+	etre.Debug("trace: %s", traceValue)
+	ec = ec.WithTrace(traceValue)
 
 	// //////////////////////////////////////////////////////////////////////
 	// Update and exit, if --update
@@ -367,6 +406,33 @@ func Run(ctx app.Context) {
 		return
 	}
 
+	// //////////////////////////////////////////////////////////////////////
+	// Bulk delete or rename label and exit, if --delete-labels or --rename-label
+	// //////////////////////////////////////////////////////////////////////
+
+	if o.DeleteLabels {
+		label := cmdLine.Args[1]
+		ctx.Query = strings.Join(cmdLine.Args[2:], " ")
+		wr, err := ec.DeleteLabels(ctx.Query, label)
+		if _, err := writeResult(ctx, set, wr, err, "delete label from"); err != nil {
+			printAndExit(err, ctx)
+		}
+		fmt.Printf("OK, deleted label %s from %d %s entities%s\n", label, len(wr.Writes), ctx.EntityType, setInfo(set))
+		return
+	}
+
+	if o.RenameLabel {
+		from := cmdLine.Args[1]
+		to := cmdLine.Args[2]
+		ctx.Query = strings.Join(cmdLine.Args[3:], " ")
+		wr, err := ec.RenameLabel(ctx.Query, from, to)
+		if _, err := writeResult(ctx, set, wr, err, "rename label on"); err != nil {
+			printAndExit(err, ctx)
+		}
+		fmt.Printf("OK, renamed label %s to %s on %d %s entities%s\n", from, to, len(wr.Writes), ctx.EntityType, setInfo(set))
+		return
+	}
+
 	// //////////////////////////////////////////////////////////////////////
 	// Query
 	// //////////////////////////////////////////////////////////////////////
@@ -396,6 +462,7 @@ func Run(ctx app.Context) {
 	f := etre.QueryFilter{
 		ReturnLabels: ctx.ReturnLabels,
 		Distinct:     ctx.Options.Unique,
+		Expand:       expandLabels(ctx.ReturnLabels, ctx.Options.Expand),
 	}
 	entities, err := ec.Query(ctx.Query, f)
 	etre.Debug("ec.Query return: %d entities, err: %v", len(entities), err)
@@ -470,6 +537,31 @@ func Run(ctx app.Context) {
 	}
 }
 
+// expandLabels returns the reference labels to expand for return labels like
+// rack_id.name (expand rack_id). The API returns the value of label name of
+// the referenced rack as label rack_id.name. Only references listed in refs
+// (--expand) are expanded; other return labels with a "." are plain labels.
+func expandLabels(returnLabels []string, refs string) []string {
+	if refs == "" {
+		return nil
+	}
+	declared := map[string]bool{}
+	for _, ref := range strings.Split(refs, ",") {
+		declared[strings.TrimSpace(ref)] = true
+	}
+	var expand []string
+	seen := map[string]bool{}
+	for _, label := range returnLabels {
+		p := strings.SplitN(label, ".", 2)
+		if len(p) != 2 || !declared[p[0]] || seen[p[0]] {
+			continue
+		}
+		seen[p[0]] = true
+		expand = append(expand, p[0])
+	}
+	return expand
+}
+
 func setInfo(set etre.Set) string {
 	if set.Size == 0 {
 		return ""
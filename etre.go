@@ -11,19 +11,30 @@ import (
 	"path"
 	"runtime"
 	"sort"
+
+	"github.com/square/etre/query"
 )
 
 const (
-	VERSION                  = "0.11.2"
-	API_ROOT          string = "/api/v1"
-	META_LABEL_ID            = "_id"
-	META_LABEL_TYPE          = "_type"
-	META_LABEL_REV           = "_rev"
-	CDC_WRITE_TIMEOUT int    = 5 // seconds
+	VERSION                      = "0.11.2"
+	API_ROOT              string = "/api/v1"
+	META_LABEL_ID                = "_id"
+	META_LABEL_TYPE              = "_type"
+	META_LABEL_REV               = "_rev"
+	META_LABEL_TS                = "_ts"
+	META_LABEL_CREATED_TS        = "_created_ts"
+	META_LABEL_CREATED_BY        = "_created_by"
+	META_LABEL_UPDATED_TS        = "_updated_ts"
+	META_LABEL_UPDATED_BY        = "_updated_by"
+	META_LABEL_EXPIRES           = "_expires"
+	META_LABEL_DELETED           = "_deleted"
+	META_LABEL_DELETED_TS        = "_deleted_ts"
+	CDC_WRITE_TIMEOUT     int    = 5 // seconds
 
 	VERSION_HEADER       = "X-Etre-Version"
 	TRACE_HEADER         = "X-Etre-Trace"
 	QUERY_TIMEOUT_HEADER = "X-Etre-Query-Timeout"
+	TRACEPARENT_HEADER   = "traceparent" // W3C Trace Context
 )
 
 var (
@@ -66,7 +77,8 @@ func (e Entity) Rev() int64 {
 	// but that is magical in BSON: "int marshals to a BSON int32 if the value
 	// is between math.MinInt32 and math.MaxInt32, inclusive, and a BSON int64
 	// otherwise." As of v0.11 _rev is int64 everywhere, but for backwards-compat
-	// we check for int and int32.
+	// we check for int and int32. Entities decoded from JSON (API responses)
+	// have float64.
 	v := e[META_LABEL_REV]
 	switch v.(type) {
 	case int64:
@@ -75,6 +87,8 @@ func (e Entity) Rev() int64 {
 		return int64(v.(int32))
 	case int:
 		return int64(v.(int))
+	case float64:
+		return int64(v.(float64))
 	}
 	panic(fmt.Sprintf("entity %s has invalid _rev data type: %T; expected int64 (or int/int32 before v0.11)",
 		e.Id(), v))
@@ -117,19 +131,51 @@ func (e Entity) Set() Set {
 }
 
 var metaLabels = map[string]bool{
-	"_id":      true,
-	"_rev":     true,
-	"_setId":   true,
-	"_setOp":   true,
-	"_setSize": true,
-	"_ts":      true,
-	"_type":    true,
+	"_id":         true,
+	"_rev":        true,
+	"_setId":      true,
+	"_setOp":      true,
+	"_setSize":    true,
+	"_ts":         true,
+	"_type":       true,
+	"_created_ts": true,
+	"_created_by": true,
+	"_updated_ts": true,
+	"_updated_by": true,
+
+	// _expires is the only metalabel that callers can set, change, and delete.
+	// The value is Unix milliseconds after which the server deletes the entity.
+	// It's also set on insert if the entity type has a TTL (config.entity.schemas.<type>.ttl).
+	"_expires": true,
+
+	// _deleted and _deleted_ts (Unix milliseconds) are set by the server when
+	// an entity is soft deleted (config.entity.schemas.<type>.soft_delete).
+	// Soft-deleted entities are not returned unless QueryFilter.IncludeDeleted.
+	"_deleted":    true,
+	"_deleted_ts": true,
 }
 
 func IsMetalabel(label string) bool {
 	return metaLabels[label]
 }
 
+// Computed labels are metalabels set by the server on write if enabled for the
+// entity type (config.entity.schemas.<type>.computed_labels). Timestamps are
+// Unix milliseconds. _ts is set on every write; _created_ts and _created_by
+// on insert; _updated_ts and _updated_by on update. _created_by and _updated_by
+// are the caller name.
+var computedLabels = map[string]bool{
+	META_LABEL_TS:         true,
+	META_LABEL_CREATED_TS: true,
+	META_LABEL_CREATED_BY: true,
+	META_LABEL_UPDATED_TS: true,
+	META_LABEL_UPDATED_BY: true,
+}
+
+func IsComputedLabel(label string) bool {
+	return computedLabels[label]
+}
+
 // Labels returns all labels, sorted, including meta-labels (_id, _type, etc.)
 func (e Entity) Labels() []string {
 	labels := make([]string, len(e))
@@ -163,6 +209,31 @@ type QueryFilter struct {
 	// Distinct returns unique entities if ReturnLabels contains a single value.
 	// Etre returns an error if enabled and ReturnLabels has more than one value.
 	Distinct bool
+
+	// Expand inlines the labels of entities referenced by these labels, which must
+	// be references (config.entity.schemas.<type>.references). Inlined labels are
+	// prefixed with the reference label, like "rack_id.name". ReturnLabels can
+	// include inlined labels to return only those labels of the referenced entity.
+	// Expand and Distinct are mutually exclusive.
+	Expand []string
+
+	// ExpandScope limits expanded references to referenced entities that match
+	// the query, keyed on expand label. It is set by the server to apply the read
+	// scope of the referenced entity type (ACL read scope); clients do not set it.
+	ExpandScope map[string]query.Query `json:"-"`
+
+	// IncludeDeleted returns soft-deleted entities, which have metalabel _deleted=true.
+	// It has no effect if soft delete is not enabled for the entity type
+	// (config.entity.schemas.<type>.soft_delete).
+	IncludeDeleted bool
+}
+
+// LabelRename represents the payload for renaming a label on many entities,
+// sent by EntityClient.RenameLabel.
+type LabelRename struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Query string `json:"query,omitempty"` // optional, default all entities with label From
 }
 
 // WriteResult represents the result of a write operation (insert, update delete).
@@ -217,15 +288,24 @@ func (e Error) Error() string {
 type CDCEvent struct {
 	Id     string `json:"eventId" bson:"_id,omitempty"`
 	Ts     int64  `json:"ts" bson:"ts"` // Unix nanoseconds
-	Op     string `json:"op" bson:"op"` // i=insert, u=update, d=delete
 	Caller string `json:"user" bson:"caller"`
 
+	// Op is i=insert, u=update, d=delete, or p=purge. A soft delete (config
+	// entity.schemas.<type>.soft_delete) is op d with New set to metalabels
+	// _deleted=true and _deleted_ts. The entity is removed later by a purge,
+	// op p, which is the final event for the entity.
+	Op string `json:"op" bson:"op"`
+
 	EntityId   string  `json:"entityId" bson:"entityId"`           // _id of entity
 	EntityType string  `json:"entityType" bson:"entityType"`       // user-defined
 	EntityRev  int64   `json:"rev" bson:"entityRev"`               // entity revision as of this op, 0 on insert
 	Old        *Entity `json:"old,omitempty" bson:"old,omitempty"` // old values of affected labels, null on insert
 	New        *Entity `json:"new,omitempty" bson:"new,omitempty"` // new values of affected labels, null on delete
 
+	// Full is the whole entity after the write, null on delete. It's set only
+	// if enabled for the entity type (config entity.schemas.<type>.cdc_full_entity).
+	Full *Entity `json:"full,omitempty" bson:"full,omitempty"`
+
 	// Set op fields are optional, copied from entity if set. The three
 	// fields are all or nothing: all should be set, or none should be set.
 	// Etre has no semantic awareness of set op values, nor does it validate
@@ -233,6 +313,64 @@ type CDCEvent struct {
 	SetId   string `json:"setId,omitempty" bson:"setId,omitempty"`
 	SetOp   string `json:"setOp,omitempty" bson:"setOp,omitempty"`
 	SetSize int    `json:"setSize,omitempty" bson:"setSize,omitempty"`
+
+	// Seq is the insert order of the event in the CDC collection, assigned by
+	// MongoDB (not an API node clock), so it orders events across API nodes.
+	// It's assigned when the event is written, not committed, so events can
+	// be received slightly out of Seq order. It's 0 for events not read from
+	// the CDC collection. Ack events with Seq so the position is exact.
+	Seq uint64 `json:"seq,omitempty,string" bson:"-"`
+}
+
+// CDCFilter filters a CDC feed on the server. All fields are optional; an event
+// is sent only if it matches every field that is set. See CDCClientV2.StartWithOptions.
+//
+// Query matches the entity before or after the write. Update events have only the
+// changed labels in New and Old, so for entity types without cdc_full_entity (see
+// CDCEvent.Full), a query matches an update only if it uses the changed labels.
+type CDCFilter struct {
+	EntityTypes []string `json:"entityTypes,omitempty"` // entity type is one of these
+	Ops         []string `json:"ops,omitempty"`         // op is one of these: i, u, d, p
+	Query       string   `json:"query,omitempty"`       // KLS selector that matches the entity
+	Labels      []string `json:"labels,omitempty"`      // New or Old has one of these labels
+}
+
+// IsZero returns true if the filter is empty, i.e. it matches all events.
+func (f CDCFilter) IsZero() bool {
+	return len(f.EntityTypes) == 0 && len(f.Ops) == 0 && f.Query == "" && len(f.Labels) == 0
+}
+
+// CDCGap is a revision gap in a change feed: revisions of an entity that were
+// received out of order, but the missing revisions could not be received or read
+// from the CDC store, so the feed skipped them. Events after the gap are sent.
+// If Resync is true, the missing revisions could not be read (Error), so the
+// client should resync all entities; else, only the entity is out of date.
+// If Compacted is true, the missing revisions were deleted by CDC retention
+// compaction, not lost: the events after the gap have the latest entity state.
+// Gaps are sent to CDCStartOptions.GapHandler, in CDCPollResult.Gaps, as SSE
+// "gap" events, and to CDC sinks that implement cdc.GapSink.
+type CDCGap struct {
+	EntityId   string  `json:"entityId"`
+	EntityType string  `json:"entityType"`
+	Revs       []int64 `json:"revs"` // missing revisions
+	Resync     bool    `json:"resync"`
+	Compacted  bool    `json:"compacted,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// CDCPollResult is the response from the long-poll change feed: GET /changes/poll.
+// To get the next events, poll again with since=Next.
+type CDCPollResult struct {
+	Events []CDCEvent `json:"events"`
+	Gaps   []CDCGap   `json:"gaps,omitempty"` // revision gaps while polling
+	Next   string     `json:"next"`           // cursor after the last event read, even if filtered
+}
+
+// CDCSnapshot is the response from GET /snapshot/:type: entities and the
+// change feed cursor they correspond to. See CDCClientV2.Bootstrap.
+type CDCSnapshot struct {
+	Entities []Entity `json:"entities"`
+	Cursor   string   `json:"cursor"` // start the change feed after this position
 }
 
 // Latency represents network latencies in milliseconds.
@@ -34,6 +34,30 @@ type MetricsSystemReport struct {
 	// The API returns HTTP status 401 (unauthorized). If the caller fails to
 	// authenticate, only Query and AuthenticationFailed are incremented.
 	AuthenticationFailed int64 `json:"authentication-failed"`
+
+	// CDCEvents and CDCBytes gauges are the number of events and data size
+	// (bytes) of the CDC collection as of the last CDC retention run. They are
+	// zero if CDC retention is not enabled.
+	CDCEvents int64 `json:"cdc-events"`
+	CDCBytes  int64 `json:"cdc-bytes"`
+
+	// CDCTrimmed counter is the number of CDC events deleted by retention
+	// (max age or max events). CDCCompacted counter is the number of CDC events
+	// deleted by compaction.
+	CDCTrimmed   int64 `json:"cdc-trimmed"`
+	CDCCompacted int64 `json:"cdc-compacted"`
+
+	// CDC revision order counters, all change feeds on this API. CDCOutOfOrder
+	// is the number of events received out of revision order (held until the
+	// missing revisions are received). CDCDropped is the number of events not
+	// sent because the revision was already sent (duplicate or past revision).
+	// CDCGapsRepaired is the number of revision gaps filled by reading the
+	// missing revisions from the CDC store. CDCGapsLost is the number of gaps
+	// that could not be filled; clients are sent a gap or resync control message.
+	CDCOutOfOrder   int64 `json:"cdc-out-of-order"`
+	CDCDropped      int64 `json:"cdc-dropped"`
+	CDCGapsRepaired int64 `json:"cdc-gaps-repaired"`
+	CDCGapsLost     int64 `json:"cdc-gaps-lost"`
 }
 
 // MetricsGroupReport is the top-level metric reporting structure for each metric group.
@@ -58,6 +82,11 @@ type MetricsRequestReport struct {
 	// The caller authenticated, but ACLs do not allow the request.
 	AuthorizationFailed int64 `json:"authorization-failed"`
 
+	// Throttled counter is the number of requests that exceeded a rate limit
+	// or concurrency quota (ACL role_limit or caller_limit). The API returns
+	// HTTP status 429 (too many requests).
+	Throttled int64 `json:"throttled"`
+
 	// InvalidEntityType counter is the number of invalid entity types the caller
 	// tried to query. The API returns HTTP status 400 (bad request) and an etre.Error
 	// message.
@@ -110,10 +139,12 @@ type MetricsQueryReport struct {
 	// ReadMatch stats represent the number of entities that matched the read
 	// query and were returned to the client. See Labels stats for the number
 	// of labels used in the query.
-	ReadMatch_min int64 `json:"read-match_min"`
-	ReadMatch_max int64 `json:"read-match_max"`
-	ReadMatch_avg int64 `json:"read-match_avg"`
-	ReadMatch_med int64 `json:"read-match_med"`
+	ReadMatch_min   int64 `json:"read-match_min"`
+	ReadMatch_max   int64 `json:"read-match_max"`
+	ReadMatch_avg   int64 `json:"read-match_avg"`
+	ReadMatch_med   int64 `json:"read-match_med"`
+	ReadMatch_sum   int64 `json:"read-match_sum"`
+	ReadMatch_count int64 `json:"read-match_count"`
 
 	// Write counter is the grand total number of write queries. All write queries
 	// increment Write by 1. Write = CreateOne + CreateMany + UpdateId +
@@ -136,10 +167,12 @@ type MetricsQueryReport struct {
 	// (API endpoing POST /api/v1/entities/:type). The Created counter measures
 	// the number of entities successfully created. These stats measure the size
 	// of bulk create requests.
-	CreateBulk_min int64 `json:"create-bulk_min"`
-	CreateBulk_max int64 `json:"create-bulk_max"`
-	CreateBulk_avg int64 `json:"create-bulk_avg"`
-	CreateBulk_med int64 `json:"create-bulk_med"`
+	CreateBulk_min   int64 `json:"create-bulk_min"`
+	CreateBulk_max   int64 `json:"create-bulk_max"`
+	CreateBulk_avg   int64 `json:"create-bulk_avg"`
+	CreateBulk_med   int64 `json:"create-bulk_med"`
+	CreateBulk_sum   int64 `json:"create-bulk_sum"`
+	CreateBulk_count int64 `json:"create-bulk_count"`
 
 	// UpdateId and UpdateQuery counters are the number of update (patch) queries.
 	// They are a subset of Write. These API endpoints increment the metrics:
@@ -153,10 +186,12 @@ type MetricsQueryReport struct {
 	// update query and were updated. The Updated counter measures the number
 	// of entities successfully updated. These stats measure the size of bulk
 	// update requests.
-	UpdateBulk_min int64 `json:"update-bulk_min"`
-	UpdateBulk_max int64 `json:"update-bulk_max"`
-	UpdateBulk_avg int64 `json:"update-bulk_avg"`
-	UpdateBulk_med int64 `json:"update-bulk_med"`
+	UpdateBulk_min   int64 `json:"update-bulk_min"`
+	UpdateBulk_max   int64 `json:"update-bulk_max"`
+	UpdateBulk_avg   int64 `json:"update-bulk_avg"`
+	UpdateBulk_med   int64 `json:"update-bulk_med"`
+	UpdateBulk_sum   int64 `json:"update-bulk_sum"`
+	UpdateBulk_count int64 `json:"update-bulk_count"`
 
 	// DeleteId and DeleteQuery counters are the number of delete queries.
 	// They are a subset of Write. These API endpoints increment the metrics:
@@ -170,10 +205,12 @@ type MetricsQueryReport struct {
 	// delete query and were deleted. The Deleted counter measures the number
 	// of entities successfully deleted. These stats measure the size of bulk
 	// delete requests.
-	DeleteBulk_min int64 `json:"delete-bulk_min"`
-	DeleteBulk_max int64 `json:"delete-bulk_max"`
-	DeleteBulk_avg int64 `json:"delete-bulk_avg"`
-	DeleteBulk_med int64 `json:"delete-bulk_med"`
+	DeleteBulk_min   int64 `json:"delete-bulk_min"`
+	DeleteBulk_max   int64 `json:"delete-bulk_max"`
+	DeleteBulk_avg   int64 `json:"delete-bulk_avg"`
+	DeleteBulk_med   int64 `json:"delete-bulk_med"`
+	DeleteBulk_sum   int64 `json:"delete-bulk_sum"`
+	DeleteBulk_count int64 `json:"delete-bulk_count"`
 
 	// DeleteLabel counter is the number of delete label queries. It is a subset of Write.
 	// These API endpoints increment DeleteLabel:
@@ -191,6 +228,11 @@ type MetricsQueryReport struct {
 	Updated int64 `json:"updated"`
 	Deleted int64 `json:"deleted"`
 
+	// Expired counter is the number of expired entities deleted by the reaper
+	// (see metalabel _expires). It's a subset of Deleted. The reaper records
+	// metrics in the default metric group (auth.DefaultMetricGroup).
+	Expired int64 `json:"expired"`
+
 	// SetOp counter is the number of queries that used a set op.
 	SetOp int64 `json:"set-op"`
 
@@ -204,19 +246,25 @@ type MetricsQueryReport struct {
 	// label-specific counters.
 	//
 	// For example, with query "a=1,!b,c in (x,y)" the label count is 3.
-	Labels_min int64 `json:"labels_min"`
-	Labels_max int64 `json:"labels_max"`
-	Labels_avg int64 `json:"labels_avg"`
-	Labels_med int64 `json:"labels_med"`
+	Labels_min   int64 `json:"labels_min"`
+	Labels_max   int64 `json:"labels_max"`
+	Labels_avg   int64 `json:"labels_avg"`
+	Labels_med   int64 `json:"labels_med"`
+	Labels_sum   int64 `json:"labels_sum"`
+	Labels_count int64 `json:"labels_count"`
 
 	// LatencyMs stats represent query latency (response time) in milliseconds
 	// for all queries (read and write). Low query latency is not a problem,
 	// so stats only represent the worst case: high query latency. _p99 is the
 	// 99th percentile (ignoring the top 1% as outliers). _p999 is the 99.9th
-	// percentile (ignoring the top 0.1% as outliers).
-	LatencyMs_max  float64 `json:"latency-ms_max"`
-	LatencyMs_p99  float64 `json:"latency-ms_p99"`
-	LatencyMs_p999 float64 `json:"latency-ms_p999"`
+	// percentile (ignoring the top 0.1% as outliers). _sum and _count, here and
+	// in the other stats, are the sum and number of all samples: unlike the
+	// other stats, they're not reset by reset=true, so they never decrease.
+	LatencyMs_max   float64 `json:"latency-ms_max"`
+	LatencyMs_p99   float64 `json:"latency-ms_p99"`
+	LatencyMs_p999  float64 `json:"latency-ms_p999"`
+	LatencyMs_sum   float64 `json:"latency-ms_sum"`
+	LatencyMs_count int64   `json:"latency-ms_count"`
 
 	// MissSLA counter is the number of queries with LatencyMs greater than
 	// the configured query latency SLA (config.metrics.query_latency_sla).
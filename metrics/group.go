@@ -96,6 +96,7 @@ var _ Metrics = &groupMetrics{} // ensure groupMetrics implements Metrics
 
 type globalMetrics struct {
 	AuthorizationFailed *gm.Counter
+	Throttled           *gm.Counter
 	InvalidEntityType   *gm.Counter
 	DbError             *gm.Counter
 	APIError            *gm.Counter
@@ -103,9 +104,18 @@ type globalMetrics struct {
 }
 
 type entityMetrics struct {
-	query *queryMetrics
-	label map[string]*labelMetrics
-	trace map[string]map[string]*gm.Counter
+	query  *queryMetrics
+	label  map[string]*labelMetrics
+	trace  map[string]map[string]*gm.Counter
+	totals map[*gm.Histogram]histogramTotal // samples before last reset
+}
+
+// histogramTotal is the sum and number of histogram samples before the last
+// reset. It's added to the current samples so _sum and _count are cumulative:
+// Prometheus summary totals must never decrease.
+type histogramTotal struct {
+	sum float64
+	n   int64
 }
 
 type queryMetrics struct {
@@ -133,6 +143,7 @@ type queryMetrics struct {
 	Created      *gm.Counter
 	Updated      *gm.Counter
 	Deleted      *gm.Counter
+	Expired      *gm.Counter
 	QueryTimeout *gm.Counter
 }
 
@@ -150,6 +161,7 @@ func NewGroupMetrics() *groupMetrics {
 	return &groupMetrics{
 		request: &globalMetrics{
 			AuthorizationFailed: gm.NewCounter(),
+			Throttled:           gm.NewCounter(),
 			InvalidEntityType:   gm.NewCounter(),
 			DbError:             gm.NewCounter(),
 			APIError:            gm.NewCounter(),
@@ -195,6 +207,7 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 	m.report.Ts = time.Now().Unix()
 
 	m.report.Request.AuthorizationFailed = m.request.AuthorizationFailed.Count()
+	m.report.Request.Throttled = m.request.Throttled.Count()
 	m.report.Request.InvalidEntityType = m.request.InvalidEntityType.Count()
 	m.report.Request.DbError = m.request.DbError.Count()
 	m.report.Request.APIError = m.request.APIError.Count()
@@ -225,18 +238,22 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 		er.Query.Created = em.query.Created.Count()
 		er.Query.Updated = em.query.Updated.Count()
 		er.Query.Deleted = em.query.Deleted.Count()
+		er.Query.Expired = em.query.Expired.Count()
 		er.Query.QueryTimeout = em.query.QueryTimeout.Count()
 
 		// Histograms
-		qr.ReadMatch_min, qr.ReadMatch_max, qr.ReadMatch_avg, qr.ReadMatch_med = minMaxAvgMed(em.query.ReadMatch, reset)
-		qr.CreateBulk_min, qr.CreateBulk_max, qr.CreateBulk_avg, qr.CreateBulk_med = minMaxAvgMed(em.query.CreateBulk, reset)
-		qr.UpdateBulk_min, qr.UpdateBulk_max, qr.UpdateBulk_avg, qr.UpdateBulk_med = minMaxAvgMed(em.query.UpdateBulk, reset)
-		qr.DeleteBulk_min, qr.DeleteBulk_max, qr.DeleteBulk_avg, qr.DeleteBulk_med = minMaxAvgMed(em.query.DeleteBulk, reset)
-		qr.Labels_min, qr.Labels_max, qr.Labels_avg, qr.Labels_med = minMaxAvgMed(em.query.Labels, reset)
+		qr.ReadMatch_min, qr.ReadMatch_max, qr.ReadMatch_avg, qr.ReadMatch_med, qr.ReadMatch_sum, qr.ReadMatch_count = em.histogramStats(em.query.ReadMatch, reset)
+		qr.CreateBulk_min, qr.CreateBulk_max, qr.CreateBulk_avg, qr.CreateBulk_med, qr.CreateBulk_sum, qr.CreateBulk_count = em.histogramStats(em.query.CreateBulk, reset)
+		qr.UpdateBulk_min, qr.UpdateBulk_max, qr.UpdateBulk_avg, qr.UpdateBulk_med, qr.UpdateBulk_sum, qr.UpdateBulk_count = em.histogramStats(em.query.UpdateBulk, reset)
+		qr.DeleteBulk_min, qr.DeleteBulk_max, qr.DeleteBulk_avg, qr.DeleteBulk_med, qr.DeleteBulk_sum, qr.DeleteBulk_count = em.histogramStats(em.query.DeleteBulk, reset)
+		qr.Labels_min, qr.Labels_max, qr.Labels_avg, qr.Labels_med, qr.Labels_sum, qr.Labels_count = em.histogramStats(em.query.Labels, reset)
 		latencySnap := em.query.Latency.Snapshot(reset)
+		latencyTotal := em.total(em.query.Latency, latencySnap.Sum, int64(latencySnap.N), reset)
 		er.Query.LatencyMs_max = latencySnap.Max
 		er.Query.LatencyMs_p99 = latencySnap.Percentile[0.99]
 		er.Query.LatencyMs_p999 = latencySnap.Percentile[0.999]
+		er.Query.LatencyMs_sum = latencyTotal.sum
+		er.Query.LatencyMs_count = latencyTotal.n
 
 		for label, lm := range em.label {
 			lr, ok := er.Label[label]
@@ -262,13 +279,30 @@ func (m *groupMetrics) Report(reset bool) etre.Metrics {
 	return etre.Metrics{Groups: []etre.MetricsGroupReport{m.report}}
 }
 
-func minMaxAvgMed(h *gm.Histogram, reset bool) (int64, int64, int64, int64) {
+// histogramStats returns min, max, avg, med, sum, and count. Sum and count are
+// cumulative (see histogramTotal); the other stats are since the last reset.
+func (em *entityMetrics) histogramStats(h *gm.Histogram, reset bool) (int64, int64, int64, int64, int64, int64) {
 	snap := h.Snapshot(reset)
 	var avg int64
 	if snap.N > 0 {
 		avg = int64(snap.Sum / float64(snap.N))
 	}
-	return int64(snap.Min), int64(snap.Max), avg, int64(snap.Percentile[0.50])
+	total := em.total(h, snap.Sum, int64(snap.N), reset)
+	return int64(snap.Min), int64(snap.Max), avg, int64(snap.Percentile[0.50]), int64(total.sum), total.n
+}
+
+// total returns the cumulative sum and count of the histogram given the sum and
+// count of its current samples. If reset, the current samples are added to the
+// total before the last reset because the histogram was just reset. The caller
+// must lock groupMetrics.
+func (em *entityMetrics) total(h *gm.Histogram, sum float64, n int64, reset bool) histogramTotal {
+	t := em.totals[h]
+	t.sum += sum
+	t.n += n
+	if reset {
+		em.totals[h] = t
+	}
+	return t
 }
 
 // --------------------------------------------------------------------------
@@ -338,13 +372,15 @@ func (m *groupEntityMetrics) EntityType(entityType string) {
 			Created:      gm.NewCounter(),
 			Updated:      gm.NewCounter(),
 			Deleted:      gm.NewCounter(),
+			Expired:      gm.NewCounter(),
 			Labels:       gm.NewHistogram(medConfig),
 			Latency:      gm.NewHistogram(latencyConfig),
 			MissSLA:      gm.NewCounter(),
 			QueryTimeout: gm.NewCounter(),
 		},
-		label: map[string]*labelMetrics{},
-		trace: map[string]map[string]*gm.Counter{},
+		label:  map[string]*labelMetrics{},
+		trace:  map[string]map[string]*gm.Counter{},
+		totals: map[*gm.Histogram]histogramTotal{},
 	}
 
 	m.report.Entity[entityType] = &etre.MetricsEntityReport{
@@ -395,6 +431,8 @@ func (m *groupEntityMetrics) Inc(mn byte, n int64) {
 		m.em.query.Updated.Add(n)
 	case Deleted:
 		m.em.query.Deleted.Add(n)
+	case Expired:
+		m.em.query.Expired.Add(n)
 	case QueryTimeout:
 		m.em.query.QueryTimeout.Add(n)
 	// CDC
@@ -403,6 +441,8 @@ func (m *groupEntityMetrics) Inc(mn byte, n int64) {
 	// Request
 	case AuthorizationFailed:
 		m.request.AuthorizationFailed.Add(n)
+	case Throttled:
+		m.request.Throttled.Add(n)
 	case InvalidEntityType:
 		m.request.InvalidEntityType.Add(n)
 	case DbError:
@@ -52,12 +52,22 @@ const (
 	Created                          // counter
 	Updated                          // counter
 	Deleted                          // counter
+	Expired                          // counter
 	AuthenticationFailed             // counter (system)
 	AuthorizationFailed              // counter
+	Throttled                        // counter
 	InvalidEntityType                // counter
 	QueryTimeout                     // counter
 	Load                             // gauge   (system)
 	Error                            // counter (system)
+	CDCEvents                        // gauge   (system)
+	CDCBytes                         // gauge   (system)
+	CDCTrimmed                       // counter (system)
+	CDCCompacted                     // counter (system)
+	CDCOutOfOrder                    // counter (system)
+	CDCDropped                       // counter (system)
+	CDCGapsRepaired                  // counter (system)
+	CDCGapsLost                      // counter (system)
 )
 
 // Metrics abstracts how metrics are stored and sampled.
@@ -47,6 +47,7 @@ func TestEntityMetrics(t *testing.T) {
 	em.Inc(metrics.Created, 118)
 	em.Inc(metrics.Updated, 119)
 	em.Inc(metrics.Deleted, 120)
+	em.Inc(metrics.Expired, 121)
 	em.Inc(metrics.QueryTimeout, 130)
 
 	em.IncLabel(metrics.LabelRead, "lr")
@@ -63,6 +64,7 @@ func TestEntityMetrics(t *testing.T) {
 	em.Inc(metrics.DbError, 200)
 	em.Inc(metrics.APIError, 201)
 	em.Inc(metrics.ClientError, 202)
+	em.Inc(metrics.Throttled, 204)
 	em.Inc(metrics.InvalidEntityType, 203)
 
 	em.Val(metrics.ReadMatch, 30)
@@ -94,53 +96,67 @@ func TestEntityMetrics(t *testing.T) {
 					APIError:          201,
 					ClientError:       202,
 					InvalidEntityType: 203,
+					Throttled:         204,
 				},
 				Entity: map[string]*etre.MetricsEntityReport{
 					"t1": &etre.MetricsEntityReport{
 						EntityType: "t1",
 						Query: &etre.MetricsQueryReport{
-							Query:          100,
-							SetOp:          101,
-							MissSLA:        102,
-							Read:           103,
-							ReadQuery:      104,
-							ReadId:         105,
-							ReadMatch_min:  30,
-							ReadMatch_max:  30,
-							ReadMatch_avg:  30,
-							ReadMatch_med:  30,
-							ReadLabels:     106,
-							Write:          107,
-							CreateOne:      108,
-							CreateMany:     115,
-							CreateBulk_min: 40,
-							CreateBulk_max: 40,
-							CreateBulk_avg: 40,
-							CreateBulk_med: 40,
-							UpdateId:       110,
-							UpdateQuery:    116,
-							UpdateBulk_min: 50,
-							UpdateBulk_max: 50,
-							UpdateBulk_avg: 50,
-							UpdateBulk_med: 50,
-							DeleteId:       112,
-							DeleteQuery:    117,
-							DeleteBulk_min: 60,
-							DeleteBulk_max: 60,
-							DeleteBulk_avg: 60,
-							DeleteBulk_med: 60,
-							DeleteLabel:    114,
-							Labels_min:     5,
-							Labels_max:     20,
-							Labels_avg:     11,
-							Labels_med:     10,
-							LatencyMs_max:  250,
-							LatencyMs_p99:  250,
-							LatencyMs_p999: 250,
-							Created:        118,
-							Updated:        119,
-							Deleted:        120,
-							QueryTimeout:   130,
+							Query:            100,
+							SetOp:            101,
+							MissSLA:          102,
+							Read:             103,
+							ReadQuery:        104,
+							ReadId:           105,
+							ReadMatch_min:    30,
+							ReadMatch_max:    30,
+							ReadMatch_avg:    30,
+							ReadMatch_med:    30,
+							ReadMatch_sum:    30,
+							ReadMatch_count:  1,
+							ReadLabels:       106,
+							Write:            107,
+							CreateOne:        108,
+							CreateMany:       115,
+							CreateBulk_min:   40,
+							CreateBulk_max:   40,
+							CreateBulk_avg:   40,
+							CreateBulk_med:   40,
+							CreateBulk_sum:   40,
+							CreateBulk_count: 1,
+							UpdateId:         110,
+							UpdateQuery:      116,
+							UpdateBulk_min:   50,
+							UpdateBulk_max:   50,
+							UpdateBulk_avg:   50,
+							UpdateBulk_med:   50,
+							UpdateBulk_sum:   50,
+							UpdateBulk_count: 1,
+							DeleteId:         112,
+							DeleteQuery:      117,
+							DeleteBulk_min:   60,
+							DeleteBulk_max:   60,
+							DeleteBulk_avg:   60,
+							DeleteBulk_med:   60,
+							DeleteBulk_sum:   60,
+							DeleteBulk_count: 1,
+							DeleteLabel:      114,
+							Labels_min:       5,
+							Labels_max:       20,
+							Labels_avg:       11,
+							Labels_med:       10,
+							Labels_sum:       35,
+							Labels_count:     3,
+							LatencyMs_max:    250,
+							LatencyMs_p99:    250,
+							LatencyMs_p999:   250,
+							LatencyMs_sum:    250,
+							LatencyMs_count:  1,
+							Created:          118,
+							Updated:          119,
+							Deleted:          120,
+							Expired:          121,
+							QueryTimeout:     130,
 						},
 						Label: map[string]*etre.MetricsLabelReport{
 							"lr": &etre.MetricsLabelReport{
@@ -180,6 +196,37 @@ func TestEntityMetrics(t *testing.T) {
 	}
 }
 
+func TestResetCumulativeTotals(t *testing.T) {
+	// Reset clears histogram samples, but _sum and _count must never decrease
+	// because Prometheus summaries are cumulative
+	gm := metrics.NewGroupMetrics()
+	em := metrics.NewGroupEntityMetrics(gm)
+	em.EntityType("t1")
+
+	em.Val(metrics.ReadMatch, 10)
+	em.Val(metrics.LatencyMs, 100)
+	r := em.Report(true).Groups[0].Entity["t1"].Query
+	if r.ReadMatch_sum != 10 || r.ReadMatch_count != 1 || r.LatencyMs_count != 1 {
+		t.Errorf("first report: ReadMatch_sum %d, ReadMatch_count %d, LatencyMs_count %d, expected 10, 1, 1", r.ReadMatch_sum, r.ReadMatch_count, r.LatencyMs_count)
+	}
+
+	em.Val(metrics.ReadMatch, 5)
+	em.Val(metrics.LatencyMs, 100)
+	r = em.Report(false).Groups[0].Entity["t1"].Query
+	if r.ReadMatch_sum != 15 || r.ReadMatch_count != 2 || r.LatencyMs_count != 2 {
+		t.Errorf("after reset: ReadMatch_sum %d, ReadMatch_count %d, LatencyMs_count %d, expected 15, 2, 2", r.ReadMatch_sum, r.ReadMatch_count, r.LatencyMs_count)
+	}
+	if r.ReadMatch_min != 5 || r.ReadMatch_max != 5 {
+		t.Errorf("after reset: ReadMatch_min %d, ReadMatch_max %d, expected 5, 5", r.ReadMatch_min, r.ReadMatch_max)
+	}
+
+	// Report without reset doesn't add the current samples twice
+	r = em.Report(true).Groups[0].Entity["t1"].Query
+	if r.ReadMatch_sum != 15 || r.ReadMatch_count != 2 {
+		t.Errorf("second reset: ReadMatch_sum %d, ReadMatch_count %d, expected 15, 2", r.ReadMatch_sum, r.ReadMatch_count)
+	}
+}
+
 func TestMultipleEntityMetrics(t *testing.T) {
 	// The same group metrics should hold distrinct metrics for each
 	// entity type used. Save a metric for entity type t1, then switch to
@@ -0,0 +1,184 @@
+// Copyright 2020, Square, Inc.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/square/etre"
+)
+
+// PROMETHEUS_CONTENT_TYPE is the content type of WritePrometheus output.
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes the metrics in Prometheus text exposition format.
+// Metric names are derived from the etre.Metrics JSON field names, like
+// "read-query" in the query report is etre_query_read_query_total. Group,
+// entity type, and label values are Prometheus labels. Trace values are not
+// exported because their cardinality is unbounded. Sampled stats, like
+// latency-ms_p99, are summaries: etre_query_latency_ms{quantile="0.99"} plus
+// etre_query_latency_ms_sum and _count. The _avg stats are not exported because
+// they're _sum / _count.
+func WritePrometheus(w io.Writer, m etre.Metrics) error {
+	p := &promWriter{families: map[string]*promFamily{}}
+
+	if m.System != nil {
+		p.report("system", *m.System, nil)
+	}
+	for _, g := range m.Groups {
+		groupLabels := []promLabel{{"group", g.Group}}
+		if g.Request != nil {
+			p.report("request", *g.Request, groupLabels)
+		}
+		if g.CDC != nil {
+			p.report("cdc", *g.CDC, groupLabels)
+		}
+		entityTypes := make([]string, 0, len(g.Entity))
+		for entityType := range g.Entity {
+			entityTypes = append(entityTypes, entityType)
+		}
+		sort.Strings(entityTypes)
+		for _, entityType := range entityTypes {
+			er := g.Entity[entityType]
+			entityLabels := append(groupLabels[:1:1], promLabel{"entity_type", entityType})
+			if er.Query != nil {
+				p.report("query", *er.Query, entityLabels)
+			}
+			for _, label := range sortedKeys(er.Label) {
+				p.report("label", *er.Label[label], append(entityLabels[:2:2], promLabel{"label", label}))
+			}
+		}
+	}
+
+	for _, name := range p.order {
+		f := p.families[name]
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, f.typ); err != nil {
+			return err
+		}
+		for _, s := range f.samples {
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promFamily struct {
+	typ     string
+	samples []string
+}
+
+// promWriter collects samples by metric family because all samples of a
+// family must be written together, after its TYPE line.
+type promWriter struct {
+	families map[string]*promFamily
+	order    []string
+}
+
+// gauges are fields that are not counters or sampled stats.
+var promGauges = map[string]bool{
+	"etre_system_load":       true,
+	"etre_system_cdc_events": true,
+	"etre_system_cdc_bytes":  true,
+	"etre_cdc_clients":       true,
+}
+
+// report adds a sample for each int64 or float64 field of the report struct.
+func (p *promWriter) report(prefix string, report interface{}, labels []promLabel) {
+	v := reflect.ValueOf(report)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		var val float64
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Int64:
+			val = float64(f.Int())
+		case reflect.Float64:
+			val = f.Float()
+		default:
+			continue
+		}
+		name := "etre_" + prefix + "_" + strings.Replace(tag, "-", "_", -1)
+		if n := strings.LastIndex(tag, "_"); n > 0 {
+			// Sampled stat like "latency-ms_p99"
+			name = "etre_" + prefix + "_" + strings.Replace(tag[:n], "-", "_", -1)
+			switch stat := tag[n+1:]; stat {
+			case "sum", "count":
+				p.sample(name, "summary", name+"_"+stat, labels, val)
+			default:
+				if q, ok := promQuantiles[stat]; ok {
+					p.add(name, "summary", append(labels[:len(labels):len(labels)], promLabel{"quantile", q}), val)
+				}
+			}
+			continue
+		}
+		if promGauges[name] {
+			p.add(name, "gauge", labels, val)
+			continue
+		}
+		p.add(name+"_total", "counter", labels, val)
+	}
+}
+
+// promQuantiles maps sampled stat suffixes to summary quantiles. Stats not
+// listed, like _avg, are not exported.
+var promQuantiles = map[string]string{
+	"min":  "0",
+	"med":  "0.5",
+	"p99":  "0.99",
+	"p999": "0.999",
+	"max":  "1",
+}
+
+func (p *promWriter) add(name, typ string, labels []promLabel, val float64) {
+	p.sample(name, typ, name, labels, val)
+}
+
+// sample adds a sample to the metric family. The sample name differs from the
+// family name for summary _sum and _count samples.
+func (p *promWriter) sample(family, typ, name string, labels []promLabel, val float64) {
+	f, ok := p.families[family]
+	if !ok {
+		f = &promFamily{typ: typ}
+		p.families[family] = f
+		p.order = append(p.order, family)
+	}
+	var s strings.Builder
+	s.WriteString(name)
+	if len(labels) > 0 {
+		s.WriteString("{")
+		for i, l := range labels {
+			if i > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(l.name + `="` + promEscape.Replace(l.value) + `"`)
+		}
+		s.WriteString("}")
+	}
+	fmt.Fprintf(&s, " %v\n", val)
+	f.samples = append(f.samples, s.String())
+}
+
+var promEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]*etre.MetricsLabelReport) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,91 @@
+// Copyright 2020, Square, Inc.
+
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre"
+	"github.com/square/etre/metrics"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	m := etre.Metrics{
+		System: &etre.MetricsSystemReport{Query: 10, Load: 2, Error: 1, AuthenticationFailed: 0},
+		Groups: []etre.MetricsGroupReport{
+			{
+				Group:   "g1",
+				Request: &etre.MetricsRequestReport{AuthorizationFailed: 3},
+				CDC:     &etre.MetricsCDCReport{Clients: 1},
+				Entity: map[string]*etre.MetricsEntityReport{
+					"host": {
+						EntityType: "host",
+						Query:      &etre.MetricsQueryReport{Query: 5, ReadQuery: 4, LatencyMs_p99: 12.5, LatencyMs_sum: 30, LatencyMs_count: 4},
+						Label: map[string]*etre.MetricsLabelReport{
+							"zone": {Read: 4},
+						},
+						Trace: map[string]map[string]int64{
+							"app": {"cron \"x\"": 2},
+						},
+					},
+				},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	// Spot check each type of metric; there are too many query metrics to
+	// list them all
+	for _, expect := range []string{
+		"# TYPE etre_system_query_total counter\netre_system_query_total 10\n",
+		"# TYPE etre_system_load gauge\netre_system_load 2\n",
+		"# TYPE etre_request_authorization_failed_total counter\netre_request_authorization_failed_total{group=\"g1\"} 3\n",
+		"# TYPE etre_cdc_clients gauge\netre_cdc_clients{group=\"g1\"} 1\n",
+		"# TYPE etre_query_read_query_total counter\netre_query_read_query_total{group=\"g1\",entity_type=\"host\"} 4\n",
+		"# TYPE etre_query_latency_ms summary\n",
+		"etre_query_latency_ms{group=\"g1\",entity_type=\"host\",quantile=\"1\"} 0\n",
+		"etre_query_latency_ms{group=\"g1\",entity_type=\"host\",quantile=\"0.99\"} 12.5\n",
+		"etre_query_latency_ms_sum{group=\"g1\",entity_type=\"host\"} 30\n",
+		"etre_query_latency_ms_count{group=\"g1\",entity_type=\"host\"} 4\n",
+		"# TYPE etre_query_read_match summary\n",
+		"etre_query_read_match{group=\"g1\",entity_type=\"host\",quantile=\"0.5\"} 0\n",
+		"# TYPE etre_label_read_total counter\netre_label_read_total{group=\"g1\",entity_type=\"host\",label=\"zone\"} 4\n",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(expect)) {
+			t.Errorf("output does not contain %q", expect)
+		}
+	}
+
+	// Trace values and _avg stats are not exported
+	for _, notExpect := range []string{"etre_trace", "stat=", "quantile=\"avg\""} {
+		if bytes.Contains(buf.Bytes(), []byte(notExpect)) {
+			t.Errorf("output contains %q", notExpect)
+		}
+	}
+
+	// Each metric family has exactly one TYPE line
+	types := map[string]int{}
+	for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("# TYPE ")) {
+			types[string(bytes.Fields(line)[2])]++
+		}
+	}
+	for name, n := range types {
+		if n != 1 {
+			t.Errorf("%s has %d TYPE lines, expected 1", name, n)
+		}
+	}
+	if diff := deep.Equal(types["etre_query_latency_ms"], 1); diff != nil {
+		t.Error(diff)
+	}
+	if t.Failed() {
+		t.Log(got)
+	}
+}
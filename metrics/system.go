@@ -19,6 +19,14 @@ type systemMetrics struct {
 	invalidEntityType *gm.Counter
 	load              *gm.Gauge
 	error             *gm.Counter
+	cdcEvents         *gm.Gauge
+	cdcBytes          *gm.Gauge
+	cdcTrimmed        *gm.Counter
+	cdcCompacted      *gm.Counter
+	cdcOutOfOrder     *gm.Counter
+	cdcDropped        *gm.Counter
+	cdcGapsRepaired   *gm.Counter
+	cdcGapsLost       *gm.Counter
 }
 
 var _ Metrics = &systemMetrics{} // ensure systemMetrics implements Metrics
@@ -31,6 +39,14 @@ func NewSystemMetrics() *systemMetrics {
 		invalidEntityType: gm.NewCounter(),
 		load:              gm.NewGauge(gm.Config{}),
 		error:             gm.NewCounter(),
+		cdcEvents:         gm.NewGauge(gm.Config{}),
+		cdcBytes:          gm.NewGauge(gm.Config{}),
+		cdcTrimmed:        gm.NewCounter(),
+		cdcCompacted:      gm.NewCounter(),
+		cdcOutOfOrder:     gm.NewCounter(),
+		cdcDropped:        gm.NewCounter(),
+		cdcGapsRepaired:   gm.NewCounter(),
+		cdcGapsLost:       gm.NewCounter(),
 	}
 }
 
@@ -48,6 +64,18 @@ func (m *systemMetrics) Inc(mn byte, n int64) {
 		m.load.Add(n)
 	case Error:
 		m.error.Add(n)
+	case CDCTrimmed:
+		m.cdcTrimmed.Add(n)
+	case CDCCompacted:
+		m.cdcCompacted.Add(n)
+	case CDCOutOfOrder:
+		m.cdcOutOfOrder.Add(n)
+	case CDCDropped:
+		m.cdcDropped.Add(n)
+	case CDCGapsRepaired:
+		m.cdcGapsRepaired.Add(n)
+	case CDCGapsLost:
+		m.cdcGapsLost.Add(n)
 	default:
 		errMsg := fmt.Sprintf("non-counter metric number passed to Inc: %d", mn)
 		panic(errMsg)
@@ -59,7 +87,15 @@ func (m *systemMetrics) IncLabel(mn byte, label string) {
 }
 
 func (m *systemMetrics) Val(mn byte, n int64) {
-	panic("Val() called on systemMetrics")
+	switch mn {
+	case CDCEvents:
+		m.cdcEvents.Record(float64(n))
+	case CDCBytes:
+		m.cdcBytes.Record(float64(n))
+	default:
+		errMsg := fmt.Sprintf("non-gauge metric number passed to Val: %d", mn)
+		panic(errMsg)
+	}
 }
 
 func (m *systemMetrics) Trace(trace map[string]string) {
@@ -74,6 +110,14 @@ func (m *systemMetrics) Report(reset bool) etre.Metrics {
 		AuthenticationFailed: m.authFail.Count(),
 		Load:                 int64(m.load.Last()),
 		Error:                m.error.Count(),
+		CDCEvents:            int64(m.cdcEvents.Last()),
+		CDCBytes:             int64(m.cdcBytes.Last()),
+		CDCTrimmed:           m.cdcTrimmed.Count(),
+		CDCCompacted:         m.cdcCompacted.Count(),
+		CDCOutOfOrder:        m.cdcOutOfOrder.Count(),
+		CDCDropped:           m.cdcDropped.Count(),
+		CDCGapsRepaired:      m.cdcGapsRepaired.Count(),
+		CDCGapsLost:          m.cdcGapsLost.Count(),
 	}
 	return etre.Metrics{System: r}
 }
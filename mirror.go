@@ -0,0 +1,479 @@
+// Copyright 2020, Square, Inc.
+
+package etre
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/square/etre/query"
+)
+
+const (
+	DEFAULT_MIRROR_RETRY_WAIT    = 1 * time.Second
+	DEFAULT_MIRROR_PING_INTERVAL = 10 * time.Second
+)
+
+// MirrorConfig configures a Mirror.
+type MirrorConfig struct {
+	// EntityTypes are the entity types to mirror. Required.
+	EntityTypes []string
+
+	// NewCDCClient returns a new CDCClient that implements CDCClientV2, like
+	// NewCDCClient. Required. The mirror makes one client for each entity type,
+	// and a new one to resync after a feed error.
+	NewCDCClient func() CDCClient
+
+	// IndexLabels are labels indexed for queries: "=", "==", and "in" on an
+	// indexed label look up matching entities instead of scanning all entities.
+	// Entity ID (_id) is always indexed.
+	IndexLabels []string
+
+	// RetryWait is how long to wait before resyncing after a feed error.
+	// Default: DEFAULT_MIRROR_RETRY_WAIT.
+	RetryWait time.Duration
+
+	// PingInterval is how often to ping the API to detect a dead feed and
+	// measure staleness when there are no events. Default: DEFAULT_MIRROR_PING_INTERVAL.
+	PingInterval time.Duration
+
+	// MaxEntities is the RevOrder max entities. Default: DEFAULT_MAX_ENTITIES.
+	MaxEntities uint
+}
+
+// MirrorStatus is the sync status of one entity type in a Mirror.
+type MirrorStatus struct {
+	EntityType  string
+	Entities    int
+	Synced      bool          // bootstrapped and feed running
+	SyncTime    time.Time     // last bootstrap
+	Resyncs     int           // bootstraps after feed errors
+	LastEvent   time.Time     // ts of last event applied
+	LastContact time.Time     // last event or ping from the API
+	Staleness   time.Duration // time since LastContact, i.e. how out of date the mirror could be
+	Error       string        // last feed error, if any
+}
+
+// A Mirror is an in-memory copy of entities kept in sync by the CDC feed. It
+// answers queries locally, so a service can query it as often as needed instead
+// of polling the API. For each entity type, it bootstraps from a snapshot (see
+// CDCClientV2.Bootstrap), then applies CDC events in revision order (see RevOrder).
+// On feed error or revision gap (see CDCGap), it resyncs: bootstraps again and
+// replaces the entities. If CDC events have the full entity (CDCEvent.Full),
+// updates replace the whole entity.
+//
+// The mirror has all entities of each type. Use Status to check staleness.
+type Mirror struct {
+	cfg MirrorConfig
+	// --
+	*sync.RWMutex
+	types    map[string]*mirrorType
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// mirrorFeed is the CDC feed of one entity type and revision gaps in it.
+type mirrorFeed struct {
+	events <-chan CDCEvent
+	gaps   <-chan CDCGap
+}
+
+type mirrorType struct {
+	entities map[string]Entity                     // keyed on _id
+	index    map[string]map[string]map[string]bool // label -> value -> _id
+	status   MirrorStatus
+}
+
+// NewMirror makes a new Mirror. Call Start to bootstrap and start syncing.
+func NewMirror(cfg MirrorConfig) *Mirror {
+	if cfg.RetryWait == 0 {
+		cfg.RetryWait = DEFAULT_MIRROR_RETRY_WAIT
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = DEFAULT_MIRROR_PING_INTERVAL
+	}
+	return &Mirror{
+		cfg:      cfg,
+		RWMutex:  &sync.RWMutex{},
+		types:    map[string]*mirrorType{},
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start bootstraps every entity type, then syncs them in the background until
+// Stop is called. It returns an error if any entity type cannot be bootstrapped.
+func (m *Mirror) Start() error {
+	if len(m.cfg.EntityTypes) == 0 || m.cfg.NewCDCClient == nil {
+		return fmt.Errorf("MirrorConfig.EntityTypes and NewCDCClient are required")
+	}
+	clients := make([]CDCClient, len(m.cfg.EntityTypes))
+	feeds := make([]mirrorFeed, len(m.cfg.EntityTypes))
+	for i, entityType := range m.cfg.EntityTypes {
+		client, feed, err := m.bootstrap(entityType)
+		if err != nil {
+			for _, c := range clients[:i] {
+				c.Stop()
+			}
+			return fmt.Errorf("cannot bootstrap %s: %s", entityType, err)
+		}
+		clients[i] = client
+		feeds[i] = feed
+	}
+	for i, entityType := range m.cfg.EntityTypes {
+		m.wg.Add(1)
+		go m.sync(entityType, clients[i], feeds[i])
+	}
+	return nil
+}
+
+// Stop stops syncing. The entities remain queryable but are no longer updated.
+func (m *Mirror) Stop() {
+	m.Lock()
+	select {
+	case <-m.stopChan:
+		m.Unlock()
+		return // already stopped
+	default:
+	}
+	close(m.stopChan)
+	m.Unlock()
+	m.wg.Wait()
+}
+
+// Query returns entities of the type that match the KLS selector, like
+// EntityClient.Query. An empty selector matches all entities. The returned
+// entities are copies.
+func (m *Mirror) Query(entityType, selector string) ([]Entity, error) {
+	q, err := query.Translate(selector)
+	if err != nil {
+		return nil, err
+	}
+	m.RLock()
+	defer m.RUnlock()
+	t, ok := m.types[entityType]
+	if !ok {
+		return nil, fmt.Errorf("entity type %s not mirrored", entityType)
+	}
+	entities := []Entity{}
+	match := func(e Entity) {
+		if query.Matches(q, e) {
+			c := Entity{}
+			for k, v := range e {
+				c[k] = v
+			}
+			entities = append(entities, c)
+		}
+	}
+	if ids, ok := t.lookup(q); ok {
+		for id := range ids {
+			if e, ok := t.entities[id]; ok {
+				match(e)
+			}
+		}
+	} else {
+		for _, e := range t.entities {
+			match(e)
+		}
+	}
+	return entities, nil
+}
+
+// Status returns the sync status of each entity type, in MirrorConfig.EntityTypes order.
+func (m *Mirror) Status() []MirrorStatus {
+	m.RLock()
+	defer m.RUnlock()
+	now := time.Now()
+	status := make([]MirrorStatus, 0, len(m.cfg.EntityTypes))
+	for _, entityType := range m.cfg.EntityTypes {
+		t, ok := m.types[entityType]
+		if !ok {
+			status = append(status, MirrorStatus{EntityType: entityType})
+			continue
+		}
+		s := t.status
+		s.Entities = len(t.entities)
+		if !s.LastContact.IsZero() {
+			s.Staleness = now.Sub(s.LastContact)
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// --------------------------------------------------------------------------
+
+// bootstrap loads a snapshot of the entity type, replacing any existing entities,
+// and returns the client and its feed started after the snapshot.
+func (m *Mirror) bootstrap(entityType string) (CDCClient, mirrorFeed, error) {
+	client, ok := m.cfg.NewCDCClient().(CDCClientV2)
+	if !ok {
+		return nil, mirrorFeed{}, fmt.Errorf("MirrorConfig.NewCDCClient returned a CDCClient that does not implement CDCClientV2")
+	}
+	gaps := make(chan CDCGap, 1)
+	opts := CDCStartOptions{
+		GapHandler: func(g CDCGap) {
+			select {
+			case gaps <- g:
+			default: // already resyncing
+			}
+		},
+	}
+	snap, events, err := client.Bootstrap(entityType, opts)
+	if err != nil {
+		return nil, mirrorFeed{}, err
+	}
+	t := &mirrorType{
+		entities: make(map[string]Entity, len(snap.Entities)),
+		index:    map[string]map[string]map[string]bool{},
+	}
+	for _, label := range m.cfg.IndexLabels {
+		t.index[label] = map[string]map[string]bool{}
+	}
+	for _, e := range snap.Entities {
+		t.put(e)
+	}
+	now := time.Now()
+	m.Lock()
+	if prev, ok := m.types[entityType]; ok {
+		t.status = prev.status
+		t.status.Resyncs++
+	}
+	t.status.EntityType = entityType
+	t.status.Synced = true
+	t.status.SyncTime = now
+	t.status.LastContact = now
+	m.types[entityType] = t
+	m.Unlock()
+	Debug("mirror %s: bootstrapped %d entities, cursor %s", entityType, len(snap.Entities), snap.Cursor)
+	return client, mirrorFeed{events: events, gaps: gaps}, nil
+}
+
+// sync applies events from the feed, resyncing on error, until Stop is called.
+func (m *Mirror) sync(entityType string, client CDCClient, feed mirrorFeed) {
+	defer m.wg.Done()
+	for {
+		err := m.feed(entityType, client, feed)
+		client.Stop()
+		if err == nil {
+			return // stopped
+		}
+		m.setError(entityType, err)
+
+		// Resync: bootstrap again after waiting, until it works or stopped
+		for {
+			select {
+			case <-time.After(m.cfg.RetryWait):
+			case <-m.stopChan:
+				return
+			}
+			client, feed, err = m.bootstrap(entityType)
+			if err == nil {
+				break
+			}
+			m.setError(entityType, err)
+		}
+	}
+}
+
+// feed applies events in revision order until the feed closes or has a revision
+// gap (error), or Stop is called (nil). It pings the API so LastContact is current
+// when there are no events.
+func (m *Mirror) feed(entityType string, client CDCClient, feed mirrorFeed) error {
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	go func() {
+		ticker := time.NewTicker(m.cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if lag := client.Ping(m.cfg.PingInterval); lag.RTT > 0 || lag.Send > 0 || lag.Recv > 0 {
+					m.contact(entityType)
+				}
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	revo := NewRevOrder(m.cfg.MaxEntities, true)
+	for {
+		select {
+		case e, ok := <-feed.events:
+			if !ok {
+				if err := client.Error(); err != nil {
+					return err
+				}
+				return fmt.Errorf("feed closed")
+			}
+			ok, prev := revo.InOrder(e)
+			if evicted := revo.Evicted(); len(evicted) > 0 {
+				g := evicted[0].Gap // resync fixes all
+				return fmt.Errorf("revision gap: entity %s revisions %v lost (%s)", g.EntityId, g.Revs, g.Error)
+			}
+			if !ok {
+				continue // out of order, buffered in revo
+			}
+			m.Lock()
+			t := m.types[entityType]
+			if prev != nil {
+				for _, p := range prev {
+					t.apply(p) // includes e
+				}
+			} else {
+				t.apply(e)
+			}
+			t.status.LastEvent = time.Unix(0, e.Ts*int64(time.Millisecond))
+			t.status.LastContact = time.Now()
+			m.Unlock()
+		case g := <-feed.gaps:
+			// Missing revisions are lost, so the entity (or all entities if
+			// resync) could be out of date
+			return fmt.Errorf("revision gap: entity %s revisions %v lost (resync: %t, error: %s)", g.EntityId, g.Revs, g.Resync, g.Error)
+		case <-m.stopChan:
+			return nil
+		}
+	}
+}
+
+func (m *Mirror) contact(entityType string) {
+	m.Lock()
+	m.types[entityType].status.LastContact = time.Now()
+	m.Unlock()
+}
+
+func (m *Mirror) setError(entityType string, err error) {
+	Debug("mirror %s: %s", entityType, err)
+	m.Lock()
+	t := m.types[entityType]
+	t.status.Synced = false
+	t.status.Error = err.Error()
+	m.Unlock()
+}
+
+// apply applies the event to the entities. Events at or before the entity
+// revision are ignored: they're already in the snapshot.
+func (t *mirrorType) apply(e CDCEvent) {
+	old, exists := t.entities[e.EntityId]
+	if exists && old.Rev() >= e.EntityRev {
+		return
+	}
+	switch e.Op {
+	case "i":
+		if e.New == nil {
+			return
+		}
+		new := Entity{}
+		for k, v := range *e.New {
+			new[k] = v
+		}
+		new[META_LABEL_ID] = e.EntityId
+		new[META_LABEL_TYPE] = e.EntityType
+		new[META_LABEL_REV] = e.EntityRev
+		t.put(new)
+	case "u":
+		if e.Full != nil {
+			new := Entity{}
+			for k, v := range *e.Full {
+				new[k] = v
+			}
+			t.put(new) // whole entity, even if not in snapshot
+			return
+		}
+		if !exists {
+			return // not in snapshot, e.g. soft-deleted
+		}
+		new := Entity{}
+		for k, v := range old {
+			new[k] = v
+		}
+		if e.Old != nil {
+			for k := range *e.Old {
+				delete(new, k) // deleted or renamed label, set again if in New
+			}
+		}
+		if e.New != nil {
+			for k, v := range *e.New {
+				new[k] = v
+			}
+		}
+		new[META_LABEL_REV] = e.EntityRev
+		t.put(new)
+	case "d", "p": // soft delete and purge, or delete
+		t.remove(e.EntityId)
+	}
+}
+
+func (t *mirrorType) put(e Entity) {
+	id, _ := e[META_LABEL_ID].(string)
+	if old, ok := t.entities[id]; ok {
+		t.unindex(id, old)
+	}
+	t.entities[id] = e
+	for label, values := range t.index {
+		v, ok := e[label].(string)
+		if !ok {
+			continue // only strings match "=" and "in"
+		}
+		if values[v] == nil {
+			values[v] = map[string]bool{}
+		}
+		values[v][id] = true
+	}
+}
+
+func (t *mirrorType) remove(id string) {
+	if old, ok := t.entities[id]; ok {
+		t.unindex(id, old)
+		delete(t.entities, id)
+	}
+}
+
+func (t *mirrorType) unindex(id string, e Entity) {
+	for label, values := range t.index {
+		if v, ok := e[label].(string); ok {
+			delete(values[v], id)
+			if len(values[v]) == 0 {
+				delete(values, v)
+			}
+		}
+	}
+}
+
+// lookup returns the IDs of entities that can match the query using the index:
+// the smallest set for an "=", "==", or "in" predicate on _id or an indexed
+// label. It returns false if no predicate can use the index.
+func (t *mirrorType) lookup(q query.Query) (map[string]bool, bool) {
+	var ids map[string]bool
+	for _, p := range q.Predicates {
+		var values []string
+		switch p.Operator {
+		case "=", "==":
+			v, _ := p.Value.(string)
+			values = []string{v}
+		case "in":
+			values, _ = p.Value.([]string)
+		default:
+			continue
+		}
+		set := map[string]bool{}
+		if p.Label == META_LABEL_ID {
+			for _, v := range values {
+				set[v] = true
+			}
+		} else if index, ok := t.index[p.Label]; ok {
+			for _, v := range values {
+				for id := range index[v] {
+					set[id] = true
+				}
+			}
+		} else {
+			continue
+		}
+		if ids == nil || len(set) < len(ids) {
+			ids = set
+		}
+	}
+	return ids, ids != nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2020, Square, Inc.
+
+package etre_test
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/square/etre"
+)
+
+func mirrorIds(entities []etre.Entity) []string {
+	ids := make([]string, len(entities))
+	for i, e := range entities {
+		ids[i] = e.Id()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func waitMirror(t *testing.T, m *etre.Mirror, f func(etre.MirrorStatus) bool) etre.MirrorStatus {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		s := m.Status()[0]
+		if f(s) {
+			return s
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for mirror status, last: %+v", s)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	// Entities decoded from JSON have float64 _rev
+	snap := etre.CDCSnapshot{
+		Entities: []etre.Entity{
+			{"_id": "a", "_type": "node", "_rev": float64(0), "x": "1", "y": "foo"},
+			{"_id": "b", "_type": "node", "_rev": float64(2), "x": "2", "y": "bar"},
+			{"_id": "c", "_type": "node", "_rev": float64(0), "x": "1", "y": "bar"},
+		},
+		Cursor: "10:e1",
+	}
+
+	var mux sync.Mutex
+	var feedErr error
+	bootstraps := 0
+	var events chan etre.CDCEvent
+	var gapHandler func(etre.CDCGap)
+	newClient := func() etre.CDCClient {
+		return etre.MockCDCClient{
+			BootstrapFunc: func(entityType string, opts etre.CDCStartOptions) (etre.CDCSnapshot, <-chan etre.CDCEvent, error) {
+				mux.Lock()
+				defer mux.Unlock()
+				if entityType != "node" {
+					t.Errorf("got entity type %s, expected node", entityType)
+				}
+				bootstraps++
+				events = make(chan etre.CDCEvent, 10)
+				gapHandler = opts.GapHandler
+				return snap, events, nil
+			},
+			ErrorFunc: func() error {
+				mux.Lock()
+				defer mux.Unlock()
+				return feedErr
+			},
+		}
+	}
+
+	m := etre.NewMirror(etre.MirrorConfig{
+		EntityTypes:  []string{"node"},
+		NewCDCClient: newClient,
+		IndexLabels:  []string{"x"},
+		RetryWait:    10 * time.Millisecond,
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// Indexed label, _id, and scan
+	tests := map[string][]string{
+		"":             {"a", "b", "c"},
+		"x=1":          {"a", "c"},
+		"x=1,y=bar":    {"c"},
+		"_id in (a,b)": {"a", "b"},
+		"y=bar":        {"b", "c"},
+		"x=3":          {},
+	}
+	for selector, expect := range tests {
+		got, err := m.Query("node", selector)
+		if err != nil {
+			t.Fatalf("%s: %s", selector, err)
+		}
+		if diff := deep.Equal(mirrorIds(got), expect); diff != nil {
+			t.Errorf("%s: %v", selector, diff)
+		}
+	}
+
+	if _, err := m.Query("rack", ""); err == nil {
+		t.Error("no error querying entity type not mirrored")
+	}
+
+	// Apply events: insert d, update a x=1 -> 3, past rev of b (ignored),
+	// and delete c
+	mux.Lock()
+	feed := events
+	mux.Unlock()
+	feed <- etre.CDCEvent{Id: "e2", Ts: 11, Op: "i", EntityId: "d", EntityType: "node", EntityRev: 0,
+		New: &etre.Entity{"_id": "d", "_type": "node", "_rev": int64(0), "x": "1", "y": "new"}}
+	feed <- etre.CDCEvent{Id: "e3", Ts: 12, Op: "u", EntityId: "a", EntityType: "node", EntityRev: 1,
+		Old: &etre.Entity{"x": "1"}, New: &etre.Entity{"x": "3"}}
+	feed <- etre.CDCEvent{Id: "e4", Ts: 13, Op: "u", EntityId: "b", EntityType: "node", EntityRev: 2,
+		Old: &etre.Entity{"x": "2"}, New: &etre.Entity{"x": "stale"}}
+	feed <- etre.CDCEvent{Id: "e5", Ts: 14, Op: "d", EntityId: "c", EntityType: "node", EntityRev: 1,
+		Old: &etre.Entity{"_id": "c", "_type": "node", "_rev": int64(0), "x": "1", "y": "bar"}}
+
+	s := waitMirror(t, m, func(s etre.MirrorStatus) bool { return s.LastEvent.Equal(time.Unix(0, 14*int64(time.Millisecond))) })
+	if !s.Synced || s.Entities != 3 || s.Resyncs != 0 || s.Error != "" {
+		t.Errorf("wrong status: %+v", s)
+	}
+
+	tests = map[string][]string{
+		"":        {"a", "b", "d"},
+		"x=1":     {"d"},
+		"x=3":     {"a"},
+		"x=2":     {"b"},
+		"x=stale": {},
+	}
+	for selector, expect := range tests {
+		got, err := m.Query("node", selector)
+		if err != nil {
+			t.Fatalf("%s: %s", selector, err)
+		}
+		if diff := deep.Equal(mirrorIds(got), expect); diff != nil {
+			t.Errorf("%s: %v", selector, diff)
+		}
+	}
+
+	// Returned entities are copies
+	got, _ := m.Query("node", "_id=a")
+	got[0]["x"] = "changed"
+	got, _ = m.Query("node", "_id=a")
+	expect := []etre.Entity{{"_id": "a", "_type": "node", "_rev": int64(1), "x": "3", "y": "foo"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Feed error causes resync from a new snapshot
+	mux.Lock()
+	feedErr = errors.New("lost connection")
+	mux.Unlock()
+	close(feed)
+
+	s = waitMirror(t, m, func(s etre.MirrorStatus) bool { return s.Resyncs == 1 && s.Synced })
+	if s.Error != "lost connection" || s.Entities != 3 {
+		t.Errorf("wrong status after resync: %+v", s)
+	}
+	got, _ = m.Query("node", "")
+	if diff := deep.Equal(mirrorIds(got), []string{"a", "b", "c"}); diff != nil {
+		t.Error(diff)
+	}
+	mux.Lock()
+	if bootstraps != 2 {
+		t.Errorf("%d bootstraps, expected 2", bootstraps)
+	}
+	feed = events
+	mux.Unlock()
+
+	// Full entity replaces the entity, so label z not in New is set
+	feed <- etre.CDCEvent{Id: "e6", Ts: 15, Op: "u", EntityId: "b", EntityType: "node", EntityRev: 3,
+		Old: &etre.Entity{"x": "2"}, New: &etre.Entity{"x": "4"},
+		Full: &etre.Entity{"_id": "b", "_type": "node", "_rev": float64(3), "x": "4", "y": "bar", "z": "full"}}
+	waitMirror(t, m, func(s etre.MirrorStatus) bool { return s.LastEvent.Equal(time.Unix(0, 15*int64(time.Millisecond))) })
+	got, _ = m.Query("node", "x=4")
+	expect = []etre.Entity{{"_id": "b", "_type": "node", "_rev": float64(3), "x": "4", "y": "bar", "z": "full"}}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Revision gap causes resync
+	mux.Lock()
+	gap := gapHandler
+	mux.Unlock()
+	if gap == nil {
+		t.Fatal("GapHandler not set")
+	}
+	gap(etre.CDCGap{EntityId: "b", EntityType: "node", Revs: []int64{4}})
+	s = waitMirror(t, m, func(s etre.MirrorStatus) bool { return s.Resyncs == 2 && s.Synced })
+	if s.Error != "revision gap: entity b revisions [4] lost (resync: false, error: )" {
+		t.Errorf("got error '%s', expected revision gap", s.Error)
+	}
+}
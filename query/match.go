@@ -0,0 +1,82 @@
+// Copyright 2020, Square, Inc.
+
+package query
+
+// Matches returns true if the labels match the query. It matches like the
+// MongoDB filter for the query (see entity.Filter): values match only if the
+// types match: "=" and "in" match string values, and "<" (etc.) match numeric
+// values. Numeric values can be any int type or float64 (decoded from JSON).
+func Matches(q Query, labels map[string]interface{}) bool {
+	for _, p := range q.Predicates {
+		v, ok := labels[p.Label]
+		switch p.Operator {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "notexists":
+			if ok {
+				return false
+			}
+		case "=", "==":
+			if !ok || v != p.Value {
+				return false
+			}
+		case "!=":
+			if ok && v == p.Value {
+				return false
+			}
+		case "in":
+			if !ok || !inValues(v, p.Value.([]string)) {
+				return false
+			}
+		case "notin":
+			if ok && inValues(v, p.Value.([]string)) {
+				return false
+			}
+		case "<", "<=", ">", ">=":
+			n, isNum := number(v)
+			if !ok || !isNum {
+				return false
+			}
+			pv := int64(p.Value.(int))
+			switch {
+			case p.Operator == "<" && !(n < pv),
+				p.Operator == "<=" && !(n <= pv),
+				p.Operator == ">" && !(n > pv),
+				p.Operator == ">=" && !(n >= pv):
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func inValues(v interface{}, values []string) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	for _, val := range values {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
+
+func number(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
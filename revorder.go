@@ -52,6 +52,15 @@ type RevOrder struct {
 	reorder        map[string]*events // keyed on CDCEvent.EntityId
 	lru            *lru.Cache
 	ignorePastRevs bool
+	evicted        []Eviction
+}
+
+// An Eviction is an entity evicted from the LRU cache while InOrder was waiting
+// for its missing revisions. The missing revisions are a gap (see CDCGap), and
+// Events are the buffered revisions after the gap, in order. See RevOrder.Evicted.
+type Eviction struct {
+	Gap    CDCGap
+	Events []CDCEvent
 }
 
 type events struct {
@@ -222,27 +231,98 @@ func (r *RevOrder) InOrder(e CDCEvent) (bool, []CDCEvent) {
 	return true, buf // sync buf then event
 }
 
+// Last returns the last in-order revision of the entity, or false if the entity
+// has not been seen (or was evicted from the LRU cache). An event with a revision
+// less than or equal to the last revision is a duplicate or past revision.
+func (r *RevOrder) Last(entityId string) (int64, bool) {
+	if re, ok := r.reorder[entityId]; ok {
+		return re.qR, true
+	}
+	v, ok := r.lru.Get(entityId)
+	if !ok {
+		return 0, false
+	}
+	return v.(int64), true
+}
+
+// Missing returns the revisions of the entity that InOrder is waiting for:
+// revisions between the last in-order revision and the out-of-order revisions
+// it has buffered. It returns nil if InOrder is not waiting for any revisions.
+func (r *RevOrder) Missing(entityId string) []int64 {
+	re, ok := r.reorder[entityId]
+	if !ok {
+		return nil
+	}
+	missing := []int64{}
+	next := re.qR + 1
+	for _, b := range re.buf {
+		for ; next < b.EntityRev; next++ {
+			missing = append(missing, next)
+		}
+		if b.EntityRev == next {
+			next++
+		}
+	}
+	return missing
+}
+
+// Skip stops waiting for the missing revisions of the entity and returns the
+// buffered out-of-order revisions in order, which the caller should sync. Call
+// it when the missing revisions are lost (see Missing). It returns nil if InOrder
+// is not waiting for any revisions.
+func (r *RevOrder) Skip(entityId string) []CDCEvent {
+	buf := r.skip(entityId)
+	if buf == nil {
+		return nil
+	}
+	r.lru.Add(entityId, buf[len(buf)-1].EntityRev)
+	return buf
+}
+
+func (r *RevOrder) skip(entityId string) []CDCEvent {
+	re, ok := r.reorder[entityId]
+	if !ok {
+		return nil
+	}
+	delete(r.reorder, entityId)
+	buf := make([]CDCEvent, 0, len(re.buf))
+	for _, b := range re.buf {
+		if len(buf) > 0 && buf[len(buf)-1].EntityRev == b.EntityRev {
+			continue // duplicate
+		}
+		buf = append(buf, b)
+	}
+	Debug("skip id %s revs (%d, %d)", entityId, re.qR, buf[0].EntityRev)
+	return buf
+}
+
+// Evicted returns and clears the entities evicted from the LRU cache while
+// InOrder was waiting for their missing revisions. This happens if revisions
+// are lost or extremely delayed and maxEntities other entities are seen first.
+// Call it after InOrder and Skip; for each Eviction, the caller should handle
+// the gap, then sync the events.
+func (r *RevOrder) Evicted() []Eviction {
+	evicted := r.evicted
+	r.evicted = nil
+	return evicted
+}
+
 // This func is called by r.lru when it evicts a key. We never call it directly.
 func (r *RevOrder) onEvictedCallback(key lru.Key, value interface{}) {
 	id := key.(string)
 	Debug("evict id: %s", id)
 
-	// This should never happen: the oldest key (entity ID) is still being
-	// reordered. If maxEntities is tiny (< 10), then maybe this is just bad luck,
-	// but more than likely we'll never receive the out-of-order revs, which
-	// indicates a serious problem: we lost revs.
-	if re, reordering := r.reorder[id]; reordering {
-		msg1 := fmt.Sprintf("Entity %s evicted from the LRU cache because"+
-			" it is the oldest entity but still waiting to receive revisions"+
-			" > %d. Received revisions:", id, re.qR)
-		for _, b := range re.buf {
-			msg1 += fmt.Sprintf(" %d", b.EntityRev)
+	// The oldest key (entity ID) is still being reordered, so its missing revs
+	// were most likely lost. Stop waiting for them (like Skip) and save the gap
+	// for Evicted; the entity is no longer in the LRU cache to track.
+	if _, reordering := r.reorder[id]; reordering {
+		gap := CDCGap{
+			EntityId: id,
+			Revs:     r.Missing(id),
+			Error:    "entity evicted from RevOrder LRU cache while waiting for missing revisions",
 		}
-		msg2 := fmt.Sprintf(". This is a rare edge case that indicates some revisions"+
-			" were not received or extremely delayed. Increasing maxEntities and replaying"+
-			" the CDC feed from a time before entity %s revision %d could fix this problem."+
-			" Please file a bug at https://github.com/square/etre",
-			id, re.qR)
-		panic(msg1 + msg2)
+		events := r.skip(id)
+		gap.EntityType = events[0].EntityType
+		r.evicted = append(r.evicted, Eviction{Gap: gap, Events: events})
 	}
 }
@@ -129,57 +129,57 @@ func TestRevOrderPanicRRltQR(t *testing.T) {
 	}
 }
 
-func TestRevOrderPanicEvict(t *testing.T) {
-	recoverChan := make(chan interface{}, 1)
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				recoverChan <- r
-			} else {
-				recoverChan <- nil
-			}
-		}()
-		revo := etre.NewRevOrder(2, false)
-		e := etre.CDCEvent{
-			EntityId:  "abc",
-			EntityRev: 1,
-			Op:        "i",
-		}
-		revo.InOrder(e)
-		e.EntityRev = 2
-		revo.InOrder(e)
-		e.EntityRev = 4
-		revo.InOrder(e)
-		// Now abc is being reordered
-
-		e.EntityId = "def"
-		e.EntityRev = 1
-		revo.InOrder(e)
-		e.EntityRev = 2
-		revo.InOrder(e)
-		// Now LRU cache is full: abc and def
+func TestRevOrderEvict(t *testing.T) {
+	// Test that evicting an entity that is being reordered reports its gap and
+	// buffered revisions instead of panicking
+	revo := etre.NewRevOrder(2, false)
+	e := etre.CDCEvent{
+		EntityId:   "abc",
+		EntityType: "node",
+		EntityRev:  1,
+		Op:         "i",
+	}
+	revo.InOrder(e)
+	e.EntityRev = 2
+	revo.InOrder(e)
+	e.EntityRev = 4
+	revo.InOrder(e)
+	// Now abc is being reordered
 
-		// Add entity ghi which evicts abc and causes the panic
-		e.EntityId = "ghi"
-		revo.InOrder(e)
-	}()
+	e.EntityId = "def"
+	e.EntityRev = 1
+	revo.InOrder(e)
+	e.EntityRev = 2
+	revo.InOrder(e)
+	// Now LRU cache is full: abc and def
+	if evicted := revo.Evicted(); len(evicted) != 0 {
+		t.Errorf("got evictions before LRU cache full: %+v", evicted)
+	}
 
-	select {
-	case r := <-recoverChan:
-		if r == nil {
-			t.Errorf("nil panic/recover, expected non-nil recover() value")
-		} else {
-			pat1 := "Entity abc evicted"
-			if !strings.Contains(r.(string), pat1) {
-				t.Errorf("panic msg doesn't contain '%s': %s", pat1, r)
-			}
-			pat2 := "revisions > 2. Received revisions: 4"
-			if !strings.Contains(r.(string), pat2) {
-				t.Errorf("panic msg doesn't contain '%s': %s", pat2, r)
-			}
-		}
-	case <-time.After(1 * time.Second):
-		t.Fatal("timeout waiting for goroutine to panic")
+	// Add entity ghi which evicts abc
+	e.EntityId = "ghi"
+	if ok, _ := revo.InOrder(e); !ok {
+		t.Errorf("ghi not in order")
+	}
+	expect := []etre.Eviction{
+		{
+			Gap: etre.CDCGap{
+				EntityId:   "abc",
+				EntityType: "node",
+				Revs:       []int64{3},
+				Error:      "entity evicted from RevOrder LRU cache while waiting for missing revisions",
+			},
+			Events: []etre.CDCEvent{{EntityId: "abc", EntityType: "node", EntityRev: 4, Op: "i"}},
+		},
+	}
+	if diff := deep.Equal(revo.Evicted(), expect); diff != nil {
+		t.Error(diff)
+	}
+	if evicted := revo.Evicted(); len(evicted) != 0 {
+		t.Errorf("Evicted did not clear evictions: %+v", evicted)
+	}
+	if missing := revo.Missing("abc"); missing != nil {
+		t.Errorf("still waiting for abc revs %v", missing)
 	}
 }
 
@@ -217,3 +217,49 @@ func TestRevOrderIgnorePastRevs(t *testing.T) {
 		t.Fatal("timeout waiting for goroutine to panic")
 	}
 }
+
+func TestRevOrderMissingSkip(t *testing.T) {
+	revo := etre.NewRevOrder(0, true)
+
+	if _, seen := revo.Last("abc"); seen {
+		t.Error("seen before first event")
+	}
+	revo.InOrder(etre.CDCEvent{EntityId: "abc", EntityRev: 1})
+	if last, seen := revo.Last("abc"); !seen || last != 1 {
+		t.Errorf("got last %d, seen %t; expected 1, true", last, seen)
+	}
+	if missing := revo.Missing("abc"); missing != nil {
+		t.Errorf("got missing %v, expected nil", missing)
+	}
+
+	// Revs 4 and 6 out of order: waiting for 2, 3, and 5
+	revo.InOrder(etre.CDCEvent{EntityId: "abc", EntityRev: 4})
+	revo.InOrder(etre.CDCEvent{EntityId: "abc", EntityRev: 6})
+	if diff := deep.Equal(revo.Missing("abc"), []int64{2, 3, 5}); diff != nil {
+		t.Error(diff)
+	}
+	if last, _ := revo.Last("abc"); last != 1 {
+		t.Errorf("got last %d, expected 1", last)
+	}
+
+	// Skip the missing revs: buffered revs returned in order
+	var revs []int64
+	for _, e := range revo.Skip("abc") {
+		revs = append(revs, e.EntityRev)
+	}
+	if diff := deep.Equal(revs, []int64{4, 6}); diff != nil {
+		t.Error(diff)
+	}
+	if missing := revo.Missing("abc"); missing != nil {
+		t.Errorf("got missing %v after skip, expected nil", missing)
+	}
+	if last, _ := revo.Last("abc"); last != 6 {
+		t.Errorf("got last %d after skip, expected 6", last)
+	}
+	if ok, _ := revo.InOrder(etre.CDCEvent{EntityId: "abc", EntityRev: 7}); !ok {
+		t.Error("rev 7 not in order after skip")
+	}
+	if buf := revo.Skip("abc"); buf != nil {
+		t.Errorf("got %v, expected nil", buf)
+	}
+}
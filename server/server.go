@@ -13,6 +13,7 @@ import (
 	"github.com/square/etre"
 	"github.com/square/etre/api"
 	"github.com/square/etre/app"
+	"github.com/square/etre/audit"
 	"github.com/square/etre/auth"
 	"github.com/square/etre/cdc"
 	"github.com/square/etre/cdc/changestream"
@@ -20,6 +21,7 @@ import (
 	"github.com/square/etre/db"
 	"github.com/square/etre/entity"
 	"github.com/square/etre/metrics"
+	"github.com/square/etre/trace"
 )
 
 type Server struct {
@@ -28,6 +30,12 @@ type Server struct {
 	mainDbClient *mongo.Client
 	cdcDbClient  *mongo.Client
 	stopChan     chan struct{}
+
+	typeRefreshInterval time.Duration
+	reaper              *entity.Reaper
+	cdcRetainer         *cdc.Retainer
+	cdcSinkRunners      []*changestream.SinkRunner
+	otlpExporter        *trace.OTLPExporter
 }
 
 func NewServer(appCtx app.Context) *Server {
@@ -53,6 +61,10 @@ func (s *Server) Boot(configFile string) error {
 	s.appCtx.Config = cfg
 	log.Printf("Config: %+v", s.appCtx.Config)
 
+	s.appCtx.MetricsStore = metrics.NewMemoryStore()
+	s.appCtx.MetricsFactory = metrics.GroupFactory{Store: s.appCtx.MetricsStore}
+	s.appCtx.SystemMetrics = metrics.NewSystemMetrics()
+
 	// //////////////////////////////////////////////////////////////////////
 	// CDC Store and Change Stream
 	// //////////////////////////////////////////////////////////////////////
@@ -74,6 +86,26 @@ func (s *Server) Boot(configFile string) error {
 		}
 		s.appCtx.CDCStore = cdc.NewStore(cdcColl, cfg.CDC.FallbackFile, wrp)
 
+		// Durable consumer checkpoints
+		checkpointColl := cdcClient.Database(cfg.Datasource.Database).Collection(config.CDC_CHECKPOINT_COLLECTION)
+		s.appCtx.CDCCheckpoints = cdc.NewCheckpointStore(checkpointColl)
+
+		// Retention
+		policy, interval, err := MapConfigCDCRetention(cfg.CDC.Retention)
+		if err != nil {
+			return err
+		}
+		if interval > 0 {
+			s.cdcRetainer = cdc.NewRetainer(cdcColl, checkpointColl, policy, interval, s.appCtx.SystemMetrics)
+			s.appCtx.CDCStore = cdc.NewRetentionStore(s.appCtx.CDCStore, s.cdcRetainer)
+			log.Printf("CDC retention every %s: %+v", interval, policy)
+		}
+
+		// Fallback file replay
+		if cfg.CDC.FallbackFile != "" {
+			s.appCtx.CDCReplayer = cdc.NewReplayer(cdcColl, cfg.CDC.FallbackFile)
+		}
+
 		s.appCtx.ChangesServer = changestream.NewMongoDBServer(changestream.ServerConfig{
 			CDCCollection: cdcColl,
 			MaxClients:    cfg.CDC.ChangeStream.MaxClients,
@@ -81,8 +113,25 @@ func (s *Server) Boot(configFile string) error {
 		})
 
 		s.appCtx.StreamerFactory = changestream.ServerStreamFactory{
-			Server: s.appCtx.ChangesServer,
-			Store:  s.appCtx.CDCStore,
+			Server:  s.appCtx.ChangesServer,
+			Store:   s.appCtx.CDCStore,
+			Metrics: s.appCtx.SystemMetrics,
+		}
+
+		// Sinks: built-in from config, then plugins
+		sinks, err := MapConfigCDCSinks(cfg.CDC.Sinks)
+		if err != nil {
+			return err
+		}
+		sinkNames := map[string]bool{}
+		for _, sink := range append(sinks, s.appCtx.Plugins.CDCSinks...) {
+			if sinkNames[sink.Name()] {
+				return fmt.Errorf("duplicate CDC sink name: %s", sink.Name())
+			}
+			sinkNames[sink.Name()] = true
+			runner := changestream.NewSinkRunner(sink, s.appCtx.StreamerFactory, s.appCtx.CDCCheckpoints)
+			s.cdcSinkRunners = append(s.cdcSinkRunners, runner)
+			log.Printf("CDC sink %s enabled", sink.Name())
 		}
 	}
 
@@ -98,8 +147,34 @@ func (s *Server) Boot(configFile string) error {
 	for _, entityType := range cfg.Entity.Types {
 		coll[entityType] = mainClient.Database(cfg.Datasource.Database).Collection(entityType)
 	}
-	s.appCtx.EntityStore = entity.NewStore(coll, s.appCtx.CDCStore)
-	s.appCtx.EntityValidator = entity.NewValidator(cfg.Entity.Types)
+	schemas := MapConfigSchemas(cfg.Entity.Schemas)
+	// Change feeds check read scope on the whole entity (CDCEvent.Full), so
+	// scoped entity types always have it
+	for _, acl := range cfg.Security.ACL {
+		if acl.ReadScope == "" {
+			continue
+		}
+		for _, entityType := range acl.Read {
+			schema := schemas[entityType]
+			schema.CDCFullEntity = true
+			schemas[entityType] = schema
+		}
+	}
+	entityStore := entity.NewStore(coll, s.appCtx.CDCStore, schemas)
+	entityValidator := entity.NewValidator(cfg.Entity.Types)
+	s.appCtx.EntityStore = entityStore
+	s.appCtx.EntityValidator = entityValidator
+
+	// Snapshots for CDC consumers: consistent in a transaction only if the CDC
+	// collection is on the same cluster as entities
+	if !cfg.CDC.Disabled {
+		txn := cfg.CDC.Datasource.URL == cfg.Datasource.URL
+		cdcColl := s.cdcDbClient.Database(cfg.Datasource.Database).Collection(config.CDC_COLLECTION)
+		if txn {
+			cdcColl = mainClient.Database(cfg.Datasource.Database).Collection(config.CDC_COLLECTION)
+		}
+		s.appCtx.Snapshotter = entity.NewSnapshotter(entityStore, mainClient, cdcColl, txn)
+	}
 
 	// //////////////////////////////////////////////////////////////////////
 	// Auth
@@ -108,7 +183,101 @@ func (s *Server) Boot(configFile string) error {
 	if err != nil {
 		return fmt.Errorf("invalid ACL role: %s", err)
 	}
-	s.appCtx.Auth = auth.NewManager(acls, s.appCtx.Plugins.Auth)
+	authPlugin := s.appCtx.Plugins.Auth
+	switch cfg.Security.Plugin {
+	case "jwt":
+		jwtConfig, err := MapConfigJWT(cfg.Security.JWT)
+		if err != nil {
+			return err
+		}
+		if authPlugin, err = auth.NewJWT(jwtConfig); err != nil {
+			return fmt.Errorf("auth.NewJWT: %s", err)
+		}
+	case "mtls":
+		if authPlugin, err = auth.NewMTLS(MapConfigMTLS(cfg.Security.MTLS)); err != nil {
+			return fmt.Errorf("auth.NewMTLS: %s", err)
+		}
+	case "api-key":
+		apiKeyConfig, err := MapConfigAPIKey(cfg.Security.APIKey)
+		if err != nil {
+			return err
+		}
+		if authPlugin, err = auth.NewAPIKeys(apiKeyConfig); err != nil {
+			return fmt.Errorf("auth.NewAPIKeys: %s", err)
+		}
+	}
+	authManager := auth.NewManager(acls, authPlugin)
+	s.appCtx.Auth = authManager
+
+	// //////////////////////////////////////////////////////////////////////
+	// Audit log
+	// //////////////////////////////////////////////////////////////////////
+	if s.appCtx.Plugins.Audit != nil {
+		s.appCtx.Audit = s.appCtx.Plugins.Audit
+	} else if cfg.Audit.File != "" {
+		fileSink, err := audit.NewFileSink(cfg.Audit.File)
+		if err != nil {
+			return err
+		}
+		s.appCtx.Audit = fileSink
+		log.Printf("Audit log: %s", cfg.Audit.File)
+	} else {
+		log.Printf("Audit log disabled (audit.file not set)")
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Tracing
+	// //////////////////////////////////////////////////////////////////////
+	var traceExporter trace.Exporter
+	if s.appCtx.Plugins.TraceExporter != nil {
+		traceExporter = s.appCtx.Plugins.TraceExporter
+	} else if cfg.Trace.File != "" {
+		if traceExporter, err = trace.NewFileExporter(cfg.Trace.File); err != nil {
+			return err
+		}
+		log.Printf("Trace file: %s", cfg.Trace.File)
+	} else if cfg.Trace.OTLPEndpoint != "" {
+		serviceName := cfg.Trace.ServiceName
+		if serviceName == "" {
+			serviceName = config.DEFAULT_TRACE_SERVICE_NAME
+		}
+		s.otlpExporter = trace.NewOTLPExporter(cfg.Trace.OTLPEndpoint, serviceName)
+		traceExporter = s.otlpExporter
+		log.Printf("Trace OTLP endpoint: %s", cfg.Trace.OTLPEndpoint)
+	}
+	if traceExporter != nil {
+		s.appCtx.Tracer = trace.NewTracer(traceExporter, cfg.Trace.SampleRate)
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Entity Type Registry
+	// //////////////////////////////////////////////////////////////////////
+	refreshInterval := cfg.Entity.TypeRefreshInterval
+	if refreshInterval == "" {
+		refreshInterval = config.DEFAULT_ENTITY_TYPE_REFRESH_INTERVAL
+	}
+	s.typeRefreshInterval, err = time.ParseDuration(refreshInterval)
+	if err != nil {
+		return fmt.Errorf("invalid config.entity.type_refresh_interval: %s: %s", refreshInterval, err)
+	}
+	mainDb := mainClient.Database(cfg.Datasource.Database)
+	s.appCtx.EntityTypes = entity.NewTypeRegistry(
+		mainDb.Collection(config.ENTITY_TYPES_COLLECTION),
+		cfg.Entity.Types,
+		func(types []entity.EntityType) {
+			active := entity.ActiveTypes(types)
+			coll := make(map[string]*mongo.Collection, len(active))
+			for _, entityType := range active {
+				coll[entityType] = mainDb.Collection(entityType)
+			}
+			// Validator first so requests for a retired type are rejected
+			// before the store no longer has its collection
+			entityValidator.SetEntityTypes(active)
+			entityStore.SetCollections(coll)
+			authManager.SetACLs(EntityTypeACLs(acls, types))
+			log.Printf("Entity types: %v", active)
+		},
+	)
 
 	// //////////////////////////////////////////////////////////////////////
 	// Metrics
@@ -117,9 +286,33 @@ func (s *Server) Boot(configFile string) error {
 		return fmt.Errorf("invalid config.metrics.query_latency_sla: %s: %s", s.appCtx.Config.Metrics.QueryLatencySLA, err)
 	}
 
-	s.appCtx.MetricsStore = metrics.NewMemoryStore()
-	s.appCtx.MetricsFactory = metrics.GroupFactory{Store: s.appCtx.MetricsStore}
-	s.appCtx.SystemMetrics = metrics.NewSystemMetrics()
+	// //////////////////////////////////////////////////////////////////////
+	// Reaper (entity expiry)
+	// //////////////////////////////////////////////////////////////////////
+	reaperInterval := cfg.Entity.ReaperInterval
+	if reaperInterval == "" {
+		for _, schema := range cfg.Entity.Schemas {
+			if schema.TTL != "" || schema.SoftDelete {
+				reaperInterval = config.DEFAULT_REAPER_INTERVAL
+				break
+			}
+		}
+	}
+	if reaperInterval != "" {
+		d, err := time.ParseDuration(reaperInterval)
+		if err != nil {
+			return fmt.Errorf("invalid config.entity.reaper_interval: %s: %s", reaperInterval, err)
+		}
+		entityTypes := s.appCtx.EntityTypes
+		s.reaper = entity.NewReaper(
+			entityStore,
+			func() []string { return entity.ActiveTypes(entityTypes.List()) },
+			s.appCtx.MetricsFactory,
+			[]string{auth.DefaultMetricGroup},
+			d,
+		)
+		log.Printf("Reaping expired entities every %s", d)
+	}
 
 	// //////////////////////////////////////////////////////////////////////
 	// API
@@ -167,6 +360,25 @@ DB_CONN_WAIT:
 	}
 	notifyTimeout.Stop()
 
+	go s.refreshEntityTypes()
+
+	// Replay CDC events written to the fallback file when MongoDB was down
+	if s.appCtx.CDCReplayer != nil {
+		res, err := s.appCtx.CDCReplayer.Replay()
+		if err != nil {
+			log.Printf("ERROR: replaying CDC fallback file: %s (result: %+v)", err, res)
+		} else if res.Events > 0 {
+			log.Printf("Replayed CDC fallback file: %+v", res)
+		}
+	}
+
+	if s.cdcRetainer != nil {
+		go s.cdcRetainer.Run(s.stopChan)
+	}
+	if s.reaper != nil {
+		go s.reaper.Run(s.stopChan)
+	}
+
 	go func() {
 		for {
 			if err := s.appCtx.ChangesServer.Run(); err != nil {
@@ -176,6 +388,12 @@ DB_CONN_WAIT:
 		}
 	}()
 
+	// Every node runs every sink runner, but only the node with the sink lease
+	// streams events to the sink
+	for _, runner := range s.cdcSinkRunners {
+		go runner.Run(s.stopChan)
+	}
+
 	// Run the API - this will block until the API is stopped (or encounters
 	// some fatal error). If the RunAPI hook has been provided, call that instead
 	// of the default api.Run.
@@ -199,6 +417,11 @@ func (s *Server) Stop() error {
 	} else {
 		err = s.api.Stop()
 	}
+
+	// Send queued trace spans
+	if s.otlpExporter != nil {
+		s.otlpExporter.Stop()
+	}
 	return err
 }
 
@@ -219,6 +442,25 @@ func (s *Server) stopped() bool {
 	}
 }
 
+// refreshEntityTypes reloads entity types created or retired at runtime,
+// including by other API nodes, until the server is stopped.
+func (s *Server) refreshEntityTypes() {
+	ticker := time.NewTicker(s.typeRefreshInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.typeRefreshInterval)
+		if err := s.appCtx.EntityTypes.Refresh(ctx); err != nil {
+			log.Printf("ERROR: refreshing entity types: %s", err)
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
 func (s *Server) connectToDatasource(ds config.DatasourceConfig, client *mongo.Client, doneChan chan struct{}) {
 	defer close(doneChan)
 	firstError := true
@@ -238,13 +480,237 @@ func (s *Server) connectToDatasource(ds config.DatasourceConfig, client *mongo.C
 func MapConfigACLRoles(aclRoles []config.ACL) ([]auth.ACL, error) {
 	acls := make([]auth.ACL, len(aclRoles))
 	for i, acl := range aclRoles {
+		if err := auth.ValidateScope(acl.ReadScope); err != nil {
+			return nil, fmt.Errorf("%s: invalid read_scope: %s: %s", acl.Role, acl.ReadScope, err)
+		}
+		if err := auth.ValidateScope(acl.WriteScope); err != nil {
+			return nil, fmt.Errorf("%s: invalid write_scope: %s: %s", acl.Role, acl.WriteScope, err)
+		}
+		for name, l := range map[string]config.Limit{"role_limit": acl.RoleLimit, "caller_limit": acl.CallerLimit} {
+			if l.Rate < 0 || l.Burst < 0 || l.MaxConcurrent < 0 {
+				return nil, fmt.Errorf("%s: invalid %s: values must be zero or greater", acl.Role, name)
+			}
+		}
 		acls[i] = auth.ACL{
 			Role:              acl.Role,
 			Admin:             acl.Admin,
 			Read:              acl.Read,
 			Write:             acl.Write,
+			WriteLabels:       acl.WriteLabels,
+			DenyReadLabels:    acl.DenyReadLabels,
+			ReadScope:         acl.ReadScope,
+			WriteScope:        acl.WriteScope,
+			RoleLimit:         auth.Limit(acl.RoleLimit),
+			CallerLimit:       auth.Limit(acl.CallerLimit),
 			TraceKeysRequired: acl.TraceKeysRequired,
 		}
 	}
 	return acls, nil
 }
+
+func MapConfigJWT(cfg config.JWTConfig) (auth.JWTConfig, error) {
+	var leeway time.Duration
+	if cfg.Leeway != "" {
+		var err error
+		if leeway, err = time.ParseDuration(cfg.Leeway); err != nil {
+			return auth.JWTConfig{}, fmt.Errorf("invalid security.jwt.leeway: %s: %s", cfg.Leeway, err)
+		}
+	}
+	return auth.JWTConfig{
+		JWKSFile:          cfg.JWKSFile,
+		KeyFiles:          cfg.KeyFiles,
+		Issuer:            cfg.Issuer,
+		Audience:          cfg.Audience,
+		Leeway:            leeway,
+		AllowNoExp:        cfg.AllowNoExp,
+		NameClaim:         cfg.NameClaim,
+		RolesClaim:        cfg.RolesClaim,
+		MetricGroupsClaim: cfg.MetricGroupsClaim,
+		AttributeClaims:   cfg.AttributeClaims,
+	}, nil
+}
+
+func MapConfigMTLS(cfg config.MTLSConfig) auth.MTLSConfig {
+	return auth.MTLSConfig{
+		NameFrom:    cfg.NameFrom,
+		RolesFile:   cfg.RolesFile,
+		RequireCert: cfg.RequireCert,
+	}
+}
+
+func MapConfigAPIKey(cfg config.APIKeyConfig) (auth.APIKeyConfig, error) {
+	var reloadInterval time.Duration
+	if cfg.ReloadInterval != "" {
+		var err error
+		if reloadInterval, err = time.ParseDuration(cfg.ReloadInterval); err != nil {
+			return auth.APIKeyConfig{}, fmt.Errorf("invalid security.api_key.reload_interval: %s: %s", cfg.ReloadInterval, err)
+		}
+	}
+	keys := make([]auth.APIKey, len(cfg.Keys))
+	for i, key := range cfg.Keys {
+		keys[i] = auth.APIKey{
+			Name:         key.Name,
+			Hash:         key.Hash,
+			Roles:        key.Roles,
+			MetricGroups: key.MetricGroups,
+		}
+	}
+	return auth.APIKeyConfig{
+		Keys:           keys,
+		KeysFile:       cfg.KeysFile,
+		ReloadInterval: reloadInterval,
+	}, nil
+}
+
+// MapConfigCDCRetention returns the CDC retention policy and interval. The
+// interval is zero if retention is disabled: no max age, max events, or
+// compact age.
+func MapConfigCDCRetention(cfg config.CDCRetentionConfig) (cdc.RetentionPolicy, time.Duration, error) {
+	var policy cdc.RetentionPolicy
+	var err error
+	if cfg.MaxAge != "" {
+		if policy.MaxAge, err = time.ParseDuration(cfg.MaxAge); err != nil {
+			return policy, 0, fmt.Errorf("invalid cdc.retention.max_age: %s: %s", cfg.MaxAge, err)
+		}
+	}
+	if cfg.CompactAge != "" {
+		if policy.CompactAge, err = time.ParseDuration(cfg.CompactAge); err != nil {
+			return policy, 0, fmt.Errorf("invalid cdc.retention.compact_age: %s: %s", cfg.CompactAge, err)
+		}
+	}
+	policy.MaxEvents = cfg.MaxEvents
+	if policy.MaxAge == 0 && policy.MaxEvents == 0 && policy.CompactAge == 0 {
+		return policy, 0, nil
+	}
+	interval := cfg.Interval
+	if interval == "" {
+		interval = config.DEFAULT_CDC_RETENTION_INTERVAL
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return policy, 0, fmt.Errorf("invalid cdc.retention.interval: %s: %s", interval, err)
+	}
+	return policy, d, nil
+}
+
+// MapConfigCDCSinks returns the built-in CDC sinks. File sinks open their files.
+func MapConfigCDCSinks(sinkConfigs []config.CDCSinkConfig) ([]cdc.Sink, error) {
+	sinks := make([]cdc.Sink, len(sinkConfigs))
+	for i, sc := range sinkConfigs {
+		switch sc.Type {
+		case "webhook":
+			timeout, retryWait := sc.Timeout, sc.RetryWait
+			if timeout == "" {
+				timeout = config.DEFAULT_CDC_SINK_TIMEOUT
+			}
+			if retryWait == "" {
+				retryWait = config.DEFAULT_CDC_SINK_RETRY_WAIT
+			}
+			t, err := time.ParseDuration(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cdc.sinks.%s.timeout: %s: %s", sc.Name, timeout, err)
+			}
+			w, err := time.ParseDuration(retryWait)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cdc.sinks.%s.retry_wait: %s: %s", sc.Name, retryWait, err)
+			}
+			sinks[i] = cdc.NewWebhookSink(cdc.WebhookSinkConfig{
+				Name:       sc.Name,
+				URL:        sc.URL,
+				Secret:     sc.Secret,
+				Timeout:    t,
+				RetryCount: sc.RetryCount,
+				RetryWait:  w,
+			})
+		case "file":
+			sink, err := cdc.NewFileSink(cdc.FileSinkConfig{
+				Name:     sc.Name,
+				File:     sc.File,
+				MaxSize:  sc.MaxSizeMB * 1024 * 1024,
+				MaxFiles: sc.MaxFiles,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cdc.sinks.%s: %s", sc.Name, err)
+			}
+			sinks[i] = sink
+		default:
+			return nil, fmt.Errorf("invalid cdc.sinks.%s.type: %s", sc.Name, sc.Type)
+		}
+	}
+	return sinks, nil
+}
+
+// EntityTypeACLs returns the ACLs with read and write grants for runtime entity
+// types added to the roles, which are created if they don't exist. Retired types
+// are not granted. If there are no ACLs, auth is disabled and no grants are added.
+func EntityTypeACLs(acls []auth.ACL, types []entity.EntityType) []auth.ACL {
+	if len(acls) == 0 {
+		return acls
+	}
+	byRole := map[string]int{}
+	merged := make([]auth.ACL, len(acls))
+	for i, acl := range acls {
+		acl.Read = append([]string{}, acl.Read...)
+		acl.Write = append([]string{}, acl.Write...)
+		merged[i] = acl
+		byRole[acl.Role] = i
+	}
+	grant := func(role string) *auth.ACL {
+		i, ok := byRole[role]
+		if !ok {
+			merged = append(merged, auth.ACL{Role: role})
+			i = len(merged) - 1
+			byRole[role] = i
+		}
+		return &merged[i]
+	}
+	for _, t := range types {
+		if t.Static || t.Retired {
+			continue
+		}
+		for _, role := range t.Read {
+			acl := grant(role)
+			acl.Read = append(acl.Read, t.Name)
+		}
+		for _, role := range t.Write {
+			acl := grant(role)
+			acl.Write = append(acl.Write, t.Name)
+		}
+	}
+	return merged
+}
+
+func MapConfigSchemas(schemaConfigs map[string]config.SchemaConfig) map[string]entity.Schema {
+	schemas := make(map[string]entity.Schema, len(schemaConfigs))
+	for entityType, sc := range schemaConfigs {
+		refs := make(map[string]entity.Reference, len(sc.References))
+		for label, ref := range sc.References {
+			onDelete := ref.OnDelete
+			if onDelete == "" {
+				onDelete = entity.ON_DELETE_RESTRICT
+			}
+			refs[label] = entity.Reference{
+				EntityType: ref.EntityType,
+				OnDelete:   onDelete,
+			}
+		}
+		ttl, _ := time.ParseDuration(sc.TTL) // validated in config.Validate
+		schema := entity.Schema{
+			References:     refs,
+			Defaults:       sc.Defaults,
+			ComputedLabels: sc.ComputedLabels,
+			TTL:            ttl,
+			SoftDelete:     sc.SoftDelete,
+			CDCFullEntity:  sc.CDCFullEntity,
+		}
+		if sc.SoftDelete {
+			retention := sc.SoftDeleteRetention
+			if retention == "" {
+				retention = config.DEFAULT_SOFT_DELETE_RETENTION
+			}
+			schema.SoftDeleteRetention, _ = time.ParseDuration(retention) // validated in config.Validate
+		}
+		schemas[entityType] = schema
+	}
+	return schemas
+}
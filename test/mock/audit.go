@@ -0,0 +1,29 @@
+// Copyright 2020, Square, Inc.
+
+package mock
+
+import (
+	"sync"
+
+	"github.com/square/etre/audit"
+)
+
+var _ audit.Sink = &AuditSink{}
+
+// AuditSink records audit events written to it.
+type AuditSink struct {
+	WriteFunc func(audit.Event) error
+	// --
+	mux    sync.Mutex
+	Events []audit.Event
+}
+
+func (s *AuditSink) Write(e audit.Event) error {
+	s.mux.Lock()
+	s.Events = append(s.Events, e)
+	s.mux.Unlock()
+	if s.WriteFunc != nil {
+		return s.WriteFunc(e)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ package mock
 
 import (
 	"context"
+	"time"
 
 	"github.com/square/etre"
 	"github.com/square/etre/cdc"
@@ -30,6 +31,88 @@ func (s CDCStore) Read(filter cdc.Filter) ([]etre.CDCEvent, error) {
 	return nil, nil
 }
 
+var _ cdc.CheckpointStore = CDCCheckpointStore{}
+var _ cdc.Leaser = CDCCheckpointStore{}
+
+type CDCCheckpointStore struct {
+	ReadCheckpointFunc  func(consumer string) (cdc.Checkpoint, error)
+	WriteCheckpointFunc func(cdc.Checkpoint) error
+	LeaseFunc           func(consumer, owner string, ttl time.Duration) (bool, error)
+	ReleaseFunc         func(consumer, owner string) error
+}
+
+func (s CDCCheckpointStore) ReadCheckpoint(consumer string) (cdc.Checkpoint, error) {
+	if s.ReadCheckpointFunc != nil {
+		return s.ReadCheckpointFunc(consumer)
+	}
+	return cdc.Checkpoint{Consumer: consumer}, nil
+}
+
+func (s CDCCheckpointStore) WriteCheckpoint(c cdc.Checkpoint) error {
+	if s.WriteCheckpointFunc != nil {
+		return s.WriteCheckpointFunc(c)
+	}
+	return nil
+}
+
+func (s CDCCheckpointStore) Lease(consumer, owner string, ttl time.Duration) (bool, error) {
+	if s.LeaseFunc != nil {
+		return s.LeaseFunc(consumer, owner, ttl)
+	}
+	return true, nil
+}
+
+func (s CDCCheckpointStore) Release(consumer, owner string) error {
+	if s.ReleaseFunc != nil {
+		return s.ReleaseFunc(consumer, owner)
+	}
+	return nil
+}
+
+var _ cdc.Replayer = CDCReplayer{}
+
+type CDCReplayer struct {
+	ReplayFunc func() (cdc.ReplayResult, error)
+}
+
+func (r CDCReplayer) Replay() (cdc.ReplayResult, error) {
+	if r.ReplayFunc != nil {
+		return r.ReplayFunc()
+	}
+	return cdc.ReplayResult{}, nil
+}
+
+var _ cdc.Sink = CDCSink{}
+
+var _ cdc.GapSink = CDCSink{}
+
+type CDCSink struct {
+	NameFunc    func() string
+	SendFunc    func(etre.CDCEvent) error
+	SendGapFunc func(etre.CDCGap) error
+}
+
+func (s CDCSink) Name() string {
+	if s.NameFunc != nil {
+		return s.NameFunc()
+	}
+	return "mock"
+}
+
+func (s CDCSink) Send(e etre.CDCEvent) error {
+	if s.SendFunc != nil {
+		return s.SendFunc(e)
+	}
+	return nil
+}
+
+func (s CDCSink) SendGap(g etre.CDCGap) error {
+	if s.SendGapFunc != nil {
+		return s.SendGapFunc(g)
+	}
+	return nil
+}
+
 // Some test events that can be insterted into a db.
 var CDCEvents = []etre.CDCEvent{
 	etre.CDCEvent{Id: "nru", EntityId: "e1", EntityRev: 0, Ts: 10},
@@ -59,13 +59,17 @@ func (f StreamerFactory) Make(clientId string) changestream.Streamer {
 }
 
 var _ changestream.Streamer = &Stream{}
+var _ changestream.GapReporter = &Stream{}
+var _ changestream.FilteredStreamer = &Stream{}
 
 type Stream struct {
-	StartFunc  func(sinceTs int64) <-chan etre.CDCEvent
-	InSyncFunc func() chan struct{}
-	StatusFunc func() changestream.Status
-	StopFunc   func()
-	ErrorFunc  func() error
+	StartFunc           func(sinceTs int64) <-chan etre.CDCEvent
+	StartWithFilterFunc func(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent
+	InSyncFunc          func() chan struct{}
+	StatusFunc          func() changestream.Status
+	StopFunc            func()
+	ErrorFunc           func() error
+	GapsFunc            func() <-chan etre.CDCGap
 }
 
 func (s Stream) Start(sinceTs int64) <-chan etre.CDCEvent {
@@ -76,6 +80,13 @@ func (s Stream) Start(sinceTs int64) <-chan etre.CDCEvent {
 
 }
 
+func (s Stream) StartWithFilter(sinceTs int64, filter changestream.Filter) <-chan etre.CDCEvent {
+	if s.StartWithFilterFunc != nil {
+		return s.StartWithFilterFunc(sinceTs, filter)
+	}
+	return s.Start(sinceTs)
+}
+
 func (s Stream) InSync() chan struct{} {
 	if s.InSyncFunc != nil {
 		return s.InSyncFunc()
@@ -103,6 +114,13 @@ func (s Stream) Error() error {
 	return nil
 }
 
+func (s Stream) Gaps() <-chan etre.CDCGap {
+	if s.GapsFunc != nil {
+		return s.GapsFunc()
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------------
 
 var RawInsertEvents = []bson.M{
@@ -18,6 +18,9 @@ type EntityStore struct {
 	UpdateEntitiesFunc    func(entity.WriteOp, query.Query, etre.Entity) ([]etre.Entity, error)
 	DeleteEntitiesFunc    func(entity.WriteOp, query.Query) ([]etre.Entity, error)
 	DeleteLabelFunc       func(entity.WriteOp, string) (etre.Entity, error)
+	RenameLabelFunc       func(entity.WriteOp, query.Query, string, string) ([]etre.Entity, error)
+	DeleteLabelsFunc      func(entity.WriteOp, query.Query, string) ([]etre.Entity, error)
+	PurgeEntitiesFunc     func(entity.WriteOp) ([]etre.Entity, error)
 }
 
 func (s EntityStore) WithContext(ctx context.Context) entity.Store {
@@ -68,3 +71,72 @@ func (s EntityStore) DeleteLabel(wo entity.WriteOp, label string) (etre.Entity,
 	}
 	return etre.Entity{}, nil
 }
+
+func (s EntityStore) RenameLabel(wo entity.WriteOp, q query.Query, from, to string) ([]etre.Entity, error) {
+	if s.RenameLabelFunc != nil {
+		return s.RenameLabelFunc(wo, q, from, to)
+	}
+	return nil, nil
+}
+
+func (s EntityStore) DeleteLabels(wo entity.WriteOp, q query.Query, label string) ([]etre.Entity, error) {
+	if s.DeleteLabelsFunc != nil {
+		return s.DeleteLabelsFunc(wo, q, label)
+	}
+	return nil, nil
+}
+
+func (s EntityStore) PurgeEntities(wo entity.WriteOp) ([]etre.Entity, error) {
+	if s.PurgeEntitiesFunc != nil {
+		return s.PurgeEntitiesFunc(wo)
+	}
+	return nil, nil
+}
+
+type EntityTypeRegistry struct {
+	ListFunc    func() []entity.EntityType
+	CreateFunc  func(context.Context, entity.EntityType) error
+	RetireFunc  func(context.Context, string, string) error
+	RefreshFunc func(context.Context) error
+}
+
+func (r EntityTypeRegistry) List() []entity.EntityType {
+	if r.ListFunc != nil {
+		return r.ListFunc()
+	}
+	return nil
+}
+
+func (r EntityTypeRegistry) Create(ctx context.Context, t entity.EntityType) error {
+	if r.CreateFunc != nil {
+		return r.CreateFunc(ctx, t)
+	}
+	return nil
+}
+
+func (r EntityTypeRegistry) Retire(ctx context.Context, name, caller string) error {
+	if r.RetireFunc != nil {
+		return r.RetireFunc(ctx, name, caller)
+	}
+	return nil
+}
+
+func (r EntityTypeRegistry) Refresh(ctx context.Context) error {
+	if r.RefreshFunc != nil {
+		return r.RefreshFunc(ctx)
+	}
+	return nil
+}
+
+var _ entity.Snapshotter = EntitySnapshotter{}
+
+type EntitySnapshotter struct {
+	SnapshotFunc func(context.Context, string, query.Query) (entity.Snapshot, error)
+}
+
+func (s EntitySnapshotter) Snapshot(ctx context.Context, entityType string, q query.Query) (entity.Snapshot, error) {
+	if s.SnapshotFunc != nil {
+		return s.SnapshotFunc(ctx, entityType, q)
+	}
+	return entity.Snapshot{}, nil
+}
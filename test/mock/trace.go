@@ -0,0 +1,29 @@
+// Copyright 2020, Square, Inc.
+
+package mock
+
+import (
+	"sync"
+
+	"github.com/square/etre/trace"
+)
+
+var _ trace.Exporter = &TraceExporter{}
+
+// TraceExporter records trace spans exported to it.
+type TraceExporter struct {
+	ExportFunc func(trace.Span) error
+	// --
+	mux   sync.Mutex
+	Spans []trace.Span
+}
+
+func (e *TraceExporter) Export(span trace.Span) error {
+	e.mux.Lock()
+	e.Spans = append(e.Spans, span)
+	e.mux.Unlock()
+	if e.ExportFunc != nil {
+		return e.ExportFunc(span)
+	}
+	return nil
+}
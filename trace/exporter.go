@@ -0,0 +1,251 @@
+// Copyright 2020, Square, Inc.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileExporter appends spans to a file as JSON lines.
+type FileExporter struct {
+	*sync.Mutex
+	file *os.File
+}
+
+var _ Exporter = &FileExporter{}
+
+// NewFileExporter opens the file for appending, creating it if needed.
+func NewFileExporter(file string) (*FileExporter, error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open trace file: %s", err)
+	}
+	return &FileExporter{
+		Mutex: &sync.Mutex{},
+		file:  f,
+	}, nil
+}
+
+func (e *FileExporter) Export(span Span) error {
+	bytes, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	_, err = e.file.Write(append(bytes, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.file.Close()
+}
+
+const (
+	OTLP_BATCH_SIZE     = 512
+	OTLP_QUEUE_SIZE     = 2048
+	OTLP_FLUSH_INTERVAL = 2 * time.Second
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP over HTTP
+// with JSON encoding. Spans are queued and sent in batches by a goroutine, so
+// Export does not block. If the queue is full, the span is dropped.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan Span
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+	stopOnce    *sync.Once
+}
+
+var _ Exporter = &OTLPExporter{}
+
+// NewOTLPExporter makes and starts an OTLPExporter. The endpoint is the full URL,
+// like "http://localhost:4318/v1/traces". Call Stop to flush queued spans.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan Span, OTLP_QUEUE_SIZE),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+		stopOnce:    &sync.Once{},
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(span Span) error {
+	select {
+	case e.queue <- span:
+		return nil
+	default:
+		return fmt.Errorf("OTLP exporter queue full, span dropped")
+	}
+}
+
+// Stop sends queued spans and stops the exporter.
+func (e *OTLPExporter) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopChan)
+		<-e.doneChan
+	})
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.doneChan)
+	ticker := time.NewTicker(OTLP_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	batch := make([]Span, 0, OTLP_BATCH_SIZE)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("Error sending %d trace spans to %s: %s", len(batch), e.endpoint, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == OTLP_BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stopChan:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []Span) error {
+	req, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest. Only the fields that Etre
+// sets are defined.
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1=OK, 2=ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"` // 1=INTERNAL, 2=SERVER
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpRequest(serviceName string, spans []Span) otlpExportRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, len(spans))}
+	scope.Scope.Name = "github.com/square/etre"
+	for i, s := range spans {
+		kind := 1
+		if s.Kind == KIND_SERVER {
+			kind = 2
+		}
+		status := otlpStatus{Code: 1}
+		if s.Error != "" {
+			status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		scope.Spans[i] = otlpSpan{
+			TraceId:           s.TraceId,
+			SpanId:            s.SpanId,
+			ParentSpanId:      s.ParentId,
+			Name:              s.Name,
+			Kind:              kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            status,
+		}
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = otlpAttributes(map[string]string{"service.name": serviceName})
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kv := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		kv[i].Key = k
+		kv[i].Value.StringValue = attrs[k]
+	}
+	return kv
+}
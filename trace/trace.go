@@ -0,0 +1,226 @@
+// Copyright 2020, Square, Inc.
+
+// Package trace provides distributed tracing with W3C Trace Context propagation.
+// The API starts a server span for each request, continuing the trace from the
+// traceparent header if the client sent one, and packages that do work for the
+// request start child spans from the request context.Context.
+//
+// All Span methods are safe to call on a nil Span, which is what Start returns
+// when tracing is disabled or the trace is not sampled, so callers do not need
+// to check.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	KIND_SERVER   = "server"
+	KIND_INTERNAL = "internal"
+)
+
+// Exporter sends finished spans to a tracing backend. Implement this interface
+// and set app.Plugins.TraceExporter to send spans elsewhere. Export is called
+// synchronously when a span ends, so it should be fast and safe for concurrent use.
+type Exporter interface {
+	Export(Span) error
+}
+
+// SpanContext is the part of a span propagated between processes.
+type SpanContext struct {
+	TraceId string // 32 lowercase hex chars
+	SpanId  string // 16 lowercase hex chars
+	Sampled bool
+}
+
+var reTraceParent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+const (
+	zeroTraceId = "00000000000000000000000000000000"
+	zeroSpanId  = "0000000000000000"
+)
+
+// ParseTraceParent parses a W3C traceparent header value like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceParent(s string) (SpanContext, error) {
+	m := reTraceParent.FindStringSubmatch(s)
+	if m == nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: %s", s)
+	}
+	if m[1] == "ff" || (m[1] == "00" && m[5] != "") {
+		return SpanContext{}, fmt.Errorf("invalid traceparent version: %s", s)
+	}
+	if m[2] == zeroTraceId || m[3] == zeroSpanId {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: all-zero trace or span ID: %s", s)
+	}
+	flags, _ := strconv.ParseUint(m[4], 16, 8)
+	return SpanContext{TraceId: m[2], SpanId: m[3], Sampled: flags&1 == 1}, nil
+}
+
+// TraceParent returns the W3C traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceId + "-" + sc.SpanId + "-" + flags
+}
+
+// NewTraceParent returns a traceparent for a new, sampled trace. Clients use it
+// to start a trace that the server continues.
+func NewTraceParent() string {
+	return SpanContext{TraceId: newId(16), SpanId: newId(8), Sampled: true}.TraceParent()
+}
+
+// Span is one timed operation in a trace.
+type Span struct {
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_span_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       string            `json:"kind"`
+	StartTime  time.Time         `json:"start_time"`
+	EndTime    time.Time         `json:"end_time"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	// --
+	tracer *Tracer
+}
+
+// SpanContext returns the span context to propagate to other processes.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceId: s.TraceId, SpanId: s.SpanId, Sampled: true}
+}
+
+// Child starts a child span.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		TraceId:   s.TraceId,
+		SpanId:    newId(8),
+		ParentId:  s.SpanId,
+		Name:      name,
+		Kind:      KIND_INTERNAL,
+		StartTime: time.Now(),
+		tracer:    s.tracer,
+	}
+}
+
+// SetAttribute sets an attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// End ends the span and exports it. Do not use the span after calling End.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.EndTime = time.Now()
+	if err := s.tracer.exporter.Export(*s); err != nil {
+		log.Printf("Error exporting trace span %s: %s", s.Name, err)
+	}
+}
+
+// Tracer starts server spans for requests. A nil Tracer is valid: it does not
+// trace anything.
+type Tracer struct {
+	exporter   Exporter
+	sampleRate float64
+}
+
+// NewTracer makes a Tracer that exports spans to the exporter. Requests with
+// a traceparent are traced if the parent is sampled; other requests are traced
+// at the sample rate (0.0 to 1.0).
+func NewTracer(exporter Exporter, sampleRate float64) *Tracer {
+	return &Tracer{
+		exporter:   exporter,
+		sampleRate: sampleRate,
+	}
+}
+
+// Start starts a server span. If traceparent is valid, the span continues that
+// trace, else it starts a new trace. Start returns nil if the trace is not sampled.
+func (t *Tracer) Start(traceparent, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		SpanId:    newId(8),
+		Name:      name,
+		Kind:      KIND_SERVER,
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+	if parent, err := ParseTraceParent(traceparent); err == nil {
+		if !parent.Sampled {
+			return nil
+		}
+		span.TraceId = parent.TraceId
+		span.ParentId = parent.SpanId
+	} else {
+		if mathrand.Float64() >= t.sampleRate {
+			return nil
+		}
+		span.TraceId = newId(16)
+	}
+	return span
+}
+
+type spanKey struct{}
+
+// NewContext returns a copy of ctx with the span. If span is nil, ctx is returned.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a child of the span in ctx and returns a copy of ctx with the
+// child span. If ctx has no span, it returns ctx and a nil span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := FromContext(ctx).Child(name)
+	return NewContext(ctx, span), span
+}
+
+func newId(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand.Read: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
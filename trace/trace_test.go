@@ -0,0 +1,212 @@
+// Copyright 2020, Square, Inc.
+
+package trace_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/square/etre/test/mock"
+	"github.com/square/etre/trace"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	got, err := trace.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := trace.SpanContext{
+		TraceId: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:  "00f067aa0ba902b7",
+		Sampled: true,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+	if tp := got.TraceParent(); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("TraceParent() = %s, expected the parsed value", tp)
+	}
+
+	got, err = trace.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sampled {
+		t.Errorf("Sampled = true, expected false for flags 00")
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",        // no flags
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",     // uppercase
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",     // zero trace ID
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",     // zero span ID
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",     // invalid version
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", // version 00 has no more fields
+	}
+	for _, tp := range invalid {
+		if _, err := trace.ParseTraceParent(tp); err == nil {
+			t.Errorf("no error parsing %q, expected one", tp)
+		}
+	}
+
+	// New traces are valid and sampled
+	sc, err := trace.ParseTraceParent(trace.NewTraceParent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled {
+		t.Errorf("new traceparent is not sampled")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &mock.TraceExporter{}
+	tracer := trace.NewTracer(exporter, 0)
+
+	// Not sampled: sample rate is zero and parent is not sampled
+	if span := tracer.Start("", "GET /"); span != nil {
+		t.Errorf("got span %+v, expected nil", span)
+	}
+	if span := tracer.Start("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "GET /"); span != nil {
+		t.Errorf("got span %+v, expected nil", span)
+	}
+
+	// Nil span and tracer are no-ops
+	var nilTracer *trace.Tracer
+	span := nilTracer.Start("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "GET /")
+	span.SetAttribute("k", "v")
+	span.SetError(errors.New("err"))
+	span.Child("child").End()
+	span.End()
+	ctx, child := trace.Start(context.Background(), "child")
+	child.End()
+	if trace.FromContext(ctx) != nil {
+		t.Errorf("got span in context, expected none")
+	}
+
+	// Sampled parent is continued; children propagate via context
+	span = tracer.Start("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "GET /")
+	if span == nil {
+		t.Fatal("got nil span, expected one")
+	}
+	ctx, child = trace.Start(trace.NewContext(context.Background(), span), "child")
+	if trace.FromContext(ctx) != child {
+		t.Errorf("context does not have child span")
+	}
+	child.SetError(errors.New("db error"))
+	child.End()
+	span.SetAttribute("k", "v")
+	span.End()
+
+	if len(exporter.Spans) != 2 {
+		t.Fatalf("got %d spans, expected 2: %+v", len(exporter.Spans), exporter.Spans)
+	}
+	gotChild, gotSpan := exporter.Spans[0], exporter.Spans[1]
+	if gotSpan.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || gotSpan.ParentId != "00f067aa0ba902b7" ||
+		gotSpan.Kind != trace.KIND_SERVER || gotSpan.Attributes["k"] != "v" || gotSpan.EndTime.Before(gotSpan.StartTime) {
+		t.Errorf("wrong span: %+v", gotSpan)
+	}
+	if gotChild.TraceId != gotSpan.TraceId || gotChild.ParentId != gotSpan.SpanId ||
+		gotChild.Kind != trace.KIND_INTERNAL || gotChild.Error != "db error" || gotChild.Name != "child" {
+		t.Errorf("wrong child span: %+v", gotChild)
+	}
+	if sc := gotSpan.SpanContext(); sc.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+gotSpan.SpanId+"-01" {
+		t.Errorf("wrong span context: %+v", sc)
+	}
+
+	// Sample rate 1.0 starts new traces
+	tracer = trace.NewTracer(exporter, 1)
+	span = tracer.Start("", "GET /")
+	if span == nil {
+		t.Fatal("got nil span, expected one")
+	}
+	if len(span.TraceId) != 32 || span.ParentId != "" {
+		t.Errorf("wrong new trace span: %+v", span)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etre-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "trace.json")
+
+	exporter, err := trace.NewFileExporter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := trace.NewTracer(exporter, 1).Start("", "GET /")
+	span.Child("child").End()
+	span.End()
+	exporter.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s trace.Span
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("invalid JSON line: %s: %s", scanner.Text(), err)
+		}
+		if s.TraceId != span.TraceId {
+			t.Errorf("trace_id = %s, expected %s", s.TraceId, span.TraceId)
+		}
+		names = append(names, s.Name)
+	}
+	if diff := deep.Equal(names, []string{"child", "GET /"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var gotPath string
+	var gotReq map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotReq)
+	}))
+	defer ts.Close()
+
+	exporter := trace.NewOTLPExporter(ts.URL+"/v1/traces", "etre-test")
+	span := trace.NewTracer(exporter, 1).Start("", "GET /")
+	span.SetError(errors.New("failed"))
+	span.End()
+	exporter.Stop() // flushes
+
+	if gotPath != "/v1/traces" {
+		t.Errorf("got path %s, expected /v1/traces", gotPath)
+	}
+	rs := gotReq["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	attr := rs["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	if attr["key"] != "service.name" || attr["value"].(map[string]interface{})["stringValue"] != "etre-test" {
+		t.Errorf("wrong resource attribute: %+v", attr)
+	}
+	spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, expected 1: %+v", len(spans), spans)
+	}
+	got := spans[0].(map[string]interface{})
+	if got["traceId"] != span.TraceId || got["name"] != "GET /" || got["kind"] != float64(2) {
+		t.Errorf("wrong span: %+v", got)
+	}
+	if status := got["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "failed" {
+		t.Errorf("wrong span status: %+v", status)
+	}
+}